@@ -54,6 +54,10 @@ Usage:
                        # (for testing that dependencies are correct)
   build.pl --deps      # Show each target's dependencies
 
+Environment:
+  CAMLI_SQLITE=1       Link SQLite support (the "sqliteindexer" storage
+                       type) into camlistored; needs misc/sqlite/sqlite3.c
+
 Other options:
   --verbose|-v         Verbose
   --test|-t            Run tests where found
@@ -359,6 +363,8 @@ sub build {
     v("Built '$target'");
 }
 
+# Also drops *_sqlite.go files unless $CAMLI_SQLITE is set, as they
+# need misc/sqlite, which isn't built by default.
 sub filter_go_os {
     my @good;
     my $is_windows = $^O eq "msys" || $^O eq "MSWin32";
@@ -367,6 +373,7 @@ sub filter_go_os {
         my $for_windows = $f =~ /_windows\.go$/;
         next if $for_unix && $is_windows;
         next if $for_windows && !$is_windows;
+        next if $f =~ /_sqlite\.go$/ && !$ENV{CAMLI_SQLITE};
         push @good, $f;
     }
     return @good;
@@ -418,6 +425,9 @@ sub find_go_camli_deps {
                 my $dep = $1;
                 $depref->{$dep} = 1;
             }
+            if ($imports =~ m!"camdev/sqlite"!) {
+                $depref->{"misc/sqlite"} = 1;
+            }
         }
     }
 
@@ -494,6 +504,7 @@ sub gen_target_makefile {
         foreach my $dep (@deps) {
             my $cam_lib = $dep;
             $cam_lib =~ s!^lib/go/!!;
+            $cam_lib = "camdev/sqlite" if $dep eq "misc/sqlite";
             $pr .= '$(QUOTED_GOROOT)/pkg/$(GOOS)_$(GOARCH)/' . $cam_lib . ".a\\\n\t";
         }
         chop $pr; chop $pr; chop $pr;
@@ -638,29 +649,41 @@ TARGET: clients/go/camwebdav
 TARGET: lib/go/camli/auth
 TARGET: lib/go/camli/blobref
 TARGET: lib/go/camli/blobserver
+TARGET: lib/go/camli/blobserver/compress
 TARGET: lib/go/camli/blobserver/cond
+TARGET: lib/go/camli/blobserver/diskcache
+TARGET: lib/go/camli/blobserver/diskpacked
+TARGET: lib/go/camli/blobserver/encrypt
 TARGET: lib/go/camli/blobserver/google
 TARGET: lib/go/camli/blobserver/handlers
 TARGET: lib/go/camli/blobserver/localdisk
+TARGET: lib/go/camli/blobserver/memory
 TARGET: lib/go/camli/blobserver/remote
 TARGET: lib/go/camli/blobserver/replica
 TARGET: lib/go/camli/blobserver/shard
 TARGET: lib/go/camli/blobserver/s3
+TARGET: lib/go/camli/blobserver/storagetest
 TARGET: lib/go/camli/cacher
 TARGET: lib/go/camli/client
 TARGET: lib/go/camli/db
 TARGET: lib/go/camli/db/dbimpl
+TARGET: lib/go/camli/db/mysql
 TARGET: lib/go/camli/errorutil
 TARGET: lib/go/camli/fs
+TARGET: lib/go/camli/fsck
+TARGET: lib/go/camli/gc
 TARGET: lib/go/camli/googlestorage
     =skip_tests
 TARGET: lib/go/camli/httputil
 TARGET: lib/go/camli/jsonconfig
 TARGET: lib/go/camli/jsonsign
+TARGET: lib/go/camli/kvfile
+TARGET: lib/go/camli/kvindexer
 TARGET: lib/go/camli/lru
 TARGET: lib/go/camli/magic
 TARGET: lib/go/camli/misc
 TARGET: lib/go/camli/misc/amazon/s3
+TARGET: lib/go/camli/misc/amazon/s3/fakes3
 TARGET: lib/go/camli/misc/fileembed
 TARGET: lib/go/camli/misc/httprange
 TARGET: lib/go/camli/misc/gpgagent
@@ -669,6 +692,7 @@ TARGET: lib/go/camli/misc/resize
 TARGET: lib/go/camli/mysqlindexer
 TARGET: lib/go/camli/netutil
 TARGET: lib/go/camli/osutil
+TARGET: lib/go/camli/reindex
 TARGET: lib/go/camli/rollsum
 TARGET: lib/go/camli/schema
 TARGET: lib/go/camli/search
@@ -687,6 +711,11 @@ TARGET: lib/go/camli/third_party/github.com/Philio/GoMySQL
 TARGET: lib/go/camli/third_party/github.com/camlistore/GoMySQL
     =skip_tests
 TARGET: lib/go/camli/webserver
+TARGET: misc/sqlite
+    - lib/go/camli/db
+    - lib/go/camli/db/dbimpl
+    =not_in_all  # needs sqlite3.c (the SQLite amalgamation) copied in;
+                 # built for camlistored if CAMLI_SQLITE is set
 TARGET: server/go/camlistored
 TARGET: camlistore.org/server/uistatic
     =fileembed
@@ -24,7 +24,7 @@ import (
 	"sort"
 
 	"camli/blobref"
-	"camli/blobserver/localdisk" // used for the blob cache
+	"camli/blobserver/diskcache"
 	"camli/cacher"
 	"camli/client"
 	"camli/fs"
@@ -49,6 +49,9 @@ func main() {
 	// Scans the arg list and sets up flags
 	debug := flag.Bool("debug", false, "print debugging messages.")
 	threaded := flag.Bool("threaded", true, "switch off threading; print debugging messages.")
+	cacheDirFlag := flag.String("cachedir", "", "directory to keep the blob cache in between runs; if empty, a temporary directory is used.")
+	cacheSize := flag.Int("cachesize", 512, "maximum size of the blob cache, in MB.")
+	cachePolicy := flag.String("cachepolicy", "lru", "blob cache eviction policy: lru or lfu.")
 	flag.Parse()
 
 	errorf := func(msg string, args ...interface{}) {
@@ -66,16 +69,26 @@ func main() {
 	}
 	client := client.NewOrFail() // automatic from flags
 
-	cacheDir, err := ioutil.TempDir("", "camlicache")
+	policy, err := diskcache.ParsePolicy(*cachePolicy)
 	if err != nil {
-		errorf("Error creating temp cache directory: %v\n", err)
+		errorf("%v\n", err)
 	}
-	defer os.RemoveAll(cacheDir)
-	diskcache, err := localdisk.New(cacheDir)
+	cacheDir := *cacheDirFlag
+	if cacheDir == "" {
+		cacheDir, err = ioutil.TempDir("", "camlicache")
+		if err != nil {
+			errorf("Error creating temp cache directory: %v\n", err)
+		}
+		defer os.RemoveAll(cacheDir)
+	} else if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		errorf("Error creating cache directory: %v\n", err)
+	}
+	cache, err := diskcache.New(cacheDir, int64(*cacheSize)<<20, policy)
 	if err != nil {
-		errorf("Error setting up local disk cache: %v", err)
+		errorf("Error setting up local disk cache: %v\n", err)
 	}
-	fetcher := cacher.NewCachingFetcher(diskcache, client)
+	defer cache.Close()
+	fetcher := cacher.NewCachingFetcher(cache, client)
 
 	fs := fs.NewCamliFileSystem(fetcher, root)
 	timing := fuse.NewTimingPathFilesystem(fs)
@@ -109,4 +122,6 @@ func main() {
 
 	latency = rawTiming.Latencies()
 	fmt.Println("Raw FS (ms):", latency)
+
+	fmt.Println("Blob cache:", cache.Stats())
 }
@@ -18,7 +18,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"flag"
 	"fmt"
 	"http"
@@ -26,6 +25,7 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
 
 	"camli/blobref"
 	"camli/blobserver"
@@ -42,6 +42,7 @@ const buffered = 16 // arbitrary
 
 var (
 	flagVerbose = flag.Bool("verbose", false, "extra debug logging")
+	flagHash    = flag.String("hash", blobref.DefaultHashName, "hash function for new blobs, e.g. sha1 or sha256")
 )
 
 var ErrUsage = UsageError("invalid command usage")
@@ -110,12 +111,12 @@ type Uploader struct {
 	filecapc chan bool
 }
 
-func blobDetails(contents io.ReadSeeker) (bref *blobref.BlobRef, size int64, err os.Error) {
-	s1 := sha1.New()
+func (up *Uploader) blobDetails(contents io.ReadSeeker) (bref *blobref.BlobRef, size int64, err os.Error) {
+	h := blobref.NewHash(up.HashName())
 	contents.Seek(0, 0)
-	size, err = io.Copy(s1, contents)
+	size, err = io.Copy(h, contents)
 	if err == nil {
-		bref = blobref.FromHash("sha1", s1)
+		bref = blobref.FromHash(up.HashName(), h)
 	}
 	return
 }
@@ -135,12 +136,12 @@ func (up *Uploader) UploadFileBlob(filename string) (*client.PutResult, os.Error
 		}
 		// TODO(bradfitz,mpl): limit this buffer size?
 		file := buf.Bytes()
-		s1 := sha1.New()
-		size, err = io.Copy(s1, buf)
+		h := blobref.NewHash(up.HashName())
+		size, err = io.Copy(h, buf)
 		if err != nil {
 			return nil, err
 		}
-		ref = blobref.FromHash("sha1", s1)
+		ref = blobref.FromHash(up.HashName(), h)
 		body = io.LimitReader(bytes.NewBuffer(file), size)
 	} else {
 		fi, err := os.Stat(filename)
@@ -154,7 +155,7 @@ func (up *Uploader) UploadFileBlob(filename string) (*client.PutResult, os.Error
 		if err != nil {
 			return nil, err
 		}
-		ref, size, err = blobDetails(file)
+		ref, size, err = up.blobDetails(file)
 		if err != nil {
 			return nil, err
 		}
@@ -367,7 +368,11 @@ func (up *Uploader) UploadAndSignMap(m map[string]interface{}) (*client.PutResul
 }
 
 func (up *Uploader) uploadString(s string) (*client.PutResult, os.Error) {
-	uh := client.NewUploadHandleFromString(s)
+	uh := &client.UploadHandle{
+		BlobRef:  blobref.FromString(up.HashName(), s),
+		Size:     int64(len(s)),
+		Contents: strings.NewReader(s),
+	}
 	if c := up.haveCache; c != nil && c.BlobExists(uh.BlobRef) {
 		cachelog.Printf("HaveCache HIT for %s / %d", uh.BlobRef, uh.Size)
 		return &client.PutResult{BlobRef: uh.BlobRef, Size: uh.Size, Skipped: true}, nil
@@ -485,6 +490,9 @@ func makeUploader() *Uploader {
 	if !*flagVerbose {
 		cc.SetLogger(nil)
 	}
+	if err := cc.SetHashName(*flagHash); err != nil {
+		log.Fatal(err)
+	}
 
 	transport := new(tinkerTransport)
 	transport.transport = &http.Transport{DisableKeepAlives: false}
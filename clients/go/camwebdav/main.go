@@ -13,7 +13,7 @@ import (
 	"xml"
 
 	"camli/blobref"
-	"camli/blobserver/localdisk"
+	"camli/blobserver/diskcache"
 	"camli/client"
 	"camli/cacher"
 	"camli/fs"
@@ -23,20 +23,34 @@ import (
 var (
 	f       *fs.CamliFileSystem
 	davaddr = flag.String("davaddr", "", "WebDAV service address")
+
+	cacheDirFlag = flag.String("cachedir", "", "directory to keep the blob cache in between runs; if empty, a temporary directory is used.")
+	cacheSize    = flag.Int("cachesize", 512, "maximum size of the blob cache, in MB.")
+	cachePolicy  = flag.String("cachepolicy", "lru", "blob cache eviction policy: lru or lfu.")
 )
 
 // TODO(rh): tame copy/paste code from cammount
 func main() {
 	flag.Parse()
-	cacheDir, err := ioutil.TempDir("", "camlicache")
+	policy, err := diskcache.ParsePolicy(*cachePolicy)
 	if err != nil {
-		log.Fatalf("Error creating temp cache directory: %v", err)
+		log.Fatal(err)
+	}
+	cacheDir := *cacheDirFlag
+	if cacheDir == "" {
+		cacheDir, err = ioutil.TempDir("", "camlicache")
+		if err != nil {
+			log.Fatalf("Error creating temp cache directory: %v", err)
+		}
+		defer os.RemoveAll(cacheDir)
+	} else if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		log.Fatalf("Error creating cache directory: %v", err)
 	}
-	defer os.RemoveAll(cacheDir)
-	diskcache, err := localdisk.New(cacheDir)
+	cache, err := diskcache.New(cacheDir, int64(*cacheSize)<<20, policy)
 	if err != nil {
 		log.Fatalf("Error setting up local disk cache: %v", err)
 	}
+	defer cache.Close()
 	if flag.NArg() != 1 {
 		log.Fatal("usage: camwebdav <blobref>")
 	}
@@ -45,7 +59,7 @@ func main() {
 		log.Fatalf("%s was not a valid blobref.", flag.Arg(0))
 	}
 	client := client.NewOrFail()
-	fetcher := cacher.NewCachingFetcher(diskcache, client)
+	fetcher := cacher.NewCachingFetcher(cache, client)
 
 	f = fs.NewCamliFileSystem(fetcher, br)
 	http.HandleFunc("/", webdav)
@@ -18,6 +18,7 @@ package blobref
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -27,10 +28,45 @@ import (
 
 var kBlobRefPattern *regexp.Regexp = regexp.MustCompile(`^([a-z0-9]+)-([a-f0-9]+)$`)
 
-var supportedDigests = map[string]func() hash.Hash{
-	"sha1": func() hash.Hash {
-		return sha1.New()
-	},
+// DefaultHashName is the hash used for new blobs when none is
+// specified.
+const DefaultHashName = "sha1"
+
+var supportedDigests = make(map[string]func() hash.Hash)
+
+func init() {
+	RegisterHash("sha1", sha1.New)
+	RegisterHash("sha256", sha256.New)
+}
+
+// RegisterHash makes the hash function fn available for blobrefs
+// named by hashName, such as "sha256". It must be called before any
+// blobref of that hash is parsed, typically from an init function.
+func RegisterHash(hashName string, fn func() hash.Hash) {
+	if !kBlobRefPattern.MatchString(hashName + "-0") {
+		panic("blobref: invalid hash name " + hashName)
+	}
+	if _, dup := supportedDigests[hashName]; dup {
+		panic("blobref: hash " + hashName + " registered twice")
+	}
+	supportedDigests[hashName] = fn
+	kExpectedDigestSize[hashName] = fn().Size() * 2
+}
+
+// HashSupported reports whether hashName is a registered hash.
+func HashSupported(hashName string) bool {
+	_, ok := supportedDigests[hashName]
+	return ok
+}
+
+// NewHash returns a new hash.Hash for the registered hash named
+// hashName, or nil if it isn't supported.
+func NewHash(hashName string) hash.Hash {
+	fn, ok := supportedDigests[hashName]
+	if !ok {
+		return nil
+	}
+	return fn()
 }
 
 // BlobRef is an immutable reference to a blob.
@@ -110,11 +146,7 @@ func (o *BlobRef) Equals(other *BlobRef) bool {
 }
 
 func (o *BlobRef) Hash() hash.Hash {
-	fn, ok := supportedDigests[o.hashName]
-	if !ok {
-		return nil // TODO: return an error here, not nil
-	}
-	return fn()
+	return NewHash(o.hashName) // TODO: return an error here, not nil
 }
 
 func (o *BlobRef) HashMatches(h hash.Hash) bool {
@@ -122,8 +154,7 @@ func (o *BlobRef) HashMatches(h hash.Hash) bool {
 }
 
 func (o *BlobRef) IsSupported() bool {
-	_, ok := supportedDigests[o.hashName]
-	return ok
+	return HashSupported(o.hashName)
 }
 
 func (o *BlobRef) Sum32() uint32 {
@@ -163,9 +194,18 @@ func FromHash(hashfunc string, h hash.Hash) *BlobRef {
 }
 
 func Sha1FromString(s string) *BlobRef {
-	s1 := sha1.New()
-	s1.Write([]byte(s))
-	return FromHash("sha1", s1)
+	return FromString("sha1", s)
+}
+
+// FromString returns the blobref of s using the hash named hashName,
+// or nil if the hash isn't supported.
+func FromString(hashName, s string) *BlobRef {
+	h := NewHash(hashName)
+	if h == nil {
+		return nil
+	}
+	h.Write([]byte(s))
+	return FromHash(hashName, h)
 }
 
 // FromPattern takes a pattern and if it matches 's' with two exactly two valid
@@ -64,6 +64,23 @@ func TestNotSupported(t *testing.T) {
 	}
 }
 
+func TestSha256(t *testing.T) {
+	br := FromString("sha256", "foo")
+	want := "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	ExpectString(t, want, br.String(), "sha256 of foo")
+	Expect(t, br.IsSupported(), "sha256 supported")
+	parsed := Parse(want)
+	Expect(t, parsed != nil && parsed.Equals(br), "parsed sha256 blobref")
+	Expect(t, Parse("sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33") == nil, "short sha256 digest rejected")
+
+	h := br.Hash()
+	h.Write([]byte("foo"))
+	Expect(t, br.HashMatches(h), "sha256 hash matches")
+
+	Expect(t, FromString("unknownfunc", "foo") == nil, "FromString of unknown hash")
+	Expect(t, NewHash("unknownfunc") == nil, "NewHash of unknown hash")
+}
+
 func TestSum32(t *testing.T) {
 	refStr := "sha1-0000000000000000000000000000000000000012"
 	br := Parse(refStr)
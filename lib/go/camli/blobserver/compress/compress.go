@@ -0,0 +1,417 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package compress registers the "compress" blobserver storage type,
+which transparently compresses blobs stored in another storage.
+
+A blob which shrinks by at least minSavings when compressed with
+zlib is stored as a "camli-z" envelope: a one-line header naming the
+encoding, the original blobref and size, followed by the compressed
+bytes. The envelope is stored under its own blobref, since the
+wrapped storage verifies digests. Other blobs are stored unchanged.
+
+A local kvfile index maps original blobrefs to what was stored, so
+StatBlobs and EnumerateBlobs report original blobrefs and sizes. If
+the index is empty at startup, it's rebuilt from the envelope
+headers.
+
+Example low-level config:
+
+	"/storage/": {
+	    "handler": "storage-compress",
+	    "handlerArgs": {
+	        "backend": "/s3/",
+	        "index": "/var/camlistore/compress-index.kv"
+	    }
+	},
+*/
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+	"camli/kvfile"
+)
+
+// envelopeMagic starts the header line of compressed blobs, which
+// is followed by "<encoding> <blobref> <size>\n".
+const envelopeMagic = "camli-z1 "
+
+// Blobs are stored compressed only if that saves at least
+// minSavings percent.
+const minSavings = 10
+
+const (
+	encodingRaw  = "raw"
+	encodingZlib = "zlib"
+)
+
+type Storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	backend blobserver.Storage
+
+	// index maps original blobrefs to
+	// "<stored blobref> <size> <encoding>".
+	index *kvfile.DB
+}
+
+// New returns a Storage compressing blobs into backend, with its
+// index in the kvfile at indexPath.
+func New(backend blobserver.Storage, indexPath string) (*Storage, os.Error) {
+	index, err := kvfile.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	sto := &Storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		backend:                   backend,
+		index:                     index,
+	}
+	if index.Len() == 0 {
+		if err := sto.rebuildIndex(); err != nil {
+			index.Close()
+			return nil, fmt.Errorf("compress: rebuilding index: %v", err)
+		}
+	}
+	return sto, nil
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	backendPrefix := config.RequiredString("backend")
+	indexPath := config.RequiredString("index")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	backend, err := ld.GetStorage(backendPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return New(backend, indexPath)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("compress", blobserver.StorageConstructor(newFromConfig))
+}
+
+func (sto *Storage) GetBlobHub() blobserver.BlobHub {
+	return sto.SimpleBlobHubPartitionMap.GetBlobHub()
+}
+
+// Close closes the index.
+func (sto *Storage) Close() os.Error {
+	return sto.index.Close()
+}
+
+type entry struct {
+	stored   *blobref.BlobRef
+	size     int64
+	encoding string
+}
+
+func (e *entry) String() string {
+	return fmt.Sprintf("%s %d %s", e.stored, e.size, e.encoding)
+}
+
+func parseEntry(s string) (*entry, bool) {
+	f := strings.Fields(s)
+	if len(f) != 3 {
+		return nil, false
+	}
+	stored := blobref.Parse(f[0])
+	size, err := strconv.Atoi64(f[1])
+	if stored == nil || err != nil {
+		return nil, false
+	}
+	return &entry{stored, size, f[2]}, true
+}
+
+func (sto *Storage) lookup(br *blobref.BlobRef) (*entry, os.Error) {
+	v, err := sto.index.Get(br.String())
+	if err != nil {
+		return nil, err
+	}
+	e, ok := parseEntry(v)
+	if !ok {
+		return nil, fmt.Errorf("compress: corrupt index entry for %s: %q", br, v)
+	}
+	return e, nil
+}
+
+// parseHeader parses an envelope header line, without its newline.
+func parseHeader(line string) (br *blobref.BlobRef, size int64, encoding string, ok bool) {
+	if !strings.HasPrefix(line, envelopeMagic) {
+		return
+	}
+	f := strings.Fields(line[len(envelopeMagic):])
+	if len(f) != 3 {
+		return
+	}
+	br = blobref.Parse(f[1])
+	size, err := strconv.Atoi64(f[2])
+	if br == nil || err != nil {
+		return
+	}
+	return br, size, f[0], true
+}
+
+// rebuildIndex populates the index from the blobs in the backend.
+func (sto *Storage) rebuildIndex() os.Error {
+	return blobserver.EnumerateAll(sto.backend, "", func(sb blobref.SizedBlobRef) os.Error {
+		br, e, err := sto.readEntry(sb)
+		if err != nil {
+			return err
+		}
+		return sto.index.Set(br.String(), e.String())
+	})
+}
+
+// readEntry returns the original blobref and index entry of the
+// stored blob sb.
+func (sto *Storage) readEntry(sb blobref.SizedBlobRef) (*blobref.BlobRef, *entry, os.Error) {
+	rc, _, err := sto.backend.FetchStreaming(sb.BlobRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	line, _ := bufio.NewReader(io.LimitReader(rc, 512)).ReadString('\n')
+	if br, size, encoding, ok := parseHeader(strings.TrimRight(line, "\n")); ok {
+		return br, &entry{sb.BlobRef, size, encoding}, nil
+	}
+	return sb.BlobRef, &entry{sb.BlobRef, sb.Size, encodingRaw}, nil
+}
+
+func (sto *Storage) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := br.Hash()
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &buf), source)
+	if err != nil {
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if _, err := sto.lookup(br); err == nil {
+		return blobref.SizedBlobRef{BlobRef: br, Size: size}, nil
+	}
+
+	e := &entry{br, size, encodingRaw}
+	stored := buf.Bytes()
+	if env, err := envelope(br, stored); err != nil {
+		return sb, err
+	} else if int64(len(env))*100 <= size*(100-minSavings) || bytes.HasPrefix(stored, []byte(envelopeMagic)) {
+		// (Raw blobs which look like envelopes are always
+		// enveloped, so rebuildIndex can't mistake them.)
+		h := sha1.New()
+		h.Write(env)
+		e.stored, e.encoding, stored = blobref.FromHash("sha1", h), encodingZlib, env
+	}
+	if _, err = sto.backend.ReceiveBlob(e.stored, bytes.NewBuffer(stored)); err != nil {
+		return
+	}
+	if err = sto.index.Set(br.String(), e.String()); err != nil {
+		return
+	}
+	sto.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{BlobRef: br, Size: size}, nil
+}
+
+// envelope returns the zlib envelope of the blob br with contents
+// data.
+func envelope(br *blobref.BlobRef, data []byte) ([]byte, os.Error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s %s %d\n", envelopeMagic, encodingZlib, br, len(data))
+	zw, err := zlib.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() os.Error {
+	var err os.Error
+	for _, c := range rc.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (sto *Storage) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	e, err := sto.lookup(br)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, _, err := sto.backend.FetchStreaming(e.stored)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch e.encoding {
+	case encodingRaw:
+		return rc, e.size, nil
+	case encodingZlib:
+		bufr := bufio.NewReader(rc)
+		line, err := bufr.ReadString('\n')
+		envBr, envSize, _, ok := parseHeader(strings.TrimRight(line, "\n"))
+		if err != nil || !ok {
+			rc.Close()
+			return nil, 0, fmt.Errorf("compress: bad envelope header in %s", e.stored)
+		}
+		if !envBr.Equals(br) || envSize != e.size {
+			rc.Close()
+			return nil, 0, fmt.Errorf("compress: envelope %s holds %s, not %s", e.stored, envBr, br)
+		}
+		zr, err := zlib.NewReader(bufr)
+		if err != nil {
+			rc.Close()
+			return nil, 0, err
+		}
+		return &readCloser{zr, []io.Closer{zr, rc}}, e.size, nil
+	}
+	rc.Close()
+	return nil, 0, fmt.Errorf("compress: unknown encoding %q of %s", e.encoding, br)
+}
+
+// stat sends the sizes of those of blobs present to dest and returns
+// the rest.
+func (sto *Storage) stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef) (missing []*blobref.BlobRef, err os.Error) {
+	for _, br := range blobs {
+		e, err := sto.lookup(br)
+		switch {
+		case err == nil:
+			dest <- blobref.SizedBlobRef{BlobRef: br, Size: e.size}
+		case err == os.ENOENT:
+			missing = append(missing, br)
+		default:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (sto *Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	// Listen before the first stat, so no blob arrives unnoticed
+	// in between.
+	var ch chan *blobref.BlobRef
+	if waitSeconds > 0 {
+		if waitSeconds > 60 {
+			waitSeconds = 60
+		}
+		hub := sto.GetBlobHub()
+		ch = make(chan *blobref.BlobRef, len(blobs))
+		for _, br := range blobs {
+			hub.RegisterBlobListener(br, ch)
+			defer hub.UnregisterBlobListener(br, ch)
+		}
+	}
+
+	missing, err := sto.stat(dest, blobs)
+	if err != nil || len(missing) == 0 || waitSeconds == 0 {
+		return err
+	}
+	need := make(map[string]bool)
+	for _, br := range missing {
+		need[br.String()] = true
+	}
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	for len(need) > 0 {
+		select {
+		case <-timer.C:
+			return nil
+		case br := <-ch:
+			if !need[br.String()] {
+				continue
+			}
+			missing, err := sto.stat(dest, []*blobref.BlobRef{br})
+			if err != nil {
+				return err
+			}
+			if len(missing) == 0 {
+				need[br.String()] = false, false
+			}
+		}
+	}
+	return nil
+}
+
+func (sto *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	it := sto.index.Find(after)
+	for n := uint(0); n < limit && it.Next(); {
+		if it.Key() == after {
+			continue
+		}
+		br := blobref.Parse(it.Key())
+		e, ok := parseEntry(it.Value())
+		if br == nil || !ok {
+			log.Printf("compress: skipping corrupt index row %q", it.Key())
+			continue
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: e.size}
+		n++
+	}
+	return nil
+}
+
+func (sto *Storage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	var stored []*blobref.BlobRef
+	b := sto.index.BeginBatch()
+	for _, br := range blobs {
+		e, err := sto.lookup(br)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		stored = append(stored, e.stored)
+		b.Delete(br.String())
+	}
+	// Forget the blobs first, so a failure removing them leaves at
+	// worst unreferenced stored blobs.
+	if err := sto.index.CommitBatch(b); err != nil {
+		return err
+	}
+	return sto.backend.RemoveBlobs(stored)
+}
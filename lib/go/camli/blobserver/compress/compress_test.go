@@ -0,0 +1,164 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package compress
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func enumerate(t *testing.T, sto blobserver.Storage) map[string]int64 {
+	ch := make(chan blobref.SizedBlobRef, 100)
+	if err := sto.EnumerateBlobs(ch, "", 100, 0); err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	m := make(map[string]int64)
+	for sb := range ch {
+		m[sb.BlobRef.String()] = sb.Size
+	}
+	return m
+}
+
+func TestCompress(t *testing.T) {
+	dir := fmt.Sprintf("%s/camli-compress-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := localdisk.New(dir)
+	AssertNil(t, err, "localdisk.New")
+	indexPath := dir + ".index"
+	defer os.Remove(indexPath)
+
+	sto, err := New(backend, indexPath)
+	AssertNil(t, err, "New")
+
+	compressible := &test.Blob{strings.Repeat(`{"camliType": "claim"} `, 100)}
+	small := &test.Blob{"x"}
+	for _, tb := range []*test.Blob{compressible, small} {
+		sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		tb.AssertMatches(t, &sb)
+	}
+
+	stored := enumerate(t, backend)
+	ExpectInt(t, 2, len(stored), "backend blobs")
+	_, ok := stored[compressible.BlobRef().String()]
+	Expect(t, !ok, "compressible blob not stored raw")
+	_, ok = stored[small.BlobRef().String()]
+	Expect(t, ok, "small blob stored raw")
+	total := int64(0)
+	for _, size := range stored {
+		total += size
+	}
+	Expect(t, total < compressible.Size(), "compression saved space")
+
+	check := func(sto *Storage) {
+		got := enumerate(t, sto)
+		ExpectInt(t, 2, len(got), "enumerated blobs")
+		for _, tb := range []*test.Blob{compressible, small} {
+			ExpectInt(t, int(tb.Size()), int(got[tb.BlobRef().String()]), "enumerated original size")
+			rc, size, err := sto.FetchStreaming(tb.BlobRef())
+			AssertNil(t, err, "FetchStreaming")
+			all, err := ioutil.ReadAll(rc)
+			rc.Close()
+			AssertNil(t, err, "ReadAll")
+			ExpectString(t, tb.Contents, string(all), "fetched contents")
+			ExpectInt(t, int(tb.Size()), int(size), "fetched size")
+		}
+		statc := make(chan blobref.SizedBlobRef, 1)
+		AssertNil(t, sto.StatBlobs(statc, compressible.BlobRefSlice(), 0), "StatBlobs")
+		sb := <-statc
+		compressible.AssertMatches(t, &sb)
+	}
+	check(sto)
+
+	// Lose the index; it's rebuilt from the backend.
+	sto.Close()
+	AssertNil(t, os.Remove(indexPath), "removing index")
+	sto, err = New(backend, indexPath)
+	AssertNil(t, err, "New with empty index")
+	check(sto)
+
+	AssertNil(t, sto.RemoveBlobs(compressible.BlobRefSlice()), "RemoveBlobs")
+	_, _, err = sto.FetchStreaming(compressible.BlobRef())
+	Expect(t, err == os.ENOENT, "ENOENT after removal")
+	ExpectInt(t, 1, len(enumerate(t, backend)), "backend blobs after removal")
+	sto.Close()
+}
+
+func TestEnvelopeMismatch(t *testing.T) {
+	dir := fmt.Sprintf("%s/camli-compress-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := localdisk.New(dir)
+	AssertNil(t, err, "localdisk.New")
+	indexPath := dir + ".index"
+	defer os.Remove(indexPath)
+	sto, err := New(backend, indexPath)
+	AssertNil(t, err, "New")
+	defer sto.Close()
+
+	a := &test.Blob{strings.Repeat("aaaa", 100)}
+	b := &test.Blob{strings.Repeat("bbbb", 100)}
+	for _, tb := range []*test.Blob{a, b} {
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+
+	// Point a's index row at b's envelope.
+	eb, err := sto.lookup(b.BlobRef())
+	AssertNil(t, err, "lookup")
+	AssertNil(t, sto.index.Set(a.BlobRef().String(), (&entry{eb.stored, a.Size(), encodingZlib}).String()), "index Set")
+	_, _, err = sto.FetchStreaming(a.BlobRef())
+	Expect(t, err != nil, "envelope of another blob rejected")
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir := fmt.Sprintf("%s/camli-compress-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		backend, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatalf("localdisk.New: %v", err)
+		}
+		sto, err := New(backend, dir+".index")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return sto, func() {
+			sto.Close()
+			os.RemoveAll(dir)
+			os.Remove(dir + ".index")
+		}
+	})
+}
@@ -23,10 +23,13 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
 
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
+	"camli/jsonsign"
+	"camli/magic"
 	"camli/schema"
 )
 
@@ -60,18 +63,20 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 		return nil, err
 	}
 
+	sto.read, err = ld.GetStorage(read)
+	if err != nil {
+		return
+	}
+
 	if receive != nil {
-		sto.storageForReceive, err = buildStorageForReceive(ld, receive)
+		// Signatures are verified against public keys in the
+		// read storage.
+		sto.storageForReceive, err = buildStorageForReceive(ld, sto.read, receive)
 		if err != nil {
 			return
 		}
 	}
 
-	sto.read, err = ld.GetStorage(read)
-	if err != nil {
-		return
-	}
-
 	if remove != "" {
 		sto.remove, err = ld.GetStorage(remove)
 		if err != nil {
@@ -81,7 +86,52 @@ func newFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (storage blobserve
 	return sto, nil
 }
 
-func buildStorageForReceive(ld blobserver.Loader, confOrString interface{}) (storageFunc, os.Error) {
+// maxHead is how much of a blob is buffered to evaluate conditions.
+const maxHead = 1 << 20
+
+// A blobHead is the beginning of a blob being received, against
+// which conditions are evaluated.
+type blobHead struct {
+	buf []byte
+	eof bool // whether buf is the whole blob
+
+	parsed bool
+	ss     *schema.Superset // nil if not a schema blob
+}
+
+func readHead(src io.Reader) (*blobHead, os.Error) {
+	// TODO: make decision earlier, by parsing JSON as it comes in,
+	// not after we have up to 1 MB.
+	var buf bytes.Buffer
+	_, err := io.Copyn(&buf, src, maxHead)
+	if err != nil && err != os.EOF {
+		return nil, err
+	}
+	return &blobHead{buf: buf.Bytes(), eof: err == os.EOF}, nil
+}
+
+// superset returns the blob parsed as a schema blob, or nil if it
+// isn't one.
+func (h *blobHead) superset() *schema.Superset {
+	if h.parsed {
+		return h.ss
+	}
+	h.parsed = true
+	ss := new(schema.Superset)
+	if err := json.NewDecoder(bytes.NewBuffer(h.buf)).Decode(ss); err != nil || ss.Type == "" {
+		return nil
+	}
+	h.ss = ss
+	return ss
+}
+
+// A picker chooses the storage for a blob.
+type picker func(h *blobHead) blobserver.Storage
+
+// A condition is the predicate of an "if".
+type condition func(h *blobHead) bool
+
+func buildStorageForReceive(ld blobserver.Loader, keyFetcher blobref.StreamingFetcher, confOrString interface{}) (storageFunc, os.Error) {
 	// Static configuration from a string
 	if s, ok := confOrString.(string); ok {
 		sto, err := ld.GetStorage(s)
@@ -94,53 +144,143 @@ func buildStorageForReceive(ld blobserver.Loader, confOrString interface{}) (sto
 		return f, nil
 	}
 
-	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
+	pick, err := buildPicker(ld, keyFetcher, confOrString)
+	if err != nil {
+		return nil, err
+	}
+	f := func(src io.Reader) (blobserver.Storage, []byte, os.Error) {
+		h, err := readHead(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		return pick(h), h.buf, nil
+	}
+	return f, nil
+}
+
+// buildPicker returns the picker for confOrString, which is either
+// the prefix of a storage or an object with "if", "then" and
+// "else" keys, where "then" and "else" are recursively either.
+func buildPicker(ld blobserver.Loader, keyFetcher blobref.StreamingFetcher, confOrString interface{}) (picker, os.Error) {
+	if s, ok := confOrString.(string); ok {
+		sto, err := ld.GetStorage(s)
+		if err != nil {
+			return nil, err
+		}
+		return func(*blobHead) blobserver.Storage { return sto }, nil
+	}
 
-	ifStr := conf.RequiredString("if")
-	// TODO: let 'then' and 'else' point to not just strings but either
-	// a string or a JSON object with another condition, and then
-	// call buildStorageForReceive on it recursively
-	thenTarget := conf.RequiredString("then")
-	elseTarget := conf.RequiredString("else")
+	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
+	ifConf := conf.RequiredStringOrObject("if")
+	thenConf := conf.RequiredStringOrObject("then")
+	elseConf := conf.RequiredStringOrObject("else")
 	if err := conf.Validate(); err != nil {
 		return nil, err
 	}
-	thenSto, err := ld.GetStorage(thenTarget)
+	cond, err := buildCondition(keyFetcher, ifConf)
 	if err != nil {
 		return nil, err
 	}
-	elseSto, err := ld.GetStorage(elseTarget)
+	thenPick, err := buildPicker(ld, keyFetcher, thenConf)
 	if err != nil {
 		return nil, err
 	}
-
-	switch ifStr {
-	case "isSchema":
-		return isSchemaPicker(thenSto, elseSto), nil
+	elsePick, err := buildPicker(ld, keyFetcher, elseConf)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("cond: unsupported 'if' type of %q", ifStr)
+	return func(h *blobHead) blobserver.Storage {
+		if cond(h) {
+			return thenPick(h)
+		}
+		return elsePick(h)
+	}, nil
 }
 
-func isSchemaPicker(thenSto, elseSto blobserver.Storage) storageFunc {
-	return func(src io.Reader) (dest blobserver.Storage, overRead []byte, err os.Error) {
-		// TODO: make decision earlier, by parsing JSON as it comes in,
-		// not after we have up to 1 MB.
-		var buf bytes.Buffer
-		_, err = io.Copyn(&buf, src, 1<<20)
-		if err != nil && err != os.EOF {
-			return
+// buildCondition returns the condition for an "if" value, which is
+// either the name of a predicate without arguments:
+//
+//   "isSchema": the blob is a schema blob
+//   "isSignedClaim": the blob is a claim with a valid signature
+//
+// or an object with a single key naming a predicate, and its
+// argument:
+//
+//   {"sizeLessThan": 65536}: the blob is smaller than that many bytes
+//   {"mimeType": "image/jpeg"}: the blob's sniffed MIME type
+//   {"mimeTypePrefix": "image/"}: the blob's sniffed MIME type prefix
+//   {"camliType": "claim"}: the blob is a schema blob of that type
+func buildCondition(keyFetcher blobref.StreamingFetcher, confOrString interface{}) (condition, os.Error) {
+	if s, ok := confOrString.(string); ok {
+		switch s {
+		case "isSchema":
+			return isSchema, nil
+		case "isSignedClaim":
+			return isSignedClaim(keyFetcher), nil
 		}
-		ss := new(schema.Superset)
-		if err = json.NewDecoder(bytes.NewBuffer(buf.Bytes())).Decode(ss); err != nil {
-			log.Printf("cond: json parse failure => not schema => else")
-			return elseSto, buf.Bytes(), nil
+		return nil, fmt.Errorf("cond: unsupported 'if' type of %q", s)
+	}
+
+	conf := jsonconfig.Obj(confOrString.(map[string]interface{}))
+	if len(conf) != 1 {
+		return nil, fmt.Errorf("cond: 'if' object must have exactly one key; got %d", len(conf))
+	}
+	var name string
+	for k := range conf {
+		name = k
+	}
+	var cond condition
+	switch name {
+	case "sizeLessThan":
+		n := conf.RequiredInt(name)
+		if n < 0 || n > maxHead {
+			return nil, fmt.Errorf("cond: sizeLessThan of %d out of range [0, %d]", n, maxHead)
+		}
+		cond = func(h *blobHead) bool {
+			return h.eof && len(h.buf) < n
+		}
+	case "mimeType":
+		want := conf.RequiredString(name)
+		cond = func(h *blobHead) bool {
+			return magic.MimeType(h.buf) == want
+		}
+	case "mimeTypePrefix":
+		prefix := conf.RequiredString(name)
+		cond = func(h *blobHead) bool {
+			mime := magic.MimeType(h.buf)
+			return mime != "" && strings.HasPrefix(mime, prefix)
+		}
+	case "camliType":
+		want := conf.RequiredString(name)
+		cond = func(h *blobHead) bool {
+			ss := h.superset()
+			return ss != nil && ss.Type == want
+		}
+	default:
+		return nil, fmt.Errorf("cond: unsupported 'if' type of %q", name)
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return cond, nil
+}
+
+func isSchema(h *blobHead) bool {
+	return h.superset() != nil
+}
+
+func isSignedClaim(keyFetcher blobref.StreamingFetcher) condition {
+	return func(h *blobHead) bool {
+		ss := h.superset()
+		if ss == nil || ss.Type != "claim" || !h.eof {
+			return false
 		}
-		if ss.Type == "" {
-			log.Printf("cond: json => but not schema => else")
-			return elseSto, buf.Bytes(), nil
+		vr := jsonsign.NewVerificationRequest(string(h.buf), keyFetcher)
+		if !vr.Verify() {
+			log.Printf("cond: claim signature not verified: %v", vr.Err)
+			return false
 		}
-		log.Printf("cond: json => schema => then")
-		return thenSto, buf.Bytes(), nil
+		return true
 	}
 }
 
@@ -152,7 +292,11 @@ func (sto *condStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb bl
 	if len(overRead) > 0 {
 		source = io.MultiReader(bytes.NewBuffer(overRead), source)
 	}
-	return destSto.ReceiveBlob(b, source)
+	sb, err = destSto.ReceiveBlob(b, source)
+	if err == nil {
+		sto.GetBlobHub().NotifyBlobReceived(b)
+	}
+	return
 }
 
 func (sto *condStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
@@ -0,0 +1,223 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cond
+
+import (
+	"fmt"
+	"json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/jsonconfig"
+	"camli/jsonsign"
+	"camli/schema"
+	"camli/test"
+)
+
+// namedStorage is a Storage only compared by identity.
+type namedStorage struct {
+	blobserver.Storage
+	name string
+}
+
+type testLoader map[string]blobserver.Storage
+
+func (ld testLoader) GetStorage(prefix string) (blobserver.Storage, os.Error) {
+	if sto, ok := ld[prefix]; ok {
+		return sto, nil
+	}
+	return nil, fmt.Errorf("no storage %q", prefix)
+}
+
+func (ld testLoader) GetHandlerType(prefix string) string {
+	return ""
+}
+
+func (ld testLoader) GetHandler(prefix string) (interface{}, os.Error) {
+	return ld.GetStorage(prefix)
+}
+
+func (ld testLoader) FindHandlerByTypeIfLoaded(htype string) (string, interface{}, os.Error) {
+	return "", nil, os.ENOENT
+}
+
+const secringPath = "../../jsonsign/testdata/test-secring.gpg"
+
+const routeConfig = `{
+	"if": "isSchema",
+	"then": {
+		"if": "isSignedClaim",
+		"then": "/ssd/",
+		"else": {
+			"if": {"camliType": "permanode"},
+			"then": "/ssd/",
+			"else": "/schema/"
+		}
+	},
+	"else": {
+		"if": {"mimeTypePrefix": "image/"},
+		"then": "/cold/",
+		"else": {
+			"if": {"sizeLessThan": 16},
+			"then": "/packed/",
+			"else": "/bs/"
+		}
+	}
+}`
+
+func TestNestedConditions(t *testing.T) {
+	dir := fmt.Sprintf("%s/camli-cond-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keys, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatalf("localdisk.New: %v", err)
+	}
+
+	ld := make(testLoader)
+	for _, name := range []string{"/ssd/", "/schema/", "/cold/", "/packed/", "/bs/"} {
+		ld[name] = &namedStorage{name: name}
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal([]byte(routeConfig), &conf); err != nil {
+		t.Fatalf("config: %v", err)
+	}
+	pick, err := buildStorageForReceive(ld, keys, conf)
+	if err != nil {
+		t.Fatalf("buildStorageForReceive: %v", err)
+	}
+
+	entity, err := jsonsign.EntityFromSecring("26F5ABDA", secringPath)
+	if err != nil {
+		t.Fatalf("EntityFromSecring: %v", err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		t.Fatalf("ArmoredPublicKey: %v", err)
+	}
+	pubkey := &test.Blob{armored}
+	if _, err := keys.ReceiveBlob(pubkey.BlobRef(), pubkey.Reader()); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+
+	mustJson := func(m map[string]interface{}) string {
+		js, err := schema.MapToCamliJson(m)
+		if err != nil {
+			t.Fatalf("MapToCamliJson: %v", err)
+		}
+		return js
+	}
+	pn := blobref.MustParse("sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33")
+	claim := schema.NewSetAttributeClaim(pn, "title", "foo")
+	unsignedClaim := mustJson(claim)
+	claim["camliSigner"] = pubkey.BlobRef().String()
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:      mustJson(claim),
+		Fetcher:           keys,
+		ServerMode:        true,
+		SecretKeyringPath: secringPath,
+	}
+	signedClaim, err := sr.Sign()
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	tests := []struct {
+		name, blob, want string
+	}{
+		{"signed claim", signedClaim, "/ssd/"},
+		{"unsigned claim", unsignedClaim, "/schema/"},
+		{"permanode", mustJson(schema.NewUnsignedPermanode()), "/ssd/"},
+		{"file", mustJson(schema.NewFileMap("foo.txt")), "/schema/"},
+		{"jpeg", "\xff\xd8\xff\xe0" + strings.Repeat("x", 100), "/cold/"},
+		{"small", "small", "/packed/"},
+		{"large", strings.Repeat("x", 100), "/bs/"},
+		{"larger than head", strings.Repeat("x", maxHead+1), "/bs/"},
+		{"not quite json", "{" + strings.Repeat("x", 100), "/bs/"},
+	}
+	for _, tt := range tests {
+		sto, overRead, err := pick(strings.NewReader(tt.blob))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := sto.(*namedStorage).name; got != tt.want {
+			t.Errorf("%s: routed to %s; want %s", tt.name, got, tt.want)
+		}
+		want := tt.blob
+		if len(want) > maxHead {
+			want = want[:maxHead]
+		}
+		if string(overRead) != want {
+			t.Errorf("%s: over-read %d bytes; want %d", tt.name, len(overRead), len(want))
+		}
+	}
+}
+
+func TestBadConditions(t *testing.T) {
+	ld := testLoader{"/a/": &namedStorage{name: "/a/"}}
+	for _, ifConf := range []string{
+		`"isBogus"`,
+		`{"sizeLessThan": 2000000}`,
+		`{"camliType": "claim", "mimeType": "image/png"}`,
+		`{"nope": 1}`,
+	} {
+		var conf map[string]interface{}
+		js := `{"if": ` + ifConf + `, "then": "/a/", "else": "/a/"}`
+		if err := json.Unmarshal([]byte(js), &conf); err != nil {
+			t.Fatalf("config %s: %v", js, err)
+		}
+		if _, err := buildStorageForReceive(ld, nil, conf); err == nil {
+			t.Errorf("expected error for 'if' of %s", ifConf)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir := fmt.Sprintf("%s/camli-cond-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatalf("localdisk.New: %v", err)
+		}
+		ld := testLoader{"/bs/": ds}
+		sto, err := newFromConfig(ld, jsonconfig.Obj{
+			"write": map[string]interface{}{
+				"if":   "isSchema",
+				"then": "/bs/",
+				"else": "/bs/",
+			},
+			"read":   "/bs/",
+			"remove": "/bs/",
+		})
+		if err != nil {
+			t.Fatalf("newFromConfig: %v", err)
+		}
+		return sto, func() { os.RemoveAll(dir) }
+	})
+}
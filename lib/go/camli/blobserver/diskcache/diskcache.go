@@ -0,0 +1,530 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package diskcache registers the "diskcache" blobserver storage type,
+a cache of blobs on local disk bounded to a number of bytes.
+
+Blobs are stored in the directory as the "filesystem" storage type
+stores them, so an existing filesystem cache can be switched to
+diskcache in place. The size, last access and access count of each
+blob are kept in a kvfile, "diskcache.kv", in the same directory, so
+the eviction order survives restarts. Accesses are recorded in memory
+and written to the kvfile every minute and on Close.
+
+Once the cached blobs total more than maxBytes, blobs are evicted
+until they fit again: least recently used first with the "lru"
+policy (the default), or least frequently used first with "lfu".
+Blobs larger than maxBytes aren't cached at all.
+
+Example low-level config:
+
+	"/cache/": {
+	    "handler": "storage-diskcache",
+	    "handlerArgs": {
+	        "path": "/var/camlistore/cache",
+	        "maxBytes": 1073741824,
+	        "policy": "lru"
+	    }
+	},
+*/
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/jsonconfig"
+	"camli/kvfile"
+)
+
+// ErrTooLarge is returned by ReceiveBlob for blobs larger than the
+// cache.
+var ErrTooLarge = os.NewError("diskcache: blob larger than the cache")
+
+// Policy is the order in which blobs are evicted.
+type Policy int
+
+const (
+	LRU Policy = iota // least recently used first
+	LFU               // least frequently used first
+)
+
+// ParsePolicy returns the Policy named "lru" or "lfu".
+func ParsePolicy(name string) (Policy, os.Error) {
+	switch name {
+	case "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	}
+	return 0, fmt.Errorf("diskcache: unknown eviction policy %q", name)
+}
+
+func (p Policy) String() string {
+	if p == LFU {
+		return "lfu"
+	}
+	return "lru"
+}
+
+// Stats are statistics of a DiskCache. Hits and Misses are counted
+// since it was opened. The first fetch of a blob after it's
+// received counts as neither, as it's usually the fetch the blob was
+// cached for.
+type Stats struct {
+	Blobs     int
+	Bytes     int64 // total size of the cached blobs
+	MaxBytes  int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d blobs, %d of %d bytes, %d hits, %d misses, %d evictions",
+		s.Blobs, s.Bytes, s.MaxBytes, s.Hits, s.Misses, s.Evictions)
+}
+
+// indexName is the name of the access index in the cache directory.
+const indexName = "diskcache.kv"
+
+// flushInterval is how often, in nanoseconds, accesses recorded in
+// memory are written to the index.
+const flushInterval = 60e9
+
+// DiskCache is a blobserver.Storage, and blobserver.Cache, of at
+// most maxBytes of blobs on local disk.
+type DiskCache struct {
+	disk     *localdisk.DiskStorage
+	maxBytes int64
+	policy   Policy
+
+	// index has a row per cached blob:
+	//
+	//	<blobref> = <size> <last access> <access count>
+	//
+	// where the last access is a sequence number.
+	index *kvfile.DB
+
+	mu      sync.Mutex // guards following
+	entries map[string]*entry
+	bytes   int64           // total size of entries
+	seq     int64           // last access sequence number
+	writes  int             // index writes since it was last compacted
+	dirty   map[string]bool // keys of entries accessed since the last flush
+	closed  bool
+	stats   Stats
+}
+
+var _ blobserver.Cache = (*DiskCache)(nil)
+
+type entry struct {
+	size  int64
+	seq   int64 // of the last access
+	count int64 // accesses
+	fresh bool  // received, but not fetched since
+}
+
+func (e *entry) value() string {
+	return fmt.Sprintf("%d %d %d", e.size, e.seq, e.count)
+}
+
+// New returns a DiskCache of the blobs in the directory root, which
+// must exist, evicting them in the order of policy once they total
+// more than maxBytes.
+func New(root string, maxBytes int64, policy Policy) (*DiskCache, os.Error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("diskcache: invalid maxBytes %d", maxBytes)
+	}
+	disk, err := localdisk.New(root)
+	if err != nil {
+		return nil, err
+	}
+	index, err := kvfile.Open(filepath.Join(root, indexName))
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		disk:     disk,
+		maxBytes: maxBytes,
+		policy:   policy,
+		index:    index,
+		entries:  make(map[string]*entry),
+		dirty:    make(map[string]bool),
+	}
+	if err := c.load(); err != nil {
+		index.Close()
+		return nil, err
+	}
+	go c.flushLoop()
+	return c, nil
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	root := config.RequiredString("path")
+	maxBytes := config.RequiredInt("maxBytes")
+	policyName := config.OptionalString("policy", "lru")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	policy, err := ParsePolicy(policyName)
+	if err != nil {
+		return nil, err
+	}
+	return New(root, int64(maxBytes), policy)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("diskcache", blobserver.StorageConstructor(newFromConfig))
+}
+
+// load reads the index, reconciling it with the blobs on disk:
+// blobs without a row, such as those of a filesystem cache being
+// adopted, are added as never accessed, and rows of blobs which
+// are gone are deleted. Then blobs are evicted if maxBytes shrank.
+func (c *DiskCache) load() os.Error {
+	onDisk := make(map[string]int64)
+	err := blobserver.EnumerateAll(c.disk, "", func(sb blobref.SizedBlobRef) os.Error {
+		onDisk[sb.BlobRef.String()] = sb.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b := c.index.BeginBatch()
+	it := c.index.Find("")
+	for it.Next() {
+		size, ok := onDisk[it.Key()]
+		if !ok {
+			b.Delete(it.Key())
+			continue
+		}
+		e := new(entry)
+		if _, err := fmt.Sscanf(it.Value(), "%d %d %d", &e.size, &e.seq, &e.count); err != nil {
+			return fmt.Errorf("diskcache: corrupt index row %q", it.Key())
+		}
+		if e.size != size {
+			e.size = size
+			b.Set(it.Key(), e.value())
+		}
+		if e.seq > c.seq {
+			c.seq = e.seq
+		}
+		c.entries[it.Key()] = e
+		c.bytes += e.size
+	}
+	for br, size := range onDisk {
+		if _, ok := c.entries[br]; !ok {
+			e := &entry{size: size}
+			c.entries[br] = e
+			c.bytes += size
+			b.Set(br, e.value())
+		}
+	}
+	if err := c.index.CommitBatch(b); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict("")
+}
+
+// Close writes any accesses not yet written, and closes the index.
+func (c *DiskCache) Close() os.Error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	err := c.flush()
+	if cerr := c.index.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *DiskCache) flushLoop() {
+	for {
+		time.Sleep(flushInterval)
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		if err := c.flush(); err != nil {
+			// At worst the eviction order is stale after a
+			// restart.
+			log.Printf("diskcache: recording accesses: %v", err)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// flush writes the accesses recorded since the last flush to the
+// index. c.mu must be held.
+func (c *DiskCache) flush() os.Error {
+	if len(c.dirty) == 0 {
+		return nil
+	}
+	b := c.index.BeginBatch()
+	for key := range c.dirty {
+		if e, ok := c.entries[key]; ok {
+			b.Set(key, e.value())
+		}
+	}
+	if err := c.writeRows(b); err != nil {
+		return err
+	}
+	c.dirty = make(map[string]bool)
+	return nil
+}
+
+// Stats returns the cache's current statistics.
+func (c *DiskCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Blobs = len(c.entries)
+	s.Bytes = c.bytes
+	s.MaxBytes = c.maxBytes
+	return s
+}
+
+func (c *DiskCache) GetBlobHub() blobserver.BlobHub {
+	return c.disk.GetBlobHub()
+}
+
+// writeRows commits b, compacting the index once most of it is
+// superseded rows. c.mu must be held.
+func (c *DiskCache) writeRows(b *kvfile.Batch) os.Error {
+	if err := c.index.CommitBatch(b); err != nil {
+		return err
+	}
+	c.writes++
+	if c.writes > 4*(len(c.entries)+256) {
+		c.writes = 0
+		return c.index.Compact()
+	}
+	return nil
+}
+
+// touch records an access of the blob br, to be written to the
+// index by the next flush. c.mu must be held.
+func (c *DiskCache) touch(br *blobref.BlobRef) {
+	e, ok := c.entries[br.String()]
+	if !ok {
+		return
+	}
+	if e.fresh {
+		e.fresh = false
+	} else {
+		c.stats.Hits++
+	}
+	c.seq++
+	e.seq = c.seq
+	e.count++
+	c.dirty[br.String()] = true
+}
+
+func (c *DiskCache) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return c.Fetch(br)
+}
+
+func (c *DiskCache) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	file, size, err := c.disk.Fetch(br)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err == nil:
+		c.touch(br)
+	case err == os.ENOENT:
+		c.stats.Misses++
+	}
+	return file, size, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err os.Error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
+}
+
+func (c *DiskCache) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	// Read at most one byte more than fits, so blobs which are too
+	// large fail their digest check instead of filling the disk.
+	cr := &countingReader{r: io.LimitReader(source, c.maxBytes+1)}
+	sb, err = c.disk.ReceiveBlob(br, cr)
+	if cr.n > c.maxBytes {
+		if err == nil {
+			c.disk.RemoveBlobs([]*blobref.BlobRef{br})
+		}
+		return blobref.SizedBlobRef{}, ErrTooLarge
+	}
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := br.String()
+	if _, ok := c.entries[key]; ok {
+		return sb, nil
+	}
+	c.seq++
+	e := &entry{size: sb.Size, seq: c.seq, fresh: true}
+	c.entries[key] = e
+	c.bytes += e.size
+	b := c.index.BeginBatch()
+	b.Set(key, e.value())
+	if err = c.writeRows(b); err != nil {
+		return
+	}
+	if err = c.evict(key); err != nil {
+		return
+	}
+	return sb, nil
+}
+
+// byEviction sorts entries in the order they're evicted.
+type byEviction struct {
+	policy Policy
+	keys   []string
+	e      []*entry
+}
+
+func (s *byEviction) Len() int { return len(s.e) }
+
+func (s *byEviction) Less(i, j int) bool {
+	a, b := s.e[i], s.e[j]
+	if s.policy == LFU && a.count != b.count {
+		return a.count < b.count
+	}
+	return a.seq < b.seq
+}
+
+func (s *byEviction) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.e[i], s.e[j] = s.e[j], s.e[i]
+}
+
+// evict removes blobs other than keep, in the order of c.policy,
+// until the cached blobs fit in c.maxBytes. c.mu must be held.
+func (c *DiskCache) evict(keep string) os.Error {
+	if c.bytes <= c.maxBytes {
+		return nil
+	}
+	s := &byEviction{policy: c.policy}
+	for key, e := range c.entries {
+		if key != keep {
+			s.keys = append(s.keys, key)
+			s.e = append(s.e, e)
+		}
+	}
+	sort.Sort(s)
+
+	var victims []*blobref.BlobRef
+	bytes := c.bytes
+	for i, key := range s.keys {
+		if bytes <= c.maxBytes {
+			break
+		}
+		br := blobref.Parse(key)
+		if br == nil {
+			return fmt.Errorf("diskcache: invalid blobref %q in index", key)
+		}
+		victims = append(victims, br)
+		bytes -= s.e[i].size
+	}
+	if err := c.disk.RemoveBlobs(victims); err != nil {
+		// Some victims may be gone nonetheless.
+		c.forgetRemoved(victims)
+		return err
+	}
+	c.stats.Evictions += int64(len(victims))
+	return c.forget(victims)
+}
+
+// forget deletes the entries and index rows of blobs, which have
+// been removed from disk. c.mu must be held.
+func (c *DiskCache) forget(blobs []*blobref.BlobRef) os.Error {
+	b := c.index.BeginBatch()
+	for _, br := range blobs {
+		key := br.String()
+		if e, ok := c.entries[key]; ok {
+			c.bytes -= e.size
+			c.entries[key] = nil, false
+			c.dirty[key] = false, false
+			b.Delete(key)
+		}
+	}
+	return c.writeRows(b)
+}
+
+// forgetRemoved forgets those of blobs no longer on disk, after a
+// failed removal. c.mu must be held.
+func (c *DiskCache) forgetRemoved(blobs []*blobref.BlobRef) {
+	ch := make(chan blobref.SizedBlobRef, len(blobs))
+	if err := c.disk.StatBlobs(ch, blobs, 0); err != nil {
+		return
+	}
+	close(ch)
+	present := make(map[string]bool)
+	for sb := range ch {
+		present[sb.BlobRef.String()] = true
+	}
+	var gone []*blobref.BlobRef
+	for _, br := range blobs {
+		if !present[br.String()] {
+			gone = append(gone, br)
+		}
+	}
+	c.stats.Evictions += int64(len(gone))
+	if err := c.forget(gone); err != nil {
+		log.Printf("diskcache: forgetting evicted blobs: %v", err)
+	}
+}
+
+func (c *DiskCache) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	return c.disk.StatBlobs(dest, blobs, waitSeconds)
+}
+
+func (c *DiskCache) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return c.disk.EnumerateBlobs(dest, after, limit, waitSeconds)
+}
+
+func (c *DiskCache) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	if err := c.disk.RemoveBlobs(blobs); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.forget(blobs)
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func newTempDir(t *testing.T) string {
+	dir := fmt.Sprintf("%s/camli-diskcache-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	return dir
+}
+
+// tenBytes returns a test blob of 10 bytes.
+func tenBytes(i int) *test.Blob {
+	return &test.Blob{fmt.Sprintf("blob %05d", i)}
+}
+
+func receive(t *testing.T, c *DiskCache, tb *test.Blob) {
+	sb, err := c.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	tb.AssertMatches(t, &sb)
+}
+
+// fetch fetches tb from c, reporting whether it was cached.
+func fetch(t *testing.T, c *DiskCache, tb *test.Blob) bool {
+	rc, _, err := c.Fetch(tb.BlobRef())
+	if err == os.ENOENT {
+		return false
+	}
+	AssertNil(t, err, "Fetch")
+	defer rc.Close()
+	all, err := ioutil.ReadAll(rc)
+	AssertNil(t, err, "ReadAll")
+	ExpectString(t, tb.Contents, string(all), "fetched contents")
+	return true
+}
+
+// cached returns which of blobs are in c, as a string of 0s and 1s.
+func cached(t *testing.T, c *DiskCache, blobs []*test.Blob) string {
+	ch := make(chan blobref.SizedBlobRef, len(blobs))
+	var refs []*blobref.BlobRef
+	for _, tb := range blobs {
+		refs = append(refs, tb.BlobRef())
+	}
+	AssertNil(t, c.StatBlobs(ch, refs, 0), "StatBlobs")
+	close(ch)
+	have := make(map[string]bool)
+	for sb := range ch {
+		have[sb.BlobRef.String()] = true
+	}
+	s := ""
+	for _, tb := range blobs {
+		if have[tb.BlobRef().String()] {
+			s += "1"
+		} else {
+			s += "0"
+		}
+	}
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir := newTempDir(t)
+		c, err := New(dir, 1<<20, LRU)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return c, func() {
+			c.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestLRU(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 30, LRU)
+	AssertNil(t, err, "New")
+	defer c.Close()
+
+	b := []*test.Blob{tenBytes(0), tenBytes(1), tenBytes(2), tenBytes(3)}
+	receive(t, c, b[0])
+	receive(t, c, b[1])
+	receive(t, c, b[2])
+	ExpectString(t, "1110", cached(t, c, b), "cached before eviction")
+	Expect(t, fetch(t, c, b[0]), "fetch of 0")
+
+	// 1 is now the least recently used.
+	receive(t, c, b[3])
+	ExpectString(t, "1011", cached(t, c, b), "cached after eviction")
+	Expect(t, !fetch(t, c, b[1]), "evicted blob not fetched")
+
+	s := c.Stats()
+	ExpectInt(t, 3, s.Blobs, "blobs")
+	ExpectInt(t, 30, int(s.Bytes), "bytes")
+	ExpectInt(t, 1, int(s.Evictions), "evictions")
+	ExpectInt(t, 0, int(s.Hits), "hits; first fetch after receive doesn't count")
+	ExpectInt(t, 1, int(s.Misses), "misses")
+
+	Expect(t, fetch(t, c, b[0]), "second fetch of 0")
+	ExpectInt(t, 1, int(c.Stats().Hits), "hits after second fetch")
+}
+
+func TestLFU(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 30, LFU)
+	AssertNil(t, err, "New")
+	defer c.Close()
+
+	b := []*test.Blob{tenBytes(0), tenBytes(1), tenBytes(2), tenBytes(3)}
+	for _, tb := range b[:3] {
+		receive(t, c, tb)
+	}
+	// 0 is fetched three times, 1 once and 2 twice.
+	for i := 0; i < 3; i++ {
+		fetch(t, c, b[0])
+	}
+	fetch(t, c, b[1])
+	fetch(t, c, b[2])
+	fetch(t, c, b[2])
+
+	receive(t, c, b[3])
+	ExpectString(t, "1011", cached(t, c, b), "least frequently used evicted")
+}
+
+func TestPersistence(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 30, LRU)
+	AssertNil(t, err, "New")
+
+	b := []*test.Blob{tenBytes(0), tenBytes(1), tenBytes(2), tenBytes(3)}
+	for _, tb := range b[:3] {
+		receive(t, c, tb)
+	}
+	// Accesses are only written to the index by a flush or Close.
+	fi, err := os.Stat(dir + "/" + indexName)
+	AssertNil(t, err, "Stat")
+	fetch(t, c, b[0])
+	fi2, err := os.Stat(dir + "/" + indexName)
+	AssertNil(t, err, "Stat")
+	ExpectInt(t, int(fi.Size), int(fi2.Size), "index size after a fetch")
+	AssertNil(t, c.Close(), "Close")
+
+	// The access order survives reopening.
+	c, err = New(dir, 30, LRU)
+	AssertNil(t, err, "New again")
+	ExpectInt(t, 30, int(c.Stats().Bytes), "bytes after reopening")
+	receive(t, c, b[3])
+	ExpectString(t, "1011", cached(t, c, b), "cached after reopening")
+	AssertNil(t, c.Close(), "Close")
+
+	// Reopening with a smaller budget evicts the oldest.
+	c, err = New(dir, 15, LRU)
+	AssertNil(t, err, "New with smaller budget")
+	defer c.Close()
+	ExpectString(t, "0001", cached(t, c, b), "cached after shrinking")
+	ExpectInt(t, 10, int(c.Stats().Bytes), "bytes after shrinking")
+}
+
+func TestAdoptFilesystemCache(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	ds, err := localdisk.New(dir)
+	AssertNil(t, err, "localdisk.New")
+	old := []*test.Blob{tenBytes(0), tenBytes(1)}
+	for _, tb := range old {
+		_, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+
+	c, err := New(dir, 30, LRU)
+	AssertNil(t, err, "New")
+	defer c.Close()
+	s := c.Stats()
+	ExpectInt(t, 2, s.Blobs, "adopted blobs")
+	ExpectInt(t, 20, int(s.Bytes), "adopted bytes")
+
+	// Adopted blobs count as never accessed, so go first.
+	fresh := []*test.Blob{tenBytes(2), tenBytes(3)}
+	receive(t, c, fresh[0])
+	receive(t, c, fresh[1])
+	ExpectInt(t, 1, len(strings.Replace(cached(t, c, old), "0", "", -1)), "adopted blobs left")
+	ExpectString(t, "11", cached(t, c, fresh), "received blobs cached")
+}
+
+func TestTooLarge(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 15, LRU)
+	AssertNil(t, err, "New")
+	defer c.Close()
+
+	small := tenBytes(0)
+	receive(t, c, small)
+	big := &test.Blob{strings.Repeat("x", 16)}
+	_, err = c.ReceiveBlob(big.BlobRef(), big.Reader())
+	Expect(t, err == ErrTooLarge, "too large blob refused")
+	ExpectString(t, "10", cached(t, c, []*test.Blob{small, big}), "cached")
+	ExpectInt(t, 0, int(c.Stats().Evictions), "evictions")
+}
+
+// failingReader returns an error after its contents.
+type failingReader struct {
+	r io.Reader
+}
+
+func (fr *failingReader) Read(p []byte) (int, os.Error) {
+	n, err := fr.r.Read(p)
+	if err == os.EOF {
+		err = os.EPIPE
+	}
+	return n, err
+}
+
+func TestSourceError(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	c, err := New(dir, 1<<20, LRU)
+	AssertNil(t, err, "New")
+	defer c.Close()
+
+	tb := &test.Blob{strings.Repeat("y", 300<<10)}
+	_, err = c.ReceiveBlob(tb.BlobRef(), &failingReader{tb.Reader()})
+	Expect(t, err == os.EPIPE, "source error returned")
+	ExpectInt(t, 0, c.Stats().Blobs, "blobs")
+	parts, err := c.disk.StatPartial(tb.BlobRefSlice())
+	AssertNil(t, err, "StatPartial")
+	ExpectInt(t, 0, len(parts), "partial uploads kept")
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"lru", "lfu"} {
+		p, err := ParsePolicy(name)
+		AssertNil(t, err, "ParsePolicy")
+		ExpectString(t, name, p.String(), "policy name")
+	}
+	_, err := ParsePolicy("fifo")
+	Expect(t, err != nil, "unknown policy rejected")
+}
@@ -0,0 +1,679 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package diskpacked registers the "diskpacked" blobserver storage
+type, which stores blobs appended to a few large pack files on local
+disk instead of one file per blob.
+
+Each blob is appended to the current pack file ("pack-00000.blobs",
+"pack-00001.blobs", ...) after a "[<blobref> <size>]\n" header, and
+a new pack is started once the current one reaches maxPackSize. An
+index of blobref to pack, offset and size is kept in a kvfile.
+
+Removed blobs leave dead bytes in their pack. Once less than half of
+a full pack is live, its remaining blobs are copied to the current
+pack and the old pack file is deleted.
+
+If the index is lost, it's rebuilt from the record headers of the
+packs at startup. Blobs removed but not yet compacted away come back.
+
+Example low-level config:
+
+	"/storage/": {
+	    "handler": "storage-diskpacked",
+	    "handlerArgs": {
+	        "path": "/var/camlistore/blobs",
+	        "maxPackSize": 536870912
+	    }
+	},
+*/
+package diskpacked
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+	"camli/kvfile"
+)
+
+const defaultMaxPackSize = 512 << 20
+
+// maxBlobSize is the largest blob accepted; blobs are buffered in
+// memory before being appended.
+const maxBlobSize = 16 << 20
+
+// Index rows:
+//
+//	b|<blobref> = <pack> <offset of data> <size>
+//	p|<pack, %05d>|<blobref> = <record size, including header>
+//	d|<pack, %05d> = "" for a pack emptied by compaction, until it's deleted
+//	version = "1", so an index of no blobs isn't mistaken for a lost one
+const (
+	blobPrefix = "b|"
+	packPrefix = "p|"
+	deadPrefix = "d|"
+	versionKey = "version"
+)
+
+type DiskPacked struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	root        string
+	maxPackSize int64
+
+	index *kvfile.DB
+
+	mu      sync.Mutex    // guards following, and writes to packs
+	current int           // number of the pack being appended to
+	w       *os.File      // current pack, open for appending
+	size    int64         // size of the current pack
+	live    map[int]int64 // pack number -> bytes of live records
+}
+
+// New returns a DiskPacked storing blobs in the directory root,
+// which must exist. maxPackSize is the size at which a new pack
+// file is started; 0 means a default of 512 MB.
+func New(root string, maxPackSize int64) (*DiskPacked, os.Error) {
+	fi, err := os.Stat(root)
+	if err != nil || !fi.IsDirectory() {
+		return nil, fmt.Errorf("diskpacked: storage root %q doesn't exist or is not a directory", root)
+	}
+	if maxPackSize <= 0 {
+		maxPackSize = defaultMaxPackSize
+	}
+	index, err := kvfile.Open(filepath.Join(root, "index.kv"))
+	if err != nil {
+		return nil, err
+	}
+	ds := &DiskPacked{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		root:                      root,
+		maxPackSize:               maxPackSize,
+		index:                     index,
+		live:                      make(map[int]int64),
+	}
+	if err := ds.load(); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return ds, nil
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	root := config.RequiredString("path")
+	maxPackSize := config.OptionalInt("maxPackSize", defaultMaxPackSize)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return New(root, int64(maxPackSize))
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("diskpacked", blobserver.StorageConstructor(newFromConfig))
+}
+
+func (ds *DiskPacked) GetBlobHub() blobserver.BlobHub {
+	return ds.SimpleBlobHubPartitionMap.GetBlobHub()
+}
+
+// Close closes the current pack and the index.
+func (ds *DiskPacked) Close() os.Error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if err := ds.w.Close(); err != nil {
+		return err
+	}
+	return ds.index.Close()
+}
+
+func (ds *DiskPacked) packPath(n int) string {
+	return filepath.Join(ds.root, fmt.Sprintf("pack-%05d.blobs", n))
+}
+
+// packNumbers returns the numbers of the existing pack files.
+func (ds *DiskPacked) packNumbers() ([]int, os.Error) {
+	d, err := os.Open(ds.root)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var packs []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".blobs") {
+			continue
+		}
+		n, err := strconv.Atoi(name[len("pack-") : len(name)-len(".blobs")])
+		if err == nil {
+			packs = append(packs, n)
+		}
+	}
+	return packs, nil
+}
+
+// load opens the newest pack for appending and computes the live
+// bytes of each pack from the index, rebuilding the index first if
+// it's empty. Packs emptied by an interrupted compaction are deleted.
+func (ds *DiskPacked) load() os.Error {
+	if err := ds.removeCompacted(); err != nil {
+		return err
+	}
+	packs, err := ds.packNumbers()
+	if err != nil {
+		return err
+	}
+	sort.Ints(packs)
+	if len(packs) > 0 {
+		ds.current = packs[len(packs)-1]
+	}
+	if ds.index.Len() == 0 {
+		if err := ds.rebuildIndex(packs); err != nil {
+			return err
+		}
+		if err := ds.index.Set(versionKey, "1"); err != nil {
+			return err
+		}
+	}
+	it := ds.index.Find(packPrefix)
+	for it.Next() {
+		if !strings.HasPrefix(it.Key(), packPrefix) {
+			break
+		}
+		n, _, ok := parsePackKey(it.Key())
+		size, err := strconv.Atoi64(it.Value())
+		if !ok || err != nil {
+			return fmt.Errorf("diskpacked: corrupt index row %q", it.Key())
+		}
+		ds.live[n] += size
+	}
+	return ds.openCurrent()
+}
+
+func deadKey(n int) string {
+	return fmt.Sprintf("%s%05d", deadPrefix, n)
+}
+
+// removeCompacted deletes the packs which compaction emptied but
+// didn't get to delete.
+func (ds *DiskPacked) removeCompacted() os.Error {
+	b := ds.index.BeginBatch()
+	it := ds.index.Find(deadPrefix)
+	for it.Next() {
+		if !strings.HasPrefix(it.Key(), deadPrefix) {
+			break
+		}
+		n, err := strconv.Atoi(it.Key()[len(deadPrefix):])
+		if err != nil {
+			return fmt.Errorf("diskpacked: corrupt index row %q", it.Key())
+		}
+		log.Printf("diskpacked: removing compacted pack %s", ds.packPath(n))
+		err = os.Remove(ds.packPath(n))
+		if pe, ok := err.(*os.PathError); err != nil && !(ok && pe.Error == os.ENOENT) {
+			return err
+		}
+		b.Delete(it.Key())
+	}
+	return ds.index.CommitBatch(b)
+}
+
+// rebuildIndex adds the index rows for the records of the packs,
+// which must be in increasing order. A blob found in several packs,
+// as left by an interrupted compaction, is indexed in the newest. A
+// partial record at the end of the newest pack is truncated.
+func (ds *DiskPacked) rebuildIndex(packs []int) os.Error {
+	found := make(map[string]int) // blobref -> pack indexed in
+	for _, n := range packs {
+		b := ds.index.BeginBatch()
+		end, err := ds.scanPack(n, func(br *blobref.BlobRef, offset, size int64) {
+			if old, ok := found[br.String()]; ok {
+				b.Delete(packKey(old, br.String()))
+			}
+			found[br.String()] = n
+			rec := int64(len(recordHeader(br, size))) + size
+			b.Set(blobPrefix+br.String(), fmt.Sprintf("%d %d %d", n, offset, size))
+			b.Set(packKey(n, br.String()), strconv.Itoa64(rec))
+		})
+		if err != nil {
+			if n != ds.current {
+				return fmt.Errorf("diskpacked: rebuilding index from %s: %v", ds.packPath(n), err)
+			}
+			log.Printf("diskpacked: truncating %s at offset %d after bad record: %v", ds.packPath(n), end, err)
+			if err := os.Truncate(ds.packPath(n), end); err != nil {
+				return err
+			}
+		}
+		if err := ds.index.CommitBatch(b); err != nil {
+			return err
+		}
+	}
+	if len(found) > 0 {
+		log.Printf("diskpacked: rebuilt index of %d blobs in %s", len(found), ds.root)
+	}
+	return nil
+}
+
+// scanPack calls fn with the location of each record in pack n. It
+// returns the offset of the end of the last whole record.
+func (ds *DiskPacked) scanPack(n int, fn func(br *blobref.BlobRef, offset, size int64)) (end int64, err os.Error) {
+	f, err := os.Open(ds.packPath(n))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		header, err := r.ReadString('\n')
+		if err == os.EOF && header == "" {
+			return end, nil
+		}
+		if err != nil {
+			return end, fmt.Errorf("short record header at offset %d", end)
+		}
+		var ref string
+		var size int64
+		if _, err := fmt.Sscanf(header, "[%s %d]\n", &ref, &size); err != nil || size < 0 {
+			return end, fmt.Errorf("bad record header %q at offset %d", header, end)
+		}
+		br := blobref.Parse(ref)
+		if br == nil {
+			return end, fmt.Errorf("bad blobref in record header %q at offset %d", header, end)
+		}
+		if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+			return end, fmt.Errorf("short record at offset %d", end)
+		}
+		fn(br, end+int64(len(header)), size)
+		end += int64(len(header)) + size
+	}
+	panic("unreachable")
+}
+
+// openCurrent opens ds.current for appending. ds.mu must be held,
+// or ds not yet shared.
+func (ds *DiskPacked) openCurrent() os.Error {
+	f, err := os.OpenFile(ds.packPath(ds.current), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ds.w, ds.size = f, fi.Size
+	return nil
+}
+
+func packKey(n int, br string) string {
+	return fmt.Sprintf("%s%05d|%s", packPrefix, n, br)
+}
+
+func parsePackKey(k string) (n int, br string, ok bool) {
+	parts := strings.SplitN(k[len(packPrefix):], "|", 2)
+	if len(parts) != 2 {
+		return
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return
+	}
+	return n, parts[1], true
+}
+
+func recordHeader(br *blobref.BlobRef, size int64) string {
+	return fmt.Sprintf("[%s %d]\n", br, size)
+}
+
+// location is where a blob's data is stored.
+type location struct {
+	pack   int
+	offset int64
+	size   int64
+}
+
+func (ds *DiskPacked) lookup(br *blobref.BlobRef) (loc location, err os.Error) {
+	v, err := ds.index.Get(blobPrefix + br.String())
+	if err != nil {
+		return
+	}
+	if _, err = fmt.Sscanf(v, "%d %d %d", &loc.pack, &loc.offset, &loc.size); err != nil {
+		err = fmt.Errorf("diskpacked: corrupt index entry for %s: %q", br, v)
+	}
+	return
+}
+
+// appendBlob writes the blob br with contents data to the current
+// pack, starting a new pack first if it's full, and commits b with
+// the index rows for it added. The pack and live sizes are only
+// advanced once the rows are committed. ds.mu must be held.
+func (ds *DiskPacked) appendBlob(b *kvfile.Batch, br *blobref.BlobRef, data []byte) os.Error {
+	if ds.size >= ds.maxPackSize {
+		if err := ds.w.Close(); err != nil {
+			return err
+		}
+		ds.current++
+		if err := ds.openCurrent(); err != nil {
+			return err
+		}
+	}
+	header := recordHeader(br, int64(len(data)))
+	rec := make([]byte, 0, len(header)+len(data))
+	rec = append(rec, header...)
+	rec = append(rec, data...)
+	b.Set(blobPrefix+br.String(), fmt.Sprintf("%d %d %d", ds.current, ds.size+int64(len(header)), len(data)))
+	b.Set(packKey(ds.current, br.String()), strconv.Itoa(len(rec)))
+
+	_, err := ds.w.Write(rec)
+	if err == nil {
+		err = ds.w.Sync()
+	}
+	if err == nil {
+		err = ds.index.CommitBatch(b)
+	}
+	if err != nil {
+		// Don't leave a record behind which isn't indexed. If it
+		// can't be removed, the pack's size is no longer known, so
+		// have the next append start a new pack.
+		if terr := ds.w.Truncate(ds.size); terr != nil {
+			ds.size = ds.maxPackSize
+			return fmt.Errorf("diskpacked: %v; truncating %s: %v", err, ds.packPath(ds.current), terr)
+		}
+		return err
+	}
+	ds.size += int64(len(rec))
+	ds.live[ds.current] += int64(len(rec))
+	return nil
+}
+
+func (ds *DiskPacked) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := br.Hash()
+	var buf bytes.Buffer
+	size, err := io.Copy(io.MultiWriter(hash, &buf), io.LimitReader(source, maxBlobSize+1))
+	if err != nil {
+		return
+	}
+	if size > maxBlobSize {
+		err = fmt.Errorf("diskpacked: blob %s larger than %d bytes", br, maxBlobSize)
+		return
+	}
+	if !br.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if _, err := ds.lookup(br); err == nil {
+		return blobref.SizedBlobRef{BlobRef: br, Size: size}, nil
+	}
+	if err = ds.appendBlob(ds.index.BeginBatch(), br, buf.Bytes()); err != nil {
+		return
+	}
+	ds.GetBlobHub().NotifyBlobReceived(br)
+	return blobref.SizedBlobRef{BlobRef: br, Size: size}, nil
+}
+
+// sectionFile is a blob's section of a pack file.
+type sectionFile struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (sf *sectionFile) Close() os.Error {
+	return sf.f.Close()
+}
+
+func (ds *DiskPacked) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return ds.Fetch(br)
+}
+
+func (ds *DiskPacked) Fetch(br *blobref.BlobRef) (blobref.ReadSeekCloser, int64, os.Error) {
+	// A compaction may move the blob between the lookup and the
+	// open, so retry once if the pack is gone.
+	for try := 0; ; try++ {
+		loc, err := ds.lookup(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		f, err := os.Open(ds.packPath(loc.pack))
+		if err != nil {
+			if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT && try == 0 {
+				continue
+			}
+			return nil, 0, err
+		}
+		return &sectionFile{io.NewSectionReader(f, loc.offset, loc.size), f}, loc.size, nil
+	}
+	panic("unreachable")
+}
+
+// stat sends the sizes of those of blobs present to dest and returns
+// the rest.
+func (ds *DiskPacked) stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef) (missing []*blobref.BlobRef, err os.Error) {
+	for _, br := range blobs {
+		loc, err := ds.lookup(br)
+		switch {
+		case err == nil:
+			dest <- blobref.SizedBlobRef{BlobRef: br, Size: loc.size}
+		case err == os.ENOENT:
+			missing = append(missing, br)
+		default:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (ds *DiskPacked) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	// Listen before the first stat, so no blob arrives unnoticed
+	// in between.
+	var ch chan *blobref.BlobRef
+	if waitSeconds > 0 {
+		if waitSeconds > 60 {
+			waitSeconds = 60
+		}
+		hub := ds.GetBlobHub()
+		ch = make(chan *blobref.BlobRef, len(blobs))
+		for _, br := range blobs {
+			hub.RegisterBlobListener(br, ch)
+			defer hub.UnregisterBlobListener(br, ch)
+		}
+	}
+
+	missing, err := ds.stat(dest, blobs)
+	if err != nil || len(missing) == 0 || waitSeconds == 0 {
+		return err
+	}
+	need := make(map[string]bool)
+	for _, br := range missing {
+		need[br.String()] = true
+	}
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	for len(need) > 0 {
+		select {
+		case <-timer.C:
+			return nil
+		case br := <-ch:
+			if !need[br.String()] {
+				continue
+			}
+			missing, err := ds.stat(dest, []*blobref.BlobRef{br})
+			if err != nil {
+				return err
+			}
+			if len(missing) == 0 {
+				need[br.String()] = false, false
+			}
+		}
+	}
+	return nil
+}
+
+func (ds *DiskPacked) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	n := ds.enumerate(dest, after, limit)
+	if n > 0 || waitSeconds == 0 {
+		return nil
+	}
+
+	hub := ds.GetBlobHub()
+	ch := make(chan *blobref.BlobRef, 1)
+	hub.RegisterListener(ch)
+	defer hub.UnregisterListener(ch)
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ch:
+		ds.enumerate(dest, after, limit)
+	}
+	return nil
+}
+
+// enumerate sends up to limit blobs after after, in sorted order,
+// and returns how many it sent.
+func (ds *DiskPacked) enumerate(dest chan<- blobref.SizedBlobRef, after string, limit uint) (n uint) {
+	it := ds.index.Find(blobPrefix + after)
+	for n < limit && it.Next() {
+		k := it.Key()
+		if !strings.HasPrefix(k, blobPrefix) {
+			break
+		}
+		if k == blobPrefix+after {
+			continue
+		}
+		br := blobref.Parse(k[len(blobPrefix):])
+		var loc location
+		if _, err := fmt.Sscanf(it.Value(), "%d %d %d", &loc.pack, &loc.offset, &loc.size); br == nil || err != nil {
+			continue
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: loc.size}
+		n++
+	}
+	return
+}
+
+func (ds *DiskPacked) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	b := ds.index.BeginBatch()
+	touched := make(map[int]bool)
+	for _, br := range blobs {
+		loc, err := ds.lookup(br)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		b.Delete(blobPrefix + br.String())
+		b.Delete(packKey(loc.pack, br.String()))
+		ds.live[loc.pack] -= int64(len(recordHeader(br, loc.size))) + loc.size
+		touched[loc.pack] = true
+	}
+	if err := ds.index.CommitBatch(b); err != nil {
+		return err
+	}
+	for n := range touched {
+		if err := ds.maybeCompact(n); err != nil {
+			return fmt.Errorf("diskpacked: compacting pack %d: %v", n, err)
+		}
+	}
+	return nil
+}
+
+// maybeCompact copies the live blobs of pack n to the current pack
+// and deletes pack n, if less than half of n is live. The current
+// pack is never compacted. ds.mu must be held.
+func (ds *DiskPacked) maybeCompact(n int) os.Error {
+	if n == ds.current {
+		return nil
+	}
+	fi, err := os.Stat(ds.packPath(n))
+	if err != nil {
+		return err
+	}
+	if ds.live[n]*2 >= fi.Size {
+		return nil
+	}
+
+	var refs []*blobref.BlobRef
+	it := ds.index.Find(packKey(n, ""))
+	for it.Next() {
+		pn, br, ok := parsePackKey(it.Key())
+		if !strings.HasPrefix(it.Key(), packPrefix) || !ok || pn != n {
+			break
+		}
+		refs = append(refs, blobref.Parse(br))
+	}
+
+	f, err := os.Open(ds.packPath(n))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Each blob is moved by its own batch, so the index stays
+	// consistent if compaction stops half way.
+	for _, br := range refs {
+		if br == nil {
+			continue
+		}
+		loc, err := ds.lookup(br)
+		if err != nil {
+			return err
+		}
+		data := make([]byte, loc.size)
+		if _, err := f.ReadAt(data, loc.offset); err != nil {
+			return err
+		}
+		b := ds.index.BeginBatch()
+		b.Delete(packKey(n, br.String()))
+		if err := ds.appendBlob(b, br, data); err != nil {
+			return err
+		}
+		ds.live[n] -= int64(len(recordHeader(br, loc.size))) + loc.size
+	}
+	// Record that the pack is empty before deleting it, so load
+	// finishes the job if it's interrupted.
+	if err := ds.index.Set(deadKey(n), ""); err != nil {
+		return err
+	}
+	ds.live[n] = 0, false
+	log.Printf("diskpacked: compacted pack %d, moving %d blobs", n, len(refs))
+	if err := os.Remove(ds.packPath(n)); err != nil {
+		return err
+	}
+	return ds.index.Delete(deadKey(n))
+}
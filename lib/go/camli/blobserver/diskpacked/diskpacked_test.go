@@ -0,0 +1,173 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diskpacked
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func newTempDir(t *testing.T) string {
+	dir := fmt.Sprintf("%s/camli-diskpacked-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	return dir
+}
+
+func fetchString(t *testing.T, ds *DiskPacked, br *blobref.BlobRef) string {
+	rc, _, err := ds.Fetch(br)
+	if err != nil {
+		t.Fatalf("Fetch(%s): %v", br, err)
+	}
+	defer rc.Close()
+	all, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll(%s): %v", br, err)
+	}
+	return string(all)
+}
+
+func enumerateAll(t *testing.T, ds *DiskPacked, after string, limit uint) []string {
+	ch := make(chan blobref.SizedBlobRef, 100)
+	if err := ds.EnumerateBlobs(ch, after, limit, 0); err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	var refs []string
+	for sb := range ch {
+		refs = append(refs, sb.BlobRef.String())
+	}
+	return refs
+}
+
+func TestDiskPacked(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Small packs, so the blobs below span several.
+	ds, err := New(dir, 100)
+	AssertNil(t, err, "New")
+
+	var blobs []*test.Blob
+	var refs []string
+	for i := 0; i < 20; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob number %d with some padding", i)}
+		blobs = append(blobs, tb)
+		refs = append(refs, tb.BlobRef().String())
+		sb, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		tb.AssertMatches(t, &sb)
+	}
+	sort.Strings(refs)
+	packs, err := ds.packNumbers()
+	AssertNil(t, err, "packNumbers")
+	Expect(t, len(packs) > 2, "blobs span several packs")
+
+	for _, tb := range blobs {
+		ExpectString(t, tb.Contents, fetchString(t, ds, tb.BlobRef()), "fetched contents")
+	}
+	ExpectString(t, fmt.Sprint(refs), fmt.Sprint(enumerateAll(t, ds, "", 100)), "enumeration")
+	ExpectString(t, fmt.Sprint(refs[5:8]), fmt.Sprint(enumerateAll(t, ds, refs[4], 3)), "enumeration after, with limit")
+
+	statc := make(chan blobref.SizedBlobRef, 2)
+	AssertNil(t, ds.StatBlobs(statc, []*blobref.BlobRef{blobs[3].BlobRef(), blobref.MustParse("sha1-0000000000000000000000000000000000000000")}, 0), "StatBlobs")
+	close(statc)
+	n := 0
+	for sb := range statc {
+		blobs[3].AssertMatches(t, &sb)
+		n++
+	}
+	ExpectInt(t, 1, n, "stat results")
+
+	// Remove most blobs, compacting all but the current pack.
+	var remove []*blobref.BlobRef
+	for i, tb := range blobs {
+		if i%4 != 0 {
+			remove = append(remove, tb.BlobRef())
+		}
+	}
+	AssertNil(t, ds.RemoveBlobs(remove), "RemoveBlobs")
+	packsAfter, err := ds.packNumbers()
+	AssertNil(t, err, "packNumbers")
+	Expect(t, len(packsAfter) < len(packs), "compaction removed packs")
+	AssertNil(t, ds.Close(), "Close")
+
+	// Reopen; the kept blobs are still there.
+	ds, err = New(dir, 100)
+	AssertNil(t, err, "New again")
+	defer ds.Close()
+	ExpectInt(t, 5, len(enumerateAll(t, ds, "", 100)), "blobs after removal")
+	for i, tb := range blobs {
+		if i%4 == 0 {
+			ExpectString(t, tb.Contents, fetchString(t, ds, tb.BlobRef()), "kept blob contents")
+			continue
+		}
+		_, _, err := ds.Fetch(tb.BlobRef())
+		Expect(t, err == os.ENOENT, "removed blob is gone")
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	dir := newTempDir(t)
+	defer os.RemoveAll(dir)
+	ds, err := New(dir, 100)
+	AssertNil(t, err, "New")
+
+	var blobs []*test.Blob
+	for i := 0; i < 10; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob number %d with some padding", i)}
+		blobs = append(blobs, tb)
+		_, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+	AssertNil(t, ds.Close(), "Close")
+
+	// Losing the index loses no blobs.
+	AssertNil(t, os.Remove(dir+"/index.kv"), "removing index")
+	ds, err = New(dir, 100)
+	AssertNil(t, err, "New without index")
+	defer ds.Close()
+	ExpectInt(t, len(blobs), len(enumerateAll(t, ds, "", 100)), "blobs after rebuild")
+	for _, tb := range blobs {
+		ExpectString(t, tb.Contents, fetchString(t, ds, tb.BlobRef()), "contents after rebuild")
+	}
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		dir := newTempDir(t)
+		// Small packs, so removals compact them.
+		ds, err := New(dir, 100)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return ds, func() {
+			ds.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
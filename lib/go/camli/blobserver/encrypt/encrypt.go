@@ -0,0 +1,492 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package encrypt registers the "encrypt" blobserver storage type,
+which stores blobs encrypted in another storage so its provider
+never sees plaintext.
+
+Each blob is encrypted with AES in CTR mode under a random IV,
+authenticated with an HMAC-SHA256 of the IV and ciphertext, and
+stored in the "blobs" storage under the blobref of the result.
+Blobs whose MAC doesn't verify are rejected before decryption.
+For every blob, a small meta blob mapping the plaintext blobref to
+the ciphertext blobref is encrypted the same way and stored in the
+"meta" storage. The mappings are cached in a local kvfile index, so
+fetches, stats and enumerations keep using plaintext blobrefs. If
+the index is empty at startup, it's rebuilt from the meta blobs.
+
+Example low-level config:
+
+	"/enc/": {
+	    "handler": "storage-encrypt",
+	    "handlerArgs": {
+	        "blobs": "/s3-blobs/",
+	        "meta": "/s3-meta/",
+	        "index": "/var/camlistore/encrypt-index.kv",
+	        "key": "000102030405060708090a0b0c0d0e0f"
+	    }
+	},
+
+The key is 16, 24 or 32 hex-encoded bytes, selecting AES-128,
+AES-192 or AES-256. The cipher and MAC keys are both derived from it.
+*/
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+	"camli/kvfile"
+)
+
+// maxBlobSize is the largest blob accepted; blobs are encrypted in
+// memory.
+const maxBlobSize = 16 << 20
+
+// macSize is the size of the HMAC-SHA256 ending every stored blob.
+const macSize = 32
+
+// metaHeader starts the plaintext of every meta blob. It's followed
+// by a line of the form "<plaintext blobref>/<size>/<ciphertext blobref>".
+const metaHeader = "#camlistore/encmeta=1\n"
+
+type Storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	blobs blobserver.Storage // encrypted blobs
+	meta  blobserver.Storage // encrypted plaintext->ciphertext mappings
+
+	block  cipher.Block
+	macKey []byte
+
+	// index maps plaintext blobrefs to
+	// "<plaintext size> <ciphertext blobref> <meta blobref>".
+	index *kvfile.DB
+}
+
+type encRef struct {
+	size int64            // plaintext size
+	enc  *blobref.BlobRef // ciphertext blob, in blobs
+	meta *blobref.BlobRef // mapping blob, in meta
+}
+
+func (er *encRef) String() string {
+	return fmt.Sprintf("%d %s %s", er.size, er.enc, er.meta)
+}
+
+// New returns a Storage encrypting blobs with the AES key into
+// blobs, with the mappings to their plaintext blobrefs in meta,
+// cached in the kvfile at indexPath. If that's empty, the mappings
+// are read from meta first.
+func New(blobs, meta blobserver.Storage, key []byte, indexPath string) (*Storage, os.Error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("encrypt: bad key: %d bytes, want 16, 24 or 32", len(key))
+	}
+	block, err := aes.NewCipher(deriveKey(key, "cipher")[:len(key)])
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: bad key: %v", err)
+	}
+	sto := &Storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		blobs:                     blobs,
+		meta:                      meta,
+		block:                     block,
+		macKey:                    deriveKey(key, "mac"),
+	}
+	sto.index, err = kvfile.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if sto.index.Len() == 0 {
+		if err := sto.readAllMeta(); err != nil {
+			sto.index.Close()
+			return nil, err
+		}
+	}
+	return sto, nil
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	blobsPrefix := config.RequiredString("blobs")
+	metaPrefix := config.RequiredString("meta")
+	indexPath := config.RequiredString("index")
+	hexKey := config.RequiredString("key")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: key isn't hex: %v", err)
+	}
+	if blobsPrefix == metaPrefix {
+		return nil, os.NewError("encrypt: the blobs and meta storages must differ")
+	}
+	blobs, err := ld.GetStorage(blobsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := ld.GetStorage(metaPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return New(blobs, meta, key, indexPath)
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("encrypt", blobserver.StorageConstructor(newFromConfig))
+}
+
+func (sto *Storage) GetBlobHub() blobserver.BlobHub {
+	return sto.SimpleBlobHubPartitionMap.GetBlobHub()
+}
+
+// Close closes the index.
+func (sto *Storage) Close() os.Error {
+	return sto.index.Close()
+}
+
+// invalidError is the error for a stored blob which fails to
+// authenticate or parse, as opposed to one which can't be read.
+type invalidError string
+
+func (e invalidError) String() string {
+	return "encrypt: " + string(e)
+}
+
+// deriveKey returns a key for purpose derived from the configured
+// key, so the cipher and MAC keys are independent.
+func deriveKey(key []byte, purpose string) []byte {
+	h := hmac.NewSHA256(key)
+	h.Write([]byte("camlistore/encrypt/" + purpose))
+	return h.Sum()
+}
+
+func (sto *Storage) mac(data []byte) []byte {
+	h := hmac.NewSHA256(sto.macKey)
+	h.Write(data)
+	return h.Sum()
+}
+
+// encrypt returns the IV, plain encrypted, and the MAC of both.
+func (sto *Storage) encrypt(plain []byte) ([]byte, os.Error) {
+	out := make([]byte, aes.BlockSize+len(plain), aes.BlockSize+len(plain)+macSize)
+	iv := out[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	cipher.NewCTR(sto.block, iv).XORKeyStream(out[aes.BlockSize:], plain)
+	return append(out, sto.mac(out)...), nil
+}
+
+// decrypt verifies the MAC of the output of encrypt and, if it
+// matches, decrypts it.
+func (sto *Storage) decrypt(data []byte) ([]byte, os.Error) {
+	if len(data) < aes.BlockSize+macSize {
+		return nil, invalidError("ciphertext too short")
+	}
+	ciphertext, mac := data[:len(data)-macSize], data[len(data)-macSize:]
+	if subtle.ConstantTimeCompare(mac, sto.mac(ciphertext)) != 1 {
+		return nil, invalidError("bad MAC; tampered with, or wrong key?")
+	}
+	iv := ciphertext[:aes.BlockSize]
+	plain := make([]byte, len(ciphertext)-aes.BlockSize)
+	cipher.NewCTR(sto.block, iv).XORKeyStream(plain, ciphertext[aes.BlockSize:])
+	return plain, nil
+}
+
+// put encrypts plain and stores it in dst under the blobref of the
+// ciphertext, which it returns.
+func (sto *Storage) put(dst blobserver.Storage, plain []byte) (*blobref.BlobRef, os.Error) {
+	ciphertext, err := sto.encrypt(plain)
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.New()
+	h.Write(ciphertext)
+	br := blobref.FromHash("sha1", h)
+	if _, err := dst.ReceiveBlob(br, bytes.NewBuffer(ciphertext)); err != nil {
+		return nil, err
+	}
+	return br, nil
+}
+
+// get fetches br from src, verifies its MAC and decrypts it.
+func (sto *Storage) get(src blobserver.Storage, br *blobref.BlobRef) ([]byte, os.Error) {
+	rc, _, err := src.FetchStreaming(br)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	ciphertext, err := ioutil.ReadAll(io.LimitReader(rc, aes.BlockSize+maxBlobSize+macSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return sto.decrypt(ciphertext)
+}
+
+// lookup returns the index entry of br, or os.ENOENT.
+func (sto *Storage) lookup(br *blobref.BlobRef) (*encRef, os.Error) {
+	v, err := sto.index.Get(br.String())
+	if err != nil {
+		return nil, err
+	}
+	er, err := parseEncRef(v)
+	if err != nil {
+		return nil, fmt.Errorf("encrypt: corrupt index entry for %s: %q", br, v)
+	}
+	return er, nil
+}
+
+func parseEncRef(v string) (*encRef, os.Error) {
+	fields := strings.Fields(v)
+	if len(fields) != 3 {
+		return nil, os.NewError("wrong number of fields")
+	}
+	size, err := strconv.Atoi64(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	er := &encRef{size: size, enc: blobref.Parse(fields[1]), meta: blobref.Parse(fields[2])}
+	if er.enc == nil || er.meta == nil {
+		return nil, os.NewError("bad blobref")
+	}
+	return er, nil
+}
+
+// readAllMeta populates the index from all the meta blobs. Meta
+// blobs which don't authenticate are skipped; any other error
+// fails, rather than leaving blobs out of the index.
+func (sto *Storage) readAllMeta() os.Error {
+	err := blobserver.EnumerateAll(sto.meta, "", func(sb blobref.SizedBlobRef) os.Error {
+		err := sto.readMeta(sb.BlobRef)
+		if _, ok := err.(invalidError); ok {
+			log.Printf("encrypt: skipping meta blob %s: %v", sb.BlobRef, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading meta blob %s: %v", sb.BlobRef, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("encrypt: rebuilding index: %v", err)
+	}
+	return nil
+}
+
+func (sto *Storage) readMeta(metaRef *blobref.BlobRef) os.Error {
+	plain, err := sto.get(sto.meta, metaRef)
+	if err != nil {
+		return err
+	}
+	s := string(plain)
+	if !strings.HasPrefix(s, metaHeader) {
+		return invalidError("bad meta header")
+	}
+	fields := strings.Split(strings.TrimSpace(s[len(metaHeader):]), "/")
+	if len(fields) != 3 {
+		return invalidError("malformed meta blob")
+	}
+	br, enc := blobref.Parse(fields[0]), blobref.Parse(fields[2])
+	size, err := strconv.Atoi64(fields[1])
+	if br == nil || enc == nil || err != nil {
+		return invalidError("malformed meta blob")
+	}
+	er := &encRef{size: size, enc: enc, meta: metaRef}
+	return sto.index.Set(br.String(), er.String())
+}
+
+func (sto *Storage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	hash := b.Hash()
+	var buf bytes.Buffer
+	n, err := io.Copy(io.MultiWriter(hash, &buf), io.LimitReader(source, maxBlobSize+1))
+	if err != nil {
+		return
+	}
+	if n > maxBlobSize {
+		err = fmt.Errorf("encrypt: blob %s larger than %d bytes", b, maxBlobSize)
+		return
+	}
+	if !b.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	if _, err := sto.lookup(b); err == nil {
+		return blobref.SizedBlobRef{BlobRef: b, Size: n}, nil
+	}
+
+	enc, err := sto.put(sto.blobs, buf.Bytes())
+	if err != nil {
+		return
+	}
+	meta, err := sto.put(sto.meta, []byte(fmt.Sprintf("%s%s/%d/%s\n", metaHeader, b, n, enc)))
+	if err != nil {
+		return
+	}
+	er := &encRef{size: n, enc: enc, meta: meta}
+	if err = sto.index.Set(b.String(), er.String()); err != nil {
+		return
+	}
+
+	sto.GetBlobHub().NotifyBlobReceived(b)
+	return blobref.SizedBlobRef{BlobRef: b, Size: n}, nil
+}
+
+func (sto *Storage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
+	er, err := sto.lookup(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	plain, err := sto.get(sto.blobs, er.enc)
+	if err != nil {
+		return nil, 0, err
+	}
+	hash := b.Hash()
+	hash.Write(plain)
+	if !b.HashMatches(hash) {
+		return nil, 0, blobserver.ErrCorruptBlob
+	}
+	return ioutil.NopCloser(bytes.NewBuffer(plain)), int64(len(plain)), nil
+}
+
+// stat sends the sizes of those of blobs present to dest and returns
+// the rest.
+func (sto *Storage) stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef) (missing []*blobref.BlobRef, err os.Error) {
+	for _, b := range blobs {
+		er, err := sto.lookup(b)
+		switch {
+		case err == nil:
+			dest <- blobref.SizedBlobRef{BlobRef: b, Size: er.size}
+		case err == os.ENOENT:
+			missing = append(missing, b)
+		default:
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (sto *Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	// Listen before the first stat, so no blob arrives unnoticed
+	// in between.
+	var ch chan *blobref.BlobRef
+	if waitSeconds > 0 {
+		if waitSeconds > 60 {
+			waitSeconds = 60
+		}
+		hub := sto.GetBlobHub()
+		ch = make(chan *blobref.BlobRef, len(blobs))
+		for _, b := range blobs {
+			hub.RegisterBlobListener(b, ch)
+			defer hub.UnregisterBlobListener(b, ch)
+		}
+	}
+
+	missing, err := sto.stat(dest, blobs)
+	if err != nil || len(missing) == 0 || waitSeconds == 0 {
+		return err
+	}
+	need := make(map[string]bool)
+	for _, b := range missing {
+		need[b.String()] = true
+	}
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	for len(need) > 0 {
+		select {
+		case <-timer.C:
+			return nil
+		case b := <-ch:
+			if !need[b.String()] {
+				continue
+			}
+			missing, err := sto.stat(dest, []*blobref.BlobRef{b})
+			if err != nil {
+				return err
+			}
+			if len(missing) == 0 {
+				need[b.String()] = false, false
+			}
+		}
+	}
+	return nil
+}
+
+func (sto *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	n := uint(0)
+	it := sto.index.Find(after)
+	for n < limit && it.Next() {
+		if it.Key() == after {
+			continue
+		}
+		br := blobref.Parse(it.Key())
+		er, err := parseEncRef(it.Value())
+		if br == nil || err != nil {
+			return fmt.Errorf("encrypt: corrupt index entry for %q", it.Key())
+		}
+		dest <- blobref.SizedBlobRef{BlobRef: br, Size: er.size}
+		n++
+	}
+	return nil
+}
+
+func (sto *Storage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	var encs, metas []*blobref.BlobRef
+	batch := sto.index.BeginBatch()
+	for _, b := range blobs {
+		er, err := sto.lookup(b)
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		encs = append(encs, er.enc)
+		metas = append(metas, er.meta)
+		batch.Delete(b.String())
+	}
+	if err := sto.index.CommitBatch(batch); err != nil {
+		return err
+	}
+
+	// Remove the mappings first, so a failure leaves at worst
+	// unreferenced ciphertext.
+	if err := sto.meta.RemoveBlobs(metas); err != nil {
+		return err
+	}
+	return sto.blobs.RemoveBlobs(encs)
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package encrypt
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+var testKey = []byte("0123456789abcdef")
+
+func newDisk(t *testing.T, name string) (*localdisk.DiskStorage, string) {
+	dir := fmt.Sprintf("%s/camli-encrypt-%s-%d-%d", os.TempDir(), name, os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	ds, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatalf("localdisk.New: %v", err)
+	}
+	return ds, dir
+}
+
+func enumerate(t *testing.T, sto blobserver.Storage) []blobref.SizedBlobRef {
+	ch := make(chan blobref.SizedBlobRef, 100)
+	if err := sto.EnumerateBlobs(ch, "", 100, 0); err != nil {
+		t.Fatalf("EnumerateBlobs: %v", err)
+	}
+	var sbs []blobref.SizedBlobRef
+	for sb := range ch {
+		sbs = append(sbs, sb)
+	}
+	return sbs
+}
+
+func TestEncrypt(t *testing.T) {
+	blobs, blobsDir := newDisk(t, "blobs")
+	defer os.RemoveAll(blobsDir)
+	meta, metaDir := newDisk(t, "meta")
+	defer os.RemoveAll(metaDir)
+
+	sto, err := New(blobs, meta, testKey, blobsDir+".index")
+	AssertNil(t, err, "New")
+	defer os.Remove(blobsDir + ".index")
+
+	secret := &test.Blob{"my secret plaintext"}
+	other := &test.Blob{"another blob"}
+	for _, tb := range []*test.Blob{secret, other} {
+		sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		tb.AssertMatches(t, &sb)
+	}
+
+	_, err = sto.ReceiveBlob(secret.BlobRef(), strings.NewReader("tampered"))
+	Expect(t, err == blobserver.ErrCorruptBlob, "corrupt blob rejected")
+
+	rc, size, err := sto.FetchStreaming(secret.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	got, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	ExpectString(t, secret.Contents, string(got), "fetched plaintext")
+	ExpectInt(t, len(secret.Contents), int(size), "fetched size")
+
+	// The backing storages see only ciphertext.
+	for _, backing := range []blobserver.Storage{blobs, meta} {
+		for _, sb := range enumerate(t, backing) {
+			Expect(t, !sb.BlobRef.Equals(secret.BlobRef()), "plaintext blobref not stored")
+			rc, _, err := backing.FetchStreaming(sb.BlobRef)
+			AssertNil(t, err, "backing FetchStreaming")
+			raw, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			Expect(t, !strings.Contains(string(raw), "secret"), "plaintext not stored")
+			Expect(t, !strings.Contains(string(raw), secret.BlobRef().String()), "plaintext blobref not in meta")
+		}
+	}
+
+	// Reopened, the index has the same blobs.
+	AssertNil(t, sto.Close(), "Close")
+	sto, err = New(blobs, meta, testKey, blobsDir+".index")
+	AssertNil(t, err, "New with the same index")
+	ExpectInt(t, 2, len(enumerate(t, sto)), "enumerated blobs after reopening")
+	sto.Close()
+
+	// A new Storage with an empty index rebuilds it from the meta
+	// blobs.
+	sto2, err := New(blobs, meta, testKey, metaDir+".index")
+	AssertNil(t, err, "New with an empty index")
+	defer os.Remove(metaDir + ".index")
+	defer sto2.Close()
+	sbs := enumerate(t, sto2)
+	ExpectInt(t, 2, len(sbs), "enumerated blobs after reopening")
+	for _, sb := range sbs {
+		Expect(t, sb.BlobRef.Equals(secret.BlobRef()) || sb.BlobRef.Equals(other.BlobRef()), "enumerated plaintext blobref")
+	}
+	statc := make(chan blobref.SizedBlobRef, 2)
+	AssertNil(t, sto2.StatBlobs(statc, []*blobref.BlobRef{secret.BlobRef()}, 0), "StatBlobs")
+	sb := <-statc
+	secret.AssertMatches(t, &sb)
+
+	// With the wrong key, nothing is readable.
+	sto3, err := New(blobs, meta, []byte("fedcba9876543210"), blobsDir+".index3")
+	AssertNil(t, err, "New with other key")
+	defer os.Remove(blobsDir + ".index3")
+	ExpectInt(t, 0, len(enumerate(t, sto3)), "blobs visible with wrong key")
+	sto3.Close()
+
+	AssertNil(t, sto2.RemoveBlobs([]*blobref.BlobRef{secret.BlobRef()}), "RemoveBlobs")
+	_, _, err = sto2.FetchStreaming(secret.BlobRef())
+	Expect(t, err == os.ENOENT, "ENOENT after removal")
+	ExpectInt(t, 1, len(enumerate(t, blobs)), "ciphertext blobs after removal")
+	ExpectInt(t, 1, len(enumerate(t, meta)), "meta blobs after removal")
+}
+
+func TestTamperedMeta(t *testing.T) {
+	blobs, blobsDir := newDisk(t, "blobs")
+	defer os.RemoveAll(blobsDir)
+	meta, metaDir := newDisk(t, "meta")
+	defer os.RemoveAll(metaDir)
+
+	sto, err := New(blobs, meta, testKey, blobsDir+".index")
+	AssertNil(t, err, "New")
+	defer os.Remove(blobsDir + ".index")
+	defer sto.Close()
+	tb := &test.Blob{"some blob"}
+	_, err = sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	// Flip a bit of the plaintext size in a copy of the meta blob.
+	metas := enumerate(t, meta)
+	ExpectInt(t, 1, len(metas), "meta blobs")
+	rc, _, err := meta.FetchStreaming(metas[0].BlobRef)
+	AssertNil(t, err, "meta FetchStreaming")
+	raw, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	pos := len(raw) - macSize - len(tb.BlobRef().String()) - 3
+	raw[pos] ^= 1
+	forged := (&test.Blob{string(raw)}).BlobRef()
+	_, err = meta.ReceiveBlob(forged, bytes.NewBuffer(raw))
+	AssertNil(t, err, "ReceiveBlob forged meta")
+
+	_, ok := sto.readMeta(forged).(invalidError)
+	Expect(t, ok, "forged meta blob rejected")
+	sto2, err := New(blobs, meta, testKey, metaDir+".index")
+	AssertNil(t, err, "New with forged meta blob")
+	defer os.Remove(metaDir + ".index")
+	defer sto2.Close()
+	sbs := enumerate(t, sto2)
+	ExpectInt(t, 1, len(sbs), "enumerated blobs")
+	tb.AssertMatches(t, &sbs[0])
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		blobs, blobsDir := newDisk(t, "blobs")
+		meta, metaDir := newDisk(t, "meta")
+		sto, err := New(blobs, meta, testKey, blobsDir+".index")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		return sto, func() {
+			sto.Close()
+			os.Remove(blobsDir + ".index")
+			os.RemoveAll(blobsDir)
+			os.RemoveAll(metaDir)
+		}
+	})
+}
+
+// failFetch is a storage whose fetches fail.
+type failFetch struct {
+	*localdisk.DiskStorage
+}
+
+func (failFetch) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return nil, 0, os.NewError("injected fetch failure")
+}
+
+func TestMetaReadError(t *testing.T) {
+	blobs, blobsDir := newDisk(t, "blobs")
+	defer os.RemoveAll(blobsDir)
+	meta, metaDir := newDisk(t, "meta")
+	defer os.RemoveAll(metaDir)
+	sto, err := New(blobs, meta, testKey, blobsDir+".index")
+	AssertNil(t, err, "New")
+	defer os.Remove(blobsDir + ".index")
+	tb := &test.Blob{"some blob"}
+	_, err = sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	sto.Close()
+
+	// Rebuilding the index fails rather than leaving out the blobs
+	// whose meta blobs can't be read.
+	sto, err = New(blobs, failFetch{meta}, testKey, metaDir+".index")
+	defer os.Remove(metaDir + ".index")
+	if err == nil {
+		sto.Close()
+		t.Fatalf("New succeeded with unreadable meta blobs")
+	}
+}
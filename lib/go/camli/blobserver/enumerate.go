@@ -0,0 +1,58 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"os"
+
+	"camli/blobref"
+)
+
+// enumerateAllBatch is the number of blobs EnumerateAll requests per
+// EnumerateBlobs call.
+var enumerateAllBatch uint = 1000
+
+// EnumerateAll calls fn with each blob of src sorting after after,
+// in order. It enumerates a page of blobs at a time, and only calls
+// fn once each page's enumeration is over, so fn may modify src. It
+// stops at the first error, from src or fn, and returns it.
+func EnumerateAll(src BlobEnumerator, after string, fn func(sb blobref.SizedBlobRef) os.Error) os.Error {
+	for {
+		ch := make(chan blobref.SizedBlobRef, buffered)
+		errch := make(chan os.Error, 1)
+		go func(after string) {
+			errch <- src.EnumerateBlobs(ch, after, enumerateAllBatch, 0)
+		}(after)
+		var page []blobref.SizedBlobRef
+		for sb := range ch {
+			page = append(page, sb)
+		}
+		if err := <-errch; err != nil {
+			return err
+		}
+		if len(page) == 0 {
+			return nil
+		}
+		for _, sb := range page {
+			if err := fn(sb); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].BlobRef.String()
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blobserver
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"camli/blobref"
+	. "camli/test/asserts"
+)
+
+// sortedBlobs enumerates its sorted blobs, counting calls.
+type sortedBlobs struct {
+	blobs []blobref.SizedBlobRef
+	calls int
+}
+
+func (s *sortedBlobs) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	s.calls++
+	n := uint(0)
+	for _, sb := range s.blobs {
+		if n == limit {
+			break
+		}
+		if sb.BlobRef.String() > after {
+			dest <- sb
+			n++
+		}
+	}
+	return nil
+}
+
+func TestEnumerateAll(t *testing.T) {
+	defer func(n uint) { enumerateAllBatch = n }(enumerateAllBatch)
+	enumerateAllBatch = 3
+
+	src := new(sortedBlobs)
+	var refs []string
+	for i := 0; i < 10; i++ {
+		refs = append(refs, blobref.Sha1FromString(fmt.Sprintf("blob %d", i)).String())
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		src.blobs = append(src.blobs, blobref.SizedBlobRef{blobref.Parse(ref), 6})
+	}
+
+	var got []string
+	err := EnumerateAll(src, refs[1], func(sb blobref.SizedBlobRef) os.Error {
+		got = append(got, sb.BlobRef.String())
+		return nil
+	})
+	AssertNil(t, err, "EnumerateAll")
+	ExpectInt(t, 8, len(got), "blobs enumerated after the second")
+	for i, ref := range got {
+		ExpectString(t, refs[i+2], ref, "enumerated blob")
+	}
+	ExpectInt(t, 4, src.calls, "EnumerateBlobs calls")
+
+	stop := os.NewError("stop")
+	n := 0
+	err = EnumerateAll(src, "", func(sb blobref.SizedBlobRef) os.Error {
+		if n++; n == 5 {
+			return stop
+		}
+		return nil
+	})
+	Expect(t, err == stop, "fn's error returned")
+	ExpectInt(t, 5, n, "blobs enumerated until fn's error")
+}
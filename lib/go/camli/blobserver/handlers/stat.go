@@ -91,7 +91,9 @@ func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.
 	}
 
 	statRes := make([]map[string]interface{}, 0)
+	var partialRes []map[string]interface{}
 	if len(toStat) > 0 {
+		have := make(map[string]bool)
 		blobch := make(chan blobref.SizedBlobRef)
 		resultch := make(chan os.Error, 1)
 		go func() {
@@ -105,6 +107,7 @@ func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.
 			ah["blobRef"] = sb.BlobRef.String()
 			ah["size"] = sb.Size
 			statRes = append(statRes, ah)
+			have[sb.BlobRef.String()] = true
 		}
 
 		err := <-resultch
@@ -113,11 +116,36 @@ func handleStat(conn http.ResponseWriter, req *http.Request, storage blobserver.
 			conn.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+
+		// Per doc/protocol/blob-upload-resume.txt.
+		if pu, ok := storage.(blobserver.PartialUploader); ok {
+			var missing []*blobref.BlobRef
+			for _, br := range toStat {
+				if !have[br.String()] {
+					missing = append(missing, br)
+				}
+			}
+			partials, err := pu.StatPartial(missing)
+			if err != nil {
+				log.Printf("Stat error on partial uploads: %v", err)
+			}
+			for _, p := range partials {
+				ah := make(map[string]interface{})
+				ah["blobRef"] = p.BlobRef.String()
+				ah["size"] = p.Size
+				ah["partBlobRef"] = p.PartBlobRef.String()
+				ah["resumeKey"] = p.ResumeKey
+				partialRes = append(partialRes, ah)
+			}
+		}
 	}
 
 	configer, _ := storage.(blobserver.Configer)
 	ret := commonUploadResponse(configer, req)
 	ret["stat"] = statRes
+	if len(partialRes) > 0 {
+		ret["alreadyHavePartially"] = partialRes
+	}
 	ret["canLongPoll"] = true
 	httputil.ReturnJson(conn, ret)
 }
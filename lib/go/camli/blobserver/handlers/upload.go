@@ -103,11 +103,31 @@ func handleMultiPartUpload(conn http.ResponseWriter, req *http.Request, blobRece
 		}
 
 		formName := params["name"]
+		if strings.HasPrefix(formName, "resume-") {
+			// Per doc/protocol/blob-upload-resume.txt.
+			pu, ok := blobReceiver.(blobserver.PartialUploader)
+			if !ok {
+				addError(fmt.Sprintf("Resuming uploads isn't supported; ignoring form key %q", formName))
+				continue
+			}
+			blobGot, err := pu.ReceiveResumedBlob(formName, mimePart)
+			if err != nil {
+				addError(fmt.Sprintf("Error receiving resumed blob %q: %v\n", formName, err))
+				break
+			}
+			log.Printf("Received resumed blob %v\n", blobGot)
+			receivedBlobs = append(receivedBlobs, blobGot)
+			continue
+		}
 		ref := blobref.Parse(formName)
 		if ref == nil {
 			addError(fmt.Sprintf("Ignoring form key %q", formName))
 			continue
 		}
+		if !ref.IsSupported() {
+			addError(fmt.Sprintf("Unsupported hash function for blobref %s", ref))
+			continue
+		}
 
 		if oldAppEngineHappySpec {
 			_, hasContentType := mimePart.Header["Content-Type"]
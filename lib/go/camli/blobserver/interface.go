@@ -56,6 +56,40 @@ type QueueCreator interface {
 	CreateQueue(name string) (Storage, os.Error)
 }
 
+// Quarantiner is implemented by Storage interfaces which can move a
+// bad blob aside, out of reach of fetches and enumeration, rather
+// than deleting it.  This is used by fsck.
+type Quarantiner interface {
+	Quarantine(blob *blobref.BlobRef) os.Error
+}
+
+// StrayLister is implemented by Storage interfaces which can find
+// files they left behind which aren't blobs, such as the temp files
+// of interrupted uploads.  This is used by fsck.
+type StrayLister interface {
+	StrayFiles() ([]string, os.Error)
+}
+
+// PartialUpload describes the beginning of a blob kept from an
+// interrupted upload.  See doc/protocol/blob-upload-resume.txt.
+type PartialUpload struct {
+	BlobRef     *blobref.BlobRef // the complete blob
+	Size        int64            // bytes kept
+	PartBlobRef *blobref.BlobRef // digest of the bytes kept
+	ResumeKey   string
+}
+
+// PartialUploader is implemented by Storage interfaces which keep
+// the beginning of interrupted uploads so clients can resume them.
+type PartialUploader interface {
+	// StatPartial returns the partial uploads kept of blobs.
+	StatPartial(blobs []*blobref.BlobRef) ([]PartialUpload, os.Error)
+
+	// ReceiveResumedBlob receives a blob whose beginning was kept
+	// under resumeKey, and whose remainder is read from source.
+	ReceiveResumedBlob(resumeKey string, source io.Reader) (blobref.SizedBlobRef, os.Error)
+}
+
 type MaxEnumerateConfig interface {
 	// Returns the max that this storage interface is capable
 	// of enumerating at once.
@@ -0,0 +1,101 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"camli/blobref"
+)
+
+// quarantinePartition is the partition bad blobs are moved into.
+const quarantinePartition = "quarantine"
+
+// Quarantine moves blob out of the storage into the "quarantine"
+// partition, where it's kept for inspection but is no longer
+// fetched or enumerated.
+func (ds *DiskStorage) Quarantine(blob *blobref.BlobRef) os.Error {
+	dir := ds.blobDirectory(quarantinePartition, blob)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	err := os.Rename(ds.blobPath(ds.partition, blob), ds.blobPath(quarantinePartition, blob))
+	if errorIsNoEnt(err) {
+		return os.ENOENT
+	}
+	return err
+}
+
+// StrayFiles returns the paths of the files under the storage root
+// which aren't blobs at their expected location, such as temp files
+// left by interrupted uploads.  Partitions other than the storage's
+// own are skipped.
+func (ds *DiskStorage) StrayFiles() ([]string, os.Error) {
+	var stray []string
+	err := ds.findStray(ds.PartitionRoot(ds.partition), true, &stray)
+	return stray, err
+}
+
+func (ds *DiskStorage) findStray(dir string, top bool, stray *[]string) os.Error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if top && name == "partition" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDirectory() {
+			if err := ds.findStray(path, false, stray); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.IsRegular() || !ds.isBlobPath(path) {
+			*stray = append(*stray, path)
+		}
+	}
+	return nil
+}
+
+// isBlobPath reports whether path is where the blob it's named
+// after belongs.
+func (ds *DiskStorage) isBlobPath(path string) bool {
+	base := filepath.Base(path)
+	if !strings.HasSuffix(base, ".dat") {
+		return false
+	}
+	br := blobref.Parse(base[:len(base)-len(".dat")])
+	if br == nil {
+		return false
+	}
+	return path == ds.blobPath(ds.partition, br)
+}
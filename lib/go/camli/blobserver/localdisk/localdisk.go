@@ -38,6 +38,9 @@ type DiskStorage struct {
 	// queue partitions to mirror new blobs into (when partition
 	// above is the empty string)
 	mirrorPartitions []*DiskStorage
+
+	// whether to keep interrupted uploads for resuming
+	keepPartials bool
 }
 
 func New(root string) (storage *DiskStorage, err os.Error) {
@@ -51,6 +54,7 @@ func New(root string) (storage *DiskStorage, err os.Error) {
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
 		root:                      root,
 	}
+	storage.sweepPartials()
 	return
 }
 
@@ -58,6 +62,7 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserv
 	sto := &DiskStorage{
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
 		root:                      config.RequiredString("path"),
+		keepPartials:              config.OptionalBool("keepPartialUploads", false),
 	}
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -69,6 +74,10 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserv
 	if !fi.IsDirectory() {
 		return nil, fmt.Errorf("Path %q isn't a directory", sto.root)
 	}
+	sto.sweepPartials()
+	if sto.keepPartials {
+		go sto.sweepPartialsLoop()
+	}
 	return sto, nil
 }
 
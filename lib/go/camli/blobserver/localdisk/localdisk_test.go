@@ -19,6 +19,7 @@ package localdisk
 import (
 	"camli/blobref"
 	"camli/blobserver"
+	"camli/blobserver/storagetest"
 	. "camli/test/asserts"
 	"crypto/sha1"
 	"fmt"
@@ -206,3 +207,52 @@ func TestMissingGetReturnsNoEnt(t *testing.T) {
 		t.Errorf("expected nil blob; got a value")
 	}
 }
+
+func TestMixedHashes(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	sha1Ref := blobref.FromString("sha1", "foo")
+	sha256Ref := blobref.FromString("sha256", "foo")
+	for _, br := range []*blobref.BlobRef{sha256Ref, sha1Ref} {
+		sb, err := ds.ReceiveBlob(br, strings.NewReader("foo"))
+		AssertNil(t, err, "ReceiveBlob of "+br.String())
+		ExpectString(t, br.String(), sb.BlobRef.String(), "received blobref")
+	}
+	_, err := ds.ReceiveBlob(sha256Ref, strings.NewReader("bar"))
+	Expect(t, err == blobserver.ErrCorruptBlob, "sha256 digest verified")
+
+	ch := make(chan blobref.SizedBlobRef, 2)
+	AssertNil(t, ds.StatBlobs(ch, []*blobref.BlobRef{sha1Ref, sha256Ref}, 0), "StatBlobs")
+	close(ch)
+	got := 0
+	for sb := range ch {
+		got++
+		ExpectInt(t, 3, int(sb.Size), "stat size of "+sb.BlobRef.String())
+	}
+	ExpectInt(t, 2, got, "stat results")
+
+	enumerate := func(after string) (refs []string) {
+		ch := make(chan blobref.SizedBlobRef, 10)
+		AssertNil(t, ds.EnumerateBlobs(ch, after, 10, 0), "EnumerateBlobs")
+		for sb := range ch {
+			refs = append(refs, sb.BlobRef.String())
+		}
+		return
+	}
+	refs := enumerate("")
+	if len(refs) != 2 || refs[0] != sha1Ref.String() || refs[1] != sha256Ref.String() {
+		t.Errorf("enumerated %q; want [%s %s]", refs, sha1Ref, sha256Ref)
+	}
+	refs = enumerate(sha1Ref.String())
+	if len(refs) != 1 || refs[0] != sha256Ref.String() {
+		t.Errorf("enumerated after %s: %q; want [%s]", sha1Ref, refs, sha256Ref)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		ds := NewStorage(t)
+		return ds, func() { cleanUp(ds) }
+	})
+}
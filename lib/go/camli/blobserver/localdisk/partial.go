@@ -0,0 +1,191 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+const (
+	// partialPartition is the partition interrupted uploads are
+	// kept in, one file per blob, for resuming.
+	partialPartition = "partial"
+
+	// Interrupted uploads shorter than this aren't worth keeping.
+	minPartialSize = 64 << 10
+
+	// Partial uploads older than this, in seconds, are removed.
+	maxPartialAge = 86400
+
+	// How often, in seconds, expired partial uploads are swept.
+	partialSweepInterval = 3600
+
+	resumeKeyPrefix = "resume-"
+)
+
+func (ds *DiskStorage) partialPath(b *blobref.BlobRef) string {
+	return filepath.Join(ds.PartitionRoot(partialPartition), b.String()+".part")
+}
+
+func partialExpired(fi *os.FileInfo) bool {
+	return time.Seconds()-fi.Mtime_ns/1e9 > maxPartialAge
+}
+
+// sweepPartials removes the expired partial uploads.
+func (ds *DiskStorage) sweepPartials() {
+	if ds.partition != "" {
+		return
+	}
+	dir := ds.PartitionRoot(partialPartition)
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		log.Printf("localdisk: sweeping partial uploads: %v", err)
+		return
+	}
+	n := 0
+	for _, fi := range fis {
+		if !fi.IsRegular() || !strings.HasSuffix(fi.Name, ".part") || !partialExpired(&fi) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name)); err != nil {
+			log.Printf("localdisk: sweeping partial uploads: %v", err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("localdisk: removed %d expired partial uploads", n)
+	}
+}
+
+func (ds *DiskStorage) sweepPartialsLoop() {
+	for {
+		time.Sleep(partialSweepInterval * 1e9)
+		ds.sweepPartials()
+	}
+}
+
+// keepPartial moves the temp file of an interrupted upload of b
+// aside for resuming, and reports whether it did.
+func (ds *DiskStorage) keepPartial(b *blobref.BlobRef, tempFile *os.File) bool {
+	if err := tempFile.Sync(); err != nil {
+		return false
+	}
+	if err := tempFile.Close(); err != nil {
+		return false
+	}
+	if err := os.MkdirAll(ds.PartitionRoot(partialPartition), 0700); err != nil {
+		log.Printf("localdisk: keeping partial upload of %s: %v", b, err)
+		return false
+	}
+	if err := os.Rename(tempFile.Name(), ds.partialPath(b)); err != nil {
+		log.Printf("localdisk: keeping partial upload of %s: %v", b, err)
+		return false
+	}
+	return true
+}
+
+func resumeKey(b *blobref.BlobRef, size int64) string {
+	return fmt.Sprintf("%s%s-%d", resumeKeyPrefix, b, size)
+}
+
+func parseResumeKey(key string) (b *blobref.BlobRef, size int64, ok bool) {
+	if !strings.HasPrefix(key, resumeKeyPrefix) {
+		return
+	}
+	key = key[len(resumeKeyPrefix):]
+	dash := strings.LastIndex(key, "-")
+	if dash < 0 {
+		return
+	}
+	size, err := strconv.Atoi64(key[dash+1:])
+	if err != nil || size <= 0 {
+		return
+	}
+	b = blobref.Parse(key[:dash])
+	return b, size, b != nil
+}
+
+func (ds *DiskStorage) StatPartial(blobs []*blobref.BlobRef) ([]blobserver.PartialUpload, os.Error) {
+	if ds.partition != "" || !ds.keepPartials {
+		return nil, nil
+	}
+	var partials []blobserver.PartialUpload
+	for _, b := range blobs {
+		path := ds.partialPath(b)
+		fi, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if partialExpired(fi) {
+			os.Remove(path)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		h := b.Hash()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		partials = append(partials, blobserver.PartialUpload{
+			BlobRef:     b,
+			Size:        n,
+			PartBlobRef: blobref.FromHash(b.HashName(), h),
+			ResumeKey:   resumeKey(b, n),
+		})
+	}
+	return partials, nil
+}
+
+func (ds *DiskStorage) ReceiveResumedBlob(key string, source io.Reader) (blobref.SizedBlobRef, os.Error) {
+	b, size, ok := parseResumeKey(key)
+	if !ok {
+		return blobref.SizedBlobRef{}, fmt.Errorf("localdisk: invalid resume key %q", key)
+	}
+	f, err := os.Open(ds.partialPath(b))
+	if err != nil {
+		return blobref.SizedBlobRef{}, fmt.Errorf("localdisk: partial upload for resume key %q is gone", key)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if fi.Size != size {
+		return blobref.SizedBlobRef{}, fmt.Errorf("localdisk: partial upload for resume key %q has changed", key)
+	}
+	return ds.ReceiveBlob(b, io.MultiReader(f, source))
+}
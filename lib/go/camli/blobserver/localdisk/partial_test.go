@@ -0,0 +1,112 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	. "camli/test/asserts"
+)
+
+// interruptedReader reads r, then fails like a dropped connection.
+type interruptedReader struct {
+	r io.Reader
+}
+
+func (ir *interruptedReader) Read(p []byte) (int, os.Error) {
+	n, err := ir.r.Read(p)
+	if err == os.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func TestResumeUpload(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	ds.keepPartials = true
+
+	blob := &testBlob{strings.Repeat("0123456789", 20000)}
+	br := blob.BlobRef()
+	const cut = 150000
+
+	_, err := ds.ReceiveBlob(br, &interruptedReader{strings.NewReader(blob.val[:cut])})
+	Expect(t, err != nil, "interrupted upload fails")
+
+	// Too short to be worth keeping.
+	_, err = ds.ReceiveBlob(br, &interruptedReader{strings.NewReader(blob.val[:100])})
+	Expect(t, err != nil, "interrupted upload fails")
+
+	partials, err := ds.StatPartial([]*blobref.BlobRef{br})
+	AssertNil(t, err, "StatPartial")
+	if len(partials) != 1 {
+		t.Fatalf("got %d partial uploads; want 1", len(partials))
+	}
+	p := partials[0]
+	ExpectString(t, br.String(), p.BlobRef.String(), "partial blobref")
+	ExpectInt(t, cut, int(p.Size), "partial size")
+	ExpectString(t, (&testBlob{blob.val[:cut]}).BlobRef().String(), p.PartBlobRef.String(), "partial digest")
+
+	_, err = ds.ReceiveResumedBlob("resume-"+br.String()+"-123", strings.NewReader(blob.val[123:]))
+	Expect(t, err != nil, "resume with a stale key fails")
+
+	sb, err := ds.ReceiveResumedBlob(p.ResumeKey, strings.NewReader(blob.val[cut:]))
+	AssertNil(t, err, "ReceiveResumedBlob")
+	blob.AssertMatches(t, sb)
+
+	partials, err = ds.StatPartial([]*blobref.BlobRef{br})
+	AssertNil(t, err, "StatPartial after resume")
+	ExpectInt(t, 0, len(partials), "partial uploads after resume")
+}
+
+func TestPartialsOptIn(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	blob := &testBlob{strings.Repeat("0123456789", 20000)}
+	br := blob.BlobRef()
+	_, err := ds.ReceiveBlob(br, &interruptedReader{strings.NewReader(blob.val[:150000])})
+	Expect(t, err != nil, "interrupted upload fails")
+	_, err = os.Stat(ds.partialPath(br))
+	Expect(t, err != nil, "partial upload not kept by default")
+}
+
+func TestSweepPartials(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	ds.keepPartials = true
+
+	fresh := &testBlob{strings.Repeat("fresh", 20000)}
+	stale := &testBlob{strings.Repeat("stale", 20000)}
+	for _, blob := range []*testBlob{fresh, stale} {
+		_, err := ds.ReceiveBlob(blob.BlobRef(), &interruptedReader{strings.NewReader(blob.val)})
+		Expect(t, err != nil, "interrupted upload fails")
+	}
+	old := (time.Seconds() - maxPartialAge - 60) * 1e9
+	AssertNil(t, os.Chtimes(ds.partialPath(stale.BlobRef()), old, old), "Chtimes")
+
+	ds.sweepPartials()
+	_, err := os.Stat(ds.partialPath(fresh.BlobRef()))
+	AssertNil(t, err, "fresh partial upload kept")
+	_, err = os.Stat(ds.partialPath(stale.BlobRef()))
+	Expect(t, err != nil, "stale partial upload swept")
+}
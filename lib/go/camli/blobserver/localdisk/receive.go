@@ -34,6 +34,10 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 		err = fmt.Errorf("refusing upload directly to queue partition %q", pname)
 		return
 	}
+	if !blobRef.IsSupported() {
+		err = fmt.Errorf("localdisk: unsupported hash function for blobref %s", blobRef)
+		return
+	}
 	hashedDirectory := ds.blobDirectory(pname, blobRef)
 	err = os.MkdirAll(hashedDirectory, 0700)
 	if err != nil {
@@ -46,8 +50,9 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 	}
 
 	success := false // set true later
+	keptPartial := false
 	defer func() {
-		if !success {
+		if !success && !keptPartial {
 			log.Println("Removing temp file: ", tempFile.Name())
 			os.Remove(tempFile.Name())
 		}
@@ -56,6 +61,11 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 	hash := blobRef.Hash()
 	written, err := io.Copy(io.MultiWriter(hash, tempFile), source)
 	if err != nil {
+		// Most likely the client went away. Keep what we
+		// got so it can resume the upload.
+		if ds.keepPartials && written >= minPartialSize {
+			keptPartial = ds.keepPartial(blobRef, tempFile)
+		}
 		return
 	}
 	if err = tempFile.Sync(); err != nil {
@@ -108,6 +118,7 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 
 	blobGot = blobref.SizedBlobRef{BlobRef: blobRef, Size: stat.Size}
 	success = true
+	os.Remove(ds.partialPath(blobRef))
 
 	if os.Getenv("CAMLI_HACK_OPEN_IMAGES") == "1" {
 		exec.Command("eog", fileName).Run()
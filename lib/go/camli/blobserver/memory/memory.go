@@ -0,0 +1,272 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+/*
+Package memory registers the "memory" blobserver storage type, which
+keeps blobs in memory. Everything is lost when the server exits,
+which makes it useful for throwaway servers and integration tests.
+
+Example low-level config:
+
+	"/bs/": {
+	    "handler": "storage-memory",
+	    "handlerArgs": {}
+	},
+*/
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+)
+
+// Storage is an in-memory blobserver.Storage. It also implements
+// blobserver.QueueCreator.
+type Storage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	mu     sync.RWMutex
+	blobs  map[string]string // blobref string to contents
+	queues map[string]*Storage
+
+	// queue is the name of the queue this is, or "" if it isn't a
+	// queue.
+	queue string
+}
+
+var _ blobserver.QueueCreator = (*Storage)(nil)
+
+// New returns a new, empty in-memory storage.
+func New() *Storage {
+	return &Storage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		blobs:                     make(map[string]string),
+		queues:                    make(map[string]*Storage),
+	}
+}
+
+func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return New(), nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("memory", blobserver.StorageConstructor(newFromConfig))
+}
+
+var validQueueName = regexp.MustCompile(`^[a-zA-Z0-9\-\_]+$`)
+
+// CreateQueue returns the queue named name, creating it if needed.
+// Blobs received after its creation are also added to the queue,
+// until removed from it.
+func (s *Storage) CreateQueue(name string) (blobserver.Storage, os.Error) {
+	if !validQueueName.MatchString(name) {
+		return nil, fmt.Errorf("invalid queue name %q", name)
+	}
+	if s.queue != "" {
+		return nil, fmt.Errorf("can't create queue %q on existing queue %q", name, s.queue)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, ok := s.queues[name]
+	if !ok {
+		q = New()
+		q.queue = name
+		s.queues[name] = q
+	}
+	return q, nil
+}
+
+func (s *Storage) FetchStreaming(b *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	contents, ok := s.blobs[b.String()]
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), int64(len(contents)), nil
+}
+
+func (s *Storage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
+	if s.queue != "" {
+		err = fmt.Errorf("refusing upload directly to queue %q", s.queue)
+		return
+	}
+	hash := b.Hash()
+	if hash == nil {
+		err = fmt.Errorf("memory: unsupported hash function for blobref %s", b)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copy(io.MultiWriter(hash, &buf), source); err != nil {
+		return
+	}
+	if !b.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+	contents := buf.String()
+
+	s.mu.Lock()
+	s.blobs[b.String()] = contents
+	var queues []*Storage
+	for _, q := range s.queues {
+		queues = append(queues, q)
+	}
+	s.mu.Unlock()
+
+	for _, q := range queues {
+		q.mu.Lock()
+		q.blobs[b.String()] = contents
+		q.mu.Unlock()
+		q.GetBlobHub().NotifyBlobReceived(b)
+	}
+	s.GetBlobHub().NotifyBlobReceived(b)
+	return blobref.SizedBlobRef{b, int64(len(contents))}, nil
+}
+
+// stat sends the sizes of the blobs present to dest, returning
+// those missing.
+func (s *Storage) stat(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef) (missing []*blobref.BlobRef) {
+	var sbs []blobref.SizedBlobRef
+	s.mu.RLock()
+	for _, b := range blobs {
+		if contents, ok := s.blobs[b.String()]; ok {
+			sbs = append(sbs, blobref.SizedBlobRef{b, int64(len(contents))})
+		} else {
+			missing = append(missing, b)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, sb := range sbs {
+		dest <- sb
+	}
+	return
+}
+
+func (s *Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	// Listen before the first stat, so no blob arrives unnoticed
+	// in between.
+	var ch chan *blobref.BlobRef
+	if waitSeconds > 0 {
+		if waitSeconds > 60 {
+			waitSeconds = 60
+		}
+		hub := s.GetBlobHub()
+		ch = make(chan *blobref.BlobRef, len(blobs))
+		for _, b := range blobs {
+			hub.RegisterBlobListener(b, ch)
+			defer hub.UnregisterBlobListener(b, ch)
+		}
+	}
+
+	missing := s.stat(dest, blobs)
+	if len(missing) == 0 || waitSeconds == 0 {
+		return nil
+	}
+	need := make(map[string]bool)
+	for _, b := range missing {
+		need[b.String()] = true
+	}
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	for len(need) > 0 {
+		select {
+		case <-timer.C:
+			return nil
+		case b := <-ch:
+			if !need[b.String()] {
+				continue
+			}
+			if len(s.stat(dest, []*blobref.BlobRef{b})) == 0 {
+				need[b.String()] = false, false
+			}
+		}
+	}
+	return nil
+}
+
+// enumerate sends up to limit blobs after after to dest, returning
+// how many it sent.
+func (s *Storage) enumerate(dest chan<- blobref.SizedBlobRef, after string, limit uint) uint {
+	s.mu.RLock()
+	var refs []string
+	for br := range s.blobs {
+		if br > after {
+			refs = append(refs, br)
+		}
+	}
+	sort.Strings(refs)
+	if uint(len(refs)) > limit {
+		refs = refs[:limit]
+	}
+	sbs := make([]blobref.SizedBlobRef, 0, len(refs))
+	for _, br := range refs {
+		sbs = append(sbs, blobref.SizedBlobRef{blobref.Parse(br), int64(len(s.blobs[br]))})
+	}
+	s.mu.RUnlock()
+
+	for _, sb := range sbs {
+		dest <- sb
+	}
+	return uint(len(sbs))
+}
+
+func (s *Storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	var ch chan *blobref.BlobRef
+	if waitSeconds > 0 {
+		hub := s.GetBlobHub()
+		ch = make(chan *blobref.BlobRef, 1)
+		hub.RegisterListener(ch)
+		defer hub.UnregisterListener(ch)
+	}
+	if s.enumerate(dest, after, limit) > 0 || waitSeconds == 0 {
+		return nil
+	}
+	timer := time.NewTimer(int64(waitSeconds) * 1e9)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ch:
+		s.enumerate(dest, after, limit)
+	}
+	return nil
+}
+
+func (s *Storage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range blobs {
+		s.blobs[b.String()] = "", false
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package memory
+
+import (
+	"os"
+	"testing"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/jsonconfig"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		return New(), func() {}
+	})
+}
+
+func TestFromConfig(t *testing.T) {
+	sto, err := blobserver.CreateStorage("memory", nil, jsonconfig.Obj{})
+	AssertNil(t, err, "CreateStorage")
+	_, ok := sto.(*Storage)
+	Expect(t, ok, "memory storage type")
+
+	_, err = blobserver.CreateStorage("memory", nil, jsonconfig.Obj{"path": "/tmp"})
+	Expect(t, err != nil, "unknown config key rejected")
+}
+
+func TestQueue(t *testing.T) {
+	sto := New()
+	before := &test.Blob{"before the queue"}
+	_, err := sto.ReceiveBlob(before.BlobRef(), before.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	q, err := sto.CreateQueue("sync-to-remote")
+	AssertNil(t, err, "CreateQueue")
+	q2, err := sto.CreateQueue("sync-to-remote")
+	AssertNil(t, err, "CreateQueue again")
+	Expect(t, q == q2, "same queue returned for same name")
+	_, err = sto.CreateQueue("bad/name")
+	Expect(t, err != nil, "invalid queue name rejected")
+
+	after := &test.Blob{"after the queue"}
+	_, err = sto.ReceiveBlob(after.BlobRef(), after.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	ch := make(chan blobref.SizedBlobRef, 10)
+	AssertNil(t, q.EnumerateBlobs(ch, "", 10, 0), "EnumerateBlobs of queue")
+	var got []string
+	for sb := range ch {
+		got = append(got, sb.BlobRef.String())
+	}
+	if len(got) != 1 || got[0] != after.BlobRef().String() {
+		t.Errorf("queue has %q; want only %s", got, after.BlobRef())
+	}
+
+	_, err = q.ReceiveBlob(after.BlobRef(), after.Reader())
+	Expect(t, err != nil, "upload directly to queue refused")
+
+	// Removing from the queue leaves the blob in the storage.
+	AssertNil(t, q.RemoveBlobs(after.BlobRefSlice()), "RemoveBlobs from queue")
+	_, _, err = q.FetchStreaming(after.BlobRef())
+	Expect(t, err == os.ENOENT, "removed from queue")
+	rc, _, err := sto.FetchStreaming(after.BlobRef())
+	AssertNil(t, err, "still in storage")
+	rc.Close()
+}
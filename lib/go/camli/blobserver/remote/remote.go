@@ -55,6 +55,12 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserv
 	return sto, nil
 }
 
+// HashName returns the client's hash for new blobs, so the schema
+// file writers use it.
+func (sto *remoteStorage) HashName() string {
+	return sto.client.HashName()
+}
+
 func (sto *remoteStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
 	return sto.client.RemoveBlobs(blobs)
 }
@@ -0,0 +1,209 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// healBatch is the number of blobs an anti-entropy pass checks at
+// once.
+const healBatch = 1000
+
+// repairAsync copies b from the replica from to each of the replicas
+// in to, in the background, unless startRepair says not to.
+func (sto *replicaStorage) repairAsync(b *blobref.BlobRef, from blobserver.Storage, to []blobserver.Storage) {
+	if !sto.startRepair(b) {
+		return
+	}
+	sto.repairs.Add(1)
+	go func() {
+		defer sto.repairs.Done()
+		defer sto.endRepair(b)
+		if err := copyBlob(b, from, to); err != nil {
+			log.Printf("replica: read repair of %s: %v", b, err)
+		} else {
+			log.Printf("replica: read repair copied %s to %d replicas", b, len(to))
+		}
+	}()
+}
+
+// startRepair marks b as being repaired and reports whether it may be.
+// Blobs already being repaired, or being received or removed, may not:
+// replicas missing them may just not have caught up yet, and copying
+// a blob back while it's being removed would resurrect it.
+func (sto *replicaStorage) startRepair(b *blobref.BlobRef) bool {
+	bstr := b.String()
+	sto.repairMu.Lock()
+	defer sto.repairMu.Unlock()
+	if sto.repairing[bstr] || sto.writing[bstr] > 0 {
+		return false
+	}
+	sto.repairing[bstr] = true
+	return true
+}
+
+func (sto *replicaStorage) endRepair(b *blobref.BlobRef) {
+	sto.repairMu.Lock()
+	defer sto.repairMu.Unlock()
+	sto.repairing[b.String()] = false, false
+	sto.repairDone.Broadcast()
+}
+
+// beginWrite marks blobs as being received or removed, so they aren't
+// repaired until endWrite, first waiting for any repairs of them
+// already under way.
+func (sto *replicaStorage) beginWrite(blobs []*blobref.BlobRef) {
+	sto.repairMu.Lock()
+	defer sto.repairMu.Unlock()
+	for _, b := range blobs {
+		sto.writing[b.String()]++
+	}
+	for _, b := range blobs {
+		for sto.repairing[b.String()] {
+			sto.repairDone.Wait()
+		}
+	}
+}
+
+func (sto *replicaStorage) endWrite(blobs []*blobref.BlobRef) {
+	sto.repairMu.Lock()
+	defer sto.repairMu.Unlock()
+	for _, b := range blobs {
+		bstr := b.String()
+		if sto.writing[bstr]--; sto.writing[bstr] == 0 {
+			sto.writing[bstr] = 0, false
+		}
+	}
+}
+
+// copyBlob copies b from the storage from to each of to.
+func copyBlob(b *blobref.BlobRef, from blobserver.Storage, to []blobserver.Storage) os.Error {
+	for _, dest := range to {
+		rc, _, err := from.FetchStreaming(b)
+		if err != nil {
+			return err
+		}
+		_, err = dest.ReceiveBlob(b, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sto *replicaStorage) healLoop(intervalSeconds int64) {
+	for {
+		time.Sleep(intervalSeconds * 1e9)
+		n, err := sto.heal()
+		if err != nil {
+			log.Printf("replica: anti-entropy pass: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("replica: anti-entropy pass re-replicated %d blobs", n)
+		}
+	}
+}
+
+// heal makes one anti-entropy pass: it enumerates the blobs of all
+// replicas, merged by EnumerateBlobs, and copies each blob found on fewer than
+// minWritesForSuccess replicas to enough of the others. It returns
+// the number of blobs re-replicated.
+func (sto *replicaStorage) heal() (nHealed int, err os.Error) {
+	var batch []*blobref.BlobRef
+	err = blobserver.EnumerateAll(sto, "", func(sb blobref.SizedBlobRef) os.Error {
+		if batch = append(batch, sb.BlobRef); len(batch) == healBatch {
+			nHealed += sto.healBlobs(batch)
+			batch = nil
+		}
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		nHealed += sto.healBlobs(batch)
+	}
+	return
+}
+
+// healBlobs re-replicates those of blobs found on fewer than
+// minWritesForSuccess replicas, returning how many it copied.
+// Replicas which fail to stat are left alone, as are blobs which
+// startRepair refuses.
+func (sto *replicaStorage) healBlobs(blobs []*blobref.BlobRef) int {
+	have := make([]map[string]bool, len(sto.replicas))
+	for idx, replica := range sto.replicas {
+		ch := make(chan blobref.SizedBlobRef, buffered)
+		errch := make(chan os.Error, 1)
+		go func(replica blobserver.Storage) {
+			errch <- replica.StatBlobs(ch, blobs, 0)
+			close(ch)
+		}(replica)
+		m := make(map[string]bool)
+		for sb := range ch {
+			m[sb.BlobRef.String()] = true
+		}
+		if err := <-errch; err != nil {
+			log.Printf("replica: anti-entropy stat of %s: %v", sto.replicaPrefixes[idx], err)
+			continue
+		}
+		have[idx] = m
+	}
+
+	nHealed := 0
+	for _, b := range blobs {
+		bstr := b.String()
+		var from blobserver.Storage
+		var missing []blobserver.Storage
+		count := 0
+		for idx, replica := range sto.replicas {
+			switch {
+			case have[idx] == nil:
+				// Unknown.
+			case have[idx][bstr]:
+				count++
+				if from == nil {
+					from = replica
+				}
+			default:
+				missing = append(missing, replica)
+			}
+		}
+		if from == nil || count >= sto.minWritesForSuccess || len(missing) == 0 {
+			continue
+		}
+		if need := sto.minWritesForSuccess - count; len(missing) > need {
+			missing = missing[:need]
+		}
+		if !sto.startRepair(b) {
+			continue
+		}
+		err := copyBlob(b, from, missing)
+		sto.endRepair(b)
+		if err != nil {
+			log.Printf("replica: anti-entropy copy of %s: %v", b, err)
+			continue
+		}
+		nHealed++
+	}
+	return nHealed
+}
@@ -21,6 +21,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"sync"
 
 	"camli/blobref"
 	"camli/blobserver"
@@ -40,6 +41,26 @@ type replicaStorage struct {
 	// Minimum number of writes that must succeed before
 	// acknowledging success to the client.
 	minWritesForSuccess int
+
+	// Whether to copy blobs which fetches and stats find missing
+	// from some replicas back to them.
+	readRepair bool
+
+	repairMu   sync.Mutex
+	repairDone *sync.Cond      // on repairMu; broadcast as repairs finish
+	repairing  map[string]bool // blobrefs being repaired
+	writing    map[string]int  // blobrefs being received or removed
+	repairs    sync.WaitGroup  // outstanding read repairs
+}
+
+func newReplicaStorage() *replicaStorage {
+	sto := &replicaStorage{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		repairing:                 make(map[string]bool),
+		writing:                   make(map[string]int),
+	}
+	sto.repairDone = sync.NewCond(&sto.repairMu)
+	return sto
 }
 
 func (sto *replicaStorage) GetBlobHub() blobserver.BlobHub {
@@ -47,18 +68,21 @@ func (sto *replicaStorage) GetBlobHub() blobserver.BlobHub {
 }
 
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
-	sto := &replicaStorage{
-		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
-	}
+	sto := newReplicaStorage()
 	sto.replicaPrefixes = config.RequiredList("backends")
 	nReplicas := len(sto.replicaPrefixes)
 	sto.minWritesForSuccess = config.OptionalInt("minWritesForSuccess", nReplicas)
+	sto.readRepair = config.OptionalBool("readRepair", true)
+	healInterval := config.OptionalInt("healInterval", 0) // seconds; 0 disables
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
 	if nReplicas == 0 {
 		return nil, os.NewError("replica: need at least one replica")
 	}
+	if healInterval < 0 {
+		return nil, os.NewError("replica: negative healInterval")
+	}
 	if sto.minWritesForSuccess == 0 {
 		sto.minWritesForSuccess = nReplicas
 	}
@@ -70,6 +94,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobser
 		}
 		sto.replicas[i] = replicaSto
 	}
+	if healInterval > 0 {
+		go sto.healLoop(int64(healInterval))
+	}
 	return sto, nil
 }
 
@@ -79,11 +106,18 @@ func (sto *replicaStorage) weightedRandomReplicas() []blobserver.Storage {
 }
 
 func (sto *replicaStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
+	var missing []blobserver.Storage
 	for _, replica := range sto.weightedRandomReplicas() {
 		file, size, err = replica.FetchStreaming(b)
 		if err == nil {
+			if len(missing) > 0 && sto.readRepair {
+				sto.repairAsync(b, replica, missing)
+			}
 			return
 		}
+		if err == os.ENOENT {
+			missing = append(missing, replica)
+		}
 	}
 	return
 }
@@ -99,46 +133,94 @@ func (sto *replicaStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*
 		need[br.String()] = br
 	}
 
-	ch := make(chan blobref.SizedBlobRef, buffered)
+	// found maps the blobrefs found by any replica to whether
+	// each replica found it, for read repair.
+	found := make(map[string][]bool)
+
+	ch := make(chan replicaStat, buffered)
 	donechan := make(chan bool)
 
 	go func() {
-		for sb := range ch {
-			bstr := sb.BlobRef.String()
+		for rs := range ch {
+			bstr := rs.sb.BlobRef.String()
 			if _, needed := need[bstr]; needed {
-				dest <- sb
+				dest <- rs.sb
 				need[bstr] = nil, false
 			}
+			if found[bstr] == nil {
+				found[bstr] = make([]bool, len(sto.replicas))
+			}
+			found[bstr][rs.idx] = true
 		}
 		donechan <- true
 	}()
 
-	errch := make(chan os.Error, buffered)
-	statReplica := func(s blobserver.Storage) {
-		errch <- s.StatBlobs(ch, blobs, waitSeconds)
+	errch := make(chan replicaErr, buffered)
+	statReplica := func(idx int, s blobserver.Storage) {
+		rch := make(chan blobref.SizedBlobRef, buffered)
+		fwdDone := make(chan bool)
+		go func() {
+			for sb := range rch {
+				ch <- replicaStat{idx, sb}
+			}
+			fwdDone <- true
+		}()
+		err := s.StatBlobs(rch, blobs, waitSeconds)
+		close(rch)
+		<-fwdDone
+		errch <- replicaErr{idx, err}
 	}
 
-	for _, replica := range sto.replicas {
-		go statReplica(replica)
+	for idx, replica := range sto.replicas {
+		go statReplica(idx, replica)
 	}
 
 	var retErr os.Error
+	failed := make([]bool, len(sto.replicas))
 	for _ = range sto.replicas {
-		if err := <-errch; err != nil {
-			retErr = err
+		if re := <-errch; re.err != nil {
+			retErr = re.err
+			failed[re.idx] = true
 		}
 	}
 	close(ch)
 	<-donechan
 
-	// Safe to access need map now; as helper goroutine is
-	// done with it.
+	// Safe to access need and found maps now; as helper
+	// goroutine is done with them.
+	if sto.readRepair {
+		for bstr, which := range found {
+			var from blobserver.Storage
+			var missing []blobserver.Storage
+			for idx, ok := range which {
+				switch {
+				case ok && from == nil:
+					from = sto.replicas[idx]
+				case !ok && !failed[idx]:
+					missing = append(missing, sto.replicas[idx])
+				}
+			}
+			if len(missing) > 0 {
+				sto.repairAsync(blobref.Parse(bstr), from, missing)
+			}
+		}
+	}
 	if len(need) == 0 {
 		return nil
 	}
 	return retErr
 }
 
+type replicaStat struct {
+	idx int // index in replicas
+	sb  blobref.SizedBlobRef
+}
+
+type replicaErr struct {
+	idx int // index in replicas
+	err os.Error
+}
+
 type sizedBlobAndError struct {
 	sb  blobref.SizedBlobRef
 	err os.Error
@@ -161,11 +243,28 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 		sb, err := s.ReceiveBlob(b, source)
 		upResult <- sizedBlobAndError{sb, err}
 	}
+
+	// b isn't repaired until all replicas are done with it, even
+	// after enough of them have succeeded for this to return.
+	sto.beginWrite([]*blobref.BlobRef{b})
+	nResults := 0
+	defer func() {
+		go func(remaining int) {
+			for ; remaining > 0; remaining-- {
+				<-upResult
+			}
+			sto.endWrite([]*blobref.BlobRef{b})
+		}(nReplicas - nResults)
+	}()
+
 	for idx, replica := range sto.replicas {
 		go uploadToReplica(rpipe[idx], replica)
 	}
 	size, err := io.Copy(io.MultiWriter(writer...), source)
 	if err != nil {
+		for idx := range sto.replicas {
+			wpipe[idx].CloseWithError(err)
+		}
 		return
 	}
 	for idx := range sto.replicas {
@@ -173,7 +272,9 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 	}
 	nSuccess := 0
 	for _ = range sto.replicas {
-		switch res := <-upResult; {
+		res := <-upResult
+		nResults++
+		switch {
 		case res.err == nil && res.sb.Size == size:
 			nSuccess++
 			if nSuccess == sto.minWritesForSuccess {
@@ -189,7 +290,12 @@ func (sto *replicaStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (xx
 	return
 }
 
+// RemoveBlobs removes blobs from every replica. It fails unless all
+// of them succeed, as the blobs are left on (and may be repaired from)
+// those which didn't.
 func (sto *replicaStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	sto.beginWrite(blobs)
+	defer sto.endWrite(blobs)
 	errch := make(chan os.Error, buffered)
 	removeFrom := func(s blobserver.Storage) {
 		errch <- s.RemoveBlobs(blobs)
@@ -198,21 +304,17 @@ func (sto *replicaStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
 		go removeFrom(replica)
 	}
 	var reterr os.Error
-	nSuccess := 0
-	for _ = range errch {
+	nFailed := 0
+	for _ = range sto.replicas {
 		if err := <-errch; err != nil {
 			reterr = err
-		} else {
-			nSuccess++
+			nFailed++
 		}
 	}
-	if nSuccess > 0 {
-		// TODO: decide on the return value. for now this is best
-		// effort and we return nil if any of the blobservers said
-		// success.  maybe a bit weird, though.
-		return nil
+	if nFailed > 0 {
+		return fmt.Errorf("replica: remove failed on %d of %d replicas: %v", nFailed, len(sto.replicas), reterr)
 	}
-	return reterr
+	return nil
 }
 
 func (sto *replicaStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
@@ -0,0 +1,203 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package replica
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+type testReplicas struct {
+	sto  *replicaStorage
+	ds   []*localdisk.DiskStorage
+	dirs []string
+}
+
+func newTestReplicas(t *testing.T, n, minWrites int) *testReplicas {
+	tr := &testReplicas{sto: newReplicaStorage()}
+	tr.sto.minWritesForSuccess = minWrites
+	tr.sto.readRepair = true
+	for i := 0; i < n; i++ {
+		dir := fmt.Sprintf("%s/camli-replica-test-%d-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds(), i)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		tr.dirs = append(tr.dirs, dir)
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatalf("localdisk.New: %v", err)
+		}
+		tr.ds = append(tr.ds, ds)
+		tr.sto.replicaPrefixes = append(tr.sto.replicaPrefixes, fmt.Sprintf("/r%d/", i))
+		tr.sto.replicas = append(tr.sto.replicas, ds)
+	}
+	return tr
+}
+
+func (tr *testReplicas) cleanUp() {
+	for _, dir := range tr.dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// has reports which replicas have b.
+func (tr *testReplicas) has(b *blobref.BlobRef) []bool {
+	which := make([]bool, len(tr.ds))
+	for i, ds := range tr.ds {
+		rc, _, err := ds.FetchStreaming(b)
+		if err == nil {
+			rc.Close()
+			which[i] = true
+		}
+	}
+	return which
+}
+
+func countTrue(bs []bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReadRepair(t *testing.T) {
+	tr := newTestReplicas(t, 3, 3)
+	defer tr.cleanUp()
+
+	tb := &test.Blob{"foo"}
+	_, err := tr.sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	ExpectInt(t, 3, countTrue(tr.has(tb.BlobRef())), "replicas after upload")
+
+	// A fetch which misses on the first replica repairs it.
+	AssertNil(t, tr.ds[0].RemoveBlobs(tb.BlobRefSlice()), "RemoveBlobs")
+	rc, size, err := tr.sto.FetchStreaming(tb.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	rc.Close()
+	ExpectInt(t, 3, int(size), "fetched size")
+	tr.sto.repairs.Wait()
+	Expect(t, tr.has(tb.BlobRef())[0], "replica 0 repaired by fetch")
+
+	// A stat finding the blob missing from a replica repairs it.
+	AssertNil(t, tr.ds[2].RemoveBlobs(tb.BlobRefSlice()), "RemoveBlobs")
+	ch := make(chan blobref.SizedBlobRef, 10)
+	AssertNil(t, tr.sto.StatBlobs(ch, tb.BlobRefSlice(), 0), "StatBlobs")
+	close(ch)
+	n := 0
+	for sb := range ch {
+		tb.AssertMatches(t, &sb)
+		n++
+	}
+	ExpectInt(t, 1, n, "stat results")
+	tr.sto.repairs.Wait()
+	Expect(t, tr.has(tb.BlobRef())[2], "replica 2 repaired by stat")
+}
+
+func TestNoRepairWhileWriting(t *testing.T) {
+	tr := newTestReplicas(t, 2, 2)
+	defer tr.cleanUp()
+
+	tb := &test.Blob{"foo"}
+	_, err := tr.sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	// Pretend tb is being removed, and has gone from replica 0 so far.
+	tr.sto.beginWrite(tb.BlobRefSlice())
+	AssertNil(t, tr.ds[0].RemoveBlobs(tb.BlobRefSlice()), "RemoveBlobs")
+	rc, _, err := tr.sto.FetchStreaming(tb.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	rc.Close()
+	tr.sto.repairs.Wait()
+	n, err := tr.sto.heal()
+	AssertNil(t, err, "heal")
+	ExpectInt(t, 0, n, "blobs healed while being removed")
+	Expect(t, !tr.has(tb.BlobRef())[0], "replica 0 not repaired while being removed")
+
+	tr.sto.endWrite(tb.BlobRefSlice())
+	n, err = tr.sto.heal()
+	AssertNil(t, err, "heal")
+	ExpectInt(t, 1, n, "blobs healed after removal")
+}
+
+// failRemove is a replica whose removes fail.
+type failRemove struct {
+	*localdisk.DiskStorage
+}
+
+func (failRemove) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	return os.NewError("injected remove failure")
+}
+
+func TestRemovePartialFailure(t *testing.T) {
+	tr := newTestReplicas(t, 2, 2)
+	defer tr.cleanUp()
+
+	tb := &test.Blob{"foo"}
+	_, err := tr.sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	tr.sto.replicas[1] = failRemove{tr.ds[1]}
+	Expect(t, tr.sto.RemoveBlobs(tb.BlobRefSlice()) != nil, "RemoveBlobs failing on one replica returns an error")
+	ExpectInt(t, 1, countTrue(tr.has(tb.BlobRef())), "replicas after partial remove")
+}
+
+func TestHeal(t *testing.T) {
+	tr := newTestReplicas(t, 3, 2)
+	defer tr.cleanUp()
+
+	full := &test.Blob{"on all replicas"}
+	_, err := tr.sto.ReceiveBlob(full.BlobRef(), full.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+
+	var lonely []*test.Blob
+	for i := 0; i < 3; i++ {
+		tb := &test.Blob{fmt.Sprintf("only on replica %d", i)}
+		_, err := tr.ds[i].ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob on replica")
+		lonely = append(lonely, tb)
+	}
+
+	n, err := tr.sto.heal()
+	AssertNil(t, err, "heal")
+	ExpectInt(t, 3, n, "blobs healed")
+	for _, tb := range lonely {
+		ExpectInt(t, 2, countTrue(tr.has(tb.BlobRef())), "replicas of "+tb.BlobRef().String())
+	}
+
+	n, err = tr.sto.heal()
+	AssertNil(t, err, "second heal")
+	ExpectInt(t, 0, n, "blobs healed by second pass")
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+		tr := newTestReplicas(t, 2, 2)
+		return tr.sto, tr.cleanUp
+	})
+}
@@ -19,6 +19,7 @@ package s3
 import (
 	"bytes"
 	"crypto/md5"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
@@ -27,7 +28,6 @@ import (
 
 	"camli/blobref"
 	"camli/blobserver"
-	//"camli/misc/amazon/s3"
 )
 
 var _ = log.Printf
@@ -43,6 +43,7 @@ type amazonSlurper struct {
 	buf     *bytes.Buffer
 	md5     hash.Hash
 	file    *os.File // nil until allocated
+	data    []byte   // buf's contents once reading, for Seek
 	reading bool     // transitions at most once from false -> true
 }
 
@@ -54,11 +55,30 @@ func newAmazonSlurper(blob *blobref.BlobRef) *amazonSlurper {
 	}
 }
 
+// Seek rewinds the slurped blob, for retries. Only Seek(0, 0) is
+// supported.
+func (as *amazonSlurper) Seek(offset int64, whence int) (int64, os.Error) {
+	if offset != 0 || whence != 0 {
+		return 0, os.EINVAL
+	}
+	if !as.reading {
+		// Nothing read yet.
+		return 0, nil
+	}
+	if as.file != nil {
+		return as.file.Seek(0, 0)
+	}
+	as.buf = bytes.NewBuffer(as.data)
+	return 0, nil
+}
+
 func (as *amazonSlurper) Read(p []byte) (n int, err os.Error) {
 	if !as.reading {
 		as.reading = true
 		if as.file != nil {
 			as.file.Seek(0, 0)
+		} else {
+			as.data = as.buf.Bytes()
 		}
 	}
 	if as.file != nil {
@@ -96,6 +116,7 @@ func (as *amazonSlurper) Write(p []byte) (n int, err os.Error) {
 
 func (as *amazonSlurper) Cleanup() {
 	if as.file != nil {
+		as.file.Close()
 		os.Remove(as.file.Name())
 	}
 }
@@ -106,6 +127,9 @@ func (sto *s3Storage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (outs
 	defer slurper.Cleanup()
 
 	hash := blob.Hash()
+	if hash == nil {
+		return zero, fmt.Errorf("s3: unsupported hash function for blobref %s", blob)
+	}
 	size, err := io.Copy(io.MultiWriter(hash, slurper), source)
 	if err != nil {
 		return zero, err
@@ -113,9 +137,14 @@ func (sto *s3Storage) ReceiveBlob(blob *blobref.BlobRef, source io.Reader) (outs
 	if !blob.HashMatches(hash) {
 		return zero, blobserver.ErrCorruptBlob
 	}
-	err = sto.s3Client.PutObject(blob.String(), sto.bucket, slurper.md5, size, slurper)
+	if size > sto.multipartSize {
+		err = sto.s3Client.PutObjectMultipart(blob.String(), sto.bucket, sto.multipartSize, slurper)
+	} else {
+		err = sto.s3Client.PutObject(blob.String(), sto.bucket, slurper.md5, size, slurper)
+	}
 	if err != nil {
 		return zero, err
 	}
+	sto.GetBlobHub().NotifyBlobReceived(blob)
 	return blobref.SizedBlobRef{BlobRef: blob, Size: size}, nil
 }
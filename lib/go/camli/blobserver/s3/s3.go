@@ -14,6 +14,27 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
+/*
+Package s3 registers the "s3" blobserver storage type, storing blobs
+in an Amazon S3 bucket or that of an S3-compatible object store.
+
+Example low-level config:
+
+	"/r1/": {
+	    "handler": "storage-s3",
+	    "handlerArgs": {
+	       "bucket": "foo",
+	       "aws_access_key": "...",
+	       "aws_secret_access_key": "...",
+	       "hostname": "s3.example.com:9000",  // optional; default Amazon's
+	       "pathStyle": true,                  // optional; default false
+	       "multipartSize": 16777216,          // optional; bytes
+	       "skipStartupCheck": false
+	    }
+	},
+
+Blobs larger than multipartSize are uploaded with multipart uploads.
+*/
 package s3
 
 import (
@@ -26,10 +47,15 @@ import (
 	"camli/misc/amazon/s3"
 )
 
+// defaultMultipartSize is the default size over which blobs are
+// uploaded in parts, and the size of those parts.
+const defaultMultipartSize = 16 << 20
+
 type s3Storage struct {
 	*blobserver.SimpleBlobHubPartitionMap
-	s3Client *s3.Client
-	bucket   string
+	s3Client      *s3.Client
+	bucket        string
+	multipartSize int64
 }
 
 func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
@@ -39,16 +65,22 @@ func newFromConfig(_ blobserver.Loader, config jsonconfig.Obj) (storage blobserv
 			SecretAccessKey: config.RequiredString("aws_secret_access_key"),
 		},
 		HttpClient: http.DefaultClient,
+		Endpoint:   config.OptionalString("hostname", ""),
+		PathStyle:  config.OptionalBool("pathStyle", false),
 	}
 	sto := &s3Storage{
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
 		s3Client:                  client,
 		bucket:                    config.RequiredString("bucket"),
+		multipartSize:             int64(config.OptionalInt("multipartSize", defaultMultipartSize)),
 	}
 	skipStartupCheck := config.OptionalBool("skipStartupCheck", false)
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
+	if sto.multipartSize < s3.MinPartSize {
+		return nil, fmt.Errorf("s3: multipartSize %d is less than the minimum of %d", sto.multipartSize, s3.MinPartSize)
+	}
 	if !skipStartupCheck {
 		// TODO: skip this check if a file
 		// ~/.camli/.configcheck/sha1-("IS GOOD: s3: sha1(access key +
@@ -0,0 +1,111 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"http/httptest"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"camli/blobserver"
+	"camli/blobserver/storagetest"
+	"camli/jsonconfig"
+	"camli/misc/amazon/s3/fakes3"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+// newFakeStorage returns s3 storage backed by a fake S3 server, the
+// fake, and a func to stop it.
+func newFakeStorage(t *testing.T) (*s3Storage, *fakes3.Server, func()) {
+	fake := fakes3.New()
+	fake.CreateBucket("camli")
+	ts := httptest.NewServer(fake)
+	sto, err := blobserver.CreateStorage("s3", nil, jsonconfig.Obj{
+		"aws_access_key":        "key",
+		"aws_secret_access_key": "secret",
+		"bucket":                "camli",
+		"hostname":              ts.URL,
+		"pathStyle":             true,
+	})
+	if err != nil {
+		ts.Close()
+		t.Fatalf("CreateStorage: %v", err)
+	}
+	return sto.(*s3Storage), fake, ts.Close
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.TestOpt(t, storagetest.Opts{
+		New: func(t *testing.T) (blobserver.Storage, func()) {
+			sto, _, stop := newFakeStorage(t)
+			return sto, stop
+		},
+		SkipStatWait: true,
+	})
+}
+
+func TestMultipartSizeConfig(t *testing.T) {
+	_, err := blobserver.CreateStorage("s3", nil, jsonconfig.Obj{
+		"aws_access_key":        "key",
+		"aws_secret_access_key": "secret",
+		"bucket":                "camli",
+		"skipStartupCheck":      true,
+		"multipartSize":         float64(1 << 20),
+	})
+	Expect(t, err != nil, "multipartSize under the S3 minimum rejected")
+}
+
+func TestMultipartReceive(t *testing.T) {
+	sto, fake, stop := newFakeStorage(t)
+	defer stop()
+	sto.multipartSize = 10
+
+	small := &test.Blob{"small"}
+	large := &test.Blob{strings.Repeat("x", 25)}
+	for _, tb := range []*test.Blob{small, large} {
+		sb, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		tb.AssertMatches(t, &sb)
+
+		got, ok := fake.Object("camli", tb.BlobRef().String())
+		Expect(t, ok, "blob stored")
+		ExpectString(t, tb.Contents, string(got), "stored contents")
+	}
+	ExpectInt(t, 0, fake.Uploads(), "multipart uploads left in progress")
+
+	rc, size, err := sto.FetchStreaming(large.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	defer rc.Close()
+	slurp, err := ioutil.ReadAll(rc)
+	AssertNil(t, err, "ReadAll")
+	ExpectInt(t, len(large.Contents), int(size), "fetched size")
+	ExpectString(t, large.Contents, string(slurp), "fetched contents")
+}
+
+func TestReceiveRetries(t *testing.T) {
+	sto, fake, stop := newFakeStorage(t)
+	defer stop()
+
+	tb := &test.Blob{"retried"}
+	fake.Fail(2)
+	_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	AssertNil(t, err, "ReceiveBlob after transient failures")
+	got, _ := fake.Object("camli", tb.BlobRef().String())
+	ExpectString(t, tb.Contents, string(got), "stored contents")
+}
@@ -29,11 +29,13 @@ func (sto *s3Storage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobr
 	// TODO: do n stats in parallel
 	for _, br := range blobs {
 		size, err := sto.s3Client.Stat(br.String(), sto.bucket)
-		log.Printf("stat of %s: %d, %v", br.String(), size, err)
-		if err == nil {
+		switch err {
+		case nil:
 			dest <- blobref.SizedBlobRef{BlobRef: br, Size: size}
-		} else {
-			// TODO: handle
+		case os.ENOENT:
+			// Missing blobs aren't sent.
+		default:
+			return err
 		}
 	}
 	return nil
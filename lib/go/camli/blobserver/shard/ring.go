@@ -0,0 +1,79 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// vnodesPerShard is the number of points each shard has on a ring.
+// More points spread blobs more evenly.
+const vnodesPerShard = 128
+
+// A ring maps hashes to shards by consistent hashing: each shard
+// owns the arcs of the ring ending at its points, which are derived
+// from the shard's name.  Adding a shard only takes over the arcs
+// ending at its points, so only about 1/N of the blobs move,
+// instead of nearly all of them with modulo hashing.
+type ring struct {
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+type byHash []ringPoint
+
+func (p byHash) Len() int      { return len(p) }
+func (p byHash) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byHash) Less(i, j int) bool {
+	if p[i].hash != p[j].hash {
+		return p[i].hash < p[j].hash
+	}
+	return p[i].shard < p[j].shard
+}
+
+// newRing returns a ring of the shards with the given names.
+func newRing(names []string) *ring {
+	r := &ring{points: make([]ringPoint, 0, len(names)*vnodesPerShard)}
+	for shard, name := range names {
+		for i := 0; i < vnodesPerShard; i++ {
+			h := sha1.New()
+			fmt.Fprintf(h, "%s-%d", name, i)
+			r.points = append(r.points, ringPoint{binary.BigEndian.Uint32(h.Sum()), shard})
+		}
+	}
+	sort.Sort(byHash(r.points))
+	return r
+}
+
+// shardNum returns the index of the shard owning hash h: the
+// shard of the first point at or after h, wrapping around.
+func (r *ring) shardNum(h uint32) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
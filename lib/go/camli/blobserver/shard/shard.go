@@ -17,61 +17,205 @@ limitations under the License.
 package shard
 
 import (
+	"fmt"
 	"io"
+	"log"
 	"os"
+	"sync"
+	"time"
 
 	"camli/blobref"
 	"camli/blobserver"
 	"camli/jsonconfig"
 )
 
-type shardStorage struct {
-	*blobserver.SimpleBlobHubPartitionMap
+const buffered = 8
+
+// rebalanceRetry is how long to wait, in seconds, before retrying a
+// failed rebalancing pass.
+const rebalanceRetry = 60
 
+// A layout maps blobs to shards.
+type layout struct {
 	shardPrefixes []string
 	shards        []blobserver.Storage
+	ring          *ring // nil for modulo hashing
+}
+
+func newLayout(ld blobserver.Loader, prefixes []string, useRing bool) (*layout, os.Error) {
+	if len(prefixes) == 0 {
+		return nil, os.NewError("shard: need at least one shard")
+	}
+	l := &layout{
+		shardPrefixes: prefixes,
+		shards:        make([]blobserver.Storage, len(prefixes)),
+	}
+	for i, prefix := range prefixes {
+		shardSto, err := ld.GetStorage(prefix)
+		if err != nil {
+			return nil, err
+		}
+		l.shards[i] = shardSto
+	}
+	if useRing {
+		l.ring = newRing(prefixes)
+	}
+	return l, nil
+}
+
+func (l *layout) shardNum(b *blobref.BlobRef) int {
+	if l.ring != nil {
+		return l.ring.shardNum(b.Sum32())
+	}
+	return int(b.Sum32() % uint32(len(l.shards)))
+}
+
+func (l *layout) shard(b *blobref.BlobRef) blobserver.Storage {
+	return l.shards[l.shardNum(b)]
+}
+
+// homePrefix returns the prefix of the shard b belongs on.
+func (l *layout) homePrefix(b *blobref.BlobRef) string {
+	return l.shardPrefixes[l.shardNum(b)]
+}
+
+func (l *layout) batchedShards(blobs []*blobref.BlobRef, fn func(blobserver.Storage, []*blobref.BlobRef) os.Error) os.Error {
+	m := make(map[int][]*blobref.BlobRef)
+	for _, b := range blobs {
+		sn := l.shardNum(b)
+		m[sn] = append(m[sn], b)
+	}
+	ch := make(chan os.Error, len(m))
+	for sn := range m {
+		sblobs := m[sn]
+		s := l.shards[sn]
+		go func() {
+			ch <- fn(s, sblobs)
+		}()
+	}
+	var reterr os.Error
+	for _ = range m {
+		if err := <-ch; err != nil {
+			reterr = err
+		}
+	}
+	return reterr
+}
+
+type shardStorage struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	cur *layout
+
+	// prev, if non-nil, is the layout being migrated from.
+	// Blobs not found at their home in cur are looked for at
+	// their home in prev.
+	prev *layout
+
+	// all are the shards of both layouts, without duplicates.
+	all []blobserver.Storage
+
+	rebalanceMu sync.Mutex // serializes rebalance passes
+
+	moveMu   sync.Mutex
+	moveDone *sync.Cond      // on moveMu; broadcast as moves finish
+	moving   map[string]bool // blobrefs being moved by rebalancing
+	removing map[string]int  // blobrefs being removed
 }
 
 func (sto *shardStorage) GetBlobHub() blobserver.BlobHub {
 	return sto.SimpleBlobHubPartitionMap.GetBlobHub()
 }
 
+// newFromConfig builds a shardStorage from a config like:
+//
+//   {
+//     "backends": ["/s1/", "/s2/", "/s3/"],
+//     "ring": true,
+//     "previous": {"backends": ["/s1/", "/s2/"], "ring": true}
+//   }
+//
+// "ring" selects consistent hashing rather than the default (and
+// original) modulo hashing.  The optional "previous" layout is the
+// one a deployment is being grown from: reads fall back to it, and
+// unless "rebalance" is false, blobs are migrated from it to their
+// home in the new layout in the background.  Once that's done, it
+// should be removed from the config.
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (storage blobserver.Storage, err os.Error) {
 	sto := &shardStorage{
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		moving:                    make(map[string]bool),
+		removing:                  make(map[string]int),
 	}
-	sto.shardPrefixes = config.RequiredList("backends")
+	sto.moveDone = sync.NewCond(&sto.moveMu)
+	prefixes := config.RequiredList("backends")
+	useRing := config.OptionalBool("ring", false)
+	prevConf := config.OptionalObject("previous")
+	rebalance := config.OptionalBool("rebalance", true)
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
-	if len(sto.shardPrefixes) == 0 {
-		return nil, os.NewError("shard: need at least one shard")
+
+	sto.cur, err = newLayout(ld, prefixes, useRing)
+	if err != nil {
+		return nil, err
 	}
-	sto.shards = make([]blobserver.Storage, len(sto.shardPrefixes))
-	for i, prefix := range sto.shardPrefixes {
-		shardSto, err := ld.GetStorage(prefix)
-		if err != nil {
+	if len(prevConf) > 0 {
+		prevPrefixes := prevConf.RequiredList("backends")
+		prevRing := prevConf.OptionalBool("ring", false)
+		if err := prevConf.Validate(); err != nil {
 			return nil, err
 		}
-		sto.shards[i] = shardSto
+		sto.prev, err = newLayout(ld, prevPrefixes, prevRing)
+		if err != nil {
+			return nil, fmt.Errorf("shard: previous layout: %v", err)
+		}
+	}
+	sto.initAll()
+
+	if sto.prev != nil && rebalance {
+		go sto.rebalanceLoop()
 	}
 	return sto, nil
 }
 
-func (sto *shardStorage) shard(b *blobref.BlobRef) blobserver.Storage {
-	return sto.shards[int(sto.shardNum(b))]
+func (sto *shardStorage) initAll() {
+	seen := make(map[string]bool)
+	add := func(l *layout) {
+		for i, prefix := range l.shardPrefixes {
+			if !seen[prefix] {
+				seen[prefix] = true
+				sto.all = append(sto.all, l.shards[i])
+			}
+		}
+	}
+	add(sto.cur)
+	if sto.prev != nil {
+		add(sto.prev)
+	}
 }
 
-func (sto *shardStorage) shardNum(b *blobref.BlobRef) uint32 {
-	return b.Sum32() % uint32(len(sto.shards))
+// prevShard returns the shard b belonged on in the previous layout,
+// or nil if there's no previous layout or it's the same shard.
+func (sto *shardStorage) prevShard(b *blobref.BlobRef) blobserver.Storage {
+	if sto.prev == nil || sto.prev.homePrefix(b) == sto.cur.homePrefix(b) {
+		return nil
+	}
+	return sto.prev.shard(b)
 }
 
 func (sto *shardStorage) FetchStreaming(b *blobref.BlobRef) (file io.ReadCloser, size int64, err os.Error) {
-	return sto.shard(b).FetchStreaming(b)
+	file, size, err = sto.cur.shard(b).FetchStreaming(b)
+	if err == os.ENOENT {
+		if old := sto.prevShard(b); old != nil {
+			return old.FetchStreaming(b)
+		}
+	}
+	return
 }
 
 func (sto *shardStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb blobref.SizedBlobRef, err os.Error) {
-	sb, err = sto.shard(b).ReceiveBlob(b, source)
+	sb, err = sto.cur.shard(b).ReceiveBlob(b, source)
 	if err == nil {
 		hub := sto.GetBlobHub()
 		hub.NotifyBlobReceived(b)
@@ -79,43 +223,186 @@ func (sto *shardStorage) ReceiveBlob(b *blobref.BlobRef, source io.Reader) (sb b
 	return
 }
 
-func (sto *shardStorage) batchedShards(blobs []*blobref.BlobRef, fn func(blobserver.Storage, []*blobref.BlobRef) os.Error) os.Error {
-	m := make(map[uint32][]*blobref.BlobRef)
+func (sto *shardStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	sto.beginRemove(blobs)
+	defer sto.endRemove(blobs)
+	remove := func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+		return s.RemoveBlobs(blobs)
+	}
+	err := sto.cur.batchedShards(blobs, remove)
+	if sto.prev != nil {
+		if perr := sto.prev.batchedShards(blobs, remove); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func (sto *shardStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	stat := func(dest chan<- blobref.SizedBlobRef, waitSeconds int) func(blobserver.Storage, []*blobref.BlobRef) os.Error {
+		return func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
+			return s.StatBlobs(dest, blobs, waitSeconds)
+		}
+	}
+	if sto.prev == nil {
+		return sto.cur.batchedShards(blobs, stat(dest, waitSeconds))
+	}
+
+	// Note which blobs are at their new home, to look for the
+	// others at their old one.
+	found := make(map[string]bool)
+	ch := make(chan blobref.SizedBlobRef, buffered)
+	donechan := make(chan bool)
+	go func() {
+		for sb := range ch {
+			found[sb.BlobRef.String()] = true
+			dest <- sb
+		}
+		donechan <- true
+	}()
+	err := sto.cur.batchedShards(blobs, stat(ch, waitSeconds))
+	close(ch)
+	<-donechan
+	if err != nil {
+		return err
+	}
+
+	var missing []*blobref.BlobRef
 	for _, b := range blobs {
-		sn := sto.shardNum(b)
-		m[sn] = append(m[sn], b)
+		if !found[b.String()] && sto.prevShard(b) != nil {
+			missing = append(missing, b)
+		}
 	}
-	ch := make(chan os.Error, len(m))
-	for sn := range m {
-		sblobs := m[sn]
-		s := sto.shards[sn]
-		go func() {
-			ch <- fn(s, sblobs)
-		}()
+	if len(missing) == 0 {
+		return nil
 	}
-	var reterr os.Error
-	for _ = range m {
-		if err := <-ch; err != nil {
-			reterr = err
+	return sto.prev.batchedShards(missing, stat(dest, 0))
+}
+
+func (sto *shardStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	return blobserver.MergedEnumerate(dest, sto.all, after, limit, waitSeconds)
+}
+
+func (sto *shardStorage) rebalanceLoop() {
+	for {
+		moved, err := sto.rebalance()
+		if err == nil {
+			log.Printf("shard: rebalancing done; moved %d blobs. The \"previous\" layout can now be removed from the config.", moved)
+			return
 		}
+		log.Printf("shard: rebalancing (moved %d blobs so far): %v; retrying in %d seconds", moved, err, rebalanceRetry)
+		time.Sleep(rebalanceRetry * 1e9)
 	}
-	return reterr
 }
 
-func (sto *shardStorage) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
-		return s.RemoveBlobs(blobs)
-	})
+// rebalance moves every blob on a shard of the previous layout which
+// isn't its home in the current layout to its home.  Each blob is
+// copied before it's removed from its old shard, so it's always
+// readable.  It returns the number of blobs moved.
+func (sto *shardStorage) rebalance() (moved int, err os.Error) {
+	if sto.prev == nil {
+		return 0, nil
+	}
+	sto.rebalanceMu.Lock()
+	defer sto.rebalanceMu.Unlock()
+	seen := make(map[string]bool)
+	for i, prefix := range sto.prev.shardPrefixes {
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		n, err := sto.rebalanceShard(prefix, sto.prev.shards[i])
+		moved += n
+		if err != nil {
+			return moved, err
+		}
+	}
+	return moved, nil
 }
 
-func (sto *shardStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
-	return sto.batchedShards(blobs, func(s blobserver.Storage, blobs []*blobref.BlobRef) os.Error {
-		return s.StatBlobs(dest, blobs, waitSeconds)
+func (sto *shardStorage) rebalanceShard(prefix string, src blobserver.Storage) (moved int, err os.Error) {
+	err = blobserver.EnumerateAll(src, "", func(sb blobref.SizedBlobRef) os.Error {
+		b := sb.BlobRef
+		if sto.cur.homePrefix(b) == prefix {
+			return nil
+		}
+		if err := sto.moveBlob(b, src); err != nil {
+			return fmt.Errorf("moving %s from %s to %s: %v", b, prefix, sto.cur.homePrefix(b), err)
+		}
+		moved++
+		return nil
 	})
+	return
 }
 
-func (sto *shardStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
-	return blobserver.MergedEnumerate(dest, sto.shards, after, limit, waitSeconds)
+func (sto *shardStorage) moveBlob(b *blobref.BlobRef, src blobserver.Storage) os.Error {
+	if !sto.startMove(b) {
+		// Retried by the next pass, by which time it's likely gone.
+		return os.NewError("being removed")
+	}
+	defer sto.endMove(b)
+	rc, _, err := src.FetchStreaming(b)
+	if err == os.ENOENT {
+		// Removed meanwhile.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = sto.cur.shard(b).ReceiveBlob(b, rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	return src.RemoveBlobs([]*blobref.BlobRef{b})
+}
+
+// startMove marks b as being moved and reports whether it may be.
+// Blobs being removed may not: copying one to its new home while it's
+// removed from its old one would resurrect it.
+func (sto *shardStorage) startMove(b *blobref.BlobRef) bool {
+	bstr := b.String()
+	sto.moveMu.Lock()
+	defer sto.moveMu.Unlock()
+	if sto.removing[bstr] > 0 {
+		return false
+	}
+	sto.moving[bstr] = true
+	return true
+}
+
+func (sto *shardStorage) endMove(b *blobref.BlobRef) {
+	sto.moveMu.Lock()
+	defer sto.moveMu.Unlock()
+	sto.moving[b.String()] = false, false
+	sto.moveDone.Broadcast()
+}
+
+// beginRemove marks blobs as being removed, so they aren't moved
+// until endRemove, first waiting for any moves of them already under
+// way.
+func (sto *shardStorage) beginRemove(blobs []*blobref.BlobRef) {
+	sto.moveMu.Lock()
+	defer sto.moveMu.Unlock()
+	for _, b := range blobs {
+		sto.removing[b.String()]++
+	}
+	for _, b := range blobs {
+		for sto.moving[b.String()] {
+			sto.moveDone.Wait()
+		}
+	}
+}
+
+func (sto *shardStorage) endRemove(blobs []*blobref.BlobRef) {
+	sto.moveMu.Lock()
+	defer sto.moveMu.Unlock()
+	for _, b := range blobs {
+		bstr := b.String()
+		if sto.removing[bstr]--; sto.removing[bstr] == 0 {
+			sto.removing[bstr] = 0, false
+		}
+	}
 }
 
 func init() {
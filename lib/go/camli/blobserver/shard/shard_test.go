@@ -0,0 +1,217 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shard
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/blobserver/storagetest"
+	"camli/jsonconfig"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func TestRingBalance(t *testing.T) {
+	names := []string{"/s1/", "/s2/", "/s3/"}
+	r3 := newRing(names)
+	r4 := newRing(append(names, "/s4/"))
+
+	const n = 30000
+	counts := make([]int, 3)
+	moved := 0
+	for i := 0; i < n; i++ {
+		h := uint32(i) * 143053 // spread over the uint32 range
+		s3 := r3.shardNum(h)
+		counts[s3]++
+		if s4 := r4.shardNum(h); s4 != s3 {
+			moved++
+			if s4 != 3 {
+				t.Fatalf("hash %d moved from shard %d to old shard %d", h, s3, s4)
+			}
+		}
+	}
+	for i, c := range counts {
+		if c < n/5 || c > n/2 {
+			t.Errorf("shard %d got %d of %d hashes", i, c, n)
+		}
+	}
+	if moved < n/8 || moved > n*2/5 {
+		t.Errorf("adding a fourth shard moved %d of %d hashes", moved, n)
+	}
+}
+
+type testLoader map[string]blobserver.Storage
+
+func (ld testLoader) GetStorage(prefix string) (blobserver.Storage, os.Error) {
+	if sto, ok := ld[prefix]; ok {
+		return sto, nil
+	}
+	return nil, fmt.Errorf("no storage %q", prefix)
+}
+
+func (ld testLoader) GetHandlerType(prefix string) string {
+	return ""
+}
+
+func (ld testLoader) GetHandler(prefix string) (interface{}, os.Error) {
+	return ld.GetStorage(prefix)
+}
+
+func (ld testLoader) FindHandlerByTypeIfLoaded(htype string) (string, interface{}, os.Error) {
+	return "", nil, os.ENOENT
+}
+
+func newShardStorage(t *testing.T, ld blobserver.Loader, conf map[string]interface{}) *shardStorage {
+	sto, err := newFromConfig(ld, jsonconfig.Obj(conf))
+	if err != nil {
+		t.Fatalf("newFromConfig: %v", err)
+	}
+	return sto.(*shardStorage)
+}
+
+func hasBlob(s blobserver.Storage, b *blobref.BlobRef) bool {
+	rc, _, err := s.FetchStreaming(b)
+	if err != nil {
+		return false
+	}
+	rc.Close()
+	return true
+}
+
+func TestReshard(t *testing.T) {
+	ld := make(testLoader)
+	for i := 1; i <= 3; i++ {
+		dir := fmt.Sprintf("%s/camli-shard-test-%d-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds(), i)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		ds, err := localdisk.New(dir)
+		if err != nil {
+			t.Fatalf("localdisk.New: %v", err)
+		}
+		ld[fmt.Sprintf("/s%d/", i)] = ds
+	}
+
+	// Blobs written with the original two-shard modulo layout.
+	old := newShardStorage(t, ld, map[string]interface{}{
+		"backends": []interface{}{"/s1/", "/s2/"},
+	})
+	var blobs []*test.Blob
+	for i := 0; i < 50; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob %d", i)}
+		_, err := old.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		blobs = append(blobs, tb)
+	}
+
+	// Grown to three shards on a ring.
+	sto := newShardStorage(t, ld, map[string]interface{}{
+		"backends": []interface{}{"/s1/", "/s2/", "/s3/"},
+		"ring":     true,
+		"previous": map[string]interface{}{
+			"backends": []interface{}{"/s1/", "/s2/"},
+		},
+		"rebalance": false,
+	})
+
+	var refs []*blobref.BlobRef
+	for _, tb := range blobs {
+		Expect(t, hasBlob(sto, tb.BlobRef()), "fetch falls back to old layout")
+		refs = append(refs, tb.BlobRef())
+	}
+	ch := make(chan blobref.SizedBlobRef, len(refs))
+	AssertNil(t, sto.StatBlobs(ch, refs, 0), "StatBlobs")
+	close(ch)
+	n := 0
+	for _ = range ch {
+		n++
+	}
+	ExpectInt(t, len(refs), n, "stat falls back to old layout")
+
+	moved, err := sto.rebalance()
+	AssertNil(t, err, "rebalance")
+	Expect(t, moved > 0, "rebalance moved blobs")
+	for _, b := range refs {
+		home := sto.cur.homePrefix(b)
+		for prefix, s := range ld {
+			if got, want := hasBlob(s, b), prefix == home; got != want {
+				t.Errorf("after rebalance, %s on %s = %v; want %v", b, prefix, got, want)
+			}
+		}
+		Expect(t, hasBlob(sto, b), "fetch after rebalance")
+	}
+
+	moved, err = sto.rebalance()
+	AssertNil(t, err, "second rebalance")
+	ExpectInt(t, 0, moved, "blobs moved by second rebalance")
+
+	// A blob being removed isn't moved, which could resurrect it.
+	var tb *test.Blob
+	for i := 0; tb == nil || sto.prevShard(tb.BlobRef()) == nil; i++ {
+		tb = &test.Blob{fmt.Sprintf("being removed %d", i)}
+	}
+	b := tb.BlobRef()
+	src := sto.prev.shard(b)
+	_, err = src.ReceiveBlob(b, tb.Reader())
+	AssertNil(t, err, "ReceiveBlob")
+	sto.beginRemove(tb.BlobRefSlice())
+	Expect(t, sto.moveBlob(b, src) != nil, "move of a blob being removed fails")
+	Expect(t, !hasBlob(sto.cur.shard(b), b), "blob being removed not copied")
+	AssertNil(t, src.RemoveBlobs(tb.BlobRefSlice()), "RemoveBlobs")
+	sto.endRemove(tb.BlobRefSlice())
+	moved, err = sto.rebalance()
+	AssertNil(t, err, "rebalance after removal")
+	ExpectInt(t, 0, moved, "blobs moved after removal")
+	Expect(t, !hasBlob(sto, b), "removed blob not resurrected")
+}
+
+func TestConformance(t *testing.T) {
+	for _, ring := range []bool{false, true} {
+		storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+			ld := make(testLoader)
+			var dirs []string
+			for i := 1; i <= 3; i++ {
+				dir := fmt.Sprintf("%s/camli-shard-test-%d-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds(), i)
+				if err := os.Mkdir(dir, 0755); err != nil {
+					t.Fatalf("Mkdir: %v", err)
+				}
+				dirs = append(dirs, dir)
+				ds, err := localdisk.New(dir)
+				if err != nil {
+					t.Fatalf("localdisk.New: %v", err)
+				}
+				ld[fmt.Sprintf("/s%d/", i)] = ds
+			}
+			sto := newShardStorage(t, ld, map[string]interface{}{
+				"backends": []interface{}{"/s1/", "/s2/", "/s3/"},
+				"ring":     ring,
+			})
+			return sto, func() {
+				for _, dir := range dirs {
+					os.RemoveAll(dir)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,369 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package storagetest checks that a blobserver.Storage
+// implementation follows the semantics documented in
+// camli/blobserver: verified receives, StatBlobs with and without
+// waitSeconds, sorted EnumerateBlobs with limit and after, channel
+// closing, RemoveBlobs and BlobHub notifications.
+//
+// A storage implementation's tests call Test with a constructor of
+// empty storage:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.Test(t, func(t *testing.T) (blobserver.Storage, func()) {
+//			...
+//		})
+//	}
+package storagetest
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/test"
+)
+
+// Opts configures a run of the conformance tests.
+type Opts struct {
+	// New returns new, empty storage and a func to remove it.
+	New func(t *testing.T) (sto blobserver.Storage, cleanup func())
+
+	// SkipStatWait skips checking that StatBlobs with a non-zero
+	// waitSeconds reports blobs arriving while it waits, for
+	// storage which doesn't support long polling.
+	SkipStatWait bool
+
+	// SkipRemove skips the RemoveBlobs checks, for storage which
+	// can't remove blobs.
+	SkipRemove bool
+}
+
+// Test runs the conformance tests against the storage returned by
+// fn.
+func Test(t *testing.T, fn func(t *testing.T) (sto blobserver.Storage, cleanup func())) {
+	TestOpt(t, Opts{New: fn})
+}
+
+// TestOpt is like Test, but with options.
+func TestOpt(t *testing.T, opt Opts) {
+	sto, cleanup := opt.New(t)
+	defer cleanup()
+	r := &run{t: t, sto: sto}
+
+	r.testEmpty()
+	r.testReceive()
+	r.testFetch()
+	r.testStat()
+	if !opt.SkipStatWait {
+		r.testStatWait()
+	}
+	r.testEnumerate()
+	if !opt.SkipRemove {
+		r.testRemove()
+	}
+}
+
+// notifyTimeout is how long to wait for things which happen
+// asynchronously, such as BlobHub notifications.
+const notifyTimeout = 5e9
+
+type run struct {
+	t     *testing.T
+	sto   blobserver.Storage
+	blobs []*test.Blob // received, sorted by blobref
+}
+
+// missing is never received.
+var missing = &test.Blob{"never uploaded"}
+
+// stat returns the results of StatBlobs, checking that it doesn't
+// close dest.
+func (r *run) stat(blobs []*blobref.BlobRef, waitSeconds int) map[string]int64 {
+	ch := make(chan blobref.SizedBlobRef, len(blobs))
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- r.sto.StatBlobs(ch, blobs, waitSeconds)
+		close(ch) // panics if StatBlobs closed it
+	}()
+	got := make(map[string]int64)
+	for sb := range ch {
+		if _, dup := got[sb.BlobRef.String()]; dup {
+			r.t.Errorf("StatBlobs reported %s twice", sb.BlobRef)
+		}
+		got[sb.BlobRef.String()] = sb.Size
+	}
+	if err := <-errch; err != nil {
+		r.t.Errorf("StatBlobs: %v", err)
+	}
+	return got
+}
+
+// enumerate returns the results of EnumerateBlobs, checking that
+// it closes dest.
+func (r *run) enumerate(after string, limit uint) []blobref.SizedBlobRef {
+	ch := make(chan blobref.SizedBlobRef)
+	errch := make(chan os.Error, 1)
+	go func() {
+		errch <- r.sto.EnumerateBlobs(ch, after, limit, 0)
+	}()
+	var got []blobref.SizedBlobRef
+	timeout := time.After(notifyTimeout)
+	for {
+		select {
+		case sb, ok := <-ch:
+			if !ok {
+				if err := <-errch; err != nil {
+					r.t.Errorf("EnumerateBlobs(after %q, limit %d): %v", after, limit, err)
+				}
+				return got
+			}
+			got = append(got, sb)
+		case <-timeout:
+			r.t.Fatalf("EnumerateBlobs(after %q, limit %d) didn't close its channel", after, limit)
+		}
+	}
+	panic("unreachable")
+}
+
+func (r *run) testEmpty() {
+	if got := r.enumerate("", 100); len(got) != 0 {
+		r.t.Errorf("new storage enumerated %v; want nothing", got)
+	}
+	if got := r.stat(missing.BlobRefSlice(), 0); len(got) != 0 {
+		r.t.Errorf("new storage stat %v; want nothing", got)
+	}
+	if _, _, err := r.sto.FetchStreaming(missing.BlobRef()); err != os.ENOENT {
+		r.t.Errorf("FetchStreaming of missing blob = %v; want os.ENOENT", err)
+	}
+}
+
+type byBlobRef []*test.Blob
+
+func (s byBlobRef) Len() int           { return len(s) }
+func (s byBlobRef) Less(i, j int) bool { return s[i].BlobRef().String() < s[j].BlobRef().String() }
+func (s byBlobRef) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (r *run) testReceive() {
+	hubch := make(chan *blobref.BlobRef, 10)
+	hub := r.sto.GetBlobHub()
+	hub.RegisterListener(hubch)
+	defer hub.UnregisterListener(hubch)
+
+	for _, s := range []string{"foo", "bar", "baz", "", strings.Repeat("big blob ", 100<<10)} {
+		tb := &test.Blob{s}
+		sb, err := r.sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		if err != nil {
+			r.t.Fatalf("ReceiveBlob of %d bytes: %v", len(s), err)
+		}
+		tb.AssertMatches(r.t, &sb)
+		r.blobs = append(r.blobs, tb)
+	}
+	sort.Sort(byBlobRef(r.blobs))
+
+	// Receiving a blob again is fine.
+	dup := r.blobs[0]
+	sb, err := r.sto.ReceiveBlob(dup.BlobRef(), dup.Reader())
+	if err != nil {
+		r.t.Errorf("ReceiveBlob of existing blob: %v", err)
+	} else {
+		dup.AssertMatches(r.t, &sb)
+	}
+
+	// Contents not matching their blobref aren't.
+	if _, err := r.sto.ReceiveBlob(missing.BlobRef(), strings.NewReader("not "+missing.Contents)); err == nil {
+		r.t.Errorf("ReceiveBlob of corrupt blob succeeded")
+	}
+	if got := r.stat(missing.BlobRefSlice(), 0); len(got) != 0 {
+		r.t.Errorf("corrupt blob was stored: stat %v", got)
+	}
+
+	want := make(map[string]bool)
+	for _, tb := range r.blobs {
+		want[tb.BlobRef().String()] = true
+	}
+	timeout := time.After(notifyTimeout)
+	for len(want) > 0 {
+		select {
+		case br := <-hubch:
+			want[br.String()] = false, false
+		case <-timeout:
+			r.t.Errorf("no BlobHub notification of received blobs %v", want)
+			return
+		}
+	}
+}
+
+func (r *run) testFetch() {
+	for _, tb := range r.blobs {
+		rc, size, err := r.sto.FetchStreaming(tb.BlobRef())
+		if err != nil {
+			r.t.Errorf("FetchStreaming(%s): %v", tb.BlobRef(), err)
+			continue
+		}
+		contents, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			r.t.Errorf("reading %s: %v", tb.BlobRef(), err)
+			continue
+		}
+		if size != tb.Size() {
+			r.t.Errorf("FetchStreaming(%s) size = %d; want %d", tb.BlobRef(), size, tb.Size())
+		}
+		if string(contents) != tb.Contents {
+			r.t.Errorf("FetchStreaming(%s) read %d bytes not matching the blob", tb.BlobRef(), len(contents))
+		}
+	}
+}
+
+func (r *run) testStat() {
+	var refs []*blobref.BlobRef
+	for _, tb := range r.blobs {
+		refs = append(refs, tb.BlobRef())
+	}
+	r.expectStat("present and missing blobs", r.stat(append(refs, missing.BlobRef()), 0))
+
+	// Blobs which all exist are reported without waiting.
+	start := time.Nanoseconds()
+	r.expectStat("waitSeconds 10", r.stat(refs, 10))
+	if d := time.Nanoseconds() - start; d > notifyTimeout {
+		r.t.Errorf("StatBlobs of present blobs with waitSeconds 10 took %d ms", d/1e6)
+	}
+
+	if got := r.stat(nil, 0); len(got) != 0 {
+		r.t.Errorf("StatBlobs of no blobs returned %v", got)
+	}
+}
+
+func (r *run) expectStat(what string, got map[string]int64) {
+	if len(got) != len(r.blobs) {
+		r.t.Errorf("%s: StatBlobs returned %d blobs; want %d", what, len(got), len(r.blobs))
+	}
+	for _, tb := range r.blobs {
+		if size, ok := got[tb.BlobRef().String()]; !ok || size != tb.Size() {
+			r.t.Errorf("%s: StatBlobs of %s = %d, %v; want %d", what, tb.BlobRef(), size, ok, tb.Size())
+		}
+	}
+}
+
+func (r *run) testStatWait() {
+	// Nothing arrives.
+	start := time.Nanoseconds()
+	if got := r.stat(missing.BlobRefSlice(), 1); len(got) != 0 {
+		r.t.Errorf("StatBlobs of missing blob returned %v", got)
+	}
+	if d := time.Nanoseconds() - start; d > notifyTimeout {
+		r.t.Errorf("StatBlobs with waitSeconds 1 took %d ms", d/1e6)
+	}
+
+	// A blob arrives while waiting.
+	tb := &test.Blob{"arrives while waiting"}
+	type statResult struct {
+		got map[string]int64
+		d   int64
+	}
+	resch := make(chan statResult, 1)
+	go func() {
+		start := time.Nanoseconds()
+		got := r.stat(tb.BlobRefSlice(), 10)
+		resch <- statResult{got, time.Nanoseconds() - start}
+	}()
+	time.Sleep(200e6)
+	if _, err := r.sto.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+		r.t.Fatalf("ReceiveBlob: %v", err)
+	}
+	res := <-resch
+	if size, ok := res.got[tb.BlobRef().String()]; !ok || size != tb.Size() {
+		r.t.Errorf("StatBlobs waiting for %s returned %v", tb.BlobRef(), res.got)
+	}
+	if res.d > notifyTimeout {
+		r.t.Errorf("StatBlobs returned %d ms after the blob arrived", res.d/1e6)
+	}
+	r.blobs = append(r.blobs, tb)
+	sort.Sort(byBlobRef(r.blobs))
+}
+
+func (r *run) expectEnumerated(what string, got []blobref.SizedBlobRef, want []*test.Blob) {
+	if len(got) != len(want) {
+		r.t.Errorf("%s: enumerated %d blobs %v; want %d", what, len(got), got, len(want))
+		return
+	}
+	for i, sb := range got {
+		if sb.BlobRef.String() != want[i].BlobRef().String() || sb.Size != want[i].Size() {
+			r.t.Errorf("%s: blob %d is %v; want %s of size %d", what, i, sb, want[i].BlobRef(), want[i].Size())
+		}
+	}
+}
+
+func (r *run) testEnumerate() {
+	all := r.blobs
+	r.expectEnumerated("all", r.enumerate("", 1000), all)
+	r.expectEnumerated("limit 2", r.enumerate("", 2), all[:2])
+	r.expectEnumerated("limit 1", r.enumerate("", 1), all[:1])
+	for i, tb := range all {
+		after := tb.BlobRef().String()
+		r.expectEnumerated("after "+after, r.enumerate(after, 1000), all[i+1:])
+	}
+	r.expectEnumerated("after 1 with limit 2", r.enumerate(all[0].BlobRef().String(), 2), all[1:3])
+
+	// after needn't be a blob.
+	r.expectEnumerated("after a", r.enumerate("a", 1000), all)
+	r.expectEnumerated("after z", r.enumerate("z", 1000), nil)
+
+	// Pages of limit and after add up to everything.
+	var paged []blobref.SizedBlobRef
+	after := ""
+	for {
+		page := r.enumerate(after, 2)
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = page[len(page)-1].BlobRef.String()
+	}
+	r.expectEnumerated("paged", paged, all)
+}
+
+func (r *run) testRemove() {
+	gone, kept := r.blobs[:2], r.blobs[2:]
+	refs := []*blobref.BlobRef{missing.BlobRef()} // removing it isn't an error
+	for _, tb := range gone {
+		refs = append(refs, tb.BlobRef())
+	}
+	if err := r.sto.RemoveBlobs(refs); err != nil {
+		r.t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if err := r.sto.RemoveBlobs(nil); err != nil {
+		r.t.Errorf("RemoveBlobs of no blobs: %v", err)
+	}
+
+	if got := r.stat(refs, 0); len(got) != 0 {
+		r.t.Errorf("StatBlobs of removed blobs returned %v", got)
+	}
+	for _, tb := range gone {
+		if _, _, err := r.sto.FetchStreaming(tb.BlobRef()); err != os.ENOENT {
+			r.t.Errorf("FetchStreaming of removed %s = %v; want os.ENOENT", tb.BlobRef(), err)
+		}
+	}
+	r.expectEnumerated("after remove", r.enumerate("", 1000), kept)
+	r.blobs = kept
+}
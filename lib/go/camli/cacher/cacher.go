@@ -41,8 +41,16 @@ func (cf *CachingFetcher) FetchStreaming(br *blobref.BlobRef) (file io.ReadClose
 	if err == nil {
 		return
 	}
-	cf.faultIn(br)
-	return cf.c.Fetch(br)
+	switch err = cf.faultIn(br); err {
+	case nil:
+		return cf.c.Fetch(br)
+	case os.ENOENT:
+		return nil, 0, err
+	}
+	// The cache couldn't take it (for instance, a bounded cache
+	// refusing a blob larger than itself), but it can still be
+	// streamed from the source.
+	return cf.sf.FetchStreaming(br)
 }
 
 func (cf *CachingFetcher) Fetch(br *blobref.BlobRef) (file blobref.ReadSeekCloser, size int64, err os.Error) {
@@ -50,7 +58,9 @@ func (cf *CachingFetcher) Fetch(br *blobref.BlobRef) (file blobref.ReadSeekClose
 	if err == nil {
 		return
 	}
-	cf.faultIn(br)
+	if err = cf.faultIn(br); err != nil {
+		return nil, 0, err
+	}
 	return cf.c.Fetch(br)
 }
 
@@ -59,6 +69,7 @@ func (cf *CachingFetcher) faultIn(br *blobref.BlobRef) os.Error {
 	if err != nil {
 		return err
 	}
+	defer sblob.Close()
 
 	_, err = cf.c.ReceiveBlob(br, sblob)
 	return err
@@ -0,0 +1,72 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cacher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobserver/diskcache"
+	"camli/blobserver/memory"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func TestCachingFetcher(t *testing.T) {
+	dir := fmt.Sprintf("%s/camli-cacher-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	AssertNil(t, os.Mkdir(dir, 0755), "Mkdir")
+	defer os.RemoveAll(dir)
+	cache, err := diskcache.New(dir, 100, diskcache.LRU)
+	AssertNil(t, err, "diskcache.New")
+	defer cache.Close()
+
+	source := memory.New()
+	small := &test.Blob{"small"}
+	big := &test.Blob{strings.Repeat("x", 200)}
+	for _, tb := range []*test.Blob{small, big} {
+		_, err := source.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+	}
+	cf := NewCachingFetcher(cache, source).(*CachingFetcher)
+
+	for i := 0; i < 2; i++ {
+		rsc, _, err := cf.Fetch(small.BlobRef())
+		AssertNil(t, err, "Fetch")
+		all, _ := ioutil.ReadAll(rsc)
+		rsc.Close()
+		ExpectString(t, small.Contents, string(all), "fetched contents")
+	}
+	ExpectInt(t, 1, int(cache.Stats().Hits), "cache hits")
+	ExpectInt(t, 1, int(cache.Stats().Misses), "cache misses")
+
+	// Too large for the cache, but it can still be streamed.
+	_, _, err = cf.Fetch(big.BlobRef())
+	Expect(t, err == diskcache.ErrTooLarge, "seekable fetch of too large blob fails")
+	rc, size, err := cf.FetchStreaming(big.BlobRef())
+	AssertNil(t, err, "FetchStreaming")
+	all, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	ExpectInt(t, 200, int(size), "streamed size")
+	ExpectString(t, big.Contents, string(all), "streamed contents")
+
+	_, _, err = cf.FetchStreaming((&test.Blob{"missing"}).BlobRef())
+	Expect(t, err == os.ENOENT, "missing blob is ENOENT")
+}
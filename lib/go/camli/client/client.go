@@ -22,6 +22,8 @@ import (
 	"log"
 	"os"
 	"sync"
+
+	"camli/blobref"
 )
 
 type Client struct {
@@ -30,6 +32,8 @@ type Client struct {
 
 	httpClient *http.Client
 
+	hashName string // for new blobs; empty means blobref.DefaultHashName
+
 	statsMutex sync.Mutex
 	stats      Stats
 
@@ -71,6 +75,25 @@ func (c *Client) SetHttpClient(client *http.Client) {
 	c.httpClient = client
 }
 
+// SetHashName sets the name of the hash, such as "sha256", used for
+// the blobrefs of new blobs created by users of the client, like
+// camput and the schema file writers.
+func (c *Client) SetHashName(name string) os.Error {
+	if !blobref.HashSupported(name) {
+		return fmt.Errorf("client: unsupported hash %q", name)
+	}
+	c.hashName = name
+	return nil
+}
+
+// HashName returns the name of the hash to use for new blobs.
+func (c *Client) HashName() string {
+	if c.hashName == "" {
+		return blobref.DefaultHashName
+	}
+	return c.hashName
+}
+
 func NewOrFail() *Client {
 	log := log.New(os.Stderr, "", log.Ldate|log.Ltime)
 	return &Client{
@@ -17,6 +17,7 @@ limitations under the License.
 package client
 
 import (
+	"io/ioutil"
 	"reflect"
 	"strings"
 	"testing"
@@ -62,3 +63,59 @@ func TestParseStatResponse(t *testing.T) {
 		t.Errorf("Got unexpected map: %#v", hm)
 	}
 }
+
+var partialResponse = `{
+   "stat": [],
+   "alreadyHavePartially": [
+      {"blobRef": "sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15",
+       "size": 3,
+       "partBlobRef": "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+       "resumeKey": "resume-sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15-3"},
+      {"blobRef": "sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15",
+       "size": 2,
+       "partBlobRef": "sha1-0000000000000000000000000000000000000000",
+       "resumeKey": "resume-sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15-2"},
+      {"blobRef": "bogus"}
+   ],
+   "maxUploadSize": 1048576,
+   "uploadUrl": "http://upload-server.example.com/some/server-chosen/url",
+   "uploadUrlExpirationSeconds": 7200
+}
+`
+
+func TestResumePartialUpload(t *testing.T) {
+	res, err := parseStatResponse(strings.NewReader(partialResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewUploadHandleFromString("foo\n")
+	partials := res.partials[h.BlobRef.String()]
+	if len(partials) != 2 {
+		t.Fatalf("got partials %#v; want 2 for %s", res.partials, h.BlobRef)
+	}
+
+	// Only the first partial's digest matches "foo".
+	formName, skip, rest, err := resumePoint(h, partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formName != "resume-sha1-f1d2d2f924e986ac86fdf7b36c94bcdf32beec15-3" || skip != 3 {
+		t.Errorf("resumePoint = %q, %d; want the 3 byte partial", formName, skip)
+	}
+	if b, _ := ioutil.ReadAll(rest); string(b) != "\n" {
+		t.Errorf("rest = %q; want %q", b, "\n")
+	}
+
+	// Nothing matches other contents, which are sent whole.
+	h = &UploadHandle{BlobRef: h.BlobRef, Size: 4, Contents: strings.NewReader("bar\n")}
+	formName, skip, rest, err = resumePoint(h, partials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formName != h.BlobRef.String() || skip != 0 {
+		t.Errorf("resumePoint = %q, %d; want a whole upload", formName, skip)
+	}
+	if b, _ := ioutil.ReadAll(rest); string(b) != "bar\n" {
+		t.Errorf("rest = %q; want %q", b, "bar\n")
+	}
+}
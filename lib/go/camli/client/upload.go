@@ -60,6 +60,17 @@ type statResponse struct {
 	uploadUrl                  string
 	uploadUrlExpirationSeconds int
 	canLongPoll                bool
+
+	// partials are the server's partial uploads, keyed by
+	// blobref string, per doc/protocol/blob-upload-resume.txt.
+	// nil if none.
+	partials map[string][]partialUpload
+}
+
+type partialUpload struct {
+	size        int64
+	partBlobRef *blobref.BlobRef
+	resumeKey   string
 }
 
 type ResponseFormatError os.Error
@@ -143,9 +154,74 @@ func parseStatResponse(r io.Reader) (sr *statResponse, outerr os.Error) {
 		s.HaveMap[br.String()] = blobref.SizedBlobRef{br, int64(size)}
 	}
 
+	// The "alreadyHavePartially" key is an optional extension,
+	// so skip malformed entries rather than failing.
+	partials, _ := jmap["alreadyHavePartially"].([]interface{})
+	for _, li := range partials {
+		m, ok := li.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		br := blobref.Parse(fmt.Sprint(m["blobRef"]))
+		partBr := blobref.Parse(fmt.Sprint(m["partBlobRef"]))
+		size, _ := m["size"].(float64)
+		resumeKey, _ := m["resumeKey"].(string)
+		if br == nil || partBr == nil || size <= 0 || resumeKey == "" {
+			continue
+		}
+		if s.partials == nil {
+			s.partials = make(map[string][]partialUpload)
+		}
+		s.partials[br.String()] = append(s.partials[br.String()], partialUpload{int64(size), partBr, resumeKey})
+	}
+
 	return s, nil
 }
 
+// resumePoint picks which of the server's partial uploads of h, if
+// any, to resume: one whose partBlobRef matches the beginning of
+// h's contents.  It returns the form name to upload as, the number
+// of bytes the server already has, and the contents left to send.
+func resumePoint(h *UploadHandle, partials []partialUpload) (formName string, skip int64, rest io.Reader, err os.Error) {
+	formName = h.BlobRef.String()
+	rest = h.Contents
+	if len(partials) == 0 {
+		return
+	}
+	longest := int64(0)
+	for _, p := range partials {
+		if p.size > longest && (h.Size < 0 || p.size < h.Size) {
+			longest = p.size
+		}
+	}
+	if longest == 0 {
+		return
+	}
+	var buf bytes.Buffer
+	if _, err = io.Copyn(&buf, h.Contents, longest); err != nil && err != os.EOF {
+		return
+	}
+	err = nil
+	rest = io.MultiReader(bytes.NewBuffer(buf.Bytes()), h.Contents)
+	for _, p := range partials {
+		if p.size > int64(buf.Len()) || p.size <= skip {
+			continue
+		}
+		hash := p.partBlobRef.Hash()
+		if hash == nil {
+			continue
+		}
+		hash.Write(buf.Bytes()[:p.size])
+		if p.partBlobRef.HashMatches(hash) {
+			formName, skip = p.resumeKey, p.size
+		}
+	}
+	if skip > 0 {
+		rest = io.MultiReader(bytes.NewBuffer(buf.Bytes()[skip:]), h.Contents)
+	}
+	return
+}
+
 func NewUploadHandleFromString(data string) *UploadHandle {
 	bref := blobref.Sha1FromString(data)
 	r := strings.NewReader(data)
@@ -288,6 +364,14 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 		return pr, nil
 	}
 
+	formName, skip, contents, err := resumePoint(h, stat.partials[blobRefString])
+	if err != nil {
+		return errorf("reading contents to resume upload: %v", err)
+	}
+	if skip > 0 {
+		c.log.Printf("Resuming upload of %s after %d bytes", blobRefString, skip)
+	}
+
 	pipeReader, pipeWriter := io.Pipe()
 	multipartWriter := multipart.NewWriter(pipeWriter)
 
@@ -295,12 +379,12 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 	copySize := make(chan int64, 1)
 	go func() {
 		defer pipeWriter.Close()
-		part, err := multipartWriter.CreateFormFile(h.BlobRef.String(), h.BlobRef.String())
+		part, err := multipartWriter.CreateFormFile(formName, blobRefString)
 		if err != nil {
 			copyResult <- err
 			return
 		}
-		n, err := io.Copy(part, h.Contents)
+		n, err := io.Copy(part, contents)
 		if err == nil {
 			err = multipartWriter.Close()
 		}
@@ -314,7 +398,7 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 	req.Body = ioutil.NopCloser(pipeReader)
 
 	if h.Size >= 0 {
-		req.ContentLength = multipartOverhead + h.Size + int64(len(h.BlobRef.String()))*2
+		req.ContentLength = multipartOverhead + h.Size - skip + int64(len(formName)+len(blobRefString))
 	}
 	req.TransferEncoding = nil
 	resp, err = c.httpClient.Do(req)
@@ -367,7 +451,7 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, os.Error) {
 
 	expectedSize := h.Size
 	if h.Size == -1 {
-		expectedSize = <-copySize
+		expectedSize = skip + <-copySize
 	}
 
 	for _, rit := range received {
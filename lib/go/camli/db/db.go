@@ -140,10 +140,13 @@ func (db *DB) connIfFree(wanted dbimpl.Conn) (conn dbimpl.Conn, ok bool) {
 }
 
 func (db *DB) putConn(c dbimpl.Conn) {
+	db.mu.Lock()
 	if n := len(db.freeConn); n < db.maxIdleConns() {
 		db.freeConn = append(db.freeConn, c)
+		db.mu.Unlock()
 		return
 	}
+	db.mu.Unlock()
 	db.closeConn(c)
 }
 
@@ -220,8 +223,15 @@ func (db *DB) Query(query string, args ...interface{}) (*Rows, os.Error) {
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
-	return stmt.Query(args...)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		stmt.Close()
+		return nil, err
+	}
+	// The statement is only for this query; close it along
+	// with the rows.
+	rows.closeStmt = stmt
+	return rows, nil
 }
 
 func (db *DB) QueryRow(query string, args ...interface{}) *Row {
@@ -305,12 +315,27 @@ func (s *Stmt) Exec(args ...interface{}) (Result, os.Error) {
 		return nil, fmt.Errorf("db: expected %d arguments, got %d", want, len(args))
 	}
 
+	if err := convertArgs("Exec", si, args); err != nil {
+		return nil, err
+	}
+
+	resi, err := si.Exec(args)
+	if err != nil {
+		return nil, err
+	}
+	return result{resi}, nil
+}
+
+// convertArgs converts args in place to the restricted subset of
+// types that dbimpl drivers need to handle.
+func convertArgs(op string, si dbimpl.Stmt, args []interface{}) os.Error {
 	// Convert args if the driver knows its own types.
 	if cc, ok := si.(dbimpl.ColumnConverter); ok {
 		for n, arg := range args {
+			var err os.Error
 			args[n], err = cc.ColumnCoverter(n).ConvertValue(arg)
 			if err != nil {
-				return nil, fmt.Errorf("db: converting Exec column index %d: %v", n, err)
+				return fmt.Errorf("db: converting %s column index %d: %v", op, n, err)
 			}
 		}
 	}
@@ -322,20 +347,16 @@ func (s *Stmt) Exec(args ...interface{}) (Result, os.Error) {
 		var err os.Error
 		args[n], err = dbimpl.SubsetValue(arg)
 		if err != nil {
-			return nil, fmt.Errorf("db: error converting index %d: %v", n, err)
+			return fmt.Errorf("db: error converting index %d: %v", n, err)
 		}
 	}
-
-	resi, err := si.Exec(args)
-	if err != nil {
-		return nil, err
-	}
-	return result{resi}, nil
+	return nil
 }
 
 func (s *Stmt) connStmt(args ...interface{}) (dbimpl.Conn, dbimpl.Stmt, os.Error) {
 	s.mu.Lock()
 	if s.closed {
+		s.mu.Unlock()
 		return nil, nil, os.NewError("db: statement is closed")
 	}
 	var cs connStmt
@@ -343,7 +364,7 @@ func (s *Stmt) connStmt(args ...interface{}) (dbimpl.Conn, dbimpl.Stmt, os.Error
 	for _, v := range s.css {
 		// TODO(bradfitz): lazily clean up entries in this
 		// list with dead conns while enumerating
-		if _, match = s.db.connIfFree(cs.ci); match {
+		if _, match = s.db.connIfFree(v.ci); match {
 			cs = v
 			break
 		}
@@ -378,8 +399,13 @@ func (s *Stmt) Query(args ...interface{}) (*Rows, os.Error) {
 		return nil, err
 	}
 	if len(args) != si.NumInput() {
+		s.db.putConn(ci)
 		return nil, fmt.Errorf("db: statement expects %d inputs; got %d", si.NumInput(), len(args))
 	}
+	if err := convertArgs("Query", si, args); err != nil {
+		s.db.putConn(ci)
+		return nil, err
+	}
 	rowsi, err := si.Query(args)
 	if err != nil {
 		s.db.putConn(ci)
@@ -443,9 +469,10 @@ type Rows struct {
 	ci    dbimpl.Conn // owned; must be returned when Rows is closed
 	rowsi dbimpl.Rows
 
-	closed   bool
-	lastcols []interface{}
-	lasterr  os.Error
+	closed    bool
+	lastcols  []interface{}
+	lasterr   os.Error
+	closeStmt *Stmt // if non-nil, statement to Close on close
 }
 
 // Next advances the Rows' cursor (which starts before the first
@@ -462,6 +489,9 @@ func (rs *Rows) Next() bool {
 		rs.lastcols = make([]interface{}, len(rs.rowsi.Columns()))
 	}
 	rs.lasterr = rs.rowsi.Next(rs.lastcols)
+	if rs.lasterr == os.EOF {
+		rs.Close()
+	}
 	return rs.lasterr == nil
 }
 
@@ -506,6 +536,9 @@ func (rs *Rows) Close() os.Error {
 	rs.closed = true
 	err := rs.rowsi.Close()
 	rs.db.putConn(rs.ci)
+	if rs.closeStmt != nil {
+		rs.closeStmt.Close()
+	}
 	return err
 }
 
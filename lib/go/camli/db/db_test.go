@@ -152,3 +152,32 @@ func TestDb(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryReusesConnection(t *testing.T) {
+	db := newTestDB(t, "people")
+	driver := db.driver.(*fakeDriver)
+	driver.mu.Lock()
+	opens0 := driver.openCount
+	driver.mu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		rows, err := db.Query("SELECT|people|name|age=?", 2)
+		if err != nil {
+			t.Fatalf("Query: %v", err)
+		}
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		if n != 1 {
+			t.Errorf("iteration %d: got %d rows; want 1", i, n)
+		}
+	}
+
+	driver.mu.Lock()
+	opens := driver.openCount - opens0
+	driver.mu.Unlock()
+	if opens != 0 {
+		t.Errorf("opened %d new connections; want 0", opens)
+	}
+}
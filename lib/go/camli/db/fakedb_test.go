@@ -427,7 +427,11 @@ rows:
 				// lazy hack to avoid sprintf %v on a []byte
 				tcol = string(bs)
 			}
-			if fmt.Sprintf("%v", tcol) != fmt.Sprintf("%v", args[widx]) {
+			arg := args[widx]
+			if bs, ok := arg.([]byte); ok {
+				arg = string(bs)
+			}
+			if fmt.Sprintf("%v", tcol) != fmt.Sprintf("%v", arg) {
 				continue rows
 			}
 		}
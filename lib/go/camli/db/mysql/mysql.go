@@ -0,0 +1,287 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mysql registers a "mysql" driver with the camli/db package,
+// wrapping the GoMySQL client.
+//
+// The data source name is of the form:
+//
+//	user[:password]@host[:port]/database
+package mysql
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"camli/db"
+	"camli/db/dbimpl"
+	gomysql "camli/third_party/github.com/camlistore/GoMySQL"
+)
+
+func init() {
+	db.Register("mysql", driver{})
+}
+
+type driver struct{}
+
+// ParseDSN splits a data source name into its parts.
+func ParseDSN(dsn string) (host, user, password, database string, err os.Error) {
+	at := strings.LastIndex(dsn, "@")
+	slash := strings.LastIndex(dsn, "/")
+	if at < 0 || slash < at {
+		err = fmt.Errorf("mysql: invalid data source name %q; want user[:password]@host[:port]/database", dsn)
+		return
+	}
+	user, host, database = dsn[:at], dsn[at+1:slash], dsn[slash+1:]
+	if colon := strings.Index(user, ":"); colon >= 0 {
+		user, password = user[:colon], user[colon+1:]
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	if user == "" || database == "" {
+		err = fmt.Errorf("mysql: data source name %q is missing a user or database", dsn)
+	}
+	return
+}
+
+// FormatDSN is the inverse of ParseDSN.
+func FormatDSN(host, user, password, database string) string {
+	if password != "" {
+		user += ":" + password
+	}
+	return user + "@" + host + "/" + database
+}
+
+func (driver) Open(dsn string) (dbimpl.Conn, os.Error) {
+	host, user, password, database, err := ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	c, err := gomysql.DialTCP(host, user, password, database)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{c: c}, nil
+}
+
+type conn struct {
+	c *gomysql.Client
+}
+
+func (c *conn) Prepare(query string) (dbimpl.Stmt, os.Error) {
+	s, err := c.c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{s: s}, nil
+}
+
+func (c *conn) Close() os.Error {
+	return c.c.Close()
+}
+
+func (c *conn) Begin() (dbimpl.Tx, os.Error) {
+	if err := c.c.Start(); err != nil {
+		return nil, err
+	}
+	return tx{c.c}, nil
+}
+
+type tx struct {
+	c *gomysql.Client
+}
+
+func (t tx) Commit() os.Error {
+	return t.c.Commit()
+}
+
+func (t tx) Rollback() os.Error {
+	return t.c.Rollback()
+}
+
+type stmt struct {
+	s *gomysql.Statement
+}
+
+func (s *stmt) Close() os.Error {
+	return s.s.Close()
+}
+
+func (s *stmt) NumInput() int {
+	return int(s.s.ParamCount())
+}
+
+// execute binds args and runs the statement. The db package passes
+// strings as []byte; bind those as strings so they aren't sent as
+// BLOBs. GoMySQL has no bool parameter type.
+func (s *stmt) execute(args []interface{}) os.Error {
+	if len(args) > 0 {
+		bargs := make([]interface{}, len(args))
+		for i, v := range args {
+			switch tv := v.(type) {
+			case []byte:
+				v = string(tv)
+			case bool:
+				if tv {
+					v = int64(1)
+				} else {
+					v = int64(0)
+				}
+			}
+			bargs[i] = v
+		}
+		if err := s.s.BindParams(bargs...); err != nil {
+			return err
+		}
+	}
+	return s.s.Execute()
+}
+
+func isNoResultSet(err os.Error) bool {
+	ce, ok := err.(*gomysql.ClientError)
+	return ok && ce.Errno == gomysql.CR_NO_RESULT_SET
+}
+
+func (s *stmt) Exec(args []interface{}) (dbimpl.Result, os.Error) {
+	if err := s.execute(args); err != nil {
+		return nil, err
+	}
+	res, err := s.s.UseResult()
+	if err == nil {
+		// A query run through Exec; discard its rows.
+		return result{}, res.Free()
+	}
+	if !isNoResultSet(err) {
+		return nil, err
+	}
+	return result{id: s.s.LastInsertId, affected: s.s.AffectedRows}, nil
+}
+
+func (s *stmt) Query(args []interface{}) (dbimpl.Rows, os.Error) {
+	if err := s.execute(args); err != nil {
+		return nil, err
+	}
+	res, err := s.s.UseResult()
+	if err != nil {
+		if isNoResultSet(err) {
+			return &rows{}, nil
+		}
+		return nil, err
+	}
+	return &rows{res: res}, nil
+}
+
+type result struct {
+	id, affected uint64
+}
+
+func (r result) AutoIncrementId() (int64, os.Error) {
+	return int64(r.id), nil
+}
+
+func (r result) RowsAffected() (int64, os.Error) {
+	return int64(r.affected), nil
+}
+
+type rows struct {
+	res *gomysql.Result // nil for statements without a result set
+}
+
+func (r *rows) Columns() []string {
+	if r.res == nil {
+		return nil
+	}
+	fields := r.res.FetchFields()
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		cols[i] = f.Name
+	}
+	return cols
+}
+
+func (r *rows) Close() os.Error {
+	if r.res == nil {
+		return nil
+	}
+	err := r.res.Free()
+	r.res = nil
+	return err
+}
+
+func (r *rows) Next(dest []interface{}) os.Error {
+	if r.res == nil {
+		return os.EOF
+	}
+	row := r.res.FetchRow()
+	if row == nil {
+		return os.EOF
+	}
+	if len(row) != len(dest) {
+		return fmt.Errorf("mysql: row has %d columns; expected %d", len(row), len(dest))
+	}
+	fields := r.res.FetchFields()
+	for i, v := range row {
+		dec, err := decodeColumn(i, fields[i], v)
+		if err != nil {
+			return err
+		}
+		dest[i] = dec
+	}
+	return nil
+}
+
+// decodeColumn converts a column value from GoMySQL into one of the
+// dbimpl value types: nil, int64, float64 or []byte.
+func decodeColumn(idx int, field *gomysql.Field, val interface{}) (interface{}, os.Error) {
+	switch v := val.(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		return v, nil
+	case uint64:
+		if v > 1<<63-1 {
+			return nil, fmt.Errorf("mysql: value %d in row[%d] overflows int64", v, idx)
+		}
+		return int64(v), nil
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case []byte:
+		switch field.Type {
+		case gomysql.FIELD_TYPE_TINY, gomysql.FIELD_TYPE_SHORT, gomysql.FIELD_TYPE_YEAR, gomysql.FIELD_TYPE_INT24, gomysql.FIELD_TYPE_LONG, gomysql.FIELD_TYPE_LONGLONG:
+			n, err := strconv.Atoi64(string(v))
+			if err != nil {
+				return nil, fmt.Errorf("mysql: strconv.Atoi64 error on field %d: %v", idx, err)
+			}
+			return n, nil
+		case gomysql.FIELD_TYPE_FLOAT, gomysql.FIELD_TYPE_DOUBLE:
+			f, err := strconv.Atof64(string(v))
+			if err != nil {
+				return nil, fmt.Errorf("mysql: strconv.Atof64 error on field %d: %v", idx, err)
+			}
+			return f, nil
+		}
+		// v aliases GoMySQL's packet buffer.
+		return append([]byte(nil), v...), nil
+	}
+	return nil, fmt.Errorf("mysql: unexpected %T in row[%d] for field type %d", val, idx, field.Type)
+}
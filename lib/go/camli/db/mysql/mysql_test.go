@@ -0,0 +1,62 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysql
+
+import (
+	"testing"
+)
+
+var dsnTests = []struct {
+	dsn                            string
+	host, user, password, database string
+	ok                             bool
+}{
+	{"root:secret@db.example.com:3306/camlistore", "db.example.com:3306", "root", "secret", "camlistore", true},
+	{"root@localhost/camli", "localhost", "root", "", "camli", true},
+	{"root:p@ss@localhost/camli", "localhost", "root", "p@ss", "camli", true},
+	{"root@/camli", "localhost", "root", "", "camli", true},
+	{"localhost/camli", "", "", "", "", false},
+	{"root@localhost", "", "", "", "", false},
+	{"root@localhost/", "", "", "", "", false},
+}
+
+func TestParseDSN(t *testing.T) {
+	for _, tt := range dsnTests {
+		host, user, password, database, err := ParseDSN(tt.dsn)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("ParseDSN(%q): expected error", tt.dsn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDSN(%q): %v", tt.dsn, err)
+			continue
+		}
+		if host != tt.host || user != tt.user || password != tt.password || database != tt.database {
+			t.Errorf("ParseDSN(%q) = %q, %q, %q, %q; want %q, %q, %q, %q", tt.dsn,
+				host, user, password, database, tt.host, tt.user, tt.password, tt.database)
+		}
+	}
+}
+
+func TestFormatDSN(t *testing.T) {
+	const want = "root:secret@localhost/camli"
+	if got := FormatDSN("localhost", "root", "secret", "camli"); got != want {
+		t.Errorf("FormatDSN = %q; want %q", got, want)
+	}
+}
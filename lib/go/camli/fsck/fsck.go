@@ -0,0 +1,165 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fsck verifies the integrity of blob storage.
+//
+// Every enumerated blob is fetched and re-hashed, and its size is
+// compared between EnumerateBlobs, FetchStreaming and the bytes
+// actually read. Bad blobs can optionally be quarantined, if the
+// storage implements blobserver.Quarantiner. Storage implementing
+// blobserver.StrayLister is also checked for stray files.
+package fsck
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// Problem kinds.
+const (
+	Corrupt  = "corrupt" // the contents don't match the digest
+	Size     = "size"    // sizes disagree
+	Missing  = "missing" // enumerated, but not fetchable
+	FetchErr = "fetch"   // fetching or reading failed
+)
+
+// A Problem is a bad blob found by a Checker.
+type Problem struct {
+	BlobRef *blobref.BlobRef
+	Kind    string // Corrupt, Size, Missing or FetchErr
+	Err     os.Error
+
+	Quarantined bool
+}
+
+func (p *Problem) String() string {
+	s := fmt.Sprintf("%s: %s: %v", p.BlobRef, p.Kind, p.Err)
+	if p.Quarantined {
+		s += " (quarantined)"
+	}
+	return s
+}
+
+// A Checker verifies the blobs of Storage.
+type Checker struct {
+	Storage blobserver.Storage
+
+	// Quarantine, if true, moves corrupt blobs and blobs with
+	// mismatched sizes aside. The Storage must implement
+	// blobserver.Quarantiner.
+	Quarantine bool
+}
+
+// A Report describes the outcome of a check.
+type Report struct {
+	Blobs    int   // blobs enumerated
+	Bytes    int64 // bytes read
+	Problems []*Problem
+	Stray    []string // stray files, if the Storage can list them
+}
+
+// OK reports whether no problems or stray files were found.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0 && len(r.Stray) == 0
+}
+
+func (r *Report) String() string {
+	return fmt.Sprintf("%d blobs (%d bytes) checked, %d problems, %d stray files",
+		r.Blobs, r.Bytes, len(r.Problems), len(r.Stray))
+}
+
+// Run checks every blob of the storage. The returned error is only
+// for failures preventing the check itself, such as failing to
+// enumerate; bad blobs are reported in the Report.
+func (c *Checker) Run() (*Report, os.Error) {
+	var q blobserver.Quarantiner
+	if c.Quarantine {
+		var ok bool
+		if q, ok = c.Storage.(blobserver.Quarantiner); !ok {
+			return nil, os.NewError("fsck: storage doesn't support quarantining blobs")
+		}
+	}
+
+	rep := new(Report)
+	var bad []*Problem
+	err := blobserver.EnumerateAll(c.Storage, "", func(sb blobref.SizedBlobRef) os.Error {
+		rep.Blobs++
+		p := c.check(sb, rep)
+		if p == nil {
+			return nil
+		}
+		log.Printf("fsck: %v", p)
+		rep.Problems = append(rep.Problems, p)
+		if p.Kind == Corrupt || p.Kind == Size {
+			bad = append(bad, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return rep, fmt.Errorf("fsck: enumerating blobs: %v", err)
+	}
+
+	// Quarantine once enumeration is done, so as not to move
+	// blobs out from under it.
+	if q != nil {
+		for _, p := range bad {
+			if err := q.Quarantine(p.BlobRef); err != nil {
+				return rep, fmt.Errorf("fsck: quarantining %s: %v", p.BlobRef, err)
+			}
+			p.Quarantined = true
+		}
+	}
+
+	if sl, ok := c.Storage.(blobserver.StrayLister); ok {
+		stray, err := sl.StrayFiles()
+		if err != nil {
+			return rep, fmt.Errorf("fsck: listing stray files: %v", err)
+		}
+		rep.Stray = stray
+	}
+	return rep, nil
+}
+
+// check verifies the blob sb, returning its problem, if any.
+func (c *Checker) check(sb blobref.SizedBlobRef, rep *Report) *Problem {
+	br := sb.BlobRef
+	rc, size, err := c.Storage.FetchStreaming(br)
+	if err == os.ENOENT {
+		return &Problem{br, Missing, err, false}
+	}
+	if err != nil {
+		return &Problem{br, FetchErr, err, false}
+	}
+	defer rc.Close()
+	hash := br.Hash()
+	n, err := io.Copy(hash, rc)
+	rep.Bytes += n
+	if err != nil {
+		return &Problem{br, FetchErr, err, false}
+	}
+	if !br.HashMatches(hash) {
+		return &Problem{br, Corrupt, blobserver.ErrCorruptBlob, false}
+	}
+	if n != sb.Size || n != size {
+		return &Problem{br, Size, fmt.Errorf("enumerated size %d, fetched size %d, read %d bytes", sb.Size, size, n), false}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver/localdisk"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func blobFile(root string, br *blobref.BlobRef) string {
+	d := br.Digest()
+	return filepath.Join(root, br.HashName(), d[0:3], d[3:6], localdisk.BlobFileBaseName(br))
+}
+
+func TestFsck(t *testing.T) {
+	root := fmt.Sprintf("%s/camli-fsck-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	AssertNil(t, os.Mkdir(root, 0755), "Mkdir")
+	defer os.RemoveAll(root)
+	sto, err := localdisk.New(root)
+	AssertNil(t, err, "localdisk.New")
+
+	var refs []*blobref.BlobRef
+	for _, s := range []string{"foo", "bar", "baz"} {
+		tb := &test.Blob{s}
+		_, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader())
+		AssertNil(t, err, "ReceiveBlob")
+		refs = append(refs, tb.BlobRef())
+	}
+
+	c := &Checker{Storage: sto, Quarantine: true}
+	rep, err := c.Run()
+	AssertNil(t, err, "clean Run")
+	Expect(t, rep.OK(), "clean storage is OK")
+	ExpectInt(t, 3, rep.Blobs, "blobs checked")
+	ExpectInt(t, 9, int(rep.Bytes), "bytes checked")
+
+	// Corrupt one blob and leave a temp file behind.
+	bad := refs[1]
+	AssertNil(t, ioutil.WriteFile(blobFile(root, bad), []byte("BAR"), 0600), "corrupting blob")
+	tmp := blobFile(root, refs[0]) + ".tmp123"
+	AssertNil(t, ioutil.WriteFile(tmp, []byte("partial"), 0600), "writing temp file")
+
+	rep, err = c.Run()
+	AssertNil(t, err, "Run")
+	Expect(t, !rep.OK(), "not OK")
+	ExpectInt(t, 3, rep.Blobs, "blobs checked")
+	if len(rep.Problems) != 1 {
+		t.Fatalf("got problems %v; want one", rep.Problems)
+	}
+	p := rep.Problems[0]
+	ExpectString(t, bad.String(), p.BlobRef.String(), "bad blob")
+	ExpectString(t, Corrupt, p.Kind, "problem kind")
+	Expect(t, p.Quarantined, "bad blob quarantined")
+	if len(rep.Stray) != 1 || rep.Stray[0] != tmp {
+		t.Errorf("stray files = %q; want [%q]", rep.Stray, tmp)
+	}
+
+	_, _, err = sto.FetchStreaming(bad)
+	Expect(t, err == os.ENOENT, "quarantined blob no longer fetchable")
+	_, err = os.Stat(blobFile(filepath.Join(root, "partition", "quarantine"), bad))
+	AssertNil(t, err, "quarantined blob kept")
+
+	AssertNil(t, os.Remove(tmp), "removing temp file")
+	rep, err = c.Run()
+	AssertNil(t, err, "Run after quarantine")
+	Expect(t, rep.OK(), "OK after quarantine")
+	ExpectInt(t, 2, rep.Blobs, "blobs checked after quarantine")
+}
@@ -0,0 +1,173 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsck
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/schema"
+)
+
+// A Dangling is a reference from a schema blob to a blob which
+// isn't in the storage.
+type Dangling struct {
+	Referrer *blobref.BlobRef // the schema blob
+	Field    string           // "parts", "entries", "members" or "permaNode"
+	Missing  *blobref.BlobRef
+}
+
+func (d *Dangling) String() string {
+	return fmt.Sprintf("%s: %s references missing %s", d.Referrer, d.Field, d.Missing)
+}
+
+// A RootRefs lists the dangling references found under a root,
+// which is a schema blob not referenced by any other schema blob.
+type RootRefs struct {
+	Root     *blobref.BlobRef
+	Type     string // the root's camliType
+	Dangling []*Dangling
+}
+
+// A RefReport describes the outcome of a RefChecker run.
+type RefReport struct {
+	Blobs  int // blobs enumerated
+	Schema int // schema blobs among them
+
+	// Roots are the roots with dangling references, sorted by
+	// blobref.
+	Roots []*RootRefs
+}
+
+// OK reports whether no dangling references were found.
+func (r *RefReport) OK() bool {
+	return len(r.Roots) == 0
+}
+
+func (r *RefReport) String() string {
+	n := 0
+	for _, rr := range r.Roots {
+		n += len(rr.Dangling)
+	}
+	return fmt.Sprintf("%d blobs, %d schema blobs, %d dangling references under %d roots",
+		r.Blobs, r.Schema, n, len(r.Roots))
+}
+
+// A RefChecker finds schema blobs of Storage referencing blobs
+// missing from it: file and bytes parts, directory entries, static
+// set members and claim permanodes.
+type RefChecker struct {
+	Storage blobserver.Storage
+}
+
+type schemaRef struct {
+	field string
+	ref   *blobref.BlobRef
+}
+
+type schemaBlob struct {
+	ref  *blobref.BlobRef
+	typ  string
+	refs []schemaRef
+}
+
+// Run checks every schema blob of the storage.
+func (c *RefChecker) Run() (*RefReport, os.Error) {
+	var blobs []blobref.SizedBlobRef
+	err := blobserver.EnumerateAll(c.Storage, "", func(sb blobref.SizedBlobRef) os.Error {
+		blobs = append(blobs, sb)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fsck: enumerating blobs: %v", err)
+	}
+	rep := &RefReport{Blobs: len(blobs)}
+	have := make(map[string]bool)
+	for _, sb := range blobs {
+		have[sb.BlobRef.String()] = true
+	}
+
+	schemas := make(map[string]*schemaBlob)
+	referenced := make(map[string]bool)
+	for _, sb := range blobs {
+		s, err := c.scan(sb)
+		if err != nil {
+			return nil, fmt.Errorf("fsck: reading %s: %v", sb.BlobRef, err)
+		}
+		if s == nil {
+			continue
+		}
+		schemas[sb.BlobRef.String()] = s
+		for _, r := range s.refs {
+			referenced[r.ref.String()] = true
+		}
+	}
+	rep.Schema = len(schemas)
+
+	var roots []string
+	for br := range schemas {
+		if !referenced[br] {
+			roots = append(roots, br)
+		}
+	}
+	sort.Strings(roots)
+	for _, root := range roots {
+		rr := &RootRefs{Root: schemas[root].ref, Type: schemas[root].typ}
+		seen := make(map[string]bool)
+		stack := []string{root}
+		for len(stack) > 0 {
+			br := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			s := schemas[br]
+			if s == nil || seen[br] {
+				continue
+			}
+			seen[br] = true
+			for _, r := range s.refs {
+				if !have[r.ref.String()] {
+					rr.Dangling = append(rr.Dangling, &Dangling{s.ref, r.field, r.ref})
+					continue
+				}
+				stack = append(stack, r.ref.String())
+			}
+		}
+		if len(rr.Dangling) > 0 {
+			rep.Roots = append(rep.Roots, rr)
+		}
+	}
+	return rep, nil
+}
+
+// scan returns the schema blob sb's references, or nil if it's not
+// a schema blob.
+func (c *RefChecker) scan(sb blobref.SizedBlobRef) (*schemaBlob, os.Error) {
+	ss, _, err := schema.ReadSchemaBlob(c.Storage, sb)
+	if ss == nil || err != nil {
+		return nil, err
+	}
+	s := &schemaBlob{ref: sb.BlobRef, typ: ss.Type}
+	for _, r := range ss.Refs() {
+		switch r.Field {
+		case "permaNode", "parts", "entries", "members":
+			s.refs = append(s.refs, schemaRef{r.Field, r.Ref})
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fsck
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/blobserver/localdisk"
+	"camli/schema"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+func uploadString(t *testing.T, sto blobserver.Storage, s string) *blobref.BlobRef {
+	tb := &test.Blob{s}
+	if _, err := sto.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+		t.Fatalf("ReceiveBlob: %v", err)
+	}
+	return tb.BlobRef()
+}
+
+func uploadMap(t *testing.T, sto blobserver.Storage, m map[string]interface{}) *blobref.BlobRef {
+	js, err := schema.MapToCamliJson(m)
+	if err != nil {
+		t.Fatalf("MapToCamliJson: %v", err)
+	}
+	return uploadString(t, sto, js)
+}
+
+func TestDanglingRefs(t *testing.T) {
+	root := fmt.Sprintf("%s/camli-fsckrefs-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	AssertNil(t, os.Mkdir(root, 0755), "Mkdir")
+	defer os.RemoveAll(root)
+	sto, err := localdisk.New(root)
+	AssertNil(t, err, "localdisk.New")
+
+	missingChunk := (&test.Blob{"never uploaded"}).BlobRef()
+	missingMember := (&test.Blob{"also never uploaded"}).BlobRef()
+	missingPn := (&test.Blob{"no such permanode"}).BlobRef()
+
+	// A directory whose static set has a file missing a chunk,
+	// and a missing member.
+	chunk := uploadString(t, sto, "chunk")
+	file := schema.NewFileMap("foo.txt")
+	AssertNil(t, schema.PopulateParts(file, 19, []schema.BytesPart{
+		{Size: 5, BlobRef: chunk},
+		{Size: 14, BlobRef: missingChunk},
+	}), "PopulateParts")
+	fileRef := uploadMap(t, sto, file)
+	set := new(schema.StaticSet)
+	set.Add(fileRef)
+	set.Add(missingMember)
+	setRef := uploadMap(t, sto, set.Map())
+	dir := schema.NewCommonFilenameMap("dir")
+	schema.PopulateDirectoryMap(dir, setRef)
+	dirRef := uploadMap(t, sto, dir)
+
+	// A claim of a missing permanode.
+	claimRef := uploadMap(t, sto, schema.NewSetAttributeClaim(missingPn, "title", "foo"))
+
+	// A complete file.
+	good := schema.NewFileMap("good.txt")
+	AssertNil(t, schema.PopulateParts(good, 5, []schema.BytesPart{{Size: 5, BlobRef: chunk}}), "PopulateParts")
+	uploadMap(t, sto, good)
+
+	rep, err := (&RefChecker{Storage: sto}).Run()
+	AssertNil(t, err, "Run")
+	Expect(t, !rep.OK(), "not OK")
+	ExpectInt(t, 6, rep.Blobs, "blobs")
+	ExpectInt(t, 5, rep.Schema, "schema blobs")
+
+	want := map[string][]string{
+		dirRef.String(): {
+			fmt.Sprintf("%s: members references missing %s", setRef, missingMember),
+			fmt.Sprintf("%s: parts references missing %s", fileRef, missingChunk),
+		},
+		claimRef.String(): {
+			fmt.Sprintf("%s: permaNode references missing %s", claimRef, missingPn),
+		},
+	}
+	ExpectInt(t, len(want), len(rep.Roots), "roots with dangling refs")
+	for _, rr := range rep.Roots {
+		wantd, ok := want[rr.Root.String()]
+		if !ok {
+			t.Errorf("unexpected root %s with dangling refs %v", rr.Root, rr.Dangling)
+			continue
+		}
+		got := make(map[string]bool)
+		for _, d := range rr.Dangling {
+			got[d.String()] = true
+		}
+		ExpectInt(t, len(wantd), len(got), "dangling refs of "+rr.Root.String())
+		for _, w := range wantd {
+			Expect(t, got[w], w)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package gc implements a mark-and-sweep garbage collector for blob
+// storage.
+//
+// The roots are signed permanodes, claims and "keep" objects (see
+// doc/schema/objects/keep.txt). From them, the collector follows the
+// references of schema blobs: signers' public keys, claims'
+// permanodes and blobref values, the parts of files and bytes, the
+// entries of directories and the members of static sets. Every other
+// blob is unreachable, and is removed.
+//
+// A blob uploaded just before a collection may be unreachable only
+// because the claim referencing it hasn't been uploaded yet. To
+// protect such blobs, unreachable blobs are only removed once they've
+// been seen unreachable for GracePeriod, which requires a StateFile
+// recording when each was first seen.
+package gc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonsign"
+	"camli/schema"
+)
+
+// removeBatch is the number of blobs removed per RemoveBlobs call.
+const removeBatch = 100
+
+// A Collector removes unreachable blobs from Storage.
+type Collector struct {
+	Storage blobserver.Storage
+
+	// Owners, if non-empty, restricts the roots to objects signed
+	// by these public keys. Otherwise objects with any valid
+	// signature are roots.
+	Owners []*blobref.BlobRef
+
+	// DryRun, if true, makes Run only report what it would
+	// remove, without removing anything or updating StateFile.
+	DryRun bool
+
+	// GracePeriod is the number of seconds a blob must have been
+	// unreachable before it's removed. If non-zero, StateFile is
+	// required.
+	GracePeriod int64
+
+	// StateFile names a file recording when each unreachable
+	// blob was first seen, across runs.
+	StateFile string
+
+	// Now, if non-nil, returns the current time in seconds. It's
+	// for tests; by default time.Seconds is used.
+	Now func() int64
+}
+
+// A Report describes the outcome of a collection.
+type Report struct {
+	Blobs     int // blobs in the storage
+	Roots     int // signed permanodes, claims and keep objects
+	Reachable int
+
+	Unreachable []blobref.SizedBlobRef
+
+	// Removed are the unreachable blobs which were removed, or
+	// would have been in a dry run.
+	Removed []blobref.SizedBlobRef
+
+	// Pending is the number of unreachable blobs still within
+	// their grace period.
+	Pending int
+}
+
+func (r *Report) String() string {
+	freed := int64(0)
+	for _, sb := range r.Removed {
+		freed += sb.Size
+	}
+	return fmt.Sprintf("%d blobs, %d roots, %d reachable, %d unreachable (%d pending); removed %d blobs (%d bytes)",
+		r.Blobs, r.Roots, r.Reachable, len(r.Unreachable), r.Pending, len(r.Removed), freed)
+}
+
+// Run collects garbage once. It fails without removing anything if
+// any schema blob can't be read or is too large to scan, since its
+// references are unknown.
+func (c *Collector) Run() (*Report, os.Error) {
+	if c.GracePeriod > 0 && c.StateFile == "" {
+		return nil, os.NewError("gc: a GracePeriod requires a StateFile")
+	}
+	now := time.Seconds()
+	if c.Now != nil {
+		now = c.Now()
+	}
+	pending, err := c.readState()
+	if err != nil {
+		return nil, err
+	}
+
+	blobs, err := c.enumerate()
+	if err != nil {
+		return nil, err
+	}
+	rep := &Report{Blobs: len(blobs)}
+
+	// Mark.
+	refs := make(map[string][]string)
+	var roots []string
+	for _, sb := range blobs {
+		br := sb.BlobRef.String()
+		isRoot, brefs, err := c.scan(sb)
+		if err != nil {
+			return nil, fmt.Errorf("gc: reading %s: %v", br, err)
+		}
+		if isRoot {
+			roots = append(roots, br)
+		}
+		if len(brefs) > 0 {
+			refs[br] = brefs
+		}
+	}
+	rep.Roots = len(roots)
+	marked := make(map[string]bool)
+	queue := roots
+	for len(queue) > 0 {
+		br := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if marked[br] {
+			continue
+		}
+		marked[br] = true
+		queue = append(queue, refs[br]...)
+	}
+
+	// Sweep.
+	newPending := make(map[string]int64)
+	for _, sb := range blobs {
+		br := sb.BlobRef.String()
+		if marked[br] {
+			rep.Reachable++
+			continue
+		}
+		rep.Unreachable = append(rep.Unreachable, sb)
+		first, ok := pending[br]
+		if !ok {
+			first = now
+		}
+		if now-first >= c.GracePeriod {
+			rep.Removed = append(rep.Removed, sb)
+		} else {
+			newPending[br] = first
+			rep.Pending++
+		}
+	}
+	if c.DryRun {
+		return rep, nil
+	}
+
+	for i := 0; i < len(rep.Removed); i += removeBatch {
+		end := i + removeBatch
+		if end > len(rep.Removed) {
+			end = len(rep.Removed)
+		}
+		batch := make([]*blobref.BlobRef, 0, end-i)
+		for _, sb := range rep.Removed[i:end] {
+			batch = append(batch, sb.BlobRef)
+		}
+		if err := c.Storage.RemoveBlobs(batch); err != nil {
+			return rep, fmt.Errorf("gc: removing blobs: %v", err)
+		}
+	}
+	log.Printf("gc: %v", rep)
+	return rep, c.writeState(newPending)
+}
+
+func (c *Collector) enumerate() ([]blobref.SizedBlobRef, os.Error) {
+	var blobs []blobref.SizedBlobRef
+	err := blobserver.EnumerateAll(c.Storage, "", func(sb blobref.SizedBlobRef) os.Error {
+		blobs = append(blobs, sb)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("gc: enumerating blobs: %v", err)
+	}
+	return blobs, nil
+}
+
+// scan returns whether the blob sb is a root, and the blobrefs it
+// references.
+func (c *Collector) scan(sb blobref.SizedBlobRef) (isRoot bool, refs []string, err os.Error) {
+	if sb.Size > schema.MaxSchemaBlobSize {
+		// Too large to parse as a schema blob. If it might be one
+		// anyway, its references are unknown.
+		isJSON, err := c.startsWithBrace(sb.BlobRef)
+		if err != nil {
+			return false, nil, err
+		}
+		if isJSON {
+			return false, nil, fmt.Errorf("possible schema blob of %d bytes is too large to scan (limit %d)", sb.Size, schema.MaxSchemaBlobSize)
+		}
+		return false, nil, nil
+	}
+	ss, raw, err := schema.ReadSchemaBlob(c.Storage, sb)
+	if ss == nil || err != nil {
+		return false, nil, err
+	}
+	for _, r := range ss.Refs() {
+		refs = append(refs, r.Ref.String())
+	}
+	switch ss.Type {
+	case "permanode", "claim", "keep":
+		isRoot = c.signedByOwner(string(raw))
+	}
+	return isRoot, refs, nil
+}
+
+func (c *Collector) startsWithBrace(br *blobref.BlobRef) (bool, os.Error) {
+	rc, _, err := c.Storage.FetchStreaming(br)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	var b [1]byte
+	if _, err := io.ReadFull(rc, b[:]); err != nil {
+		return false, err
+	}
+	return b[0] == '{', nil
+}
+
+func (c *Collector) signedByOwner(raw string) bool {
+	vr := jsonsign.NewVerificationRequest(raw, c.Storage)
+	if !vr.Verify() {
+		return false
+	}
+	if len(c.Owners) == 0 {
+		return true
+	}
+	for _, owner := range c.Owners {
+		if owner.Equals(vr.CamliSigner) {
+			return true
+		}
+	}
+	return false
+}
+
+// readState returns when each blob in StateFile was first seen
+// unreachable, in seconds.
+func (c *Collector) readState() (map[string]int64, os.Error) {
+	pending := make(map[string]int64)
+	if c.StateFile == "" {
+		return pending, nil
+	}
+	f, err := os.Open(c.StateFile)
+	if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+		return pending, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadString('\n')
+		if f := strings.Fields(line); len(f) == 2 {
+			sec, perr := strconv.Atoi64(f[1])
+			if blobref.Parse(f[0]) == nil || perr != nil {
+				return nil, fmt.Errorf("gc: malformed line %q in state file %s", line, c.StateFile)
+			}
+			pending[f[0]] = sec
+		}
+		if err == os.EOF {
+			return pending, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	panic("unreachable")
+}
+
+func (c *Collector) writeState(pending map[string]int64) os.Error {
+	if c.StateFile == "" {
+		return nil
+	}
+	refs := make([]string, 0, len(pending))
+	for br := range pending {
+		refs = append(refs, br)
+	}
+	sort.Strings(refs)
+	lines := make([]string, len(refs))
+	for i, br := range refs {
+		lines[i] = fmt.Sprintf("%s %d\n", br, pending[br])
+	}
+	tmp := c.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.StateFile)
+}
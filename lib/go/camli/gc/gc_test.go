@@ -0,0 +1,194 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gc
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver/localdisk"
+	"camli/jsonsign"
+	"camli/schema"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+const secringPath = "../jsonsign/testdata/test-secring.gpg"
+
+type gcHarness struct {
+	t   *testing.T
+	sto *localdisk.DiskStorage
+	dir string
+	pub *blobref.BlobRef
+}
+
+func newHarness(t *testing.T) *gcHarness {
+	dir := fmt.Sprintf("%s/camli-gc-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	sto, err := localdisk.New(dir)
+	if err != nil {
+		t.Fatalf("localdisk.New: %v", err)
+	}
+	h := &gcHarness{t: t, sto: sto, dir: dir}
+	entity, err := jsonsign.EntityFromSecring("26F5ABDA", secringPath)
+	if err != nil {
+		t.Fatalf("EntityFromSecring: %v", err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		t.Fatalf("ArmoredPublicKey: %v", err)
+	}
+	h.pub = h.upload(armored)
+	return h
+}
+
+func (h *gcHarness) upload(s string) *blobref.BlobRef {
+	tb := &test.Blob{s}
+	if _, err := h.sto.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+		h.t.Fatalf("ReceiveBlob: %v", err)
+	}
+	return tb.BlobRef()
+}
+
+func (h *gcHarness) uploadMap(m map[string]interface{}) *blobref.BlobRef {
+	js, err := schema.MapToCamliJson(m)
+	if err != nil {
+		h.t.Fatalf("MapToCamliJson: %v", err)
+	}
+	return h.upload(js)
+}
+
+func (h *gcHarness) sign(m map[string]interface{}) *blobref.BlobRef {
+	m["camliSigner"] = h.pub.String()
+	unsigned, err := schema.MapToCamliJson(m)
+	if err != nil {
+		h.t.Fatalf("MapToCamliJson: %v", err)
+	}
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:      unsigned,
+		Fetcher:           h.sto,
+		ServerMode:        true,
+		SecretKeyringPath: secringPath,
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		h.t.Fatalf("Sign: %v", err)
+	}
+	return h.upload(signed)
+}
+
+func refSet(sbs []blobref.SizedBlobRef) map[string]bool {
+	m := make(map[string]bool)
+	for _, sb := range sbs {
+		m[sb.BlobRef.String()] = true
+	}
+	return m
+}
+
+func TestCollect(t *testing.T) {
+	h := newHarness(t)
+	defer os.RemoveAll(h.dir)
+
+	// Reachable: a permanode whose content is a file of one chunk,
+	// and a blob kept by a keep object.
+	chunk := h.upload("file contents")
+	file := schema.NewFileMap("foo.txt")
+	AssertNil(t, schema.PopulateParts(file, 13, []schema.BytesPart{{Size: 13, BlobRef: chunk}}), "PopulateParts")
+	fileRef := h.uploadMap(file)
+	pn := h.sign(schema.NewUnsignedPermanode())
+	h.sign(schema.NewSetAttributeClaim(pn, "camliContent", fileRef.String()))
+	kept := h.upload("kept blob")
+	h.sign(schema.NewKeep(kept))
+
+	// Unreachable: an orphan chunk and an unsigned permanode.
+	orphan := h.upload("orphan")
+	unsigned := h.uploadMap(schema.NewUnsignedPermanode())
+
+	now := int64(1000)
+	c := &Collector{
+		Storage:     h.sto,
+		DryRun:      true,
+		GracePeriod: 60,
+		StateFile:   h.dir + ".gcstate",
+		Now:         func() int64 { return now },
+	}
+	defer os.Remove(c.StateFile)
+
+	rep, err := c.Run()
+	AssertNil(t, err, "dry run")
+	ExpectInt(t, 9, rep.Blobs, "blobs")
+	ExpectInt(t, 3, rep.Roots, "roots")
+	ExpectInt(t, 7, rep.Reachable, "reachable")
+	unreachable := refSet(rep.Unreachable)
+	Expect(t, len(unreachable) == 2 && unreachable[orphan.String()] && unreachable[unsigned.String()], "unreachable blobs")
+	ExpectInt(t, 0, len(rep.Removed), "removed within grace period")
+	ExpectInt(t, 2, rep.Pending, "pending")
+
+	// First real run starts the grace period.
+	c.DryRun = false
+	rep, err = c.Run()
+	AssertNil(t, err, "first run")
+	ExpectInt(t, 0, len(rep.Removed), "removed by first run")
+
+	// Not yet expired.
+	now += 30
+	rep, err = c.Run()
+	AssertNil(t, err, "second run")
+	ExpectInt(t, 0, len(rep.Removed), "removed by second run")
+
+	now += 30
+	rep, err = c.Run()
+	AssertNil(t, err, "third run")
+	removed := refSet(rep.Removed)
+	Expect(t, len(removed) == 2 && removed[orphan.String()] && removed[unsigned.String()], "removed blobs")
+
+	for _, br := range []*blobref.BlobRef{orphan, unsigned} {
+		_, _, err := h.sto.FetchStreaming(br)
+		Expect(t, err == os.ENOENT, "unreachable blob removed")
+	}
+	for _, br := range []*blobref.BlobRef{h.pub, chunk, fileRef, pn, kept} {
+		rc, _, err := h.sto.FetchStreaming(br)
+		AssertNil(t, err, "reachable blob kept")
+		rc.Close()
+	}
+
+	// Restricted to another owner, nothing is a root.
+	c.Owners = []*blobref.BlobRef{blobref.MustParse("sha1-0000000000000000000000000000000000000000")}
+	c.DryRun = true
+	rep, err = c.Run()
+	AssertNil(t, err, "run with other owner")
+	ExpectInt(t, 0, rep.Roots, "roots of other owner")
+}
+
+func TestLargeSchemaBlob(t *testing.T) {
+	h := newHarness(t)
+	defer os.RemoveAll(h.dir)
+
+	// Too large to scan, its references would be lost: the run
+	// fails rather than removing them.
+	h.upload("{" + strings.Repeat(" ", schema.MaxSchemaBlobSize) + "}")
+	h.upload(strings.Repeat("x", schema.MaxSchemaBlobSize+1))
+	c := &Collector{Storage: h.sto}
+	_, err := c.Run()
+	Expect(t, err != nil, "run with a large schema blob fails")
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kvfile implements a small embedded, ordered key/value
+// store persisted to a single append-only log file on local disk.
+//
+// The entire key space is held in memory in sorted order; the log
+// file exists only so the contents survive restarts. Deleted and
+// overwritten records are reclaimed by rewriting the log (see
+// Compact), which also happens automatically at Open time when
+// most of the file is garbage.
+package kvfile
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+const (
+	opSet    = 'S'
+	opDelete = 'D'
+
+	// record header: crc32 (4) + op (1) + key length (4) + value length (4)
+	headerSize = 13
+
+	// Don't bother compacting files smaller than this at Open.
+	minCompactSize = 1 << 20
+)
+
+// DB is an ordered key/value store. It's safe for concurrent use
+// by multiple goroutines.
+type DB struct {
+	path string
+
+	mu        sync.RWMutex
+	f         *os.File // append-only log; nil once closed
+	sl        *skiplist
+	fileSize  int64 // bytes in the log file
+	liveBytes int64 // bytes the log would need if compacted
+}
+
+// Open opens the database stored in the file at path, creating it
+// if it doesn't exist.
+func Open(path string) (*DB, os.Error) {
+	db := &DB{
+		path: path,
+		sl:   newSkiplist(),
+	}
+	if err := db.load(); err != nil {
+		return nil, err
+	}
+	if db.fileSize > minCompactSize && db.fileSize > 2*db.liveBytes {
+		if err := db.rewrite(); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	db.f = f
+	return db, nil
+}
+
+func recordSize(key, value string) int64 {
+	return int64(headerSize + len(key) + len(value))
+}
+
+// errTorn is returned by readRecord for a record running past the
+// end of the file, or ending at it with a bad checksum: a write
+// interrupted by a crash.
+var errTorn = os.NewError("kvfile: partially written record")
+
+// load reads the log file into memory, truncating any partially
+// written record at its tail. Bad records elsewhere fail the load,
+// rather than dropping all the records after them.
+func (db *DB) load() os.Error {
+	f, err := os.OpenFile(db.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(f)
+	var (
+		offset int64
+		header [headerSize]byte
+	)
+	for {
+		op, key, value, err := readRecord(br, header[:], fi.Size-offset)
+		if err == os.EOF {
+			break
+		}
+		if err == errTorn {
+			log.Printf("kvfile: %s: truncating partially written record at offset %d", db.path, offset)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("kvfile: %s: corrupt record at offset %d: %v", db.path, offset, err)
+		}
+		db.apply(op, key, value)
+		offset += recordSize(key, value)
+	}
+	db.fileSize = offset
+	return nil
+}
+
+// readRecord reads a record from r, which has remain bytes left.
+func readRecord(r io.Reader, header []byte, remain int64) (op byte, key, value string, err os.Error) {
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTorn
+		}
+		return
+	}
+	op = header[4]
+	if op != opSet && op != opDelete {
+		err = fmt.Errorf("unknown op %q", op)
+		return
+	}
+	klen := binary.BigEndian.Uint32(header[5:9])
+	vlen := binary.BigEndian.Uint32(header[9:13])
+	// Check the lengths before trusting them with an allocation.
+	size := int64(headerSize) + int64(klen) + int64(vlen)
+	if size > remain {
+		err = errTorn
+		return
+	}
+	buf := make([]byte, int(klen)+int(vlen))
+	if _, err = io.ReadFull(r, buf); err != nil {
+		err = os.NewError("short record body")
+		return
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(buf)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		err = os.NewError("checksum mismatch")
+		if size == remain {
+			err = errTorn
+		}
+		return
+	}
+	return op, string(buf[:klen]), string(buf[klen:]), nil
+}
+
+func appendRecord(buf []byte, op byte, key, value string) []byte {
+	var header [headerSize]byte
+	header[4] = op
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(value)))
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write([]byte(key))
+	crc.Write([]byte(value))
+	binary.BigEndian.PutUint32(header[0:4], crc.Sum32())
+	buf = append(buf, header[:]...)
+	buf = append(buf, []byte(key)...)
+	return append(buf, []byte(value)...)
+}
+
+// apply applies a record to the in-memory state.
+// db.mu must be held (or db not yet shared).
+func (db *DB) apply(op byte, key, value string) {
+	switch op {
+	case opSet:
+		if old, ok := db.sl.set(key, value); ok {
+			db.liveBytes -= recordSize(key, old)
+		}
+		db.liveBytes += recordSize(key, value)
+	case opDelete:
+		if old, ok := db.sl.delete(key); ok {
+			db.liveBytes -= recordSize(key, old)
+		}
+	}
+}
+
+// Get returns the value of key, or os.ENOENT if it's not present.
+func (db *DB) Get(key string) (value string, err os.Error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	value, ok := db.sl.get(key)
+	if !ok {
+		return "", os.ENOENT
+	}
+	return value, nil
+}
+
+// Set sets key to value.
+func (db *DB) Set(key, value string) os.Error {
+	b := db.BeginBatch()
+	b.Set(key, value)
+	return db.CommitBatch(b)
+}
+
+// Delete removes key. Deleting a non-existent key isn't an error.
+func (db *DB) Delete(key string) os.Error {
+	b := db.BeginBatch()
+	b.Delete(key)
+	return db.CommitBatch(b)
+}
+
+// Len returns the number of keys in the database.
+func (db *DB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.sl.n
+}
+
+type mutation struct {
+	op         byte
+	key, value string
+}
+
+// Batch is a set of mutations applied atomically by CommitBatch.
+type Batch struct {
+	muts []mutation
+}
+
+func (db *DB) BeginBatch() *Batch {
+	return new(Batch)
+}
+
+func (b *Batch) Set(key, value string) {
+	b.muts = append(b.muts, mutation{opSet, key, value})
+}
+
+func (b *Batch) Delete(key string) {
+	b.muts = append(b.muts, mutation{opDelete, key, ""})
+}
+
+// CommitBatch writes all of b's mutations to the log with a single
+// write and then applies them in order.
+func (db *DB) CommitBatch(b *Batch) os.Error {
+	if len(b.muts) == 0 {
+		return nil
+	}
+	var buf []byte
+	for _, m := range b.muts {
+		buf = appendRecord(buf, m.op, m.key, m.value)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return os.NewError("kvfile: DB is closed")
+	}
+	if _, err := db.f.Write(buf); err != nil {
+		// Don't leave a partial record for later ones to follow.
+		if terr := db.f.Truncate(db.fileSize); terr != nil {
+			log.Printf("kvfile: %s: truncating after failed write: %v", db.path, terr)
+		}
+		return err
+	}
+	db.fileSize += int64(len(buf))
+	for _, m := range b.muts {
+		db.apply(m.op, m.key, m.value)
+	}
+	return nil
+}
+
+// Iterator iterates over keys in sorted order. Mutations made while
+// iterating are allowed; keys added after the iterator's current
+// position will be seen.
+type Iterator struct {
+	db         *DB
+	seek       string
+	inclusive  bool // whether seek itself may be returned
+	key, value string
+}
+
+// Find returns an iterator positioned before the first key greater
+// than or equal to start. Call Next to advance to the first key.
+func (db *DB) Find(start string) *Iterator {
+	return &Iterator{db: db, seek: start, inclusive: true}
+}
+
+// Next advances the iterator, returning false when there are no
+// more keys.
+func (it *Iterator) Next() bool {
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	n := it.db.sl.findGE(it.seek, nil)
+	if n != nil && !it.inclusive && n.key == it.seek {
+		n = n.next[0]
+	}
+	if n == nil {
+		it.key, it.value = "", ""
+		return false
+	}
+	it.key, it.value = n.key, n.value
+	it.seek, it.inclusive = n.key, false
+	return true
+}
+
+// Key returns the key at the iterator's current position.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value at the iterator's current position.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Compact rewrites the log file to contain only live records.
+func (db *DB) Compact() os.Error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return os.NewError("kvfile: DB is closed")
+	}
+	if err := db.f.Close(); err != nil {
+		return err
+	}
+	db.f = nil
+	err := db.rewrite()
+	f, oerr := os.OpenFile(db.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if oerr != nil {
+		return oerr
+	}
+	db.f = f
+	return err
+}
+
+// rewrite writes all live records to a temporary file and renames
+// it over the log. db.f must not be open.
+func (db *DB) rewrite() os.Error {
+	tmpName := db.path + ".compact"
+	tf, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	success := false
+	defer func() {
+		if !success {
+			tf.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	bw := bufio.NewWriter(tf)
+	var size int64
+	for n := db.sl.head.next[0]; n != nil; n = n.next[0] {
+		rec := appendRecord(nil, opSet, n.key, n.value)
+		if _, err := bw.Write(rec); err != nil {
+			return err
+		}
+		size += int64(len(rec))
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := tf.Sync(); err != nil {
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, db.path); err != nil {
+		return err
+	}
+	success = true
+	db.fileSize = size
+	db.liveBytes = size
+	return nil
+}
+
+// Sync flushes the log file to stable storage.
+func (db *DB) Sync() os.Error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return os.NewError("kvfile: DB is closed")
+	}
+	return db.f.Sync()
+}
+
+// Close syncs and closes the log file. The DB can't be used after
+// Close.
+func (db *DB) Close() os.Error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.f == nil {
+		return nil
+	}
+	err := db.f.Sync()
+	if cerr := db.f.Close(); err == nil {
+		err = cerr
+	}
+	db.f = nil
+	return err
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func tempDBPath(t *testing.T) string {
+	path := fmt.Sprintf("%s/camli-kvfile-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	os.Remove(path)
+	return path
+}
+
+func openDB(t *testing.T, path string) *DB {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", path, err)
+	}
+	return db
+}
+
+func keys(db *DB, start string) (ret []string) {
+	it := db.Find(start)
+	for it.Next() {
+		ret = append(ret, it.Key()+"="+it.Value())
+	}
+	return
+}
+
+func TestSetGetDelete(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	defer db.Close()
+
+	if _, err := db.Get("foo"); err != os.ENOENT {
+		t.Errorf("Get of missing key = %v; want ENOENT", err)
+	}
+	db.Set("foo", "bar")
+	db.Set("foo", "baz")
+	if v, err := db.Get("foo"); err != nil || v != "baz" {
+		t.Errorf("Get(foo) = %q, %v; want baz", v, err)
+	}
+	db.Delete("foo")
+	if _, err := db.Get("foo"); err != os.ENOENT {
+		t.Errorf("Get of deleted key = %v; want ENOENT", err)
+	}
+	if db.Len() != 0 {
+		t.Errorf("Len = %d; want 0", db.Len())
+	}
+}
+
+func TestFindOrder(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	defer db.Close()
+
+	for _, k := range []string{"c", "a", "e", "b", "d"} {
+		db.Set(k, k+k)
+	}
+	got := fmt.Sprint(keys(db, "b"))
+	if want := "[b=bb c=cc d=dd e=ee]"; got != want {
+		t.Errorf("Find(b) = %s; want %s", got, want)
+	}
+	got = fmt.Sprint(keys(db, "bb"))
+	if want := "[c=cc d=dd e=ee]"; got != want {
+		t.Errorf("Find(bb) = %s; want %s", got, want)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	b := db.BeginBatch()
+	b.Set("k1", "v1")
+	b.Set("k2", "v2")
+	b.Set("k3", "v3")
+	b.Delete("k2")
+	if err := db.CommitBatch(b); err != nil {
+		t.Fatalf("CommitBatch: %v", err)
+	}
+	db.Close()
+
+	db = openDB(t, path)
+	got := fmt.Sprint(keys(db, ""))
+	if want := "[k1=v1 k3=v3]"; got != want {
+		t.Errorf("after reopen = %s; want %s", got, want)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	db.Set("k4", "v4")
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	got = fmt.Sprint(keys(db, ""))
+	if want := "[k1=v1 k3=v3 k4=v4]"; got != want {
+		t.Errorf("after compact and reopen = %s; want %s", got, want)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	db.Set("good", "value")
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := appendRecord(nil, opSet, "torn", "record")
+	f.Write(rec[:len(rec)-3])
+	f.Close()
+
+	db = openDB(t, path)
+	got := fmt.Sprint(keys(db, ""))
+	if want := "[good=value]"; got != want {
+		t.Errorf("after torn write = %s; want %s", got, want)
+	}
+	db.Set("after", "ok")
+	db.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	got = fmt.Sprint(keys(db, ""))
+	if want := "[after=ok good=value]"; got != want {
+		t.Errorf("after repair = %s; want %s", got, want)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	db.Set("first", "value")
+	db.Set("second", "value")
+	db.Close()
+
+	// A bad record before the tail fails Open, rather than
+	// dropping every record after it.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[headerSize] ^= 1
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := Open(path); err == nil {
+		db.Close()
+		t.Fatalf("Open succeeded with a corrupt record mid-file")
+	}
+}
+
+func TestHugeTornHeader(t *testing.T) {
+	path := tempDBPath(t)
+	defer os.Remove(path)
+	db := openDB(t, path)
+	db.Set("good", "value")
+	db.Close()
+
+	// A header claiming more bytes than the file has is a torn
+	// tail, and isn't allocated for.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := appendRecord(nil, opSet, "torn", "record")
+	rec[5], rec[6] = 0x7f, 0xff
+	f.Write(rec)
+	f.Close()
+
+	db = openDB(t, path)
+	defer db.Close()
+	got := fmt.Sprint(keys(db, ""))
+	if want := "[good=value]"; got != want {
+		t.Errorf("after torn header = %s; want %s", got, want)
+	}
+}
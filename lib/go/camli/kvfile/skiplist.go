@@ -0,0 +1,120 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvfile
+
+import (
+	"rand"
+)
+
+const maxLevel = 24
+
+type node struct {
+	key, value string
+	next       []*node
+}
+
+// skiplist is the in-memory ordered map backing a DB.
+// It's not safe for concurrent use; DB provides the locking.
+type skiplist struct {
+	head  *node
+	level int
+	n     int
+	rnd   *rand.Rand
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(1)),
+	}
+}
+
+func (s *skiplist) randomLevel() int {
+	level := 1
+	for level < maxLevel && s.rnd.Int63()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// findGE returns the first node with a key >= key, or nil.  If
+// update is non-nil, it's populated with the rightmost node at each
+// level whose key is < key.
+func (s *skiplist) findGE(key string, update []*node) *node {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *skiplist) get(key string) (value string, ok bool) {
+	x := s.findGE(key, nil)
+	if x != nil && x.key == key {
+		return x.value, true
+	}
+	return "", false
+}
+
+// set sets key to value, returning the previous value, if any.
+func (s *skiplist) set(key, value string) (old string, existed bool) {
+	update := make([]*node, maxLevel)
+	x := s.findGE(key, update)
+	if x != nil && x.key == key {
+		old, x.value = x.value, value
+		return old, true
+	}
+	level := s.randomLevel()
+	if level > s.level {
+		for i := s.level; i < level; i++ {
+			update[i] = s.head
+		}
+		s.level = level
+	}
+	x = &node{key: key, value: value, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	s.n++
+	return "", false
+}
+
+// delete removes key, returning its previous value, if any.
+func (s *skiplist) delete(key string) (old string, existed bool) {
+	update := make([]*node, maxLevel)
+	x := s.findGE(key, update)
+	if x == nil || x.key != key {
+		return "", false
+	}
+	for i := 0; i < len(x.next); i++ {
+		if update[i].next[i] == x {
+			update[i].next[i] = x.next[i]
+		}
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.n--
+	return x.value, true
+}
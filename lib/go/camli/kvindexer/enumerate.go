@@ -0,0 +1,76 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvindexer
+
+import (
+	"os"
+	"strconv"
+
+	"camli/blobref"
+)
+
+func (ix *Indexer) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	it := ix.db.Find(key("have", after))
+	n := uint(0)
+	for n < limit && it.Next() {
+		parts := unkey(it.Key())
+		if len(parts) != 2 || parts[0] != "have" {
+			break
+		}
+		if parts[1] == after {
+			continue
+		}
+		sb, ok := sizedBlobRef(parts[1], it.Value())
+		if !ok {
+			continue
+		}
+		dest <- sb
+		n++
+	}
+	return nil
+}
+
+func (ix *Indexer) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
+	for _, br := range blobs {
+		v, err := ix.db.Get(key("have", br.String()))
+		if err == os.ENOENT {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if sb, ok := sizedBlobRef(br.String(), v); ok {
+			dest <- sb
+		}
+	}
+	return nil
+}
+
+// sizedBlobRef parses a "have" row.
+func sizedBlobRef(blobstr, value string) (sb blobref.SizedBlobRef, ok bool) {
+	br := blobref.Parse(blobstr)
+	vals := unkey(value)
+	if br == nil || len(vals) != 2 {
+		return
+	}
+	size, err := strconv.Atoi64(vals[0])
+	if err != nil {
+		return
+	}
+	return blobref.SizedBlobRef{BlobRef: br, Size: size}, true
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kvindexer implements search.Index on top of kvfile, an
+// embedded key/value store, so small installations can run an
+// indexer without an external database server.
+package kvindexer
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"url"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonconfig"
+	"camli/kvfile"
+)
+
+// Index rows.  All key components are escaped with url.QueryEscape
+// and joined with '|'.
+//
+//   have|<blobref> = <size>|<mime>
+//   signerkeyid|<signer blobref> = <GPG keyid>
+//   pnsigner|<permanode> = <signer blobref>
+//   pnlastmod|<permanode> = <claimdate>
+//   recpn|<signer>|<reverse time>|<permanode> = ""
+//   claim|<permanode>|<signer>|<claimdate>|<claimref> = <type>|<attr>|<value>
+//   signerattrvalue|<keyid>|<attr>|<value>|<reverse time>|<claimref> = <permanode>
+//   path|<keyid>|<base>|<suffix>|<claimdate>|<claimref> = <Y or N>|<target>
+//   pathtarget|<keyid>|<target>|<claimdate>|<claimref> = <Y or N>|<base>|<suffix>
+//   fileinfo|<file schemaref> = <size>|<filename>|<mime>
+//   wholetofile|<whole digest>|<file schemaref> = ""
+//   contentword|<word>|<file schemaref> = ""
+//   contentof|<keyid>|<file schemaref>|<claimdate>|<claimref> = <permanode>
+
+type Indexer struct {
+	*blobserver.SimpleBlobHubPartitionMap
+
+	KeyFetcher blobref.StreamingFetcher // for verifying claims
+
+	// Used for fetching blobs to find the complete sha1 of schema
+	// blobs.
+	BlobSource blobserver.Storage
+
+	db *kvfile.DB
+
+	mu sync.Mutex // guards read-modify-write of permanode rows
+}
+
+// New returns an Indexer storing its rows in the kvfile at path.
+// The caller must set BlobSource and KeyFetcher.
+func New(path string) (*Indexer, os.Error) {
+	db, err := kvfile.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Indexer{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		db:                        db,
+	}, nil
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	blobPrefix := config.RequiredString("blobSource")
+	file := config.RequiredString("file")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	sto, err := ld.GetStorage(blobPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	indexer, err := New(file)
+	if err != nil {
+		return nil, err
+	}
+	indexer.BlobSource = sto
+
+	// Good enough, for now:
+	indexer.KeyFetcher = indexer.BlobSource
+
+	return indexer, nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("kvindexer", blobserver.StorageConstructor(newFromConfig))
+}
+
+// Close closes the underlying key/value file.
+func (ix *Indexer) Close() os.Error {
+	return ix.db.Close()
+}
+
+func (ix *Indexer) FetchStreaming(blob *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	return nil, 0, os.NewError("Fetch isn't supported by the kv indexer")
+}
+
+func (ix *Indexer) RemoveBlobs(blobs []*blobref.BlobRef) os.Error {
+	return os.NewError("RemoveBlobs isn't supported by the kv indexer")
+}
+
+// key returns the row key (or value) made of parts.
+func key(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = url.QueryEscape(p)
+	}
+	return strings.Join(escaped, "|")
+}
+
+// prefix returns the key prefix shared by all rows beginning with
+// parts.
+func prefix(parts ...string) string {
+	return key(parts...) + "|"
+}
+
+// unkey splits a row key (or value) made by key back into its
+// parts.  It returns nil if any part is malformed.
+func unkey(s string) []string {
+	parts := strings.Split(s, "|")
+	for i, p := range parts {
+		u, err := url.QueryUnescape(p)
+		if err != nil {
+			return nil
+		}
+		parts[i] = u
+	}
+	return parts
+}
+
+// scan calls fn with the unescaped parts of each row key beginning
+// with pfx, and the row's value, until fn returns false.
+func (ix *Indexer) scan(pfx string, fn func(parts []string, value string) bool) {
+	ix.scanAfter(pfx, "", fn)
+}
+
+// scanAfter is like scan, but skips rows up to and including the
+// row key after, if it's non-empty.
+func (ix *Indexer) scanAfter(pfx, after string, fn func(parts []string, value string) bool) {
+	start := pfx
+	if after > pfx {
+		start = after + "\x00"
+	}
+	it := ix.db.Find(start)
+	for it.Next() {
+		k := it.Key()
+		if !strings.HasPrefix(k, pfx) {
+			return
+		}
+		parts := unkey(k)
+		if parts == nil {
+			continue
+		}
+		if !fn(parts, it.Value()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,256 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvindexer
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/jsonsign"
+	"camli/schema"
+	"camli/search"
+	"camli/test"
+	. "camli/test/asserts"
+)
+
+const secringPath = "../jsonsign/testdata/test-secring.gpg"
+
+type indexHarness struct {
+	t       *testing.T
+	ix      *Indexer
+	path    string
+	fetcher *test.Fetcher
+	pubKey  *test.Blob
+	clock   int64
+}
+
+func newHarness(t *testing.T) *indexHarness {
+	path := fmt.Sprintf("%s/camli-kvindexer-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	ix, err := New(path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	entity, err := jsonsign.EntityFromSecring("26F5ABDA", secringPath)
+	if err != nil {
+		t.Fatalf("EntityFromSecring: %v", err)
+	}
+	armored, err := jsonsign.ArmoredPublicKey(entity)
+	if err != nil {
+		t.Fatalf("ArmoredPublicKey: %v", err)
+	}
+	h := &indexHarness{
+		t:       t,
+		ix:      ix,
+		path:    path,
+		fetcher: new(test.Fetcher),
+		pubKey:  &test.Blob{armored},
+		clock:   1322443956 * 1e9,
+	}
+	ix.KeyFetcher = h.fetcher
+	h.upload(h.pubKey)
+	return h
+}
+
+func (h *indexHarness) close() {
+	h.ix.Close()
+	os.Remove(h.path)
+}
+
+func (h *indexHarness) upload(b *test.Blob) *blobref.BlobRef {
+	h.fetcher.AddBlob(b)
+	br := b.BlobRef()
+	if _, err := h.ix.ReceiveBlob(br, b.Reader()); err != nil {
+		h.t.Fatalf("ReceiveBlob(%s): %v", br, err)
+	}
+	return br
+}
+
+func (h *indexHarness) nextDate() string {
+	h.clock += 1e9
+	return schema.RFC3339FromNanos(h.clock)
+}
+
+func (h *indexHarness) sign(m map[string]interface{}) *blobref.BlobRef {
+	m["camliSigner"] = h.pubKey.BlobRef().String()
+	if _, ok := m["claimDate"]; ok {
+		m["claimDate"] = h.nextDate()
+	}
+	unsigned, err := schema.MapToCamliJson(m)
+	if err != nil {
+		h.t.Fatalf("MapToCamliJson: %v", err)
+	}
+	sr := &jsonsign.SignRequest{
+		UnsignedJson:      unsigned,
+		Fetcher:           h.fetcher,
+		ServerMode:        true,
+		SecretKeyringPath: secringPath,
+	}
+	signed, err := sr.Sign()
+	if err != nil {
+		h.t.Fatalf("Sign: %v", err)
+	}
+	return h.upload(&test.Blob{signed})
+}
+
+func (h *indexHarness) newPermanode() *blobref.BlobRef {
+	return h.sign(schema.NewUnsignedPermanode())
+}
+
+func (h *indexHarness) setAttribute(pn *blobref.BlobRef, attr, value string) *blobref.BlobRef {
+	return h.sign(schema.NewSetAttributeClaim(pn, attr, value))
+}
+
+func TestBlobMeta(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	blob := &test.Blob{"hello"}
+	br := h.upload(blob)
+	mime, size, err := h.ix.GetBlobMimeType(br)
+	AssertNil(t, err, "GetBlobMimeType")
+	ExpectString(t, "", mime, "mime of plain text blob")
+	ExpectInt(t, 5, int(size), "size")
+
+	_, _, err = h.ix.GetBlobMimeType(blobref.MustParse("sha1-0000000000000000000000000000000000000000"))
+	Expect(t, err == os.ENOENT, "ENOENT for unknown blob")
+
+	ch := make(chan blobref.SizedBlobRef, 10)
+	err = h.ix.StatBlobs(ch, []*blobref.BlobRef{br}, 0)
+	AssertNil(t, err, "StatBlobs")
+	sb := <-ch
+	blob.AssertMatches(t, &sb)
+
+	enumc := make(chan blobref.SizedBlobRef, 10)
+	err = h.ix.EnumerateBlobs(enumc, "", 10, 0)
+	AssertNil(t, err, "EnumerateBlobs")
+	n := 0
+	last := ""
+	for sb := range enumc {
+		Expect(t, sb.BlobRef.String() > last, "sorted enumeration")
+		last = sb.BlobRef.String()
+		n++
+	}
+	ExpectInt(t, 2, n, "enumerated blobs (public key + hello)")
+}
+
+func TestPermanodes(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	pn1 := h.newPermanode()
+	pn2 := h.newPermanode()
+	h.setAttribute(pn1, "tag", "Vacation")
+	h.setAttribute(pn2, "title", "My vacation photos")
+	h.setAttribute(pn1, "title", "Beach")
+
+	signer := h.pubKey.BlobRef()
+
+	// Recent permanodes, most recently modified first.
+	ch := make(chan *search.Result, 10)
+	err := h.ix.GetRecentPermanodes(ch, []*blobref.BlobRef{signer}, 10, "")
+	AssertNil(t, err, "GetRecentPermanodes")
+	var got []string
+	for r := range ch {
+		got = append(got, r.BlobRef.String())
+	}
+	ExpectString(t, fmt.Sprint([]string{pn1.String(), pn2.String()}), fmt.Sprint(got), "recent permanodes")
+
+	// The same, a page at a time.
+	got = nil
+	cont := ""
+	for page := 0; page < 3; page++ {
+		ch = make(chan *search.Result, 10)
+		err = h.ix.GetRecentPermanodes(ch, []*blobref.BlobRef{signer}, 1, cont)
+		AssertNil(t, err, "GetRecentPermanodes page")
+		for r := range ch {
+			got = append(got, r.BlobRef.String())
+			cont = r.Continue
+		}
+	}
+	ExpectString(t, fmt.Sprint([]string{pn1.String(), pn2.String()}), fmt.Sprint(got), "paged recent permanodes")
+	err = h.ix.GetRecentPermanodes(make(chan *search.Result, 10), []*blobref.BlobRef{signer}, 1, "bogus!")
+	Expect(t, err == search.ErrBadContinue, "bogus continuation token rejected")
+
+	claims, err := h.ix.GetOwnerClaims(pn1, signer)
+	AssertNil(t, err, "GetOwnerClaims")
+	ExpectInt(t, 2, len(claims), "claims on pn1")
+
+	pn, err := h.ix.PermanodeOfSignerAttrValue(signer, "tag", "Vacation")
+	AssertNil(t, err, "PermanodeOfSignerAttrValue")
+	ExpectString(t, pn1.String(), pn.String(), "permanode with tag")
+
+	brch := make(chan *search.Result, 10)
+	err = h.ix.SearchPermanodesWithAttr(brch, &search.PermanodeByAttrRequest{
+		Signer:     signer,
+		Query:      "vacation",
+		FuzzyMatch: true,
+	})
+	AssertNil(t, err, "SearchPermanodesWithAttr")
+	n := 0
+	for _ = range brch {
+		n++
+	}
+	ExpectInt(t, 2, n, "fuzzy matches of \"vacation\"")
+
+	// Page through the fuzzy matches, one at a time.
+	seen := make(map[string]bool)
+	cont = ""
+	for page := 0; page < 3; page++ {
+		brch = make(chan *search.Result, 10)
+		err = h.ix.SearchPermanodesWithAttr(brch, &search.PermanodeByAttrRequest{
+			Signer:     signer,
+			Query:      "vacation",
+			FuzzyMatch: true,
+			MaxResults: 1,
+			Continue:   cont,
+		})
+		AssertNil(t, err, "SearchPermanodesWithAttr page")
+		for r := range brch {
+			seen[r.BlobRef.String()] = true
+			cont = r.Continue
+		}
+	}
+	Expect(t, seen[pn1.String()] && seen[pn2.String()], "paged fuzzy matches found both permanodes")
+}
+
+func TestPaths(t *testing.T) {
+	h := newHarness(t)
+	defer h.close()
+
+	base := h.newPermanode()
+	target1 := h.newPermanode()
+	target2 := h.newPermanode()
+	signer := h.pubKey.BlobRef()
+
+	h.setAttribute(base, "camliPath:foo", target1.String())
+	h.setAttribute(base, "camliPath:foo", target2.String())
+
+	paths, err := h.ix.PathsLookup(signer, base, "foo")
+	AssertNil(t, err, "PathsLookup")
+	ExpectInt(t, 2, len(paths), "paths for foo")
+
+	path, err := h.ix.PathLookup(signer, base, "foo", nil)
+	AssertNil(t, err, "PathLookup")
+	ExpectString(t, target2.String(), path.Target.String(), "most recent target")
+
+	paths, err = h.ix.PathsOfSignerTarget(signer, target1)
+	AssertNil(t, err, "PathsOfSignerTarget")
+	ExpectInt(t, 1, len(paths), "paths to target1")
+}
@@ -0,0 +1,257 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvindexer
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"json"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"camli/blobref"
+	"camli/blobserver"
+	"camli/jsonsign"
+	"camli/kvfile"
+	"camli/magic"
+	"camli/schema"
+	"camli/search"
+)
+
+// maxSniffSize is how much of a blob to buffer in memory for both
+// MIME sniffing and for holding a schema blob in memory for
+// analysis in later steps.
+const maxSniffSize = 1024 * 1024
+
+type blobSniffer struct {
+	header   []byte
+	written  int64
+	camli    *schema.Superset
+	mimeType string
+}
+
+func (sn *blobSniffer) Write(d []byte) (int, os.Error) {
+	sn.written += int64(len(d))
+	if len(sn.header) < maxSniffSize {
+		n := maxSniffSize - len(sn.header)
+		if len(d) < n {
+			n = len(d)
+		}
+		sn.header = append(sn.header, d[:n]...)
+	}
+	return len(d), nil
+}
+
+func (sn *blobSniffer) IsTruncated() bool {
+	return sn.written > maxSniffSize
+}
+
+func (sn *blobSniffer) Body() (string, os.Error) {
+	if sn.IsTruncated() {
+		return "", os.NewError("was truncated")
+	}
+	return string(sn.header), nil
+}
+
+func (sn *blobSniffer) Parse() {
+	if len(sn.header) >= 2 && sn.header[0] == '{' {
+		camli := new(schema.Superset)
+		if err := json.Unmarshal(sn.header, camli); err == nil {
+			sn.camli = camli
+			sn.mimeType = "application/json; camliType=" + camli.Type
+		}
+	}
+	if mime := magic.MimeType(sn.header); mime != "" {
+		sn.mimeType = mime
+	}
+}
+
+// reverseTime returns a fixed-width string which sorts in reverse
+// chronological order of the RFC 3339 time t.
+func reverseTime(t string) string {
+	nanos := schema.NanosFromRFC3339(t)
+	if nanos < 0 {
+		nanos = 0
+	}
+	return fmt.Sprintf("%019d", math.MaxInt64-nanos)
+}
+
+func (ix *Indexer) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (retsb blobref.SizedBlobRef, err os.Error) {
+	sniffer := new(blobSniffer)
+	hash := blobRef.Hash()
+	var written int64
+	written, err = io.Copy(io.MultiWriter(hash, sniffer), source)
+	if err != nil {
+		return
+	}
+
+	if !blobRef.HashMatches(hash) {
+		err = blobserver.ErrCorruptBlob
+		return
+	}
+
+	sniffer.Parse()
+
+	b := ix.db.BeginBatch()
+	camli := sniffer.camli
+	if camli != nil {
+		switch camli.Type {
+		case "claim":
+			ix.populateClaim(b, blobRef, camli, sniffer)
+		case "file":
+			if err = ix.populateFile(b, blobRef, camli); err != nil {
+				return
+			}
+		}
+	}
+	b.Set(key("have", blobRef.String()), key(strconv.Itoa64(written), sniffer.mimeType))
+
+	// The permanode rows below are read-modify-write, so
+	// serialize them with the commit.
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if camli != nil {
+		switch camli.Type {
+		case "claim":
+			ix.updateLastMod(b, camli)
+		case "permanode":
+			ix.populatePermanode(b, blobRef, camli)
+		}
+	}
+	if err = ix.db.CommitBatch(b); err != nil {
+		log.Printf("kvindexer: commit of %s: %v", blobRef, err)
+		return
+	}
+
+	retsb = blobref.SizedBlobRef{BlobRef: blobRef, Size: written}
+	return
+}
+
+func (ix *Indexer) populateClaim(b *kvfile.Batch, blobRef *blobref.BlobRef, camli *schema.Superset, sniffer *blobSniffer) {
+	pnBlobref := blobref.Parse(camli.Permanode)
+	if pnBlobref == nil {
+		// Skip bogus claim with malformed permanode.
+		return
+	}
+	pn := pnBlobref.String()
+
+	verifiedKeyId := ""
+	if rawJson, err := sniffer.Body(); err == nil {
+		vr := jsonsign.NewVerificationRequest(rawJson, ix.KeyFetcher)
+		if vr.Verify() {
+			verifiedKeyId = vr.SignerKeyId
+			b.Set(key("signerkeyid", vr.CamliSigner.String()), verifiedKeyId)
+		} else {
+			log.Printf("kvindexer: verification failure on claim %s: %v", blobRef, vr.Err)
+		}
+	}
+
+	b.Set(key("claim", pn, camli.Signer, camli.ClaimDate, blobRef.String()),
+		key(camli.ClaimType, camli.Attribute, camli.Value))
+
+	if verifiedKeyId == "" {
+		return
+	}
+	switch {
+	case search.IsIndexedAttribute(camli.Attribute):
+		b.Set(key("signerattrvalue", verifiedKeyId, camli.Attribute, camli.Value,
+			reverseTime(camli.ClaimDate), blobRef.String()), pn)
+	case camli.Attribute == "camliContent":
+		if camli.Value != "" {
+			b.Set(key("contentof", verifiedKeyId, camli.Value, camli.ClaimDate, blobRef.String()), pn)
+		}
+	}
+	if strings.HasPrefix(camli.Attribute, "camliPath:") {
+		suffix := camli.Attribute[len("camliPath:"):]
+		active := "Y"
+		if camli.ClaimType == "del-attribute" {
+			active = "N"
+		}
+		b.Set(key("path", verifiedKeyId, pn, suffix, camli.ClaimDate, blobRef.String()),
+			key(active, camli.Value))
+		b.Set(key("pathtarget", verifiedKeyId, camli.Value, camli.ClaimDate, blobRef.String()),
+			key(active, pn, suffix))
+	}
+}
+
+// updateLastMod bumps the lastmod of the claim's permanode, if the
+// claim is newer.  ix.mu must be held.
+func (ix *Indexer) updateLastMod(b *kvfile.Batch, camli *schema.Superset) {
+	pnBlobref := blobref.Parse(camli.Permanode)
+	if pnBlobref == nil {
+		return
+	}
+	pn := pnBlobref.String()
+	lastMod, _ := ix.db.Get(key("pnlastmod", pn))
+	if camli.ClaimDate <= lastMod {
+		return
+	}
+	b.Set(key("pnlastmod", pn), camli.ClaimDate)
+	if signer, err := ix.db.Get(key("pnsigner", pn)); err == nil {
+		if lastMod != "" {
+			b.Delete(key("recpn", signer, reverseTime(lastMod), pn))
+		}
+		b.Set(key("recpn", signer, reverseTime(camli.ClaimDate), pn), camli.ClaimDate)
+	}
+}
+
+// populatePermanode adds to b the rows for the permanode blobRef.
+// ix.mu must be held.
+func (ix *Indexer) populatePermanode(b *kvfile.Batch, blobRef *blobref.BlobRef, camli *schema.Superset) {
+	pn := blobRef.String()
+	b.Set(key("pnsigner", pn), camli.Signer)
+	if lastMod, err := ix.db.Get(key("pnlastmod", pn)); err == nil {
+		b.Set(key("recpn", camli.Signer, reverseTime(lastMod), pn), lastMod)
+	}
+}
+
+// populateFile adds to b the rows for the file schema blob blobRef.
+func (ix *Indexer) populateFile(b *kvfile.Batch, blobRef *blobref.BlobRef, ss *schema.Superset) os.Error {
+	seekFetcher, err := blobref.SeekerFromStreamingFetcher(ix.BlobSource)
+	if err != nil {
+		return err
+	}
+
+	sha1 := sha1.New()
+	fr, err := ss.NewFileReader(seekFetcher)
+	if err != nil {
+		log.Printf("kvindexer: error indexing file %s: %v", blobRef, err)
+		return nil
+	}
+	mime, reader := magic.MimeTypeFromReader(fr)
+	text := new(search.ContentText)
+	n, err := io.Copy(io.MultiWriter(sha1, text), reader)
+	if err != nil {
+		// TODO: job scheduling system to retry this, as in
+		// mysqlindexer. For now just log and act like all's
+		// okay.
+		log.Printf("kvindexer: error indexing file %s: %v", blobRef, err)
+		return nil
+	}
+
+	wholeRef := blobref.FromHash("sha1", sha1)
+	b.Set(key("wholetofile", wholeRef.String(), blobRef.String()), "")
+	b.Set(key("fileinfo", blobRef.String()), key(strconv.Itoa64(n), ss.FileNameString(), mime))
+	for _, w := range text.Words(ss.FileNameString(), mime) {
+		b.Set(key("contentword", w, blobRef.String()), "")
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvindexer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/schema"
+	"camli/search"
+)
+
+// Statically verify that Indexer implements the search.Index interface.
+var _ search.Index = (*Indexer)(nil)
+
+// defaultLimit is the number of results returned when the caller
+// doesn't specify a limit.
+const defaultLimit = 50
+
+func parseTime(s string) (*time.Time, os.Error) {
+	nanos := schema.NanosFromRFC3339(s)
+	if nanos < 0 {
+		return nil, fmt.Errorf("kvindexer: bogus time %q", s)
+	}
+	return time.SecondsToUTC(nanos / 1e9), nil
+}
+
+// continueAfter returns the row key held by a continuation token
+// made by continueToken, checking that it begins with pfx.
+func continueAfter(cont, pfx string) (string, os.Error) {
+	if cont == "" {
+		return "", nil
+	}
+	parts, err := search.DecodeContinue(cont, 1)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(parts[0], pfx) {
+		return "", search.ErrBadContinue
+	}
+	return parts[0], nil
+}
+
+// continueToken returns a continuation token resuming a scan after
+// the row whose key has the given parts.
+func continueToken(parts []string) string {
+	return search.EncodeContinue(key(parts...))
+}
+
+func (ix *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobref.BlobRef, limit int, cont string) os.Error {
+	defer close(dest)
+	if len(owner) == 0 {
+		return nil
+	}
+	if len(owner) > 1 {
+		return os.NewError("kvindexer: GetRecentPermanodes supports only one owner")
+	}
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+
+	signer := owner[0]
+	pfx := prefix("recpn", signer.String())
+	after, err := continueAfter(cont, pfx)
+	if err != nil {
+		return err
+	}
+	sent := 0
+	ix.scanAfter(pfx, after, func(parts []string, value string) bool {
+		if len(parts) != 4 {
+			return true
+		}
+		br := blobref.Parse(parts[3])
+		t, err := parseTime(value)
+		if br == nil || err != nil {
+			return true
+		}
+		dest <- &search.Result{
+			BlobRef:     br,
+			Signer:      signer,
+			LastModTime: t.Seconds(),
+			Continue:    continueToken(parts),
+		}
+		sent++
+		return sent < limit
+	})
+	return nil
+}
+
+func (ix *Indexer) GetOwnerClaims(permanode, owner *blobref.BlobRef) (claims search.ClaimList, err os.Error) {
+	claims = make(search.ClaimList, 0)
+	ix.scan(prefix("claim", permanode.String(), owner.String()), func(parts []string, value string) bool {
+		vals := unkey(value)
+		if len(parts) != 5 || len(vals) != 3 {
+			return true
+		}
+		t, err := parseTime(parts[3])
+		if err != nil {
+			return true
+		}
+		claims = append(claims, &search.Claim{
+			BlobRef:   blobref.Parse(parts[4]),
+			Signer:    owner,
+			Permanode: permanode,
+			Type:      vals[0],
+			Date:      t,
+			Attr:      vals[1],
+			Value:     vals[2],
+		})
+		return true
+	})
+	return
+}
+
+func (ix *Indexer) GetBlobMimeType(blob *blobref.BlobRef) (mime string, size int64, err os.Error) {
+	v, err := ix.db.Get(key("have", blob.String()))
+	if err != nil {
+		return
+	}
+	vals := unkey(v)
+	if len(vals) != 2 {
+		return "", 0, fmt.Errorf("kvindexer: bogus have row for %s: %q", blob, v)
+	}
+	size, err = strconv.Atoi64(vals[0])
+	return vals[1], size, err
+}
+
+// fuzzyAttrs are the attributes searched when a
+// PermanodeByAttrRequest doesn't name one.
+var fuzzyAttrs = []string{"tag", "title"}
+
+func (ix *Indexer) SearchPermanodesWithAttr(dest chan<- *search.Result, request *search.PermanodeByAttrRequest) os.Error {
+	defer close(dest)
+	keyId, err := ix.keyIdOfSigner(request.Signer)
+	if err != nil {
+		return err
+	}
+	limit := request.MaxResults
+	if limit <= 0 {
+		limit = defaultLimit
+	}
+	after, err := continueAfter(request.Continue, prefix("signerattrvalue", keyId))
+	if err != nil {
+		return err
+	}
+
+	// Permanodes are unique within a page, but may reappear on
+	// later pages if they have several matching claims.
+	seen := make(map[string]bool)
+	send := func(parts []string, pn string) bool {
+		if seen[pn] {
+			return true
+		}
+		seen[pn] = true
+		if br := blobref.Parse(pn); br != nil {
+			dest <- &search.Result{BlobRef: br, Continue: continueToken(parts)}
+		}
+		return len(seen) < limit
+	}
+
+	if !request.FuzzyMatch {
+		ix.scanAfter(prefix("signerattrvalue", keyId, request.Attribute, request.Query), after, send)
+		return nil
+	}
+
+	attrs := fuzzyAttrs // sorted, so rows are scanned in key order
+	if request.Attribute != "" {
+		attrs = []string{request.Attribute}
+	}
+	query := strings.ToLower(request.Query)
+	for _, attr := range attrs {
+		more := true
+		pfx := prefix("signerattrvalue", keyId, attr)
+		if after > pfx && !strings.HasPrefix(after, pfx) {
+			// Finished on a previous page.
+			continue
+		}
+		ix.scanAfter(pfx, after, func(parts []string, pn string) bool {
+			if len(parts) != 6 || !strings.Contains(strings.ToLower(parts[3]), query) {
+				return true
+			}
+			more = send(parts, pn)
+			return more
+		})
+		if !more {
+			break
+		}
+	}
+	return nil
+}
+
+func (ix *Indexer) SearchPermanodesWithContent(dest chan<- *search.Result, request *search.PermanodeByContentRequest) os.Error {
+	defer close(dest)
+	words := search.TextWords(request.Query)
+	if len(words) == 0 {
+		return nil
+	}
+	keyId, err := ix.keyIdOfSigner(request.Signer)
+	if err != nil {
+		return err
+	}
+
+	// Files containing the first word, then all of the others.
+	var files []string
+	ix.scan(prefix("contentword", words[0]), func(parts []string, _ string) bool {
+		if len(parts) == 3 {
+			files = append(files, parts[2])
+		}
+		return true
+	})
+	sent := make(map[string]bool)
+	for _, file := range files {
+		if !ix.fileHasWords(file, words[1:]) {
+			continue
+		}
+		var pns []string
+		ix.scan(prefix("contentof", keyId, file), func(_ []string, pn string) bool {
+			pns = append(pns, pn)
+			return true
+		})
+		for _, pn := range pns {
+			if sent[pn] || ix.currentContent(pn, request.Signer.String()) != file {
+				continue
+			}
+			br := blobref.Parse(pn)
+			if br == nil {
+				continue
+			}
+			sent[pn] = true
+			dest <- &search.Result{BlobRef: br}
+			if request.MaxResults > 0 && len(sent) == request.MaxResults {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (ix *Indexer) fileHasWords(file string, words []string) bool {
+	for _, w := range words {
+		if _, err := ix.db.Get(key("contentword", w, file)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// currentContent returns the camliContent of permanode pn by signer,
+// or the empty string if none.
+func (ix *Indexer) currentContent(pn, signer string) (content string) {
+	ix.scan(prefix("claim", pn, signer), func(_ []string, value string) bool {
+		v := unkey(value)
+		if len(v) != 3 || v[1] != "camliContent" {
+			return true
+		}
+		switch v[0] {
+		case "set-attribute", "add-attribute":
+			content = v[2]
+		case "del-attribute":
+			if v[2] == "" || v[2] == content {
+				content = ""
+			}
+		}
+		return true
+	})
+	return
+}
+
+func (ix *Indexer) ExistingFileSchemas(wholeDigest *blobref.BlobRef) (files []*blobref.BlobRef, err os.Error) {
+	ix.scan(prefix("wholetofile", wholeDigest.String()), func(parts []string, _ string) bool {
+		if len(parts) == 3 {
+			if br := blobref.Parse(parts[2]); br != nil {
+				files = append(files, br)
+			}
+		}
+		return true
+	})
+	return
+}
+
+func (ix *Indexer) GetFileInfo(fileRef *blobref.BlobRef) (*search.FileInfo, os.Error) {
+	v, err := ix.db.Get(key("fileinfo", fileRef.String()))
+	if err != nil {
+		return nil, err
+	}
+	vals := unkey(v)
+	if len(vals) != 3 {
+		return nil, fmt.Errorf("kvindexer: bogus fileinfo row for %s: %q", fileRef, v)
+	}
+	size, err := strconv.Atoi64(vals[0])
+	if err != nil {
+		return nil, err
+	}
+	return &search.FileInfo{
+		Size:     size,
+		FileName: vals[1],
+		MimeType: vals[2],
+	}, nil
+}
+
+func (ix *Indexer) keyIdOfSigner(signer *blobref.BlobRef) (keyid string, err os.Error) {
+	keyid, err = ix.db.Get(key("signerkeyid", signer.String()))
+	if err == os.ENOENT {
+		err = fmt.Errorf("kvindexer: failed to find keyid of signer %q", signer.String())
+	}
+	return
+}
+
+func (ix *Indexer) PermanodeOfSignerAttrValue(signer *blobref.BlobRef, attr, val string) (permanode *blobref.BlobRef, err os.Error) {
+	keyId, err := ix.keyIdOfSigner(signer)
+	if err != nil {
+		return nil, err
+	}
+	ix.scan(prefix("signerattrvalue", keyId, attr, val), func(parts []string, pn string) bool {
+		permanode = blobref.Parse(pn)
+		return permanode == nil
+	})
+	if permanode == nil {
+		return nil, os.ENOENT
+	}
+	return permanode, nil
+}
+
+func (ix *Indexer) PathsOfSignerTarget(signer, target *blobref.BlobRef) (paths []*search.Path, err os.Error) {
+	keyId, err := ix.keyIdOfSigner(signer)
+	if err != nil {
+		return
+	}
+
+	mostRecent := make(map[string]*search.Path)
+	maxClaimDates := make(map[string]string)
+	ix.scan(prefix("pathtarget", keyId, target.String()), func(parts []string, value string) bool {
+		vals := unkey(value)
+		if len(parts) != 5 || len(vals) != 3 {
+			return true
+		}
+		claimDate, claimRef := parts[3], parts[4]
+		active, baseRef, suffix := vals[0], vals[1], vals[2]
+		pathKey := baseRef + "/" + suffix
+		if claimDate > maxClaimDates[pathKey] {
+			maxClaimDates[pathKey] = claimDate
+			if active == "Y" {
+				mostRecent[pathKey] = &search.Path{
+					Claim:     blobref.MustParse(claimRef),
+					ClaimDate: claimDate,
+					Base:      blobref.MustParse(baseRef),
+					Target:    target,
+					Suffix:    suffix,
+				}
+			} else {
+				mostRecent[pathKey] = nil, false
+			}
+		}
+		return true
+	})
+	paths = make([]*search.Path, 0)
+	for _, v := range mostRecent {
+		paths = append(paths, v)
+	}
+	return paths, nil
+}
+
+func (ix *Indexer) PathLookup(signer, base *blobref.BlobRef, suffix string, at *time.Time) (*search.Path, os.Error) {
+	paths, err := ix.PathsLookup(signer, base, suffix)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		newest    = int64(0)
+		atSeconds = int64(0)
+		best      *search.Path
+	)
+	if at != nil {
+		atSeconds = at.Seconds()
+	}
+	for _, path := range paths {
+		t, err := parseTime(path.ClaimDate)
+		if err != nil {
+			continue
+		}
+		secs := t.Seconds()
+		if atSeconds != 0 && secs > atSeconds {
+			// Too new
+			continue
+		}
+		if newest > secs {
+			// Too old
+			continue
+		}
+		// Just right
+		newest, best = secs, path
+	}
+	if best == nil {
+		return nil, os.ENOENT
+	}
+	return best, nil
+}
+
+func (ix *Indexer) PathsLookup(signer, base *blobref.BlobRef, suffix string) (paths []*search.Path, err os.Error) {
+	keyId, err := ix.keyIdOfSigner(signer)
+	if err != nil {
+		return
+	}
+	ix.scan(prefix("path", keyId, base.String(), suffix), func(parts []string, value string) bool {
+		vals := unkey(value)
+		if len(parts) != 6 || len(vals) != 2 {
+			return true
+		}
+		paths = append(paths, &search.Path{
+			Claim:     blobref.Parse(parts[5]),
+			ClaimDate: parts[4],
+			Base:      base,
+			Target:    blobref.Parse(vals[1]),
+			Suffix:    suffix,
+		})
+		return true
+	})
+	return
+}
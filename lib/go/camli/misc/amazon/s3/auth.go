@@ -27,6 +27,7 @@ import (
 	"sort"
 	"strings"
 	"time"
+	"url"
 )
 
 var _ = log.Printf
@@ -38,12 +39,20 @@ type Auth struct {
 	SecretAccessKey string
 }
 
+// SignRequest signs req for Amazon's S3 endpoint.
 func (a *Auth) SignRequest(req *http.Request) {
+	a.signRequest(req, standardUSRegionAWS)
+}
+
+// signRequest signs req for the S3 service at endpoint, the host
+// (and optional port) used for path-style requests, and suffixed by
+// the bucket name for virtual-hosted-style ones.
+func (a *Auth) signRequest(req *http.Request, endpoint string) {
 	if date := req.Header.Get("Date"); date == "" {
 		req.Header.Set("Date", time.UTC().Format(http.TimeFormat))
 	}
 	hm := hmac.NewSHA1([]byte(a.SecretAccessKey))
-	ss := stringToSign(req)
+	ss := stringToSign(req, endpoint)
 	io.WriteString(hm, ss)
 
 	authHeader := new(bytes.Buffer)
@@ -71,7 +80,7 @@ func firstNonEmptyString(strs ...string) string {
 //	 Date + "\n" +
 //	 CanonicalizedAmzHeaders +
 //	 CanonicalizedResource;
-func stringToSign(req *http.Request) string {
+func stringToSign(req *http.Request, endpoint string) string {
 	buf := new(bytes.Buffer)
 	buf.WriteString(req.Method)
 	buf.WriteByte('\n')
@@ -84,7 +93,7 @@ func stringToSign(req *http.Request) string {
 	}
 	buf.WriteByte('\n')
 	writeCanonicalizedAmzHeaders(buf, req)
-	writeCanonicalizedResource(buf, req)
+	writeCanonicalizedResource(buf, req, endpoint)
 	return buf.String()
 }
 
@@ -138,28 +147,75 @@ func writeCanonicalizedAmzHeaders(buf *bytes.Buffer, req *http.Request) {
 // CanonicalizedResource = [ "/" + Bucket ] +
 // 	  <HTTP-Request-URI, from the protocol name up to the query string> +
 // 	  [ sub-resource, if present. For example "?acl", "?location", "?logging", or "?torrent"];
-func writeCanonicalizedResource(buf *bytes.Buffer, req *http.Request) {
-	if bucket := bucketFromHostname(req); bucket != "" {
+func writeCanonicalizedResource(buf *bytes.Buffer, req *http.Request, endpoint string) {
+	if bucket := bucketFromHostname(req, endpoint); bucket != "" {
 		buf.WriteByte('/')
 		buf.WriteString(bucket)
 	}
 	buf.WriteString(req.URL.Path)
-	// TODO: subresource
+	writeSubResources(buf, req)
+}
+
+// subResources are the query parameters which are part of the
+// CanonicalizedResource.
+var subResources = map[string]bool{
+	"acl":            true,
+	"location":       true,
+	"logging":        true,
+	"notification":   true,
+	"partNumber":     true,
+	"policy":         true,
+	"requestPayment": true,
+	"torrent":        true,
+	"uploadId":       true,
+	"uploads":        true,
+	"versionId":      true,
+	"versioning":     true,
+	"versions":       true,
+	"website":        true,
+}
+
+func writeSubResources(buf *bytes.Buffer, req *http.Request) {
+	q, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return
+	}
+	var keys []string
+	for k := range q {
+		if subResources[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i == 0 {
+			buf.WriteByte('?')
+		} else {
+			buf.WriteByte('&')
+		}
+		buf.WriteString(k)
+		if v := q.Get(k); v != "" {
+			buf.WriteByte('=')
+			buf.WriteString(v)
+		}
+	}
 }
 
-const standardUSRegionAWSSuffix = ".s3.amazonaws.com"
 const standardUSRegionAWS = "s3.amazonaws.com"
 
-func bucketFromHostname(req *http.Request) string {
+// bucketFromHostname returns the bucket named by req's host, which
+// is either the endpoint itself, a subdomain of the endpoint, or a
+// CNAME for a bucket.
+func bucketFromHostname(req *http.Request, endpoint string) string {
 	host := req.Host
 	if host == "" {
 		host = req.URL.Host
 	}
-	if host == standardUSRegionAWS {
+	if host == endpoint {
 		return ""
 	}
-	if strings.HasSuffix(host, standardUSRegionAWSSuffix) {
-		return host[:len(host)-len(standardUSRegionAWSSuffix)]
+	if strings.HasSuffix(host, "."+endpoint) {
+		return host[:len(host)-len(endpoint)-1]
 	}
 	if lastColon := strings.LastIndex(host, ":"); lastColon != -1 {
 		return host[:lastColon]
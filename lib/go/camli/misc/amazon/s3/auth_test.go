@@ -86,7 +86,7 @@ Content-Length: 5913339
 			"PUT\n4gJE4saaMU4BqNR0kLY+lw==\napplication/x-download\nTue, 27 Mar 2007 21:06:08 +0000\nx-amz-acl:public-read\nx-amz-meta-checksumalgorithm:crc32\nx-amz-meta-filechecksum:0x02661779\nx-amz-meta-reviewedby:joe@johnsmith.net,jane@johnsmith.net\n/static.johnsmith.net/db-backup.dat.gz"},
 	}
 	for idx, test := range tests {
-		got := stringToSign(req(test.req))
+		got := stringToSign(req(test.req), standardUSRegionAWS)
 		if got != test.expected {
 			t.Errorf("test %d: expected %q", idx, test.expected)
 			t.Errorf("test %d:      got %q", idx, got)
@@ -103,13 +103,36 @@ func TestBucketFromHostname(t *testing.T) {
 		{"GET / HTTP/1.0\nHost: bar.com\n\n", "bar.com"},
 	}
 	for idx, test := range tests {
-		got := bucketFromHostname(req(test.req))
+		got := bucketFromHostname(req(test.req), standardUSRegionAWS)
 		if got != test.expected {
 			t.Errorf("test %d: expected %q; got %q", idx, test.expected, got)
 		}
 	}
 }
 
+func TestStringToSignEndpoint(t *testing.T) {
+	tests := []struct {
+		req, endpoint, expected string
+	}{
+		// Path-style.
+		{"PUT /bucket/sha1-abc?partNumber=2&uploadId=xyz HTTP/1.1\nHost: s3.example.com:9000\nDate: Tue, 27 Mar 2007 21:15:45 +0000\n\n",
+			"s3.example.com:9000",
+			"PUT\n\n\nTue, 27 Mar 2007 21:15:45 +0000\n/bucket/sha1-abc?partNumber=2&uploadId=xyz"},
+		// Virtual-hosted-style, with a sub-resource without value
+		// and a query parameter which isn't a sub-resource.
+		{"POST /sha1-abc?uploads&foo=bar HTTP/1.1\nHost: bucket.s3.example.com\nDate: Tue, 27 Mar 2007 21:15:45 +0000\n\n",
+			"s3.example.com",
+			"POST\n\n\nTue, 27 Mar 2007 21:15:45 +0000\n/bucket/sha1-abc?uploads"},
+	}
+	for idx, test := range tests {
+		got := stringToSign(req(test.req), test.endpoint)
+		if got != test.expected {
+			t.Errorf("test %d: expected %q", idx, test.expected)
+			t.Errorf("test %d:      got %q", idx, got)
+		}
+	}
+}
+
 func TestSignRequest(t *testing.T) {
 	r := req("GET /foo HTTP/1.1\n\n")
 	auth := &Auth{"key", "secretkey"}
@@ -27,15 +27,29 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 	"url"
 	"xml"
 )
 
 var _ = log.Printf
 
+// Client is an S3 client.
 type Client struct {
 	*Auth
 	HttpClient *http.Client // or nil for default client
+
+	// Endpoint is the host (and optional port) of the S3 service,
+	// such as "s3.amazonaws.com" (the default, if empty) or an
+	// S3-compatible store's "s3.example.com:9000". It may be
+	// prefixed by "https://" or "http://" (the default).
+	Endpoint string
+
+	// PathStyle, if true, addresses buckets as the first component
+	// of the path ("http://endpoint/bucket/key") rather than as a
+	// subdomain of the endpoint ("http://bucket.endpoint/key").
+	PathStyle bool
 }
 
 type Bucket struct {
@@ -43,6 +57,15 @@ type Bucket struct {
 	CreationDate string // 2006-02-03T16:45:09.000Z
 }
 
+// maxAttempts is how many times a request failing with a network
+// error or a 5xx response is tried, waiting retryBackoff
+// nanoseconds after the first failure and doubling the wait after
+// each of the following ones.
+const (
+	maxAttempts  = 5
+	retryBackoff = 100e6
+)
+
 func (c *Client) httpClient() *http.Client {
 	if c.HttpClient != nil {
 		return c.HttpClient
@@ -50,6 +73,35 @@ func (c *Client) httpClient() *http.Client {
 	return http.DefaultClient
 }
 
+// endpoint returns the scheme and host of the S3 service.
+func (c *Client) endpoint() (scheme, host string) {
+	host = c.Endpoint
+	if host == "" {
+		host = standardUSRegionAWS
+	}
+	scheme = "http"
+	for _, sch := range []string{"http", "https"} {
+		if strings.HasPrefix(host, sch+"://") {
+			scheme, host = sch, host[len(sch)+3:]
+		}
+	}
+	return scheme, strings.TrimRight(host, "/")
+}
+
+// keyURL returns the URL of key in bucket. If key is empty, it's the
+// URL of the bucket. If bucket is empty too, it's the URL of the
+// service.
+func (c *Client) keyURL(bucket, key string) string {
+	scheme, host := c.endpoint()
+	switch {
+	case bucket == "":
+		return scheme + "://" + host + "/"
+	case c.PathStyle:
+		return scheme + "://" + host + "/" + bucket + "/" + key
+	}
+	return scheme + "://" + bucket + "." + host + "/" + key
+}
+
 func newReq(url_ string) *http.Request {
 	req, err := http.NewRequest("GET", url_, nil)
 	if err != nil {
@@ -59,17 +111,79 @@ func newReq(url_ string) *http.Request {
 	return req
 }
 
+// do signs and sends the requests returned by newReq until one
+// gets a response other than a 5xx, trying at most attempts times.
+// newReq is called once per attempt, as a request's body can only
+// be sent once.
+func (c *Client) do(attempts int, newReq func() (*http.Request, os.Error)) (res *http.Response, err os.Error) {
+	backoff := int64(retryBackoff)
+	for try := 1; ; try++ {
+		var req *http.Request
+		req, err = newReq()
+		if err != nil {
+			return nil, err
+		}
+		_, host := c.endpoint()
+		c.Auth.signRequest(req, host)
+		res, err = c.httpClient().Do(req)
+		if err == nil && res.StatusCode < 500 {
+			return res, nil
+		}
+		if try >= attempts {
+			return
+		}
+		if err == nil {
+			log.Printf("s3 client: %s %s: got response code %d; retrying", req.Method, req.URL, res.StatusCode)
+			if res.Body != nil {
+				res.Body.Close()
+			}
+		} else {
+			log.Printf("s3 client: %s %s: %v; retrying", req.Method, req.URL, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	panic("unreachable")
+}
+
+// doNoBody is like do, for method requests to url_ without a body.
+func (c *Client) doNoBody(method, url_ string) (*http.Response, os.Error) {
+	return c.do(maxAttempts, func() (*http.Request, os.Error) {
+		req := newReq(url_)
+		req.Method = method
+		return req, nil
+	})
+}
+
+// responseError returns an error describing the unexpected response
+// res to a request described by what.
+func responseError(what string, res *http.Response) os.Error {
+	slurp, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4<<10))
+	return fmt.Errorf("Amazon HTTP error on %s: %d: %q", what, res.StatusCode, slurp)
+}
+
+type listAllMyBucketsResult struct {
+	Buckets bucketList
+}
+
+type bucketList struct {
+	Bucket []*Bucket
+}
+
 func (c *Client) Buckets() ([]*Bucket, os.Error) {
-	req := newReq("https://s3.amazonaws.com/")
-	c.Auth.SignRequest(req)
-	res, err := c.httpClient().Do(req)
+	res, err := c.doNoBody("GET", c.keyURL("", ""))
 	if err != nil {
 		return nil, err
 	}
-	slurp, _ := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	log.Printf("got: %q", string(slurp))
-	return nil, nil
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError("GET service", res)
+	}
+	var bres listAllMyBucketsResult
+	if err := xml.Unmarshal(res.Body, &bres); err != nil {
+		return nil, err
+	}
+	return bres.Buckets.Bucket, nil
 }
 
 // Returns 0, os.ENOENT if not on S3, otherwise reterr is real.
@@ -77,46 +191,63 @@ func (c *Client) Stat(name, bucket string) (size int64, reterr os.Error) {
 	defer func() {
 		log.Printf("s3 client: Stat(%q, %q) = %d, %v", name, bucket, size, reterr)
 	}()
-	req := newReq("http://" + bucket + ".s3.amazonaws.com/" + name)
-	req.Method = "HEAD"
-	c.Auth.SignRequest(req)
-	res, err := c.httpClient().Do(req)
+	res, err := c.doNoBody("HEAD", c.keyURL(bucket, name))
 	if err != nil {
 		return 0, err
 	}
 	if res.Body != nil {
 		defer res.Body.Close()
 	}
-	if res.StatusCode == http.StatusNotFound {
+	switch res.StatusCode {
+	case http.StatusOK:
+		return strconv.Atoi64(res.Header.Get("Content-Length"))
+	case http.StatusNotFound:
 		return 0, os.ENOENT
 	}
-	return strconv.Atoi64(res.Header.Get("Content-Length"))
+	return 0, fmt.Errorf("Amazon HTTP error on HEAD: %d", res.StatusCode)
+}
+
+func encodeMD5(md5 hash.Hash) string {
+	b64 := new(bytes.Buffer)
+	encoder := base64.NewEncoder(base64.StdEncoding, b64)
+	encoder.Write(md5.Sum())
+	encoder.Close()
+	return b64.String()
 }
 
+// PutObject uploads the size bytes of body as name in bucket. If
+// body is an io.Seeker, it's rewound to retry failed attempts;
+// otherwise failures aren't retried.
 func (c *Client) PutObject(name, bucket string, md5 hash.Hash, size int64, body io.Reader) os.Error {
-	req := newReq("http://" + bucket + ".s3.amazonaws.com/" + name)
-	req.Method = "PUT"
-	req.ContentLength = size
-	if md5 != nil {
-		b64 := new(bytes.Buffer)
-		encoder := base64.NewEncoder(base64.StdEncoding, b64)
-		encoder.Write(md5.Sum())
-		encoder.Close()
-		req.Header.Set("Content-MD5", b64.String())
-	}
-	c.Auth.SignRequest(req)
-	req.Body = ioutil.NopCloser(body)
-
-	res, err := c.httpClient().Do(req)
-	if res != nil && res.Body != nil {
-		defer res.Body.Close()
+	attempts := 1
+	seeker, ok := body.(io.Seeker)
+	if ok {
+		attempts = maxAttempts
 	}
+	try := 0
+	res, err := c.do(attempts, func() (*http.Request, os.Error) {
+		if try++; try > 1 {
+			if _, err := seeker.Seek(0, 0); err != nil {
+				return nil, err
+			}
+		}
+		req := newReq(c.keyURL(bucket, name))
+		req.Method = "PUT"
+		req.ContentLength = size
+		if md5 != nil {
+			req.Header.Set("Content-MD5", encodeMD5(md5))
+		}
+		if size > 0 {
+			req.Body = ioutil.NopCloser(body)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != 200 {
-		res.Write(os.Stderr)
-		return fmt.Errorf("Got response code %d from s3", res.StatusCode)
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("PUT", res)
 	}
 	return nil
 }
@@ -132,17 +263,16 @@ type listBucketResults struct {
 
 func (c *Client) ListBucket(bucket string, after string, maxKeys uint) (items []*Item, reterr os.Error) {
 	var bres listBucketResults
-	url_ := fmt.Sprintf("http://%s.s3.amazonaws.com/?marker=%s&max-keys=%d",
-		bucket, url.QueryEscape(after), maxKeys)
-	req := newReq(url_)
-	c.Auth.SignRequest(req)
-	res, err := c.httpClient().Do(req)
-	if res != nil && res.Body != nil {
-		defer res.Body.Close()
-	}
+	url_ := fmt.Sprintf("%s?marker=%s&max-keys=%d",
+		c.keyURL(bucket, ""), url.QueryEscape(after), maxKeys)
+	res, err := c.doNoBody("GET", url_)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, responseError("GET bucket", res)
+	}
 	if err := xml.Unmarshal(res.Body, &bres); err != nil {
 		return nil, err
 	}
@@ -150,45 +280,35 @@ func (c *Client) ListBucket(bucket string, after string, maxKeys uint) (items []
 }
 
 func (c *Client) Get(bucket, key string) (body io.ReadCloser, size int64, err os.Error) {
-	url_ := fmt.Sprintf("http://%s.s3.amazonaws.com/%s", bucket, key)
-	req := newReq(url_)
-	c.Auth.SignRequest(req)
 	var res *http.Response
-	res, err = c.httpClient().Do(req)
+	res, err = c.doNoBody("GET", c.keyURL(bucket, key))
 	if err != nil {
 		return
 	}
-	if res.StatusCode != http.StatusOK && res != nil && res.Body != nil {
-		defer func() {
-			io.Copy(os.Stderr, res.Body)
-		}()
-	}
 	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
 		err = os.ENOENT
 		return
 	}
 	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Amazon HTTP error on GET: %d", res.StatusCode)
+		defer res.Body.Close()
+		err = responseError("GET", res)
 		return
 	}
 	return res.Body, res.ContentLength, nil
 }
 
 func (c *Client) Delete(bucket, key string) os.Error {
-	url_ := fmt.Sprintf("http://%s.s3.amazonaws.com/%s", bucket, key)
-	req := newReq(url_)
-	req.Method = "DELETE"
-	c.Auth.SignRequest(req)
-	res, err := c.httpClient().Do(req)
+	res, err := c.doNoBody("DELETE", c.keyURL(bucket, key))
 	if err != nil {
 		return err
 	}
-	if res != nil && res.Body != nil {
+	if res.Body != nil {
 		defer res.Body.Close()
 	}
 	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent ||
 		res.StatusCode == http.StatusOK {
 		return nil
 	}
-	return fmt.Errorf("Amazon HTTP error on DELETE: %d", res.StatusCode)
+	return responseError("DELETE", res)
 }
@@ -17,9 +17,16 @@ limitations under the License.
 package s3
 
 import (
+	"bytes"
+	"crypto/md5"
 	"http"
+	"http/httptest"
+	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+
+	"camli/misc/amazon/s3/fakes3"
 )
 
 var tc *Client
@@ -31,7 +38,7 @@ func getTestClient(t *testing.T) bool {
 		t.Logf("Skipping test; no AWS_ACCESS_KEY_ID or AWS_ACCESS_KEY_SECRET set in environment")
 		return false
 	}
-	tc = &Client{&Auth{accessKey, secret}, http.DefaultClient}
+	tc = &Client{Auth: &Auth{accessKey, secret}, HttpClient: http.DefaultClient}
 	return true
 }
 
@@ -41,3 +48,187 @@ func TestBuckets(t *testing.T) {
 	}
 	tc.Buckets()
 }
+
+// newFakeClient returns a client of a fake S3 server with a bucket
+// "b", and a func to stop the server.
+func newFakeClient(t *testing.T) (*Client, *fakes3.Server, func()) {
+	fake := fakes3.New()
+	fake.CreateBucket("b")
+	ts := httptest.NewServer(fake)
+	return &Client{
+		Auth:      &Auth{AccessKey: "key", SecretAccessKey: "secret"},
+		Endpoint:  ts.URL,
+		PathStyle: true,
+	}, fake, ts.Close
+}
+
+// stringSeeker is a seekable reader of a string, so PutObject can
+// retry it.
+type stringSeeker struct {
+	s   string
+	off int
+}
+
+func (r *stringSeeker) Read(p []byte) (n int, err os.Error) {
+	if r.off >= len(r.s) {
+		return 0, os.EOF
+	}
+	n = copy(p, r.s[r.off:])
+	r.off += n
+	return n, nil
+}
+
+func (r *stringSeeker) Seek(offset int64, whence int) (int64, os.Error) {
+	if offset != 0 || whence != 0 {
+		return 0, os.EINVAL
+	}
+	r.off = 0
+	return 0, nil
+}
+
+func putString(c *Client, key, s string) os.Error {
+	h := md5.New()
+	h.Write([]byte(s))
+	return c.PutObject(key, "b", h, int64(len(s)), &stringSeeker{s: s})
+}
+
+func TestFakeRoundTrip(t *testing.T) {
+	c, _, stop := newFakeClient(t)
+	defer stop()
+
+	buckets, err := c.Buckets()
+	if err != nil || len(buckets) != 1 || buckets[0].Name != "b" {
+		t.Fatalf("Buckets = %v, %v; want bucket b", buckets, err)
+	}
+	for _, key := range []string{"foo", "bar", "empty"} {
+		contents := key
+		if key == "empty" {
+			contents = ""
+		}
+		if err := putString(c, key, contents); err != nil {
+			t.Fatalf("PutObject(%q): %v", key, err)
+		}
+	}
+	if size, err := c.Stat("foo", "b"); err != nil || size != 3 {
+		t.Errorf("Stat(foo) = %d, %v; want 3, nil", size, err)
+	}
+	if _, err := c.Stat("nope", "b"); err != os.ENOENT {
+		t.Errorf("Stat(nope) error = %v; want ENOENT", err)
+	}
+
+	body, size, err := c.Get("b", "bar")
+	if err != nil {
+		t.Fatalf("Get(bar): %v", err)
+	}
+	slurp, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(slurp) != "bar" || size != 3 {
+		t.Errorf("Get(bar) = %q, %d; want \"bar\", 3", slurp, size)
+	}
+	if _, _, err := c.Get("b", "nope"); err != os.ENOENT {
+		t.Errorf("Get(nope) error = %v; want ENOENT", err)
+	}
+
+	items, err := c.ListBucket("b", "bar", 1)
+	if err != nil || len(items) != 1 || items[0].Key != "empty" || items[0].Size != 0 {
+		t.Errorf("ListBucket after bar = %v, %v; want just empty", items, err)
+	}
+
+	if err := c.Delete("b", "foo"); err != nil {
+		t.Errorf("Delete(foo): %v", err)
+	}
+	if err := c.Delete("b", "foo"); err != nil {
+		t.Errorf("second Delete(foo): %v", err)
+	}
+	if _, err := c.Stat("foo", "b"); err != os.ENOENT {
+		t.Errorf("Stat(foo) after Delete error = %v; want ENOENT", err)
+	}
+}
+
+func TestBadDigest(t *testing.T) {
+	c, _, stop := newFakeClient(t)
+	defer stop()
+	h := md5.New()
+	h.Write([]byte("something else"))
+	if err := c.PutObject("foo", "b", h, 3, strings.NewReader("foo")); err == nil {
+		t.Errorf("PutObject with wrong MD5 succeeded")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	c, fake, stop := newFakeClient(t)
+	defer stop()
+
+	fake.Fail(maxAttempts - 1)
+	if err := putString(c, "foo", "foo"); err != nil {
+		t.Fatalf("PutObject after %d failures: %v", maxAttempts-1, err)
+	}
+	if got, want := fake.Requests(), maxAttempts; got != want {
+		t.Errorf("%d requests; want %d", got, want)
+	}
+
+	fake.Fail(maxAttempts)
+	if _, err := c.Stat("foo", "b"); err == nil || err == os.ENOENT {
+		t.Errorf("Stat after %d failures: error = %v; want 5xx error", maxAttempts, err)
+	}
+
+	// Without a Seeker, the body can only be sent once.
+	fake.Fail(1)
+	h := md5.New()
+	h.Write([]byte("bar"))
+	if err := c.PutObject("bar", "b", h, 3, bytes.NewBuffer([]byte("bar"))); err == nil {
+		t.Errorf("PutObject of non-Seeker retried")
+	}
+}
+
+func TestMultipart(t *testing.T) {
+	c, fake, stop := newFakeClient(t)
+	defer stop()
+
+	for _, size := range []int{0, 10, 25, 30} {
+		data := bytes.Repeat([]byte("x"), size)
+		if err := c.PutObjectMultipart("foo", "b", 10, bytes.NewBuffer(data)); err != nil {
+			t.Fatalf("PutObjectMultipart of %d bytes: %v", size, err)
+		}
+		if got, _ := fake.Object("b", "foo"); !bytes.Equal(got, data) {
+			t.Errorf("stored %d bytes; want %d", len(got), size)
+		}
+	}
+	if n := fake.Uploads(); n != 0 {
+		t.Errorf("%d multipart uploads left in progress", n)
+	}
+
+	if err := c.PutObjectMultipart("foo", "nope", 10, strings.NewReader("abc")); err == nil {
+		t.Errorf("PutObjectMultipart to missing bucket succeeded")
+	}
+}
+
+// hostRewriter sends requests to a fixed host, keeping their Host
+// header, as if DNS resolved every bucket's subdomain to it.
+type hostRewriter string
+
+func (h hostRewriter) RoundTrip(req *http.Request) (*http.Response, os.Error) {
+	req.Host = req.URL.Host
+	req.URL.Host = string(h)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestVirtualHostStyle(t *testing.T) {
+	c, fake, stop := newFakeClient(t)
+	defer stop()
+	host := c.Endpoint[len("http://"):]
+	fake.Endpoint = "s3.example.com"
+	c.Endpoint = "s3.example.com"
+	c.PathStyle = false
+	c.HttpClient = &http.Client{Transport: hostRewriter(host)}
+
+	if err := putString(c, "foo", "bar"); err != nil {
+		t.Fatalf("PutObject: %v", err)
+	}
+	if got, _ := fake.Object("b", "foo"); string(got) != "bar" {
+		t.Errorf("stored %q; want \"bar\"", got)
+	}
+	if size, err := c.Stat("foo", "b"); err != nil || size != 3 {
+		t.Errorf("Stat(foo) = %d, %v; want 3, nil", size, err)
+	}
+}
@@ -0,0 +1,349 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fakes3 implements an in-memory fake of the parts of the
+// S3 REST API used by camli/misc/amazon/s3, for tests.
+//
+// It serves buckets both path-style ("/bucket/key") and, for hosts
+// ending in "." + Server.Endpoint, virtual-hosted-style. Requests
+// must be signed, but signatures aren't verified.
+package fakes3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"http"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"xml"
+)
+
+// Server is a fake S3 server. It's an http.Handler.
+type Server struct {
+	// Endpoint is the host (and port) of the server for
+	// virtual-hosted-style requests.
+	Endpoint string
+
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte // bucket to key to contents
+	uploads  map[string]*upload           // by upload ID
+	nextId   int
+	failures int // requests still to fail
+	requests int
+}
+
+type upload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+// New returns a new Server without buckets.
+func New() *Server {
+	return &Server{
+		buckets: make(map[string]map[string][]byte),
+		uploads: make(map[string]*upload),
+	}
+}
+
+// CreateBucket creates an empty bucket.
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[name]; !ok {
+		s.buckets[name] = make(map[string][]byte)
+	}
+}
+
+// Object returns the contents of key in bucket and whether it exists.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// Fail makes the next n requests fail with a 503 Service
+// Unavailable, as S3 sometimes does.
+func (s *Server) Fail(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Requests returns the number of requests served.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Uploads returns the number of multipart uploads in progress.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.Escape(&buf, []byte(s))
+	return buf.String()
+}
+
+func etag(data []byte) string {
+	h := md5.New()
+	h.Write(data)
+	return fmt.Sprintf("\"%x\"", h.Sum())
+}
+
+func sendError(rw http.ResponseWriter, code int, s3code, msg string) {
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(code)
+	fmt.Fprintf(rw, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3code, xmlEscape(msg))
+}
+
+// bucketAndKey returns the bucket and key addressed by req. Both are
+// empty for the service itself.
+func (s *Server) bucketAndKey(req *http.Request) (bucket, key string) {
+	path := strings.TrimLeft(req.URL.Path, "/")
+	if s.Endpoint != "" && strings.HasSuffix(req.Host, "."+s.Endpoint) {
+		return req.Host[:len(req.Host)-len(s.Endpoint)-1], path
+	}
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		sendError(rw, http.StatusServiceUnavailable, "ServiceUnavailable", "injected failure")
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS ") {
+		sendError(rw, http.StatusForbidden, "AccessDenied", "request not signed")
+		return
+	}
+
+	bucket, key := s.bucketAndKey(req)
+	if bucket == "" {
+		if req.Method != "GET" {
+			sendError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+			return
+		}
+		s.listBuckets(rw)
+		return
+	}
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		sendError(rw, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	if key == "" {
+		if req.Method != "GET" {
+			sendError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+			return
+		}
+		s.listBucket(rw, req, objects)
+		return
+	}
+
+	q := req.URL.Query()
+	switch {
+	case req.Method == "POST" && q["uploads"] != nil:
+		s.initiateMultipart(rw, bucket, key)
+	case q.Get("uploadId") != "":
+		s.multipart(rw, req, bucket, key, q.Get("uploadId"))
+	case req.Method == "PUT":
+		s.putObject(rw, req, objects, key)
+	case req.Method == "GET" || req.Method == "HEAD":
+		data, ok := objects[key]
+		if !ok {
+			sendError(rw, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		rw.Header().Set("ETag", etag(data))
+		if req.Method == "GET" {
+			rw.Write(data)
+		}
+	case req.Method == "DELETE":
+		objects[key] = nil, false
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+}
+
+func (s *Server) listBuckets(rw http.ResponseWriter) {
+	var names []string
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rw.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(rw, "<ListAllMyBucketsResult><Buckets>")
+	for _, name := range names {
+		fmt.Fprintf(rw, "<Bucket><Name>%s</Name><CreationDate>2011-01-01T00:00:00.000Z</CreationDate></Bucket>", xmlEscape(name))
+	}
+	fmt.Fprintf(rw, "</Buckets></ListAllMyBucketsResult>")
+}
+
+func (s *Server) listBucket(rw http.ResponseWriter, req *http.Request, objects map[string][]byte) {
+	q := req.URL.Query()
+	marker, prefix := q.Get("marker"), q.Get("prefix")
+	maxKeys := 1000
+	if mk := q.Get("max-keys"); mk != "" {
+		n, err := strconv.Atoi(mk)
+		if err != nil || n < 0 {
+			sendError(rw, http.StatusBadRequest, "InvalidArgument", "bad max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	var keys []string
+	for k := range objects {
+		if k > marker && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > maxKeys
+	if truncated {
+		keys = keys[:maxKeys]
+	}
+	rw.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(rw, "<ListBucketResult><Marker>%s</Marker><MaxKeys>%d</MaxKeys><IsTruncated>%v</IsTruncated>",
+		xmlEscape(marker), maxKeys, truncated)
+	for _, k := range keys {
+		fmt.Fprintf(rw, "<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag></Contents>",
+			xmlEscape(k), len(objects[k]), xmlEscape(etag(objects[k])))
+	}
+	fmt.Fprintf(rw, "</ListBucketResult>")
+}
+
+// readBody reads req's body, checking its Content-MD5 if any.
+func readBody(rw http.ResponseWriter, req *http.Request) ([]byte, bool) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		sendError(rw, http.StatusBadRequest, "IncompleteBody", err.String())
+		return nil, false
+	}
+	if req.ContentLength >= 0 && int64(len(data)) != req.ContentLength {
+		sendError(rw, http.StatusBadRequest, "IncompleteBody", "body doesn't match Content-Length")
+		return nil, false
+	}
+	if want := req.Header.Get("Content-MD5"); want != "" {
+		h := md5.New()
+		h.Write(data)
+		if got := base64.StdEncoding.EncodeToString(h.Sum()); got != want {
+			sendError(rw, http.StatusBadRequest, "BadDigest", "Content-MD5 doesn't match")
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+func (s *Server) putObject(rw http.ResponseWriter, req *http.Request, objects map[string][]byte, key string) {
+	data, ok := readBody(rw, req)
+	if !ok {
+		return
+	}
+	objects[key] = data
+	rw.Header().Set("ETag", etag(data))
+}
+
+func (s *Server) initiateMultipart(rw http.ResponseWriter, bucket, key string) {
+	s.nextId++
+	id := fmt.Sprintf("upload-%d", s.nextId)
+	s.uploads[id] = &upload{bucket: bucket, key: key, parts: make(map[int][]byte)}
+	rw.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(rw, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>",
+		xmlEscape(bucket), xmlEscape(key), id)
+}
+
+type completeMultipartUpload struct {
+	Part []completePart
+}
+
+type completePart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *Server) multipart(rw http.ResponseWriter, req *http.Request, bucket, key, id string) {
+	up, ok := s.uploads[id]
+	if !ok || up.bucket != bucket || up.key != key {
+		sendError(rw, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	switch req.Method {
+	case "PUT":
+		n, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			sendError(rw, http.StatusBadRequest, "InvalidArgument", "bad partNumber")
+			return
+		}
+		data, ok := readBody(rw, req)
+		if !ok {
+			return
+		}
+		up.parts[n] = data
+		rw.Header().Set("ETag", etag(data))
+	case "POST":
+		var cmu completeMultipartUpload
+		if err := xml.Unmarshal(req.Body, &cmu); err != nil || len(cmu.Part) == 0 {
+			sendError(rw, http.StatusBadRequest, "MalformedXML", fmt.Sprint(err))
+			return
+		}
+		var buf bytes.Buffer
+		last := 0
+		for _, p := range cmu.Part {
+			data, ok := up.parts[p.PartNumber]
+			if !ok || etag(data) != p.ETag {
+				sendError(rw, http.StatusBadRequest, "InvalidPart", strconv.Itoa(p.PartNumber))
+				return
+			}
+			if p.PartNumber <= last {
+				sendError(rw, http.StatusBadRequest, "InvalidPartOrder", strconv.Itoa(p.PartNumber))
+				return
+			}
+			last = p.PartNumber
+			buf.Write(data)
+		}
+		s.buckets[bucket][key] = buf.Bytes()
+		s.uploads[id] = nil, false
+		rw.Header().Set("Content-Type", "application/xml")
+		fmt.Fprintf(rw, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			xmlEscape(bucket), xmlEscape(key), xmlEscape(etag(buf.Bytes())))
+	case "DELETE":
+		s.uploads[id] = nil, false
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		sendError(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"http"
+	"io"
+	"io/ioutil"
+	"os"
+	"url"
+	"xml"
+)
+
+// MinPartSize is the smallest size Amazon accepts for the parts of
+// a multipart upload, other than the last one.
+const MinPartSize = 5 << 20
+
+type initiateMultipartUploadResult struct {
+	UploadId string
+}
+
+// completeMultipartUploadResult is the response to completing a
+// multipart upload, which can be an error despite a 200 status.
+type completeMultipartUploadResult struct {
+	ETag    string
+	Code    string // of an <Error>
+	Message string // of an <Error>
+}
+
+type completedPart struct {
+	number int
+	etag   string
+}
+
+// PutObjectMultipart uploads body as name in bucket with a
+// multipart upload, in parts of partSize bytes. Each part is
+// buffered in memory so it can be retried. The upload is aborted if
+// any part fails.
+func (c *Client) PutObjectMultipart(name, bucket string, partSize int64, body io.Reader) (err os.Error) {
+	if partSize <= 0 {
+		return fmt.Errorf("s3: invalid part size %d", partSize)
+	}
+	uploadId, err := c.initiateMultipart(name, bucket)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			c.abortMultipart(name, bucket, uploadId)
+		}
+	}()
+
+	var parts []completedPart
+	buf := new(bytes.Buffer)
+	for n := 1; ; n++ {
+		buf.Reset()
+		size, cerr := io.Copyn(buf, body, partSize)
+		if cerr != nil && cerr != os.EOF {
+			return cerr
+		}
+		if size == 0 && n > 1 {
+			break
+		}
+		etag, err := c.putPart(name, bucket, uploadId, n, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		parts = append(parts, completedPart{n, etag})
+		if size < partSize {
+			break
+		}
+	}
+	return c.completeMultipart(name, bucket, uploadId, parts)
+}
+
+func (c *Client) multipartURL(name, bucket, query string) string {
+	return c.keyURL(bucket, name) + "?" + query
+}
+
+func (c *Client) initiateMultipart(name, bucket string) (uploadId string, err os.Error) {
+	res, err := c.doNoBody("POST", c.multipartURL(name, bucket, "uploads"))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", responseError("initiating multipart upload", res)
+	}
+	var ires initiateMultipartUploadResult
+	if err := xml.Unmarshal(res.Body, &ires); err != nil {
+		return "", err
+	}
+	if ires.UploadId == "" {
+		return "", os.NewError("s3: no UploadId initiating multipart upload")
+	}
+	return ires.UploadId, nil
+}
+
+func (c *Client) putPart(name, bucket, uploadId string, n int, data []byte) (etag string, err os.Error) {
+	h := md5.New()
+	h.Write(data)
+	partURL := c.multipartURL(name, bucket,
+		fmt.Sprintf("partNumber=%d&uploadId=%s", n, url.QueryEscape(uploadId)))
+	res, err := c.do(maxAttempts, func() (*http.Request, os.Error) {
+		req := newReq(partURL)
+		req.Method = "PUT"
+		req.ContentLength = int64(len(data))
+		req.Header.Set("Content-MD5", encodeMD5(h))
+		if len(data) > 0 {
+			req.Body = ioutil.NopCloser(bytes.NewBuffer(data))
+		}
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", responseError(fmt.Sprintf("PUT of part %d", n), res)
+	}
+	etag = res.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3: no ETag for part %d", n)
+	}
+	return etag, nil
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.Escape(&buf, []byte(s))
+	return buf.String()
+}
+
+func (c *Client) completeMultipart(name, bucket, uploadId string, parts []completedPart) os.Error {
+	body := new(bytes.Buffer)
+	body.WriteString("<CompleteMultipartUpload>")
+	for _, p := range parts {
+		fmt.Fprintf(body, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", p.number, xmlEscape(p.etag))
+	}
+	body.WriteString("</CompleteMultipartUpload>")
+	completeURL := c.multipartURL(name, bucket, "uploadId="+url.QueryEscape(uploadId))
+	res, err := c.do(maxAttempts, func() (*http.Request, os.Error) {
+		req := newReq(completeURL)
+		req.Method = "POST"
+		req.ContentLength = int64(body.Len())
+		req.Body = ioutil.NopCloser(bytes.NewBuffer(body.Bytes()))
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("completing multipart upload", res)
+	}
+	var cres completeMultipartUploadResult
+	if err := xml.Unmarshal(res.Body, &cres); err != nil {
+		return err
+	}
+	if cres.Code != "" {
+		return fmt.Errorf("s3: completing multipart upload: %s: %s", cres.Code, cres.Message)
+	}
+	return nil
+}
+
+func (c *Client) abortMultipart(name, bucket, uploadId string) os.Error {
+	res, err := c.doNoBody("DELETE", c.multipartURL(name, bucket, "uploadId="+url.QueryEscape(uploadId)))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return responseError("aborting multipart upload", res)
+	}
+	return nil
+}
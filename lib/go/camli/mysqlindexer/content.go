@@ -0,0 +1,107 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlindexer
+
+import (
+	"os"
+	"strings"
+
+	"camli/blobref"
+	"camli/search"
+)
+
+// contentWordsTable holds the words of the text contents of file
+// schema blobs, for SearchPermanodesWithContent.
+const contentWordsTable = `CREATE TABLE contentwords (
+word VARCHAR(64) NOT NULL,
+schemaref VARCHAR(128) NOT NULL,
+PRIMARY KEY (word, schemaref),
+INDEX (schemaref))`
+
+func init() {
+	registerMigration(&migration{
+		from: 18,
+		desc: "add contentwords table for full-text search of file contents",
+		sql:  []string{contentWordsTable},
+		backfill: func(mi *Indexer, progressKey string) os.Error {
+			return mi.reindexBlobs(progressKey, "SELECT schemaref FROM bytesfiles")
+		},
+	})
+}
+
+// populateContentWords indexes the words of text, the contents of
+// the file schema blob blobRef.
+func (mi *Indexer) populateContentWords(blobRef *blobref.BlobRef, text *search.ContentText, fileName, mime string) os.Error {
+	for _, w := range text.Words(fileName, mime) {
+		if _, err := mi.db.Exec(mi.insertIgnore+" INTO contentwords (word, schemaref) VALUES (?, ?)",
+			w, blobRef.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mi *Indexer) SearchPermanodesWithContent(dest chan<- *search.Result, request *search.PermanodeByContentRequest) os.Error {
+	defer close(dest)
+	words := search.TextWords(request.Query)
+	if len(words) == 0 {
+		return nil
+	}
+	keyId, err := mi.keyIdOfSigner(request.Signer)
+	if err != nil {
+		return err
+	}
+
+	// The latest camliContent claim of each permanode, if it
+	// names a file containing all the words.
+	args := []interface{}{keyId}
+	for _, w := range words {
+		args = append(args, w)
+	}
+	args = append(args, len(words))
+	query := "SELECT c.permanode FROM claims c WHERE c.verifiedkeyid = ? AND c.attr = 'camliContent' " +
+		"AND c.claim IN ('set-attribute', 'add-attribute') " +
+		"AND c.value IN (SELECT schemaref FROM contentwords WHERE word IN (?" +
+		strings.Repeat(", ?", len(words)-1) + ") GROUP BY schemaref HAVING COUNT(*) = ?) " +
+		"AND NOT EXISTS (SELECT 1 FROM claims c2 WHERE c2.permanode = c.permanode " +
+		"AND c2.verifiedkeyid = c.verifiedkeyid AND c2.attr = 'camliContent' AND c2.date > c.date) " +
+		"ORDER BY c.date DESC"
+	if request.MaxResults > 0 {
+		query += " LIMIT ?"
+		args = append(args, request.MaxResults)
+	}
+	rs, err := mi.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rs.Close()
+
+	sent := make(map[string]bool)
+	var pn string
+	for rs.Next() {
+		if err := rs.Scan(&pn); err != nil {
+			return err
+		}
+		br := blobref.Parse(pn)
+		if br == nil || sent[pn] {
+			continue
+		}
+		sent[pn] = true
+		dest <- &search.Result{BlobRef: br}
+	}
+	return nil
+}
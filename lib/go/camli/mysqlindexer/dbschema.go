@@ -16,9 +16,13 @@ limitations under the License.
 
 package mysqlindexer
 
-import ()
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
-const requiredSchemaVersion = 18
+const requiredSchemaVersion = 19
 
 func SchemaVersion() int {
 	return requiredSchemaVersion
@@ -127,5 +131,57 @@ INDEX (keyid, baseref, suffix),
 INDEX (targetref, keyid),
 INDEX (baseref, keyid)
 )`,
+
+		contentWordsTable,
+	}
+}
+
+var (
+	createTableRx = regexp.MustCompile(`^CREATE TABLE (\w+)`)
+	inlineIndexRx = regexp.MustCompile(`,\s*(INDEX|FULLTEXT) \(([^)]*)\)`)
+	primaryKeyRx  = regexp.MustCompile(`,\s*PRIMARY KEY ?\(([^)]*)\)`)
+	engineRx      = regexp.MustCompile(`\)\s*ENGINE=\w+$`)
+)
+
+// SQLiteCreateTables returns the statements of SQLCreateTables
+// rewritten for SQLite by sqliteStatements, with all the CREATE
+// INDEX statements last.
+func SQLiteCreateTables() []string {
+	var stmts, indexes []string
+	for _, create := range SQLCreateTables() {
+		if !createTableRx.MatchString(create) {
+			panic("mysqlindexer: unexpected schema statement: " + create)
+		}
+		ss := sqliteStatements(create)
+		stmts = append(stmts, ss[0])
+		indexes = append(indexes, ss[1:]...)
+	}
+	return append(stmts, indexes...)
+}
+
+// sqliteStatements rewrites a MySQL statement for SQLite, which
+// doesn't support indexes declared inline in CREATE TABLE, FULLTEXT
+// indexes or storage engines, and requires table constraints to
+// follow all column definitions. Each inline index becomes a
+// separate CREATE INDEX statement following the CREATE TABLE.
+// Other statements are returned unchanged.
+func sqliteStatements(sql string) []string {
+	m := createTableRx.FindStringSubmatch(sql)
+	if m == nil {
+		return []string{sql}
+	}
+	table := m[1]
+	var indexes []string
+	create := inlineIndexRx.ReplaceAllStringFunc(sql, func(idx string) string {
+		cols := inlineIndexRx.FindStringSubmatch(idx)[2]
+		indexes = append(indexes, fmt.Sprintf("CREATE INDEX %s_%d ON %s (%s)", table, len(indexes)+1, table, cols))
+		return ""
+	})
+	create = engineRx.ReplaceAllString(create, ")")
+	create = strings.TrimSpace(create)
+	if m := primaryKeyRx.FindStringSubmatch(create); m != nil {
+		create = primaryKeyRx.ReplaceAllString(create, "")
+		create = create[:len(create)-1] + ",\nPRIMARY KEY (" + m[1] + "))"
 	}
+	return append([]string{create}, indexes...)
 }
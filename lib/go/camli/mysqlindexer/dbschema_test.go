@@ -0,0 +1,75 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlindexer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSQLiteCreateTables(t *testing.T) {
+	stmts := SQLiteCreateTables()
+	tables, indexes := 0, 0
+	for _, sql := range stmts {
+		switch {
+		case strings.HasPrefix(sql, "CREATE TABLE "):
+			tables++
+			if indexes > 0 {
+				t.Errorf("CREATE TABLE after CREATE INDEX: %s", sql)
+			}
+		case strings.HasPrefix(sql, "CREATE INDEX "):
+			indexes++
+		default:
+			t.Errorf("unexpected statement: %s", sql)
+		}
+		for _, bad := range []string{"INDEX (", "FULLTEXT", "ENGINE="} {
+			if strings.HasPrefix(sql, "CREATE TABLE ") && strings.Contains(sql, bad) {
+				t.Errorf("statement contains %q: %s", bad, sql)
+			}
+		}
+		if i := strings.Index(sql, "PRIMARY KEY ("); i != -1 && !strings.HasSuffix(sql, "))") {
+			t.Errorf("table constraint not last: %s", sql)
+		}
+	}
+	if tables != len(SQLCreateTables()) {
+		t.Errorf("got %d CREATE TABLE statements; want %d", tables, len(SQLCreateTables()))
+	}
+	if indexes == 0 {
+		t.Errorf("no CREATE INDEX statements")
+	}
+}
+
+func TestSQLiteStatements(t *testing.T) {
+	alter := "ALTER TABLE blobs ADD COLUMN foo VARCHAR(10)"
+	if got := sqliteStatements(alter); len(got) != 1 || got[0] != alter {
+		t.Errorf("sqliteStatements(%q) = %q; want it unchanged", alter, got)
+	}
+	got := sqliteStatements("CREATE TABLE t (a INT, b INT, INDEX (b), PRIMARY KEY (a), FULLTEXT (b)) ENGINE=MyISAM")
+	want := []string{
+		"CREATE TABLE t (a INT, b INT,\nPRIMARY KEY (a))",
+		"CREATE INDEX t_1 ON t (b)",
+		"CREATE INDEX t_2 ON t (b)",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("statement %d = %q; want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 
 	"camli/blobref"
+	"camli/db"
 )
 
 func (mi *Indexer) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
@@ -33,7 +34,7 @@ func (mi *Indexer) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string
 	return readBlobRefSizeResults(dest, rs)
 }
 
-func readBlobRefSizeResults(dest chan<- blobref.SizedBlobRef, rs ResultSet) os.Error {
+func readBlobRefSizeResults(dest chan<- blobref.SizedBlobRef, rs *db.Rows) os.Error {
 	var (
 		blobstr string
 		size    int64
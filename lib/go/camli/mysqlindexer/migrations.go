@@ -0,0 +1,244 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlindexer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"camli/blobref"
+	"camli/db"
+)
+
+// A migration upgrades the index schema from version from to
+// from+1. Migrations are registered in init functions with
+// registerMigration and run in order at startup by migrate, which
+// holds the meta table lock while they run.
+//
+// A migration interrupted part way is run again from the start, so
+// its steps must be safe to repeat.
+type migration struct {
+	from int
+	desc string
+
+	// sql are statements (MySQL dialect) run first, in order.
+	// CREATE TABLE statements, and the CREATE INDEX statements
+	// they become for SQLite, are run as IF NOT EXISTS.
+	sql []string
+
+	// backfill, if non-nil, runs after sql to populate new
+	// tables or columns, typically with reindexBlobs. progressKey
+	// is a meta table key it may use to record its progress; it's
+	// deleted once the migration is done.
+	backfill func(mi *Indexer, progressKey string) os.Error
+}
+
+var migrations = make(map[int]*migration) // from version -> migration
+
+func registerMigration(m *migration) {
+	if m.from >= requiredSchemaVersion {
+		panic(fmt.Sprintf("mysqlindexer: migration from version %d isn't below requiredSchemaVersion %d", m.from, requiredSchemaVersion))
+	}
+	if _, dup := migrations[m.from]; dup {
+		panic(fmt.Sprintf("mysqlindexer: duplicate migration from version %d", m.from))
+	}
+	migrations[m.from] = m
+}
+
+const (
+	migrationLockKey     = "migrationlock"
+	migrationLockTimeout = 120e9 // nanoseconds to wait for another migrator
+)
+
+// migrate brings the index schema up to requiredSchemaVersion,
+// running any registered migrations.
+func (mi *Indexer) migrate() os.Error {
+	version, err := mi.SchemaVersion()
+	if err != nil {
+		return fmt.Errorf("error getting schema version (need to init database?): %v", err)
+	}
+	if version == requiredSchemaVersion {
+		return nil
+	}
+	if version > requiredSchemaVersion || !mi.canMigrateFrom(version) {
+		return mi.checkSchemaVersion()
+	}
+
+	unlock, err := mi.lockMeta(migrationLockKey, migrationLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Another server may have migrated while we waited for the lock.
+	if version, err = mi.SchemaVersion(); err != nil {
+		return err
+	}
+	for ; version < requiredSchemaVersion; version++ {
+		m := migrations[version]
+		log.Printf("mysqlindexer: migrating index schema from version %d to %d: %s", version, version+1, m.desc)
+		for _, sql := range m.sql {
+			stmts := []string{sql}
+			if mi.sqlite {
+				stmts = sqliteStatements(sql)
+			}
+			for _, sql := range stmts {
+				sql = ifNotExists(sql)
+				if _, err := mi.db.Exec(sql); err != nil {
+					return fmt.Errorf("migration from schema version %d: %v running SQL: %s", version, err, sql)
+				}
+			}
+		}
+		progressKey := fmt.Sprintf("migration%dprogress", version)
+		if m.backfill != nil {
+			if err := m.backfill(mi, progressKey); err != nil {
+				return fmt.Errorf("migration from schema version %d: backfill: %v", version, err)
+			}
+		}
+		if _, err := mi.db.Exec("UPDATE meta SET value=? WHERE metakey='version'", strconv.Itoa(version+1)); err != nil {
+			return err
+		}
+		if _, err := mi.db.Exec("DELETE FROM meta WHERE metakey=?", progressKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ifNotExists makes a CREATE TABLE or CREATE INDEX statement do
+// nothing if the table or index already exists.
+func ifNotExists(sql string) string {
+	for _, create := range []string{"CREATE TABLE ", "CREATE INDEX "} {
+		if strings.HasPrefix(sql, create) && !strings.HasPrefix(sql, create+"IF NOT EXISTS ") {
+			return create + "IF NOT EXISTS " + sql[len(create):]
+		}
+	}
+	return sql
+}
+
+func (mi *Indexer) canMigrateFrom(version int) bool {
+	if version <= 0 {
+		return false
+	}
+	for v := version; v < requiredSchemaVersion; v++ {
+		if _, ok := migrations[v]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// lockMeta takes a lock recorded as the key row in the meta table,
+// waiting up to timeout nanoseconds for another holder to release
+// it. The returned func releases the lock.
+func (mi *Indexer) lockMeta(key string, timeout int64) (unlock func(), err os.Error) {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s:%d:%d", host, os.Getpid(), time.Seconds())
+	deadline := time.Nanoseconds() + timeout
+	for {
+		res, err := mi.db.Exec(mi.insertIgnore+" INTO meta (metakey, value) VALUES (?, ?)", key, owner)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 1 {
+			break
+		}
+		if time.Nanoseconds() > deadline {
+			holder := ""
+			mi.db.QueryRow("SELECT value FROM meta WHERE metakey=?", key).Scan(&holder)
+			return nil, fmt.Errorf("mysqlindexer: timed out waiting for meta lock %q held by %q (if that process is gone, delete the row from the meta table)", key, holder)
+		}
+		time.Sleep(1e9)
+	}
+	return func() {
+		if _, err := mi.db.Exec("DELETE FROM meta WHERE metakey=? AND value=?", key, owner); err != nil {
+			log.Printf("mysqlindexer: error releasing meta lock %q: %v", key, err)
+		}
+	}, nil
+}
+
+// reindexBlobs re-runs ReceiveBlob on the blobs named by the first
+// column of query, refetching them from the BlobSource. It's for
+// migrations which add tables populated from blob contents; existing
+// rows are left alone. Blobs missing from the BlobSource are skipped.
+// The blobs are indexed in sorted order, recording the last one done
+// under progressKey in the meta table, so an interrupted run
+// continues where it left off.
+func (mi *Indexer) reindexBlobs(progressKey, query string, args ...interface{}) os.Error {
+	var after string
+	err := mi.db.QueryRow("SELECT value FROM meta WHERE metakey=?", progressKey).Scan(&after)
+	if err != nil && err != db.ErrNoRows {
+		return err
+	}
+	rs, err := mi.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	var refs []string
+	for rs.Next() {
+		var s string
+		if err := rs.Scan(&s); err != nil {
+			rs.Close()
+			return err
+		}
+		if s > after && blobref.Parse(s) != nil {
+			refs = append(refs, s)
+		}
+	}
+	rs.Close()
+	sort.Strings(refs)
+
+	saveProgress := func(ref string) os.Error {
+		_, err := mi.db.Exec("REPLACE INTO meta (metakey, value) VALUES (?, ?)", progressKey, ref)
+		return err
+	}
+	skipped := 0
+	for i, ref := range refs {
+		br := blobref.Parse(ref)
+		rc, _, err := mi.BlobSource.FetchStreaming(br)
+		if err == os.ENOENT {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("fetching %s: %v", br, err)
+		}
+		_, err = mi.ReceiveBlob(br, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("indexing %s: %v", br, err)
+		}
+		if (i+1)%1000 == 0 {
+			if err := saveProgress(ref); err != nil {
+				return err
+			}
+			log.Printf("mysqlindexer: reindexed %d of %d blobs", i+1, len(refs))
+		}
+	}
+	if skipped > 0 {
+		log.Printf("mysqlindexer: skipped %d blobs missing from the blob source", skipped)
+	}
+	if len(refs) > 0 {
+		return saveProgress(refs[len(refs)-1])
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlindexer
+
+import (
+	"testing"
+)
+
+func TestMigrationsRegistered(t *testing.T) {
+	for from, m := range migrations {
+		if m.from != from {
+			t.Errorf("migration registered under version %d claims to be from %d", from, m.from)
+		}
+		if from >= requiredSchemaVersion {
+			t.Errorf("migration from version %d isn't below requiredSchemaVersion %d", from, requiredSchemaVersion)
+		}
+		if m.desc == "" {
+			t.Errorf("migration from version %d has no description", from)
+		}
+		if len(m.sql) == 0 && m.backfill == nil {
+			t.Errorf("migration from version %d does nothing", from)
+		}
+	}
+	if (&Indexer{}).canMigrateFrom(0) {
+		t.Errorf("canMigrateFrom(0) = true; uninitialized databases can't be migrated")
+	}
+	if !(&Indexer{}).canMigrateFrom(requiredSchemaVersion) {
+		t.Errorf("canMigrateFrom(requiredSchemaVersion) = false")
+	}
+}
+
+func TestIfNotExists(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"CREATE TABLE t (a INT)", "CREATE TABLE IF NOT EXISTS t (a INT)"},
+		{"CREATE TABLE IF NOT EXISTS t (a INT)", "CREATE TABLE IF NOT EXISTS t (a INT)"},
+		{"CREATE INDEX t_1 ON t (a)", "CREATE INDEX IF NOT EXISTS t_1 ON t (a)"},
+		{"ALTER TABLE t ADD b INT", "ALTER TABLE t ADD b INT"},
+	}
+	for _, tt := range tests {
+		if got := ifNotExists(tt.in); got != tt.want {
+			t.Errorf("ifNotExists(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
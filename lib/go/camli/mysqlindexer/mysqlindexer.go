@@ -24,6 +24,8 @@ import (
 
 	"camli/blobref"
 	"camli/blobserver"
+	"camli/db"
+	"camli/db/mysql"
 	"camli/jsonconfig"
 )
 
@@ -36,54 +38,75 @@ type Indexer struct {
 	// blobs.
 	BlobSource blobserver.Storage
 
-	db *MySQLWrapper
+	db *db.DB
+
+	// SQL dialect differences between databases.
+	insertIgnore string // "INSERT IGNORE" or equivalent
+	fullText     bool   // whether MATCH ... AGAINST is supported
+	sqlite       bool   // whether DDL needs rewriting by sqliteStatements
 }
 
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
 	blobPrefix := config.RequiredString("blobSource")
-	db := &MySQLWrapper{
-		Host:     config.OptionalString("host", "localhost"),
-		User:     config.RequiredString("user"),
-		Password: config.OptionalString("password", ""),
-		Database: config.RequiredString("database"),
+	dsn := mysql.FormatDSN(
+		config.OptionalString("host", "localhost"),
+		config.RequiredString("user"),
+		config.OptionalString("password", ""),
+		config.RequiredString("database"))
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	sqldb, err := db.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
 	}
 	indexer := &Indexer{
 		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
-		db:                        db,
+		db:                        sqldb,
+		insertIgnore:              "INSERT IGNORE",
+		fullText:                  true,
 	}
-	if err := config.Validate(); err != nil {
+	if err := indexer.setBlobSource(ld, blobPrefix); err != nil {
 		return nil, err
 	}
 
+	ok, err := indexer.IsAlive()
+	if !ok {
+		return nil, fmt.Errorf("Failed to connect to MySQL: %v", err)
+	}
+	if err := indexer.migrate(); err != nil {
+		return nil, err
+	}
+	return indexer, nil
+}
+
+func (mi *Indexer) setBlobSource(ld blobserver.Loader, blobPrefix string) os.Error {
 	sto, err := ld.GetStorage(blobPrefix)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	indexer.BlobSource = sto
+	mi.BlobSource = sto
 
 	// Good enough, for now:
-	indexer.KeyFetcher = indexer.BlobSource
-
-	ok, err := indexer.IsAlive()
-	if !ok {
-		return nil, fmt.Errorf("Failed to connect to MySQL: %v", err)
-	}
+	mi.KeyFetcher = mi.BlobSource
+	return nil
+}
 
-	version, err := indexer.SchemaVersion()
+func (mi *Indexer) checkSchemaVersion() os.Error {
+	version, err := mi.SchemaVersion()
 	if err != nil {
-		return nil, fmt.Errorf("error getting schema version (need to init database?): %v", err)
+		return fmt.Errorf("error getting schema version (need to init database?): %v", err)
 	}
 	if version != requiredSchemaVersion {
 		if os.Getenv("CAMLI_ADVERTISED_PASSWORD") != "" {
 			// Good signal that we're using the dev-server script, so help out
 			// the user with a more useful tip:
-			return nil, fmt.Errorf("database schema version is %d; expect %d (run \"./dev-server --wipe\" to wipe both your blobs and re-populate the database schema)", version, requiredSchemaVersion)
+			return fmt.Errorf("database schema version is %d; expect %d (run \"./dev-server --wipe\" to wipe both your blobs and re-populate the database schema)", version, requiredSchemaVersion)
 		}
-		return nil, fmt.Errorf("database schema version is %d; expect %d (need to re-init/upgrade database?)",
+		return fmt.Errorf("database schema version is %d; expect %d (need to re-init/upgrade database?)",
 			version, requiredSchemaVersion)
 	}
-
-	return indexer, nil
+	return nil
 }
 
 func init() {
@@ -91,7 +114,8 @@ func init() {
 }
 
 func (mi *Indexer) IsAlive() (ok bool, err os.Error) {
-	err = mi.db.Ping()
+	var n int64
+	err = mi.db.QueryRow("SELECT 1 + 1").Scan(&n)
 	ok = err == nil
 	return
 }
@@ -29,6 +29,7 @@ import (
 	"camli/jsonsign"
 	"camli/magic"
 	"camli/schema"
+	"camli/search"
 )
 
 // maxSniffSize is how much of a blob to buffer in memory for both
@@ -140,7 +141,7 @@ func (mi *Indexer) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (rets
 		}
 	}
 
-	if err = mi.db.Execute("INSERT IGNORE INTO blobs (blobref, size, type) VALUES (?, ?, ?)",
+	if _, err = mi.db.Exec(mi.insertIgnore+" INTO blobs (blobref, size, type) VALUES (?, ?, ?)",
 		blobRef.String(), written, mimeType); err != nil {
 		log.Printf("mysqlindexer: insert into blobs: %v", err)
 		return
@@ -164,7 +165,7 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 			verifiedKeyId = vr.SignerKeyId
 			log.Printf("mysqlindex: verified claim %s from %s", blobRef, verifiedKeyId)
 
-			if err = mi.db.Execute("INSERT IGNORE INTO signerkeyid (blobref, keyid) "+
+			if _, err = mi.db.Exec(mi.insertIgnore+" INTO signerkeyid (blobref, keyid) "+
 				"VALUES (?, ?)", vr.CamliSigner.String(), verifiedKeyId); err != nil {
 				return
 			}
@@ -173,8 +174,8 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 		}
 	}
 
-	if err = mi.db.Execute(
-		"INSERT IGNORE INTO claims (blobref, signer, verifiedkeyid, date, unverified, claim, permanode, attr, value) "+
+	if _, err = mi.db.Exec(
+		mi.insertIgnore+" INTO claims (blobref, signer, verifiedkeyid, date, unverified, claim, permanode, attr, value) "+
 			"VALUES (?, ?, ?, ?, 'Y', ?, ?, ?, ?)",
 		blobRef.String(), camli.Signer, verifiedKeyId, camli.ClaimDate,
 		camli.ClaimType, camli.Permanode,
@@ -183,12 +184,11 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 	}
 
 	if verifiedKeyId != "" {
-		switch camli.Attribute {
-		case "camliRoot", "tag", "title":
-			// TODO(bradfitz,mpl): these tag names are hard-coded.
+		if search.IsIndexedAttribute(camli.Attribute) {
+			// TODO(bradfitz,mpl): these attributes are hard-coded.
 			// we should probably have a config file of attributes
 			// and properties (e.g. which way(s) they're indexed)
-			if err = mi.db.Execute("INSERT IGNORE INTO signerattrvalue (keyid, attr, value, claimdate, blobref, permanode) "+
+			if _, err = mi.db.Exec(mi.insertIgnore+" INTO signerattrvalue (keyid, attr, value, claimdate, blobref, permanode) "+
 				"VALUES (?, ?, ?, ?, ?, ?)",
 				verifiedKeyId, camli.Attribute, camli.Value,
 				camli.ClaimDate, blobRef.String(), camli.Permanode); err != nil {
@@ -197,7 +197,7 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 			if camli.Attribute == "tag" || camli.Attribute == "title" {
 				// Identical copy for fulltext searches
 				// TODO(mpl): do the DELETEs as well
-				if err = mi.db.Execute("INSERT IGNORE INTO signerattrvalueft (keyid, attr, value, claimdate, blobref, permanode) "+
+				if _, err = mi.db.Exec(mi.insertIgnore+" INTO signerattrvalueft (keyid, attr, value, claimdate, blobref, permanode) "+
 					"VALUES (?, ?, ?, ?, ?, ?)",
 					verifiedKeyId, camli.Attribute, camli.Value,
 					camli.ClaimDate, blobRef.String(), camli.Permanode); err != nil {
@@ -216,7 +216,7 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 			if camli.ClaimType == "del-attribute" {
 				active = "N"
 			}
-			if err = mi.db.Execute("INSERT IGNORE INTO path (claimref, claimdate, keyid, baseref, suffix, targetref, active) "+
+			if _, err = mi.db.Exec(mi.insertIgnore+" INTO path (claimref, claimdate, keyid, baseref, suffix, targetref, active) "+
 				"VALUES (?, ?, ?, ?, ?, ?, ?)",
 				blobRef.String(), camli.ClaimDate, verifiedKeyId, camli.Permanode, suffix, camli.Value, active); err != nil {
 				return
@@ -225,12 +225,12 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 	}
 
 	// And update the lastmod on the permanode row.
-	if err = mi.db.Execute(
-		"INSERT IGNORE INTO permanodes (blobref) VALUES (?)",
+	if _, err = mi.db.Exec(
+		mi.insertIgnore+" INTO permanodes (blobref) VALUES (?)",
 		pnBlobref.String()); err != nil {
 		return
 	}
-	if err = mi.db.Execute(
+	if _, err = mi.db.Exec(
 		"UPDATE permanodes SET lastmod=? WHERE blobref=? AND ? > lastmod",
 		camli.ClaimDate, pnBlobref.String(), camli.ClaimDate); err != nil {
 		return
@@ -240,11 +240,17 @@ func (mi *Indexer) populateClaim(blobRef *blobref.BlobRef, camli *schema.Superse
 }
 
 func (mi *Indexer) populatePermanode(blobRef *blobref.BlobRef, camli *schema.Superset) (err os.Error) {
-	err = mi.db.Execute(
-		"INSERT IGNORE INTO permanodes (blobref, unverified, signer, lastmod) "+
-			"VALUES (?, 'Y', ?, '') "+
-			"ON DUPLICATE KEY UPDATE unverified = 'Y', signer = ?",
-		blobRef.String(), camli.Signer, camli.Signer)
+	// The row may already exist if a claim arrived first. Not
+	// using ON DUPLICATE KEY UPDATE, as it's MySQL-only.
+	_, err = mi.db.Exec(
+		mi.insertIgnore+" INTO permanodes (blobref, unverified, signer, lastmod) "+
+			"VALUES (?, 'Y', ?, '')",
+		blobRef.String(), camli.Signer)
+	if err != nil {
+		return
+	}
+	_, err = mi.db.Exec("UPDATE permanodes SET unverified = 'Y', signer = ? WHERE blobref = ?",
+		camli.Signer, blobRef.String())
 	return
 }
 
@@ -261,7 +267,8 @@ func (mi *Indexer) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset) (
 		return nil
 	}
 	mime, reader := magic.MimeTypeFromReader(fr)
-	n, err := io.Copy(sha1, reader)
+	text := new(search.ContentText)
+	n, err := io.Copy(io.MultiWriter(sha1, text), reader)
 	if err != nil {
 		// TODO: job scheduling system to retry this spaced
 		// out max n times.  Right now our options are
@@ -274,8 +281,8 @@ func (mi *Indexer) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset) (
 	}
 
 	log.Printf("file %s blobref is %s, size %d", blobRef, blobref.FromHash("sha1", sha1), n)
-	err = mi.db.Execute(
-		"INSERT IGNORE INTO bytesfiles (schemaref, camlitype, wholedigest, size, filename, mime) VALUES (?, ?, ?, ?, ?, ?)",
+	_, err = mi.db.Exec(
+		mi.insertIgnore+" INTO bytesfiles (schemaref, camlitype, wholedigest, size, filename, mime) VALUES (?, ?, ?, ?, ?, ?)",
 		blobRef.String(),
 		"file",
 		blobref.FromHash("sha1", sha1).String(),
@@ -283,5 +290,8 @@ func (mi *Indexer) populateFile(blobRef *blobref.BlobRef, ss *schema.Superset) (
 		ss.FileNameString(),
 		mime,
 	)
-	return
+	if err != nil {
+		return
+	}
+	return mi.populateContentWords(blobRef, text, ss.FileNameString(), mime)
 }
@@ -36,7 +36,7 @@ type permaNodeRow struct {
 	lastmod string // "2011-03-13T23:30:19.03946Z"
 }
 
-func (mi *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobref.BlobRef, limit int) os.Error {
+func (mi *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobref.BlobRef, limit int, cont string) os.Error {
 	defer close(dest)
 	if len(owner) == 0 {
 		return nil
@@ -45,9 +45,21 @@ func (mi *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobre
 		panic("TODO: remove support for more than one owner. push it to caller")
 	}
 
-	rs, err := mi.db.Query("SELECT blobref, signer, lastmod FROM permanodes WHERE signer = ? AND lastmod <> '' "+
-		"ORDER BY lastmod DESC LIMIT ?",
-		owner[0].String(), limit)
+	// Order by (lastmod, blobref) so a continuation token, the
+	// last row's pair, resumes at a fixed point.
+	query := "SELECT blobref, signer, lastmod FROM permanodes WHERE signer = ? AND lastmod <> '' "
+	args := []interface{}{owner[0].String()}
+	if cont != "" {
+		parts, err := search.DecodeContinue(cont, 2)
+		if err != nil {
+			return err
+		}
+		query += "AND (lastmod < ? OR (lastmod = ? AND blobref < ?)) "
+		args = append(args, parts[0], parts[0], parts[1])
+	}
+	query += "ORDER BY lastmod DESC, blobref DESC LIMIT ?"
+	args = append(args, limit)
+	rs, err := mi.db.Query(query, args...)
 	if err != nil {
 		return err
 	}
@@ -66,8 +78,7 @@ func (mi *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobre
 		if signer == nil {
 			continue
 		}
-		modstr = trimRFC3339Subseconds(modstr)
-		t, err := time.Parse(time.RFC3339, modstr)
+		t, err := time.Parse(time.RFC3339, trimRFC3339Subseconds(modstr))
 		if err != nil {
 			log.Printf("Skipping; error parsing time %q: %v", modstr, err)
 			continue
@@ -76,6 +87,7 @@ func (mi *Indexer) GetRecentPermanodes(dest chan *search.Result, owner []*blobre
 			BlobRef:     br,
 			Signer:      signer,
 			LastModTime: t.Seconds(),
+			Continue:    search.EncodeContinue(modstr, blobstr),
 		}
 	}
 	return nil
@@ -128,7 +140,7 @@ func (mi *Indexer) GetOwnerClaims(permanode, owner *blobref.BlobRef) (claims sea
 }
 
 func (mi *Indexer) GetBlobMimeType(blob *blobref.BlobRef) (mime string, size int64, err os.Error) {
-	rs, err := mi.db.Query("SELECT type, size FROM blobs WHERE blobref=?", blob.String())
+	rs, err := mi.db.Query("SELECT COALESCE(type, ''), size FROM blobs WHERE blobref=?", blob.String())
 	if err != nil {
 		return
 	}
@@ -141,49 +153,64 @@ func (mi *Indexer) GetBlobMimeType(blob *blobref.BlobRef) (mime string, size int
 	return
 }
 
-func (mi *Indexer) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *search.PermanodeByAttrRequest) os.Error {
+func (mi *Indexer) SearchPermanodesWithAttr(dest chan<- *search.Result, request *search.PermanodeByAttrRequest) os.Error {
 	defer close(dest)
 	keyId, err := mi.keyIdOfSigner(request.Signer)
 	if err != nil {
 		return err
 	}
-	query := ""
-	var rs ResultSet
-	if request.Attribute == "" {
-		query = "SELECT permanode FROM signerattrvalueft WHERE keyid = ? AND MATCH(value) AGAINST (?) AND claimdate <> '' LIMIT ?"
-		rs, err = mi.db.Query(query, keyId, request.Query, request.MaxResults)
-		if err != nil {
-			return err
+	table := "signerattrvalue"
+	where := []string{"keyid = ?", "claimdate <> ''"}
+	args := []interface{}{keyId}
+	if request.Attribute != "" {
+		where = append(where, "attr = ?")
+		args = append(args, request.Attribute)
+	}
+	if request.FuzzyMatch || request.Attribute == "" {
+		table = "signerattrvalueft"
+		// Databases without fulltext support fall back to a
+		// substring match.
+		if mi.fullText {
+			where = append(where, "MATCH(value) AGAINST (?)")
+			args = append(args, request.Query)
+		} else {
+			where = append(where, "value LIKE ?")
+			args = append(args, "%"+request.Query+"%")
 		}
 	} else {
-		if request.FuzzyMatch {
-			query = "SELECT permanode FROM signerattrvalueft WHERE keyid = ? AND attr = ? AND MATCH(value) AGAINST (?) AND claimdate <> '' LIMIT ?"
-			rs, err = mi.db.Query(query, keyId, request.Attribute,
-				request.Query, request.MaxResults)
-			if err != nil {
-				return err
-			}
-		} else {
-			query = "SELECT permanode FROM signerattrvalue WHERE keyid = ? AND attr = ? AND value = ? AND claimdate <> '' ORDER BY claimdate DESC LIMIT ?"
-			rs, err = mi.db.Query(query, keyId, request.Attribute,
-				request.Query, request.MaxResults)
-			if err != nil {
-				return err
-			}
+		where = append(where, "value = ?")
+		args = append(args, request.Query)
+	}
+	if request.Continue != "" {
+		parts, err := search.DecodeContinue(request.Continue, 2)
+		if err != nil {
+			return err
 		}
+		where = append(where, "(claimdate < ? OR (claimdate = ? AND blobref < ?))")
+		args = append(args, parts[0], parts[0], parts[1])
+	}
+	query := "SELECT permanode, claimdate, blobref FROM " + table + " WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY claimdate DESC, blobref DESC LIMIT ?"
+	args = append(args, request.MaxResults)
+	rs, err := mi.db.Query(query, args...)
+	if err != nil {
+		return err
 	}
 	defer rs.Close()
 
-	pn := ""
+	var pn, claimdate, claimref string
 	for rs.Next() {
-		if err := rs.Scan(&pn); err != nil {
+		if err := rs.Scan(&pn, &claimdate, &claimref); err != nil {
 			return err
 		}
 		br := blobref.Parse(pn)
 		if br == nil {
 			continue
 		}
-		dest <- br
+		dest <- &search.Result{
+			BlobRef:  br,
+			Continue: search.EncodeContinue(claimdate, claimref),
+		}
 	}
 	return nil
 }
@@ -0,0 +1,87 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlindexer
+
+import (
+	"fmt"
+	"os"
+
+	"camli/blobserver"
+	"camli/db"
+	"camli/jsonconfig"
+)
+
+// The "sqliteindexer" storage type runs the same index in a single
+// SQLite file, for small installations without a MySQL server.
+//
+// It uses the camli/db "sqlite3" driver, which is registered by the
+// cgo package camdev/sqlite (in misc/sqlite). Binaries wanting this
+// storage type must link that package in; camlistored does when
+// built with CAMLI_SQLITE=1 set (see build.pl).
+
+func newSQLiteFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, os.Error) {
+	blobPrefix := config.RequiredString("blobSource")
+	file := config.RequiredString("file")
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	sqldb, err := db.Open("sqlite3", file)
+	if err != nil {
+		return nil, fmt.Errorf("sqliteindexer: %v (server built without CAMLI_SQLITE=1?)", err)
+	}
+	indexer := &Indexer{
+		SimpleBlobHubPartitionMap: &blobserver.SimpleBlobHubPartitionMap{},
+		db:                        sqldb,
+		insertIgnore:              "INSERT OR IGNORE",
+		fullText:                  false,
+		sqlite:                    true,
+	}
+	if err := indexer.setBlobSource(ld, blobPrefix); err != nil {
+		return nil, err
+	}
+	if err := indexer.initSQLite(sqldb); err != nil {
+		return nil, fmt.Errorf("sqliteindexer: error initializing %s: %v", file, err)
+	}
+	if err := indexer.migrate(); err != nil {
+		return nil, err
+	}
+	return indexer, nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("sqliteindexer", blobserver.StorageConstructor(newSQLiteFromConfig))
+}
+
+// initSQLite creates the schema if sqldb is a new, empty database.
+func (mi *Indexer) initSQLite(sqldb *db.DB) os.Error {
+	var n int64
+	err := sqldb.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='meta'").Scan(&n)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	for _, sql := range SQLiteCreateTables() {
+		if _, err := sqldb.Exec(sql); err != nil {
+			return fmt.Errorf("%v running SQL: %s", err, sql)
+		}
+	}
+	_, err = sqldb.Exec("INSERT OR REPLACE INTO meta VALUES ('version', ?)", fmt.Sprint(SchemaVersion()))
+	return err
+}
@@ -19,20 +19,24 @@ package mysqlindexer
 import (
 	"camli/blobref"
 
-	"fmt"
 	"os"
 	"strings"
 )
 
 func (mi *Indexer) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, waitSeconds int) os.Error {
-	quotedBlobRefs := []string{}
-	for _, br := range blobs {
-		quotedBlobRefs = append(quotedBlobRefs, fmt.Sprintf("%q", br.String()))
+	if len(blobs) == 0 {
+		return nil
+	}
+	placeholders := make([]string, len(blobs))
+	args := make([]interface{}, len(blobs))
+	for i, br := range blobs {
+		placeholders[i] = "?"
+		args[i] = br.String()
 	}
 	sql := "SELECT blobref, size FROM blobs WHERE blobref IN (" +
-		strings.Join(quotedBlobRefs, ", ") + ")"
+		strings.Join(placeholders, ", ") + ")"
 
-	rs, err := mi.db.Query(sql)
+	rs, err := mi.db.Query(sql, args...)
 	if err != nil {
 		return err
 	}
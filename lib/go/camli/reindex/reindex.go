@@ -0,0 +1,301 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package reindex rebuilds an index by feeding it every blob in a
+// blob storage.
+package reindex
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"camli/blobref"
+	"camli/blobserver"
+)
+
+// Source is where the blobs to index come from.
+type Source interface {
+	blobref.StreamingFetcher
+	blobserver.BlobEnumerator
+}
+
+// Progress describes how far a reindex has gotten.
+type Progress struct {
+	Indexed int64 // blobs indexed successfully
+	Errors  int64 // blobs which failed to fetch or index
+	Bytes   int64 // bytes of successfully indexed blobs
+
+	// Last is the resume point: every blob up to and including
+	// Last has been processed. It's empty if nothing has been
+	// processed yet.
+	Last string
+
+	Elapsed int64 // nanoseconds since Run started
+	Done    bool  // whether this is the final report
+}
+
+func (p Progress) String() string {
+	rate := 0.0
+	if p.Elapsed > 0 {
+		rate = float64(p.Indexed+p.Errors) / (float64(p.Elapsed) / 1e9)
+	}
+	return fmt.Sprintf("%d blobs (%d bytes) indexed, %d errors, %.1f blobs/s, last %q",
+		p.Indexed, p.Bytes, p.Errors, rate, p.Last)
+}
+
+// A Reindexer copies every blob from Source into Index.
+type Reindexer struct {
+	Source Source
+	Index  blobserver.BlobReceiver
+
+	// Workers is the number of blobs indexed in parallel.
+	// If zero, 4 is used.
+	Workers int
+
+	// StateFile, if non-empty, names a file recording the resume
+	// point on its first line, and the blobs which failed to
+	// index on the following ones. Run retries those blobs, then
+	// starts after the resume point, rewriting the file as it
+	// goes. It deletes the file once the whole source has been
+	// indexed without errors.
+	StateFile string
+
+	// OnProgress, if non-nil, is called periodically and when
+	// Run finishes. If nil, progress is logged.
+	OnProgress func(Progress)
+
+	// ProgressInterval is the minimum number of nanoseconds
+	// between progress reports. If zero, 5 seconds is used.
+	ProgressInterval int64
+}
+
+type job struct {
+	seq   int64
+	sb    blobref.SizedBlobRef
+	retry bool // a failure of a previous run, not enumerated
+}
+
+type result struct {
+	seq   int64
+	ref   string
+	size  int64
+	err   os.Error
+	retry bool
+}
+
+// Run indexes every blob in Source sorting after the resume point,
+// and retries the blobs which failed in previous runs. Blobs which
+// fail to index are logged, counted and recorded in the StateFile,
+// and don't stop the reindex; Run returns an error if there were any.
+func (r *Reindexer) Run() os.Error {
+	after, retry, err := r.readState()
+	if err != nil {
+		return err
+	}
+	// failed holds the blobs to record for retrying: those still
+	// to retry, and those which failed in this run.
+	failed := make(map[string]bool)
+	for _, ref := range retry {
+		failed[ref] = true
+	}
+	workers := r.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	interval := r.ProgressInterval
+	if interval <= 0 {
+		interval = 5e9
+	}
+
+	work := make(chan job, workers)
+	results := make(chan result, workers)
+	enumErr := make(chan os.Error, 1)
+	go func() {
+		for _, ref := range retry {
+			work <- job{sb: blobref.SizedBlobRef{BlobRef: blobref.Parse(ref)}, retry: true}
+		}
+		enumErr <- r.enumerate(work, after)
+		close(work)
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.work(work, results)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Blobs finish out of order. The resume point only advances
+	// past a blob once every blob enumerated before it is done.
+	start := time.Nanoseconds()
+	lastReport := start
+	p := Progress{Last: after}
+	done := make(map[int64]string) // seq -> blobref, finished beyond next
+	next := int64(0)
+	for res := range results {
+		if res.err != nil {
+			p.Errors++
+			failed[res.ref] = true
+			log.Printf("reindex: error indexing %s: %v", res.ref, res.err)
+		} else {
+			p.Indexed++
+			p.Bytes += res.size
+			failed[res.ref] = false, false
+		}
+		if res.retry {
+			continue
+		}
+		done[res.seq] = res.ref
+		for {
+			ref, ok := done[next]
+			if !ok {
+				break
+			}
+			done[next] = "", false
+			p.Last = ref
+			next++
+		}
+		if now := time.Nanoseconds(); now-lastReport >= interval {
+			lastReport = now
+			p.Elapsed = now - start
+			if err := r.writeState(p.Last, failed); err != nil {
+				log.Printf("reindex: error saving state: %v", err)
+			}
+			r.report(p)
+		}
+	}
+
+	err = <-enumErr
+	if err == nil && len(failed) == 0 && r.StateFile != "" {
+		err = os.Remove(r.StateFile)
+		if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+			err = nil
+		}
+	} else if werr := r.writeState(p.Last, failed); werr != nil {
+		log.Printf("reindex: error saving state: %v", werr)
+	}
+	p.Elapsed = time.Nanoseconds() - start
+	p.Done = true
+	r.report(p)
+	if err != nil {
+		return fmt.Errorf("reindex: error enumerating blobs: %v", err)
+	}
+	if p.Errors > 0 {
+		return fmt.Errorf("reindex: %d blobs failed to index", p.Errors)
+	}
+	return nil
+}
+
+func (r *Reindexer) enumerate(work chan<- job, after string) os.Error {
+	seq := int64(0)
+	return blobserver.EnumerateAll(r.Source, after, func(sb blobref.SizedBlobRef) os.Error {
+		work <- job{seq: seq, sb: sb}
+		seq++
+		return nil
+	})
+}
+
+func (r *Reindexer) work(work <-chan job, results chan<- result) {
+	for j := range work {
+		res := result{seq: j.seq, ref: j.sb.BlobRef.String(), retry: j.retry}
+		rc, _, err := r.Source.FetchStreaming(j.sb.BlobRef)
+		if err == nil {
+			var sb blobref.SizedBlobRef
+			sb, err = r.Index.ReceiveBlob(j.sb.BlobRef, rc)
+			rc.Close()
+			res.size = sb.Size
+		}
+		res.err = err
+		results <- res
+	}
+}
+
+func (r *Reindexer) report(p Progress) {
+	if r.OnProgress != nil {
+		r.OnProgress(p)
+		return
+	}
+	if p.Done {
+		log.Printf("reindex: finished: %v", p)
+		return
+	}
+	log.Printf("reindex: %v", p)
+}
+
+// readState returns the resume point and the blobs to retry from
+// the state file. Failed blobs after the resume point aren't
+// returned, as they'll be enumerated again.
+func (r *Reindexer) readState() (after string, retry []string, err os.Error) {
+	if r.StateFile == "" {
+		return "", nil, nil
+	}
+	b, err := ioutil.ReadFile(r.StateFile)
+	if pe, ok := err.(*os.PathError); ok && pe.Error == os.ENOENT {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	// The resume point may be empty while there are failed blobs,
+	// so only the final newline is trimmed.
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	after = strings.TrimSpace(lines[0])
+	if after != "" && blobref.Parse(after) == nil {
+		return "", nil, fmt.Errorf("reindex: invalid blobref %q in state file %s", after, r.StateFile)
+	}
+	for _, line := range lines[1:] {
+		ref := strings.TrimSpace(line)
+		if ref == "" {
+			continue
+		}
+		if blobref.Parse(ref) == nil {
+			return "", nil, fmt.Errorf("reindex: invalid blobref %q in state file %s", ref, r.StateFile)
+		}
+		if ref <= after {
+			retry = append(retry, ref)
+		}
+	}
+	return after, retry, nil
+}
+
+// writeState atomically replaces the state file's contents.
+func (r *Reindexer) writeState(last string, failed map[string]bool) os.Error {
+	if r.StateFile == "" || (last == "" && len(failed) == 0) {
+		return nil
+	}
+	var refs []string
+	for ref := range failed {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	lines := append([]string{last}, refs...)
+	tmp := r.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.StateFile)
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package reindex
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camli/blobref"
+	"camli/test"
+)
+
+type source struct {
+	blobs  map[string]string // blobref -> contents
+	sorted []string
+}
+
+func newSource(n int) *source {
+	s := &source{blobs: make(map[string]string)}
+	for i := 0; i < n; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob %d", i)}
+		ref := tb.BlobRef().String()
+		s.blobs[ref] = tb.Contents
+		s.sorted = append(s.sorted, ref)
+	}
+	sort.Strings(s.sorted)
+	return s
+}
+
+func (s *source) FetchStreaming(br *blobref.BlobRef) (io.ReadCloser, int64, os.Error) {
+	contents, ok := s.blobs[br.String()]
+	if !ok {
+		return nil, 0, os.ENOENT
+	}
+	return ioutil.NopCloser(strings.NewReader(contents)), int64(len(contents)), nil
+}
+
+func (s *source) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit uint, waitSeconds int) os.Error {
+	defer close(dest)
+	n := uint(0)
+	for _, ref := range s.sorted {
+		if ref <= after {
+			continue
+		}
+		if n == limit {
+			break
+		}
+		dest <- blobref.SizedBlobRef{blobref.Parse(ref), int64(len(s.blobs[ref]))}
+		n++
+	}
+	return nil
+}
+
+type receiver struct {
+	fail string // blobref to fail on
+
+	mu  sync.Mutex
+	got map[string]string
+}
+
+func (r *receiver) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, os.Error) {
+	b, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	if br.String() == r.fail {
+		return blobref.SizedBlobRef{}, os.NewError("injected failure")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.got[br.String()] = string(b)
+	return blobref.SizedBlobRef{br, int64(len(b))}, nil
+}
+
+func TestReindex(t *testing.T) {
+	src := newSource(25)
+	dst := &receiver{got: make(map[string]string), fail: src.sorted[3]}
+	var last Progress
+	r := &Reindexer{
+		Source:     src,
+		Index:      dst,
+		Workers:    3,
+		OnProgress: func(p Progress) { last = p },
+	}
+	if err := r.Run(); err == nil || !strings.Contains(err.String(), "1 blobs failed") {
+		t.Errorf("Run error = %v; want 1 failed blob", err)
+	}
+	if len(dst.got) != 24 {
+		t.Errorf("indexed %d blobs; want 24", len(dst.got))
+	}
+	for ref, contents := range dst.got {
+		if src.blobs[ref] != contents {
+			t.Errorf("blob %s contents = %q; want %q", ref, contents, src.blobs[ref])
+		}
+	}
+	if !last.Done || last.Indexed != 24 || last.Errors != 1 {
+		t.Errorf("final progress = %+v", last)
+	}
+	if want := src.sorted[24]; last.Last != want {
+		t.Errorf("final Last = %q; want %q", last.Last, want)
+	}
+}
+
+func TestResume(t *testing.T) {
+	src := newSource(20)
+	dst := &receiver{got: make(map[string]string)}
+	state := fmt.Sprintf("%s/camli-reindex-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	defer os.Remove(state)
+	if err := ioutil.WriteFile(state, []byte(src.sorted[9]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &Reindexer{
+		Source:     src,
+		Index:      dst,
+		StateFile:  state,
+		OnProgress: func(Progress) {},
+	}
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(dst.got) != 10 {
+		t.Errorf("indexed %d blobs; want 10", len(dst.got))
+	}
+	for _, ref := range src.sorted[:10] {
+		if _, ok := dst.got[ref]; ok {
+			t.Errorf("blob %s before the resume point was indexed", ref)
+		}
+	}
+	if _, err := os.Stat(state); err == nil {
+		t.Errorf("state file not removed after a complete reindex")
+	}
+}
+
+func TestRetryFailed(t *testing.T) {
+	src := newSource(10)
+	dst := &receiver{got: make(map[string]string), fail: src.sorted[4]}
+	state := fmt.Sprintf("%s/camli-reindex-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	defer os.Remove(state)
+	r := &Reindexer{
+		Source:     src,
+		Index:      dst,
+		StateFile:  state,
+		OnProgress: func(Progress) {},
+	}
+	if err := r.Run(); err == nil {
+		t.Fatalf("Run succeeded despite a failed blob")
+	}
+	b, err := ioutil.ReadFile(state)
+	if err != nil {
+		t.Fatalf("state file not kept after a failed blob: %v", err)
+	}
+	if want := src.sorted[9] + "\n" + src.sorted[4] + "\n"; string(b) != want {
+		t.Errorf("state file = %q; want %q", b, want)
+	}
+
+	// The next run retries only the failed blob.
+	dst = &receiver{got: make(map[string]string)}
+	r.Index = dst
+	if err := r.Run(); err != nil {
+		t.Fatalf("second Run: %v", err)
+	}
+	if _, ok := dst.got[src.sorted[4]]; len(dst.got) != 1 || !ok {
+		t.Errorf("second run indexed %d blobs; want just the failed %s", len(dst.got), src.sorted[4])
+	}
+	if _, err := os.Stat(state); err == nil {
+		t.Errorf("state file not removed after the retry succeeded")
+	}
+}
+
+func TestEmptyResumePoint(t *testing.T) {
+	src := newSource(10)
+	dst := &receiver{got: make(map[string]string)}
+	state := fmt.Sprintf("%s/camli-reindex-test-%d-%d", os.TempDir(), os.Getpid(), time.Nanoseconds())
+	defer os.Remove(state)
+
+	// Nothing was done before a failed blob: everything is indexed
+	// again, rather than resuming after the failed blob.
+	if err := ioutil.WriteFile(state, []byte("\n"+src.sorted[5]+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &Reindexer{
+		Source:     src,
+		Index:      dst,
+		StateFile:  state,
+		OnProgress: func(Progress) {},
+	}
+	if err := r.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(dst.got) != 10 {
+		t.Errorf("indexed %d blobs; want 10", len(dst.got))
+	}
+}
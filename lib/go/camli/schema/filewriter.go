@@ -19,7 +19,6 @@ package schema
 import (
 	"bufio"
 	"bytes"
-	"crypto"
 	"fmt"
 	"io"
 	"log"
@@ -33,6 +32,20 @@ import (
 
 var _ = log.Printf
 
+// hashNameFor returns the name of the hash to use for blobs written
+// to bs: the result of its HashName method if it has one, such as a
+// *client.Client, or else blobref.DefaultHashName.
+func hashNameFor(bs interface{}) string {
+	if hn, ok := bs.(interface {
+		HashName() string
+	}); ok {
+		if name := hn.HashName(); name != "" {
+			return name
+		}
+	}
+	return blobref.DefaultHashName
+}
+
 // WriteFileFromReader creates and uploads a "file" JSON schema
 // composed of chunks of r, also uploading the chunks.  The returned
 // BlobRef is of the JSON file schema blob.
@@ -44,6 +57,7 @@ func WriteFileFromReader(bs blobserver.StatReceiver, filename string, r io.Reade
 // This is the simple 1MB chunk version. The rolling checksum version is below.
 func WriteFileMap(bs blobserver.StatReceiver, fileMap map[string]interface{}, r io.Reader) (*blobref.BlobRef, os.Error) {
 	parts, size := []BytesPart{}, int64(0)
+	hashName := hashNameFor(bs)
 
 	buf := new(bytes.Buffer)
 	for {
@@ -57,9 +71,12 @@ func WriteFileMap(bs blobserver.StatReceiver, fileMap map[string]interface{}, r
 			break
 		}
 
-		hash := crypto.SHA1.New()
+		hash := blobref.NewHash(hashName)
+		if hash == nil {
+			return nil, fmt.Errorf("schema/filewriter: unsupported hash %q", hashName)
+		}
 		io.Copy(hash, bytes.NewBuffer(buf.Bytes()))
-		br := blobref.FromHash("sha1", hash)
+		br := blobref.FromHash(hashName, hash)
 		hasBlob, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
@@ -91,7 +108,7 @@ func WriteFileMap(bs blobserver.StatReceiver, fileMap map[string]interface{}, r
 	if err != nil {
 		return nil, err
 	}
-	br := blobref.Sha1FromString(json)
+	br := blobref.FromString(hashName, json)
 	sb, err := bs.ReceiveBlob(br, strings.NewReader(json))
 	if err != nil {
 		return nil, err
@@ -145,9 +162,13 @@ func WriteFileMapRolling(bs blobserver.StatReceiver, fileMap map[string]interfac
 	n := int64(0)
 	last := n
 	buf := new(bytes.Buffer)
+	hashName := hashNameFor(bs)
+	if !blobref.HashSupported(hashName) {
+		return nil, fmt.Errorf("schema/filewriter: unsupported hash %q", hashName)
+	}
 
 	uploadString := func(s string) (*blobref.BlobRef, os.Error) {
-		br := blobref.Sha1FromString(s)
+		br := blobref.FromString(hashName, s)
 		hasIt, err := serverHasBlob(bs, br)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,100 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"io"
+	"io/ioutil"
+	"json"
+	"os"
+
+	"camli/blobref"
+)
+
+// MaxSchemaBlobSize is the size above which blobs aren't considered
+// to be schema blobs.
+const MaxSchemaBlobSize = 1 << 20
+
+// ReadSchemaBlob fetches sb from fetcher and parses it as a schema
+// blob, returning it and its raw JSON. Both are nil, without an
+// error, if sb isn't a schema blob.
+func ReadSchemaBlob(fetcher blobref.StreamingFetcher, sb blobref.SizedBlobRef) (ss *Superset, raw []byte, err os.Error) {
+	if sb.Size > MaxSchemaBlobSize {
+		return nil, nil, nil
+	}
+	rc, _, err := fetcher.FetchStreaming(sb.BlobRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rc.Close()
+	raw, err = ioutil.ReadAll(io.LimitReader(rc, MaxSchemaBlobSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(raw) == 0 || raw[0] != '{' {
+		return nil, nil, nil
+	}
+	ss = new(Superset)
+	if json.Unmarshal(raw, ss) != nil || ss.Type == "" {
+		return nil, nil, nil
+	}
+	ss.BlobRef = sb.BlobRef
+	return ss, raw, nil
+}
+
+// A Ref is a reference from a schema blob to another blob.
+type Ref struct {
+	Field string // the JSON key holding the reference, e.g. "parts"
+	Ref   *blobref.BlobRef
+}
+
+// Refs returns the blobs ss references: its signer, the permanode
+// and value of claims, the target of keep objects, the parts of files
+// and bytes, the entries of directories and the members of static
+// sets.
+func (ss *Superset) Refs() []Ref {
+	var refs []Ref
+	add := func(field, s string) {
+		if br := blobref.Parse(s); br != nil {
+			refs = append(refs, Ref{field, br})
+		}
+	}
+	add("camliSigner", ss.Signer)
+	switch ss.Type {
+	case "claim":
+		add("permaNode", ss.Permanode)
+		add("value", ss.Value)
+	case "keep":
+		add("target", ss.Target)
+	case "file", "bytes":
+		for _, part := range ss.Parts {
+			if part.BlobRef != nil {
+				refs = append(refs, Ref{"parts", part.BlobRef})
+			}
+			if part.BytesRef != nil {
+				refs = append(refs, Ref{"parts", part.BytesRef})
+			}
+		}
+	case "directory":
+		add("entries", ss.Entries)
+	case "static-set":
+		for _, m := range ss.Members {
+			add("members", m)
+		}
+	}
+	return refs
+}
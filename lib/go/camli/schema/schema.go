@@ -218,6 +218,8 @@ type Superset struct {
 	Entries string   `json:"entries"` // for directories, a blobref to a static-set
 	Members []string `json:"members"` // for static sets (for directory static-sets:
 	// blobrefs to child dirs/files)
+
+	Target string `json:"target"` // for keep and share objects
 }
 
 type BytesPart struct {
@@ -483,6 +485,14 @@ func NewShareRef(authType string, target *blobref.BlobRef, transitive bool) map[
 	return m
 }
 
+// NewKeep returns a keep object, to be signed, expressing the
+// intent to keep target from being garbage collected.
+func NewKeep(target *blobref.BlobRef) map[string]interface{} {
+	m := newCamliMap(1, "keep")
+	m["target"] = target.String()
+	return m
+}
+
 func NewClaim(permaNode *blobref.BlobRef, claimType string) map[string]interface{} {
 	m := newCamliMap(1, "claim")
 	m["permaNode"] = permaNode.String()
@@ -135,3 +135,26 @@ func TestStringFromMixedArray(t *testing.T) {
 		}
 	}
 }
+
+func TestRefs(t *testing.T) {
+	const (
+		signer = "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+		pn     = "sha1-62cdb7020ff920e5aa642c3d4066950dd1f01f4d"
+		part   = "sha1-bbe960a25ea311d21d40669e93df2003ba9b90a2"
+	)
+	var refs []string
+	for _, js := range []string{
+		`{"camliType": "claim", "camliSigner": "` + signer + `", "permaNode": "` + pn + `", "value": "not a blobref"}`,
+		`{"camliType": "file", "parts": [{"size": 3, "blobRef": "` + part + `"}]}`,
+		`{"camliType": "permanode", "target": "` + part + `"}`,
+	} {
+		ss := new(Superset)
+		if err := json.Unmarshal([]byte(js), ss); err != nil {
+			t.Fatalf("Unmarshal %s: %v", js, err)
+		}
+		for _, r := range ss.Refs() {
+			refs = append(refs, r.Field+" "+r.Ref.String())
+		}
+	}
+	ExpectString(t, "camliSigner "+signer+",permaNode "+pn+",parts "+part, strings.Join(refs, ","), "refs")
+}
@@ -114,6 +114,12 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		case "camli/search/claims":
 			sh.serveClaims(rw, req)
 			return
+		case "camli/search/history":
+			sh.serveHistory(rw, req)
+			return
+		case "camli/search/diff":
+			sh.serveDiff(rw, req)
+			return
 		case "camli/search/files":
 			sh.serveFiles(rw, req)
 			return
@@ -123,6 +129,12 @@ func (sh *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		case "camli/search/signerpaths":
 			sh.serveSignerPaths(rw, req)
 			return
+		case "camli/search/query":
+			sh.serveQuery(rw, req)
+			return
+		case "camli/search/content":
+			sh.servePermanodesWithContent(rw, req)
+			return
 		}
 	}
 
@@ -136,15 +148,21 @@ func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Reque
 	ret := jsonMap()
 	defer httputil.ReturnJson(rw, ret)
 
+	maxResults, ok := maxResultsParam(ret, req)
+	if !ok {
+		return
+	}
+
 	ch := make(chan *Result)
 	errch := make(chan os.Error)
 	go func() {
-		errch <- sh.index.GetRecentPermanodes(ch, []*blobref.BlobRef{sh.owner}, 50)
+		errch <- sh.index.GetRecentPermanodes(ch, []*blobref.BlobRef{sh.owner}, maxResults, req.FormValue("continue"))
 	}()
 
 	dr := sh.NewDescribeRequest()
 
 	recent := jsonMapList()
+	cont := ""
 	for res := range ch {
 		dr.Describe(res.BlobRef, 2)
 		jm := jsonMap()
@@ -153,6 +171,7 @@ func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Reque
 		t := time.SecondsToUTC(res.LastModTime)
 		jm["modtime"] = t.Format(time.RFC3339)
 		recent = append(recent, jm)
+		cont = res.Continue
 	}
 
 	err := <-errch
@@ -163,6 +182,72 @@ func (sh *Handler) serveRecentPermanodes(rw http.ResponseWriter, req *http.Reque
 	}
 
 	ret["recent"] = recent
+	if len(recent) == maxResults && cont != "" {
+		ret["continue"] = cont
+	}
+	dr.PopulateJSON(ret)
+}
+
+// maxResultsParam returns the value of the optional "max" parameter,
+// capped at maxPermanodes. On error, it populates ret and returns
+// false.
+func maxResultsParam(ret map[string]interface{}, req *http.Request) (int, bool) {
+	maxResults := maxPermanodes
+	if max := req.FormValue("max"); max != "" {
+		maxR, err := strconv.Atoi(max)
+		if err != nil || maxR <= 0 {
+			ret["error"] = "Invalid 'max' param"
+			ret["errorType"] = "input"
+			return 0, false
+		}
+		if maxR < maxResults {
+			maxResults = maxR
+		}
+	}
+	return maxResults, true
+}
+
+// serveQuery serves permanodes matching the "q" parameter, in the
+// syntax described at Query, with at most "max" results.
+func (sh *Handler) serveQuery(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+	defer httputil.ReturnJson(rw, ret)
+	defer setPanicError(ret)
+
+	q, err := ParseQuery(mustGet(req, "q"))
+	if err != nil {
+		ret["error"] = err.String()
+		ret["errorType"] = "input"
+		return
+	}
+	maxResults, ok := maxResultsParam(ret, req)
+	if !ok {
+		return
+	}
+
+	results, truncated, err := sh.Query(q, maxResults)
+	if err != nil {
+		ret["error"] = err.String()
+		ret["errorType"] = "server"
+		if _, ok := err.(queryError); ok {
+			ret["errorType"] = "input"
+		}
+		return
+	}
+
+	dr := sh.NewDescribeRequest()
+	jresults := jsonMapList()
+	for _, res := range results {
+		dr.Describe(res.BlobRef, 2)
+		jm := jsonMap()
+		jm["blobref"] = res.BlobRef.String()
+		jm["owner"] = res.Signer.String()
+		jm["modtime"] = time.SecondsToUTC(res.LastModTime).Format(time.RFC3339)
+		jresults = append(jresults, jm)
+	}
+	ret["query"] = q.String()
+	ret["results"] = jresults
+	ret["truncated"] = truncated
 	dr.PopulateJSON(ret)
 }
 
@@ -186,20 +271,12 @@ func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Req
 	if attr == "" {               // and force fuzzy in that case.
 		fuzzyMatch = true
 	}
-	maxResults := maxPermanodes
-	max := req.FormValue("max")
-	if max != "" {
-		maxR, err := strconv.Atoi(max)
-		if err != nil {
-			log.Printf("Invalid specified max results 'max': " + err.String())
-			return
-		}
-		if maxR < maxResults {
-			maxResults = maxR
-		}
+	maxResults, ok := maxResultsParam(ret, req)
+	if !ok {
+		return
 	}
 
-	ch := make(chan *blobref.BlobRef, buffered)
+	ch := make(chan *Result, buffered)
 	errch := make(chan os.Error)
 	go func() {
 		errch <- sh.index.SearchPermanodesWithAttr(ch,
@@ -207,17 +284,20 @@ func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Req
 				Query:      value,
 				Signer:     signer,
 				FuzzyMatch: fuzzyMatch,
-				MaxResults: maxResults})
+				MaxResults: maxResults,
+				Continue:   req.FormValue("continue")})
 	}()
 
 	dr := sh.NewDescribeRequest()
 
 	withAttr := jsonMapList()
+	cont := ""
 	for res := range ch {
-		dr.Describe(res, 2)
+		dr.Describe(res.BlobRef, 2)
 		jm := jsonMap()
-		jm["permanode"] = res.String()
+		jm["permanode"] = res.BlobRef.String()
 		withAttr = append(withAttr, jm)
+		cont = res.Continue
 	}
 
 	err := <-errch
@@ -228,6 +308,55 @@ func (sh *Handler) servePermanodesWithAttr(rw http.ResponseWriter, req *http.Req
 	}
 
 	ret["withAttr"] = withAttr
+	if len(withAttr) == maxResults && cont != "" {
+		ret["continue"] = cont
+	}
+	dr.PopulateJSON(ret)
+}
+
+// servePermanodesWithContent serves permanodes whose camliContent is
+// a text file containing all the words of the "q" parameter.
+func (sh *Handler) servePermanodesWithContent(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+	defer httputil.ReturnJson(rw, ret)
+	defer setPanicError(ret)
+
+	q := mustGet(req, "q")
+	signer := sh.owner
+	if s := req.FormValue("signer"); s != "" {
+		signer = blobref.MustParse(s)
+	}
+	maxResults, ok := maxResultsParam(ret, req)
+	if !ok {
+		return
+	}
+
+	ch := make(chan *Result, buffered)
+	errch := make(chan os.Error)
+	go func() {
+		errch <- sh.index.SearchPermanodesWithContent(ch,
+			&PermanodeByContentRequest{
+				Query:      q,
+				Signer:     signer,
+				MaxResults: maxResults,
+			})
+	}()
+
+	dr := sh.NewDescribeRequest()
+	withContent := jsonMapList()
+	for res := range ch {
+		dr.Describe(res.BlobRef, 2)
+		jm := jsonMap()
+		jm["permanode"] = res.BlobRef.String()
+		withContent = append(withContent, jm)
+	}
+
+	if err := <-errch; err != nil {
+		ret["error"] = err.String()
+		ret["errorType"] = "server"
+		return
+	}
+	ret["withContent"] = withContent
 	dr.PopulateJSON(ret)
 }
 
@@ -249,20 +378,7 @@ func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
 		jclaims := jsonMapList()
 
 		for _, claim := range claims {
-			jclaim := jsonMap()
-			jclaim["blobref"] = claim.BlobRef.String()
-			jclaim["signer"] = claim.Signer.String()
-			jclaim["permanode"] = claim.Permanode.String()
-			jclaim["date"] = claim.Date.Format(time.RFC3339)
-			jclaim["type"] = claim.Type
-			if claim.Attr != "" {
-				jclaim["attr"] = claim.Attr
-			}
-			if claim.Value != "" {
-				jclaim["value"] = claim.Value
-			}
-
-			jclaims = append(jclaims, jclaim)
+			jclaims = append(jclaims, claimJSON(claim))
 		}
 		ret["claims"] = jclaims
 	}
@@ -270,8 +386,114 @@ func (sh *Handler) serveClaims(rw http.ResponseWriter, req *http.Request) {
 	httputil.ReturnJson(rw, ret)
 }
 
+func claimJSON(claim *Claim) map[string]interface{} {
+	jclaim := jsonMap()
+	jclaim["blobref"] = claim.BlobRef.String()
+	jclaim["signer"] = claim.Signer.String()
+	jclaim["permanode"] = claim.Permanode.String()
+	jclaim["date"] = claim.Date.Format(time.RFC3339)
+	jclaim["type"] = claim.Type
+	if claim.Attr != "" {
+		jclaim["attr"] = claim.Attr
+	}
+	if claim.Value != "" {
+		jclaim["value"] = claim.Value
+	}
+	return jclaim
+}
+
+// serveHistory returns the change log of a permanode: each of its
+// attribute claims, oldest first, with the attribute's values before
+// and after the claim.
+func (sh *Handler) serveHistory(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+	defer httputil.ReturnJson(rw, ret)
+
+	pn := blobref.Parse(req.FormValue("permanode"))
+	if pn == nil {
+		ret["error"] = "Missing or invalid 'permanode' param"
+		ret["errorType"] = "input"
+		return
+	}
+	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
+	if err != nil {
+		ret["error"] = err.String()
+		ret["errorType"] = "server"
+		return
+	}
+	jchanges := jsonMapList()
+	for _, c := range ClaimHistory(claims) {
+		jc := claimJSON(c.Claim)
+		jc["old"] = c.Old
+		jc["new"] = c.New
+		jc["changed"] = c.Changed()
+		jchanges = append(jchanges, jc)
+	}
+	ret["permanode"] = pn.String()
+	ret["changes"] = jchanges
+}
+
+// serveDiff returns the attributes of a permanode which differ
+// between the times given by the "from" and "to" params. A missing
+// "from" means before the first claim; a missing "to" means now.
+func (sh *Handler) serveDiff(rw http.ResponseWriter, req *http.Request) {
+	ret := jsonMap()
+	defer httputil.ReturnJson(rw, ret)
+
+	pn := blobref.Parse(req.FormValue("permanode"))
+	if pn == nil {
+		ret["error"] = "Missing or invalid 'permanode' param"
+		ret["errorType"] = "input"
+		return
+	}
+	var times [2]*time.Time
+	for i, param := range []string{"from", "to"} {
+		v := req.FormValue(param)
+		if v == "" {
+			continue
+		}
+		sec, err := parseQueryDate(v)
+		if err != nil {
+			ret["error"] = fmt.Sprintf("Invalid '%s' param: %v", param, err)
+			ret["errorType"] = "input"
+			return
+		}
+		times[i] = time.SecondsToUTC(sec)
+		ret[param] = times[i].Format(time.RFC3339)
+	}
+	from, to := times[0], times[1]
+
+	claims, err := sh.index.GetOwnerClaims(pn, sh.owner)
+	if err != nil {
+		ret["error"] = err.String()
+		ret["errorType"] = "server"
+		return
+	}
+	fromAttr := make(url.Values)
+	if from != nil {
+		fromAttr = claimsAttr(claimsAsOf(claims, from))
+	}
+	toClaims := claims
+	if to != nil {
+		toClaims = claimsAsOf(claims, to)
+	}
+	toAttr := claimsAttr(toClaims)
+
+	jdiffs := jsonMapList()
+	for _, d := range DiffAttrs(fromAttr, toAttr) {
+		jd := jsonMap()
+		jd["attr"] = d.Attr
+		jd["old"] = d.Old
+		jd["new"] = d.New
+		jdiffs = append(jdiffs, jd)
+	}
+	ret["permanode"] = pn.String()
+	ret["changes"] = jdiffs
+}
+
 type DescribeRequest struct {
 	sh *Handler
+	at *time.Time // if non-nil, describe permanodes as of this time
 
 	lk   sync.Mutex // protects following:
 	m    map[string]*DescribedBlob
@@ -464,8 +686,16 @@ func (dp *DescribedPermanode) jsonMap() map[string]interface{} {
 // of blobs and their summarized descriptions.  Use DescribeBlob
 // one or more times before calling PopulateJSON or Result.
 func (sh *Handler) NewDescribeRequest() *DescribeRequest {
+	return sh.NewDescribeRequestAt(nil)
+}
+
+// NewDescribeRequestAt is like NewDescribeRequest, but permanodes
+// are described as they were at the given time, by only applying
+// claims dated at or before it. A nil at means now.
+func (sh *Handler) NewDescribeRequestAt(at *time.Time) *DescribeRequest {
 	return &DescribeRequest{
 		sh:   sh,
+		at:   at,
 		m:    make(map[string]*DescribedBlob),
 		errs: make(map[string]os.Error),
 		wg:   new(sync.WaitGroup),
@@ -637,7 +867,18 @@ func (sh *Handler) serveDescribe(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	dr := sh.NewDescribeRequest()
+	var at *time.Time
+	if s := req.FormValue("at"); s != "" {
+		sec, err := parseQueryDate(s)
+		if err != nil {
+			ret["error"] = "Invalid 'at' param: " + err.String()
+			ret["errorType"] = "input"
+			return
+		}
+		at = time.SecondsToUTC(sec)
+	}
+
+	dr := sh.NewDescribeRequestAt(at)
 	dr.Describe(br, 4)
 	dr.PopulateJSON(ret)
 }
@@ -669,54 +910,17 @@ func (sh *Handler) serveFiles(rw http.ResponseWriter, req *http.Request) {
 }
 
 func (dr *DescribeRequest) populatePermanodeFields(pi *DescribedPermanode, pn, signer *blobref.BlobRef, depth int) {
-	pi.Attr = make(url.Values)
-	attr := pi.Attr
-
 	claims, err := dr.sh.index.GetOwnerClaims(pn, signer)
 	if err != nil {
 		log.Printf("Error getting claims of %s: %v", pn.String(), err)
 		dr.addError(pn, fmt.Errorf("Error getting claims of %s: %v", pn.String(), err))
 		return
 	}
-
-	sort.Sort(claims)
-claimLoop:
-	for _, cl := range claims {
-		switch cl.Type {
-		case "del-attribute":
-			if cl.Value == "" {
-				attr[cl.Attr] = nil, false
-			} else {
-				sl := attr[cl.Attr]
-				filtered := make([]string, 0, len(sl))
-				for _, val := range sl {
-					if val != cl.Value {
-						filtered = append(filtered, val)
-					}
-				}
-				attr[cl.Attr] = filtered
-			}
-		case "set-attribute":
-			attr[cl.Attr] = nil, false
-			fallthrough
-		case "add-attribute":
-			if cl.Value == "" {
-				continue
-			}
-			sl, ok := attr[cl.Attr]
-			if ok {
-				for _, exist := range sl {
-					if exist == cl.Value {
-						continue claimLoop
-					}
-				}
-			} else {
-				sl = make([]string, 0, 1)
-				attr[cl.Attr] = sl
-			}
-			attr[cl.Attr] = append(sl, cl.Value)
-		}
+	if dr.at != nil {
+		claims = claimsAsOf(claims, dr.at)
 	}
+	pi.Attr = claimsAttr(claims)
+	attr := pi.Attr
 
 	// If the content permanode is now known, look up its type
 	if content, ok := attr["camliContent"]; ok && len(content) > 0 {
@@ -735,6 +939,68 @@ claimLoop:
 	}
 }
 
+// claimsAsOf returns the claims dated at or before at.
+func claimsAsOf(claims ClaimList, at *time.Time) ClaimList {
+	sec := at.Seconds()
+	old := make(ClaimList, 0, len(claims))
+	for _, cl := range claims {
+		if cl.Date != nil && cl.Date.Seconds() <= sec {
+			old = append(old, cl)
+		}
+	}
+	return old
+}
+
+// claimsAttr returns the attributes of a permanode resulting from
+// applying claims in date order. claims is sorted in place.
+func claimsAttr(claims ClaimList) url.Values {
+	attr := make(url.Values)
+	sort.Sort(claims)
+	for _, cl := range claims {
+		applyClaim(attr, cl)
+	}
+	return attr
+}
+
+// applyClaim modifies attr according to the attribute claim cl.
+// Other claim types are ignored.
+func applyClaim(attr url.Values, cl *Claim) {
+	switch cl.Type {
+	case "del-attribute":
+		if cl.Value == "" {
+			attr[cl.Attr] = nil, false
+		} else {
+			sl := attr[cl.Attr]
+			filtered := make([]string, 0, len(sl))
+			for _, val := range sl {
+				if val != cl.Value {
+					filtered = append(filtered, val)
+				}
+			}
+			attr[cl.Attr] = filtered
+		}
+	case "set-attribute":
+		attr[cl.Attr] = nil, false
+		fallthrough
+	case "add-attribute":
+		if cl.Value == "" {
+			return
+		}
+		sl, ok := attr[cl.Attr]
+		if ok {
+			for _, exist := range sl {
+				if exist == cl.Value {
+					return
+				}
+			}
+		} else {
+			sl = make([]string, 0, 1)
+			attr[cl.Attr] = sl
+		}
+		attr[cl.Attr] = append(sl, cl.Value)
+	}
+}
+
 func mustGet(req *http.Request, param string) string {
 	v := req.FormValue(param)
 	if v == "" {
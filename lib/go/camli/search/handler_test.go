@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"json"
 	"testing"
+	"time"
 
 	"camli/blobref"
 	"camli/test"
@@ -120,3 +121,40 @@ func TestDescribe(t *testing.T) {
 		}
 	}
 }
+
+func TestDescribeAt(t *testing.T) {
+	idx := test.NewFakeIndex()
+	pn := blobref.MustParse("perma-123")
+	idx.AddMeta(pn, "application/json; camliType=permanode", 123)
+	idx.AddClaim(owner, pn, "set-attribute", "title", "old") // at 1s
+	idx.AddClaim(owner, pn, "add-attribute", "tag", "x")     // at 2s
+	idx.AddClaim(owner, pn, "set-attribute", "title", "new") // at 3s
+	idx.AddClaim(owner, pn, "del-attribute", "tag", "")      // at 4s
+
+	h := NewHandler(idx, owner)
+	for _, tt := range []struct {
+		at         int64 // seconds; 0 means now
+		title, tag string
+	}{
+		{0, "new", ""},
+		{1, "old", ""},
+		{2, "old", "x"},
+		{3, "new", "x"},
+	} {
+		var at *time.Time
+		if tt.at != 0 {
+			at = time.SecondsToUTC(tt.at)
+		}
+		des, err := h.NewDescribeRequestAt(at).DescribeSync(pn)
+		if err != nil {
+			t.Fatalf("DescribeSync at %d: %v", tt.at, err)
+		}
+		attr := des.Permanode.Attr
+		if g, e := attr.Get("title"), tt.title; g != e {
+			t.Errorf("at %d: title = %q; want %q", tt.at, g, e)
+		}
+		if g, e := attr.Get("tag"), tt.tag; g != e {
+			t.Errorf("at %d: tag = %q; want %q", tt.at, g, e)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"sort"
+
+	"url"
+)
+
+// An AttrChange describes the effect of one attribute claim on a
+// permanode: the values of Attr before and after Claim was applied.
+// Either of Old or New may be empty.
+type AttrChange struct {
+	Claim    *Claim
+	Attr     string
+	Old, New []string
+}
+
+// Changed reports whether the claim modified the attribute at all.
+// Re-adding an existing value, or deleting a missing one, doesn't.
+func (c *AttrChange) Changed() bool {
+	return !equalValues(c.Old, c.New)
+}
+
+// ClaimHistory replays claims in date order and returns the change
+// log of the permanode they apply to, one AttrChange per attribute
+// claim, with the same semantics as the attributes returned by
+// describe. claims is sorted in place.
+func ClaimHistory(claims ClaimList) []*AttrChange {
+	sort.Sort(claims)
+	attr := make(url.Values)
+	var changes []*AttrChange
+	for _, cl := range claims {
+		switch cl.Type {
+		case "set-attribute", "add-attribute", "del-attribute":
+		default:
+			continue
+		}
+		old := copyValues(attr[cl.Attr])
+		applyClaim(attr, cl)
+		changes = append(changes, &AttrChange{
+			Claim: cl,
+			Attr:  cl.Attr,
+			Old:   old,
+			New:   copyValues(attr[cl.Attr]),
+		})
+	}
+	return changes
+}
+
+// An AttrDiff is the difference in one attribute between two
+// states of a permanode.
+type AttrDiff struct {
+	Attr     string
+	Old, New []string
+}
+
+// DiffAttrs returns the attributes which differ between from and
+// to, sorted by attribute name.
+func DiffAttrs(from, to url.Values) []*AttrDiff {
+	names := make(map[string]bool)
+	for k := range from {
+		names[k] = true
+	}
+	for k := range to {
+		names[k] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for k := range names {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	var diffs []*AttrDiff
+	for _, k := range sorted {
+		if equalValues(from[k], to[k]) {
+			continue
+		}
+		diffs = append(diffs, &AttrDiff{
+			Attr: k,
+			Old:  copyValues(from[k]),
+			New:  copyValues(to[k]),
+		})
+	}
+	return diffs
+}
+
+func copyValues(vals []string) []string {
+	c := make([]string, len(vals))
+	copy(c, vals)
+	return c
+}
+
+func equalValues(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
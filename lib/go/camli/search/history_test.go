@@ -0,0 +1,95 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search_test
+
+import (
+	. "camli/search"
+
+	"fmt"
+	"testing"
+	"time"
+
+	"url"
+)
+
+func claim(sec int64, typ, attr, value string) *Claim {
+	return &Claim{
+		Date:  time.SecondsToUTC(sec),
+		Type:  typ,
+		Attr:  attr,
+		Value: value,
+	}
+}
+
+func TestClaimHistory(t *testing.T) {
+	claims := ClaimList{
+		claim(3, "add-attribute", "tag", "b"),
+		claim(1, "set-attribute", "title", "old"),
+		claim(2, "add-attribute", "tag", "a"),
+		claim(4, "set-attribute", "title", "new"),
+		claim(5, "add-attribute", "tag", "a"),
+		claim(6, "del-attribute", "tag", "a"),
+		claim(7, "del-attribute", "tag", ""),
+	}
+	want := []string{
+		"title [] -> [old] true",
+		"tag [] -> [a] true",
+		"tag [a] -> [a b] true",
+		"title [old] -> [new] true",
+		"tag [a b] -> [a b] false",
+		"tag [a b] -> [b] true",
+		"tag [b] -> [] true",
+	}
+	changes := ClaimHistory(claims)
+	if len(changes) != len(want) {
+		t.Fatalf("got %d changes; want %d", len(changes), len(want))
+	}
+	for i, c := range changes {
+		got := fmt.Sprintf("%s %v -> %v %v", c.Attr, c.Old, c.New, c.Changed())
+		if got != want[i] {
+			t.Errorf("change %d = %q; want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestDiffAttrs(t *testing.T) {
+	from := url.Values{
+		"title": {"old"},
+		"tag":   {"a", "b"},
+		"gone":  {"x"},
+	}
+	to := url.Values{
+		"title": {"new"},
+		"tag":   {"a", "b"},
+		"added": {"y"},
+	}
+	want := []string{
+		"added [] -> [y]",
+		"gone [x] -> []",
+		"title [old] -> [new]",
+	}
+	diffs := DiffAttrs(from, to)
+	if len(diffs) != len(want) {
+		t.Fatalf("got %d diffs; want %d", len(diffs), len(want))
+	}
+	for i, d := range diffs {
+		got := fmt.Sprintf("%s %v -> %v", d.Attr, d.Old, d.New)
+		if got != want[i] {
+			t.Errorf("diff %d = %q; want %q", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,624 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"camli/blobref"
+)
+
+// A Query is a parsed permanode search expression, such as:
+//
+//	tag:vacation and -tag:private and after:2011-05-01
+//
+// Terms are combined with "and", "or" and "not" (or a leading "-"),
+// in decreasing order of precedence "not", "and", "or", and may be
+// grouped with parentheses. Adjacent terms are implicitly and-ed.
+// Values containing spaces may be double-quoted. The terms are:
+//
+//	attr:value    the attribute attr has the value value
+//	attr~value    a value of attr contains value, ignoring case
+//	word          any attribute value contains word, ignoring case
+//	mime:type     the content's MIME type is type, or starts
+//	              with type's prefix if type ends in "*"
+//	size:range    the content's size is in range, one of "N",
+//	              ">N", ">=N", "<N", "<=N" or "N-M", where
+//	              sizes may end in K, M or G
+//	after:date    the last claim is at or after date
+//	before:date   the last claim is before date
+//	signer:ref    the permanode's signer is the blobref ref
+//
+// Only the handler owner's permanodes are searched, so Handler.Query
+// rejects signer terms naming anyone else.
+//
+// Dates are either "2006-01-02" or RFC 3339. The "content" of a
+// permanode is its camliContent, or the permanode itself if it
+// has none.
+type Query struct {
+	expr expr
+}
+
+// ParseQuery parses a query in the syntax described at Query.
+func ParseQuery(s string) (q *Query, err os.Error) {
+	toks, err := lexQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{toks: toks}
+	defer func() {
+		if r := recover(); r != nil {
+			qe, ok := r.(queryError)
+			if !ok {
+				panic(r)
+			}
+			q, err = nil, qe
+		}
+	}()
+	e := p.parseOr()
+	if p.pos < len(p.toks) {
+		p.fail("unexpected %q", p.toks[p.pos].text)
+	}
+	return &Query{e}, nil
+}
+
+// String returns the query in a canonical, fully parenthesized form.
+func (q *Query) String() string {
+	return q.expr.String()
+}
+
+// queryCandidate is a permanode being matched against a query.
+type queryCandidate struct {
+	sh      *Handler
+	pn      *blobref.BlobRef
+	signer  *blobref.BlobRef
+	modTime int64 // seconds since epoch of the latest claim
+	attr    map[string][]string
+
+	contentLoaded bool
+	mime          string
+	size          int64
+	contentErr    os.Error
+}
+
+// content returns the MIME type and size of the candidate's
+// content, looking them up in the index on first use.
+func (c *queryCandidate) content() (mime string, size int64, err os.Error) {
+	if c.contentLoaded {
+		return c.mime, c.size, c.contentErr
+	}
+	c.contentLoaded = true
+	br := c.pn
+	if cs := c.attr["camliContent"]; len(cs) > 0 {
+		if cbr := blobref.Parse(cs[len(cs)-1]); cbr != nil {
+			br = cbr
+		}
+	}
+	c.mime, c.size, c.contentErr = c.sh.index.GetBlobMimeType(br)
+	if c.contentErr == nil && c.mime == camliTypePrefix+"file" {
+		var fi *FileInfo
+		fi, c.contentErr = c.sh.index.GetFileInfo(br)
+		if c.contentErr == nil {
+			c.mime, c.size = fi.MimeType, fi.Size
+		}
+	}
+	return c.mime, c.size, c.contentErr
+}
+
+type expr interface {
+	match(c *queryCandidate) bool
+	String() string
+}
+
+type andExpr struct{ a, b expr }
+type orExpr struct{ a, b expr }
+type notExpr struct{ e expr }
+
+func (e *andExpr) match(c *queryCandidate) bool { return e.a.match(c) && e.b.match(c) }
+func (e *orExpr) match(c *queryCandidate) bool  { return e.a.match(c) || e.b.match(c) }
+func (e *notExpr) match(c *queryCandidate) bool { return !e.e.match(c) }
+
+func (e *andExpr) String() string { return "(" + e.a.String() + " and " + e.b.String() + ")" }
+func (e *orExpr) String() string  { return "(" + e.a.String() + " or " + e.b.String() + ")" }
+func (e *notExpr) String() string { return "-" + e.e.String() }
+
+// attrPred matches attribute values. An empty attr means any
+// attribute.
+type attrPred struct {
+	attr, value string
+	fuzzy       bool // substring match, ignoring case
+}
+
+func (p *attrPred) matchValue(v string) bool {
+	if p.fuzzy {
+		return strings.Contains(strings.ToLower(v), strings.ToLower(p.value))
+	}
+	return v == p.value
+}
+
+func (p *attrPred) match(c *queryCandidate) bool {
+	if p.attr != "" {
+		for _, v := range c.attr[p.attr] {
+			if p.matchValue(v) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, vv := range c.attr {
+		for _, v := range vv {
+			if p.matchValue(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *attrPred) String() string {
+	switch {
+	case p.attr == "":
+		return quoteQueryValue(p.value)
+	case p.fuzzy:
+		return p.attr + "~" + quoteQueryValue(p.value)
+	}
+	return p.attr + ":" + quoteQueryValue(p.value)
+}
+
+type mimePred struct {
+	mime string
+}
+
+func (p *mimePred) match(c *queryCandidate) bool {
+	mime, _, err := c.content()
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(p.mime, "*") {
+		return strings.HasPrefix(mime, p.mime[:len(p.mime)-1])
+	}
+	return mime == p.mime
+}
+
+func (p *mimePred) String() string { return "mime:" + quoteQueryValue(p.mime) }
+
+// sizePred matches content sizes in [min, max].
+type sizePred struct {
+	min, max int64
+	text     string
+}
+
+func (p *sizePred) match(c *queryCandidate) bool {
+	_, size, err := c.content()
+	return err == nil && size >= p.min && size <= p.max
+}
+
+func (p *sizePred) String() string { return "size:" + p.text }
+
+// datePred matches candidates whose latest claim is at or after
+// sec (if after) or before sec (if !after).
+type datePred struct {
+	after bool
+	sec   int64
+	text  string
+}
+
+func (p *datePred) match(c *queryCandidate) bool {
+	if p.after {
+		return c.modTime >= p.sec
+	}
+	return c.modTime < p.sec
+}
+
+func (p *datePred) String() string {
+	if p.after {
+		return "after:" + p.text
+	}
+	return "before:" + p.text
+}
+
+type signerPred struct {
+	signer *blobref.BlobRef
+}
+
+func (p *signerPred) match(c *queryCandidate) bool {
+	return c.signer != nil && c.signer.String() == p.signer.String()
+}
+
+func (p *signerPred) String() string { return "signer:" + p.signer.String() }
+
+// checkSigners returns an error if e has a signer term for anyone
+// but owner, whose permanodes are the only ones searched.
+func checkSigners(e expr, owner *blobref.BlobRef) os.Error {
+	switch e := e.(type) {
+	case *andExpr:
+		if err := checkSigners(e.a, owner); err != nil {
+			return err
+		}
+		return checkSigners(e.b, owner)
+	case *orExpr:
+		if err := checkSigners(e.a, owner); err != nil {
+			return err
+		}
+		return checkSigners(e.b, owner)
+	case *notExpr:
+		return checkSigners(e.e, owner)
+	case *signerPred:
+		if e.signer.String() != owner.String() {
+			return queryError(fmt.Sprintf("signer:%s: only permanodes signed by %s are searched", e.signer, owner))
+		}
+	}
+	return nil
+}
+
+// indexedPred returns an exact match of an indexed attribute which
+// every match of e satisfies, or nil if there is none. It's used to
+// find candidates with the index instead of scanning recent
+// permanodes. Fuzzy matches aren't used, as indexers only match
+// words, or substrings, of some attributes' values.
+func indexedPred(e expr) *attrPred {
+	switch e := e.(type) {
+	case *attrPred:
+		if e.fuzzy || !IsIndexedAttribute(e.attr) {
+			return nil
+		}
+		return e
+	case *andExpr:
+		if p := indexedPred(e.a); p != nil {
+			return p
+		}
+		return indexedPred(e.b)
+	}
+	return nil
+}
+
+func quoteQueryValue(v string) string {
+	switch strings.ToLower(v) {
+	case "and", "or", "not", "-":
+		return strconv.Quote(v)
+	}
+	if v == "" || strings.IndexFunc(v, func(r int) bool {
+		return unicode.IsSpace(r) || r == '(' || r == ')' || r == '"'
+	}) >= 0 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+type queryError string
+
+func (e queryError) String() string { return string(e) }
+
+type queryToken struct {
+	text   string
+	quoted bool // whether any part of the token was quoted
+}
+
+func (t queryToken) is(keyword string) bool {
+	return !t.quoted && strings.ToLower(t.text) == keyword
+}
+
+// lexQuery splits s into words, parentheses and "-" negations.
+// Double quotes group characters into a word and are removed.
+func lexQuery(s string) ([]queryToken, os.Error) {
+	var toks []queryToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(' || c == ')':
+			toks = append(toks, queryToken{text: s[i : i+1]})
+			i++
+			continue
+		case c == '-' && i+1 < len(s) && s[i+1] != ' ':
+			toks = append(toks, queryToken{text: "-"})
+			i++
+			continue
+		}
+		var word []byte
+		quoted := false
+		for i < len(s) && strings.IndexRune(" \t\n\r()", int(s[i])) < 0 {
+			if s[i] != '"' {
+				word = append(word, s[i])
+				i++
+				continue
+			}
+			quoted = true
+			end := strings.Index(s[i+1:], `"`)
+			if end < 0 {
+				return nil, fmt.Errorf("search: unterminated quote in query %q", s)
+			}
+			word = append(word, s[i+1:i+1+end]...)
+			i += end + 2
+		}
+		toks = append(toks, queryToken{text: string(word), quoted: quoted})
+	}
+	return toks, nil
+}
+
+type queryParser struct {
+	toks []queryToken
+	pos  int
+}
+
+func (p *queryParser) fail(format string, args ...interface{}) {
+	panic(queryError("search: invalid query: " + fmt.Sprintf(format, args...)))
+}
+
+func (p *queryParser) peek() (queryToken, bool) {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos], true
+	}
+	return queryToken{}, false
+}
+
+func (p *queryParser) parseOr() expr {
+	e := p.parseAnd()
+	for {
+		t, ok := p.peek()
+		if !ok || !t.is("or") {
+			return e
+		}
+		p.pos++
+		e = &orExpr{e, p.parseAnd()}
+	}
+	panic("unreachable")
+}
+
+func (p *queryParser) parseAnd() expr {
+	e := p.parseUnary()
+	for {
+		t, ok := p.peek()
+		if !ok || t.is("or") || (!t.quoted && t.text == ")") {
+			return e
+		}
+		if t.is("and") {
+			p.pos++
+		}
+		e = &andExpr{e, p.parseUnary()}
+	}
+	panic("unreachable")
+}
+
+func (p *queryParser) parseUnary() expr {
+	t, ok := p.peek()
+	if !ok {
+		p.fail("unexpected end of query")
+	}
+	p.pos++
+	switch {
+	case t.is("not") || (!t.quoted && t.text == "-"):
+		return &notExpr{p.parseUnary()}
+	case !t.quoted && t.text == "(":
+		e := p.parseOr()
+		if t, ok := p.peek(); !ok || t.quoted || t.text != ")" {
+			p.fail("missing )")
+		}
+		p.pos++
+		return e
+	case t.is("and") || t.is("or") || (!t.quoted && t.text == ")"):
+		p.fail("unexpected %q", t.text)
+	}
+	return p.parseTerm(t.text)
+}
+
+func (p *queryParser) parseTerm(term string) expr {
+	i := strings.IndexAny(term, ":~")
+	if i <= 0 {
+		if term == "" {
+			p.fail("empty term")
+		}
+		return &attrPred{value: term, fuzzy: true}
+	}
+	key, value := term[:i], term[i+1:]
+	if term[i] == '~' {
+		return &attrPred{attr: key, value: value, fuzzy: true}
+	}
+	switch key {
+	case "mime":
+		return &mimePred{value}
+	case "size":
+		min, max, err := parseSizeRange(value)
+		if err != nil {
+			p.fail("%v", err)
+		}
+		return &sizePred{min, max, value}
+	case "after", "before":
+		sec, err := parseQueryDate(value)
+		if err != nil {
+			p.fail("%v", err)
+		}
+		return &datePred{key == "after", sec, value}
+	case "signer":
+		br := blobref.Parse(value)
+		if br == nil {
+			p.fail("invalid signer blobref %q", value)
+		}
+		return &signerPred{br}
+	}
+	return &attrPred{attr: key, value: value}
+}
+
+func parseQueryDate(s string) (sec int64, err os.Error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		t, err = time.Parse(time.RFC3339, s)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q; want YYYY-MM-DD or RFC 3339", s)
+	}
+	return t.Seconds(), nil
+}
+
+func parseSize(s string) (int64, os.Error) {
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			mult = 1 << 10
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'G', 'g':
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.Atoi64(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+const maxSize = 1<<63 - 1
+
+func parseSizeRange(s string) (min, max int64, err os.Error) {
+	switch {
+	case strings.HasPrefix(s, ">="):
+		min, err = parseSize(s[2:])
+		return min, maxSize, err
+	case strings.HasPrefix(s, ">"):
+		min, err = parseSize(s[1:])
+		return min + 1, maxSize, err
+	case strings.HasPrefix(s, "<="):
+		max, err = parseSize(s[2:])
+		return 0, max, err
+	case strings.HasPrefix(s, "<"):
+		max, err = parseSize(s[1:])
+		return 0, max - 1, err
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		if min, err = parseSize(s[:i]); err != nil {
+			return
+		}
+		max, err = parseSize(s[i+1:])
+		return
+	}
+	min, err = parseSize(s)
+	return min, min, err
+}
+
+// queryScanLimit is the number of candidate permanodes considered
+// by a query: the most recently modified permanodes, or the first
+// matches of an exact indexed attribute lookup.
+const queryScanLimit = 1000
+
+// Query returns up to limit permanodes of the handler's owner
+// matching q, most recently modified first. truncated reports
+// whether more permanodes may match, either because there were
+// more than limit matches or because queryScanLimit candidates
+// were considered and others went unexamined.
+func (sh *Handler) Query(q *Query, limit int) (results []*Result, truncated bool, err os.Error) {
+	if err := checkSigners(q.expr, sh.owner); err != nil {
+		return nil, false, err
+	}
+	ch := make(chan *Result, buffered)
+	errch := make(chan os.Error, 1)
+	if p := indexedPred(q.expr); p != nil {
+		go func() {
+			errch <- sh.index.SearchPermanodesWithAttr(ch, &PermanodeByAttrRequest{
+				Attribute:  p.attr,
+				Query:      p.value,
+				Signer:     sh.owner,
+				MaxResults: queryScanLimit,
+			})
+		}()
+	} else {
+		go func() {
+			errch <- sh.index.GetRecentPermanodes(ch, []*blobref.BlobRef{sh.owner}, queryScanLimit, "")
+		}()
+	}
+
+	var matches resultsByModTime
+	seen := make(map[string]bool)
+	var matchErr os.Error
+	candidates := 0
+	for res := range ch {
+		candidates++
+		if seen[res.BlobRef.String()] || matchErr != nil {
+			continue
+		}
+		seen[res.BlobRef.String()] = true
+		ok, err := sh.matchQuery(q, res)
+		if err != nil {
+			matchErr = err
+			continue
+		}
+		if ok {
+			res.Continue = ""
+			matches = append(matches, res)
+		}
+	}
+	if err := <-errch; err != nil {
+		return nil, false, err
+	}
+	if matchErr != nil {
+		return nil, false, matchErr
+	}
+	truncated = candidates >= queryScanLimit
+	sort.Sort(matches)
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+		truncated = true
+	}
+	return matches, truncated, nil
+}
+
+// matchQuery reports whether res matches q, filling in res's
+// Signer and LastModTime from its claims if unset.
+func (sh *Handler) matchQuery(q *Query, res *Result) (bool, os.Error) {
+	claims, err := sh.index.GetOwnerClaims(res.BlobRef, sh.owner)
+	if err != nil {
+		return false, err
+	}
+	for _, cl := range claims {
+		if sec := cl.Date.Seconds(); sec > res.LastModTime {
+			res.LastModTime = sec
+		}
+	}
+	if res.Signer == nil {
+		res.Signer = sh.owner
+	}
+	c := &queryCandidate{
+		sh:      sh,
+		pn:      res.BlobRef,
+		signer:  res.Signer,
+		modTime: res.LastModTime,
+		attr:    claimsAttr(claims),
+	}
+	return q.expr.match(c), nil
+}
+
+type resultsByModTime []*Result
+
+func (s resultsByModTime) Len() int      { return len(s) }
+func (s resultsByModTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s resultsByModTime) Less(i, j int) bool {
+	if s[i].LastModTime != s[j].LastModTime {
+		return s[i].LastModTime > s[j].LastModTime
+	}
+	return s[i].BlobRef.String() < s[j].BlobRef.String()
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search_test
+
+import (
+	. "camli/search"
+
+	"fmt"
+	"strings"
+	"testing"
+
+	"camli/blobref"
+	"camli/test"
+)
+
+var parseQueryTests = []struct {
+	in   string
+	want string // canonical form, or error substring if err
+	err  bool
+}{
+	{in: "tag:vacation", want: "tag:vacation"},
+	{in: "tag:vacation and -tag:private and after:2011-05-01",
+		want: "((tag:vacation and -tag:private) and after:2011-05-01)"},
+	{in: "tag:a tag:b or tag:c", want: "((tag:a and tag:b) or tag:c)"},
+	{in: "tag:a and (tag:b OR not tag:c)", want: "(tag:a and (tag:b or -tag:c))"},
+	{in: `title:"summer trip" title~Sum`, want: `(title:"summer trip" and title~Sum)`},
+	{in: `"and" or`, want: `unexpected end`, err: true},
+	{in: `"and"`, want: `"and"`},
+	{in: "beach mime:image/* size:>1M", want: "((beach and mime:image/*) and size:>1M)"},
+	{in: "signer:sha1-abc before:2011-01-01T00:00:00Z", want: "(signer:sha1-abc and before:2011-01-01T00:00:00Z)"},
+
+	{in: "", want: "unexpected end", err: true},
+	{in: "tag:a and", want: "unexpected end", err: true},
+	{in: "(tag:a", want: "missing )", err: true},
+	{in: "tag:a)", want: `unexpected ")"`, err: true},
+	{in: "or tag:a", want: `unexpected "or"`, err: true},
+	{in: `title:"oops`, want: "unterminated quote", err: true},
+	{in: "size:lots", want: "invalid size", err: true},
+	{in: "after:yesterday", want: "invalid date", err: true},
+	{in: "signer:bogus", want: "invalid signer", err: true},
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, tt := range parseQueryTests {
+		q, err := ParseQuery(tt.in)
+		if tt.err {
+			if err == nil || !strings.Contains(err.String(), tt.want) {
+				t.Errorf("ParseQuery(%q) error = %v; want error containing %q", tt.in, err, tt.want)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.in, err)
+			continue
+		}
+		if got := q.String(); got != tt.want {
+			t.Errorf("ParseQuery(%q) = %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	idx := test.NewFakeIndex()
+	beach := blobref.MustParse("perma-1")
+	office := blobref.MustParse("perma-2")
+	party := blobref.MustParse("perma-3")
+	idx.AddClaim(owner, beach, "add-attribute", "tag", "vacation")
+	idx.AddClaim(owner, beach, "set-attribute", "title", "Beach day")
+	idx.AddClaim(owner, beach, "set-attribute", "camliContent", "photo-1")
+	idx.AddMeta(blobref.MustParse("photo-1"), "image/jpeg", 2<<20)
+	idx.AddClaim(owner, office, "add-attribute", "tag", "work")
+	idx.AddClaim(owner, party, "add-attribute", "tag", "vacation")
+	idx.AddClaim(owner, party, "add-attribute", "tag", "private") // clock 6
+	idx.AddClaim(owner, office, "set-attribute", "title", "Office")
+
+	h := NewHandler(idx, owner)
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"tag:vacation", []string{"perma-3", "perma-1"}},
+		{"tag:vacation -tag:private", []string{"perma-1"}},
+		{"tag:work or tag:private", []string{"perma-2", "perma-3"}},
+		{"beach", []string{"perma-1"}},
+		{"title~OFF", []string{"perma-2"}},
+		{"mime:image/* size:>1M", []string{"perma-1"}},
+		{"size:<1M", []string{}},
+		{"after:1970-01-01T00:00:06Z", []string{"perma-2", "perma-3"}},
+		{"before:1970-01-01T00:00:06Z", []string{"perma-1"}},
+		{"signer:" + owner.String() + " -tag:work", []string{"perma-3", "perma-1"}},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.q, err)
+			continue
+		}
+		res, _, err := h.Query(q, 10)
+		if err != nil {
+			t.Errorf("Query(%q): %v", tt.q, err)
+			continue
+		}
+		got := []string{}
+		for _, r := range res {
+			got = append(got, r.BlobRef.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Query(%q) = %v; want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+// Terms the indexers can't look up are matched by scanning recent
+// permanodes instead.
+func TestQueryNonIndexed(t *testing.T) {
+	idx := test.NewFakeIndex()
+	beach := blobref.MustParse("perma-1")
+	office := blobref.MustParse("perma-2")
+	idx.AddClaim(owner, beach, "set-attribute", "title", "Beach day")
+	idx.AddClaim(owner, beach, "set-attribute", "color", "blue")
+	idx.AddClaim(owner, office, "set-attribute", "title", "Office")
+	idx.AddClaim(owner, office, "set-attribute", "color", "red")
+	idx.AddClaim(owner, office, "set-attribute", "description", "Quarterly planning")
+
+	h := NewHandler(idx, owner)
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"color:red", []string{"perma-2"}},
+		{"quarterly", []string{"perma-2"}},
+		{"description~PLAN", []string{"perma-2"}},
+		{"title~ach", []string{"perma-1"}},
+		{"title:Office color:blue", []string{}},
+		{"title:Office color:red", []string{"perma-2"}},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", tt.q, err)
+			continue
+		}
+		res, _, err := h.Query(q, 10)
+		if err != nil {
+			t.Errorf("Query(%q): %v", tt.q, err)
+			continue
+		}
+		got := []string{}
+		for _, r := range res {
+			got = append(got, r.BlobRef.String())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("Query(%q) = %v; want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestQueryOtherSigner(t *testing.T) {
+	idx := test.NewFakeIndex()
+	idx.AddClaim(owner, blobref.MustParse("perma-1"), "add-attribute", "tag", "work")
+	h := NewHandler(idx, owner)
+	q, err := ParseQuery("signer:sha1-abc or tag:work")
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+	if _, _, err := h.Query(q, 10); err == nil || !strings.Contains(err.String(), "signer:sha1-abc") {
+		t.Errorf("Query with another signer: error = %v; want error naming the signer", err)
+	}
+}
+
+func TestQueryTruncated(t *testing.T) {
+	idx := test.NewFakeIndex()
+	for i := 0; i < 1001; i++ {
+		idx.AddClaim(owner, blobref.MustParse(fmt.Sprintf("perma-%d", i)), "set-attribute", "color", "red")
+	}
+	h := NewHandler(idx, owner)
+	tests := []struct {
+		q         string
+		limit     int
+		n         int
+		truncated bool
+	}{
+		{"perma-5 or color:blue", 10, 0, true}, // only the 1000 most recent are scanned
+		{"color~red", 2000, 1000, true},
+		{"color~red", 10, 10, true},
+		{"-color:red", 10, 0, true},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.q)
+		if err != nil {
+			t.Fatalf("ParseQuery(%q): %v", tt.q, err)
+		}
+		res, truncated, err := h.Query(q, tt.limit)
+		if err != nil {
+			t.Errorf("Query(%q): %v", tt.q, err)
+			continue
+		}
+		if len(res) != tt.n || truncated != tt.truncated {
+			t.Errorf("Query(%q, %d) = %d results, truncated %v; want %d, %v", tt.q, tt.limit, len(res), truncated, tt.n, tt.truncated)
+		}
+	}
+
+	idx = test.NewFakeIndex()
+	idx.AddClaim(owner, blobref.MustParse("perma-1"), "set-attribute", "color", "red")
+	h = NewHandler(idx, owner)
+	q, _ := ParseQuery("color~red")
+	res, truncated, err := h.Query(q, 10)
+	if err != nil || len(res) != 1 || truncated {
+		t.Errorf("Query of one permanode = %d results, truncated %v, %v; want 1, false, nil", len(res), truncated, err)
+	}
+}
@@ -19,6 +19,7 @@ package search
 import (
 	"camli/blobref"
 
+	"encoding/base64"
 	"os"
 	"strings"
 	"time"
@@ -28,6 +29,10 @@ type Result struct {
 	BlobRef     *blobref.BlobRef
 	Signer      *blobref.BlobRef // may be nil
 	LastModTime int64            // seconds since epoch
+
+	// Continue is an opaque token which, passed back to the Index
+	// method which sent this Result, resumes after it.
+	Continue string
 }
 
 // TODO: move this to schema or something?
@@ -72,20 +77,48 @@ type Path struct {
 	Suffix              string
 }
 
+// IsIndexedAttribute reports whether indexers index the values of
+// the attribute attr, so PermanodeByAttrRequest can find them. Only
+// "tag" and "title" values are searched by fuzzy matches.
+func IsIndexedAttribute(attr string) bool {
+	switch attr {
+	case "camliRoot", "tag", "title":
+		return true
+	}
+	return false
+}
+
 type PermanodeByAttrRequest struct {
-	Attribute  string // currently supported: "tag", "title"
+	Attribute  string // must be an IsIndexedAttribute, or "" for fuzzy matches
 	Query      string
 	Signer     *blobref.BlobRef
 	FuzzyMatch bool // by default, an exact match is required
 	MaxResults int  // optional max results
+
+	// Continue, if non-empty, is the Continue token of a Result
+	// from a previous identical request, to resume after.
+	Continue string
+}
+
+// PermanodeByContentRequest is a request to find permanodes whose
+// camliContent is a text file containing all of the words of Query.
+type PermanodeByContentRequest struct {
+	Query      string
+	Signer     *blobref.BlobRef
+	MaxResults int // optional max results
 }
 
 type Index interface {
 	// dest is closed
 	// limit is <= 0 for default.  smallest possible default is 0
+	// cont, if non-empty, is the Continue token of a Result from a
+	// previous call, to resume after. Paging is stable while new
+	// claims arrive: results are ordered by modification time, so
+	// newly modified permanodes sort before the resume point.
 	GetRecentPermanodes(dest chan *Result,
 		owner []*blobref.BlobRef,
-		limit int) os.Error
+		limit int,
+		cont string) os.Error
 
 	// SearchPermanodes finds permanodes matching the provided
 	// request and sends unique permanode blobrefs to dest.
@@ -96,10 +129,23 @@ type Index interface {
 	// are searched (as fulltext), otherwise the search is 
 	// restricted  to the named attribute.
 	//
+	// The Results sent have only BlobRef and Continue set.
+	//
 	// dest is always closed, regardless of the error return value.
-	SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef,
+	SearchPermanodesWithAttr(dest chan<- *Result,
 		request *PermanodeByAttrRequest) os.Error
 
+	// SearchPermanodesWithContent finds permanodes whose current
+	// camliContent is a file with text contents (see
+	// IsTextMimeType) containing every word of request.Query,
+	// and sends unique permanode blobrefs to dest.
+	//
+	// The Results sent have only BlobRef set.
+	//
+	// dest is always closed, regardless of the error return value.
+	SearchPermanodesWithContent(dest chan<- *Result,
+		request *PermanodeByContentRequest) os.Error
+
 	GetOwnerClaims(permaNode, owner *blobref.BlobRef) (ClaimList, os.Error)
 
 	// os.ENOENT should be returned if the blob isn't known
@@ -131,3 +177,31 @@ type Index interface {
 	// provided time 'at', or most recent if 'at' is nil.
 	PathLookup(signer, base *blobref.BlobRef, suffix string, at *time.Time) (*Path, os.Error)
 }
+
+var ErrBadContinue = os.NewError("search: invalid continuation token")
+
+// EncodeContinue returns an opaque continuation token holding
+// parts, for use by Index implementations.
+func EncodeContinue(parts ...string) string {
+	src := []byte(strings.Join(parts, "\x00"))
+	enc := base64.URLEncoding
+	buf := make([]byte, enc.EncodedLen(len(src)))
+	enc.Encode(buf, src)
+	return string(buf)
+}
+
+// DecodeContinue returns the n parts of a token made by
+// EncodeContinue, or ErrBadContinue.
+func DecodeContinue(token string, n int) ([]string, os.Error) {
+	enc := base64.URLEncoding
+	buf := make([]byte, enc.DecodedLen(len(token)))
+	m, err := enc.Decode(buf, []byte(token))
+	if err != nil {
+		return nil, ErrBadContinue
+	}
+	parts := strings.Split(string(buf[:m]), "\x00")
+	if len(parts) != n {
+		return nil, ErrBadContinue
+	}
+	return parts, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// MaxIndexedText is the number of bytes at the start of a file's
+// contents which are indexed for full-text search.
+const MaxIndexedText = 1 << 20
+
+// Limits on the words returned by TextWords.
+const (
+	minWordLen = 2
+	maxWordLen = 64
+	maxWords   = 10000
+)
+
+// textExtensions maps lowercase file name extensions to the MIME
+// type of files the magic package can't sniff.
+var textExtensions = map[string]string{
+	".txt":      "text/plain",
+	".text":     "text/plain",
+	".md":       "text/x-markdown",
+	".markdown": "text/x-markdown",
+	".htm":      "text/html",
+	".html":     "text/html",
+	".json":     "application/json",
+}
+
+// IsTextMimeType reports whether files of the given MIME type have
+// their contents indexed for full-text search.
+func IsTextMimeType(mime string) bool {
+	if i := strings.Index(mime, ";"); i != -1 {
+		mime = mime[:i]
+	}
+	return strings.HasPrefix(mime, "text/") || mime == "application/json"
+}
+
+// A ContentText is an io.Writer which keeps the first MaxIndexedText
+// bytes of a file's contents written to it, for TextWords.
+type ContentText struct {
+	buf []byte
+}
+
+func (ct *ContentText) Write(p []byte) (int, os.Error) {
+	if n := MaxIndexedText - len(ct.buf); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		ct.buf = append(ct.buf, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// MimeType returns the MIME type of the contents, given the file's
+// name and the MIME type sniffed by the magic package, which may be
+// empty. Unsniffed contents which look like text are "text/plain".
+func (ct *ContentText) MimeType(fileName, sniffed string) string {
+	if sniffed != "" {
+		return sniffed
+	}
+	if mime, ok := textExtensions[strings.ToLower(path.Ext(fileName))]; ok {
+		return mime
+	}
+	if looksLikeText(ct.buf) {
+		return "text/plain"
+	}
+	return ""
+}
+
+// Words returns the distinct lowercased words of the contents, in
+// sorted order, if they're of a text MIME type (as returned by
+// MimeType), or else nil. Tags are stripped from HTML.
+func (ct *ContentText) Words(fileName, sniffed string) []string {
+	mime := ct.MimeType(fileName, sniffed)
+	if !IsTextMimeType(mime) || !looksLikeText(ct.buf) {
+		return nil
+	}
+	text := string(ct.buf)
+	if strings.HasPrefix(mime, "text/html") {
+		text = stripTags(text)
+	}
+	return TextWords(text)
+}
+
+// TextWords returns the distinct lowercased words of text, in sorted
+// order. A word is a run of letters and digits.
+func TextWords(text string) []string {
+	seen := make(map[string]bool)
+	words := []string{}
+	for _, w := range strings.FieldsFunc(text, isWordSeparator) {
+		if len(w) < minWordLen || len(w) > maxWordLen {
+			continue
+		}
+		w = strings.ToLower(w)
+		if seen[w] {
+			continue
+		}
+		seen[w] = true
+		words = append(words, w)
+		if len(words) == maxWords {
+			break
+		}
+	}
+	sort.Strings(words)
+	return words
+}
+
+func isWordSeparator(r int) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// looksLikeText reports whether b is mostly valid UTF-8 without
+// control characters other than whitespace.
+func looksLikeText(b []byte) bool {
+	bad := 0
+	for _, r := range string(b) {
+		switch {
+		case r == 0:
+			return false
+		case r == 0xFFFD: // invalid UTF-8
+			bad++
+		case r < ' ' && r != '\t' && r != '\n' && r != '\r' && r != '\f':
+			bad++
+		}
+	}
+	return bad*100 <= len(b)
+}
+
+// stripTags replaces HTML tags, comments and the contents of script
+// and style elements with spaces.
+func stripTags(s string) string {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		if s[i] != '<' {
+			buf = append(buf, s[i])
+			i++
+			continue
+		}
+		end := ">"
+		switch {
+		case hasPrefixFold(s[i:], "<!--"):
+			end = "-->"
+		case hasPrefixFold(s[i:], "<script"):
+			end = "</script>"
+		case hasPrefixFold(s[i:], "<style"):
+			end = "</style>"
+		}
+		j := indexFold(s[i:], end)
+		if j == -1 {
+			break
+		}
+		buf = append(buf, ' ')
+		i += j + len(end)
+	}
+	return string(buf)
+}
+
+// hasPrefixFold reports whether s begins with prefix, which must be
+// lower case ASCII, ignoring the case of ASCII letters. Unlike
+// lowering s, it keeps byte offsets in s valid.
+func hasPrefixFold(s, prefix string) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// indexFold is like strings.Index, using hasPrefixFold to compare.
+func indexFold(s, sub string) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if hasPrefixFold(s[i:], sub) {
+			return i
+		}
+	}
+	return -1
+}
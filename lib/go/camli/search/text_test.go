@@ -0,0 +1,82 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package search_test
+
+import (
+	. "camli/search"
+
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var textWordsTests = []struct {
+	in   string
+	want string
+}{
+	{"", "[]"},
+	{"Hello, world! hello again.", "[again hello world]"},
+	{"a I x 42 vacation-photos", "[42 photos vacation]"},
+	{"Übergröße café", "[café übergröße]"},
+}
+
+func TestTextWords(t *testing.T) {
+	for _, tt := range textWordsTests {
+		if got := fmt.Sprint(TextWords(tt.in)); got != tt.want {
+			t.Errorf("TextWords(%q) = %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+var contentTextTests = []struct {
+	fileName, sniffed, contents string
+	mime, words                 string
+}{
+	{"notes.txt", "", "Buy milk", "text/plain", "[buy milk]"},
+	{"README", "", "plain words here", "text/plain", "[here plain words]"},
+	{"doc.md", "", "# Title\n\n*emphasis*", "text/x-markdown", "[emphasis title]"},
+	{"page.html", "", "<html><script>var x;</script><b>Bold</b> text<!-- hidden --></html>",
+		"text/html", "[bold text]"},
+	{"kelvin.html", "", "<p>\u212a\u212a\u212a</p> <SCRIPT>var secret;</Script>done",
+		"text/html", "[done kkk]"},
+	{"data.json", "", `{"key": "value"}`, "application/json", "[key value]"},
+	{"photo.jpg", "image/jpeg", "\xff\xd8\xff\xe0 jpeg", "image/jpeg", "[]"},
+	{"blob.bin", "", "\x00\x01\x02binary", "", "[]"},
+}
+
+func TestContentText(t *testing.T) {
+	for _, tt := range contentTextTests {
+		ct := new(ContentText)
+		ct.Write([]byte(tt.contents))
+		if got := ct.MimeType(tt.fileName, tt.sniffed); got != tt.mime {
+			t.Errorf("%s: MimeType = %q; want %q", tt.fileName, got, tt.mime)
+		}
+		if got := fmt.Sprint(ct.Words(tt.fileName, tt.sniffed)); got != tt.words {
+			t.Errorf("%s: Words = %s; want %s", tt.fileName, got, tt.words)
+		}
+	}
+
+	ct := new(ContentText)
+	big := strings.Repeat("word ", MaxIndexedText)
+	n, err := ct.Write([]byte(big))
+	if n != len(big) || err != nil {
+		t.Errorf("Write of %d bytes = %d, %v", len(big), n, err)
+	}
+	if got := fmt.Sprint(ct.Words("big.txt", "")); got != "[word]" {
+		t.Errorf("Words of big file = %s; want [word]", got)
+	}
+}
@@ -244,6 +244,8 @@ type Config struct {
 	jsonconfig.Obj
 	UIPath     string // Not valid until after InstallHandlers
 	configPath string // Filesystem path
+
+	hl *handlerLoader // set by InstallHandlers
 }
 
 func Load(configPath string) (*Config, os.Error) {
@@ -316,5 +318,18 @@ func (config *Config) InstallHandlers(hi HandlerInstaller, baseURL string) (oute
 		}
 	}
 	hl.setupAll()
+	config.hl = hl
 	return nil
 }
+
+// GetStorage returns the storage configured at prefix, such as
+// "/bs/". It's only valid after InstallHandlers.
+func (config *Config) GetStorage(prefix string) (blobserver.Storage, os.Error) {
+	if config.hl == nil {
+		return nil, os.NewError("serverconfig: GetStorage called before InstallHandlers")
+	}
+	if _, ok := config.hl.config[prefix]; !ok {
+		return nil, fmt.Errorf("serverconfig: no handler configured at prefix %q", prefix)
+	}
+	return config.hl.GetStorage(prefix)
+}
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -35,6 +37,7 @@ type FakeIndex struct {
 	ownerClaims     map[string]search.ClaimList // "<permanode>/<owner>" -> ClaimList
 	signerAttrValue map[string]*blobref.BlobRef // "<signer>\0<attr>\0<value>" -> blobref
 	path            map[string]*search.Path     // "<signer>\0<base>\0<suffix>" -> path
+	contentWords    map[string][]string         // file schema blobref -> words
 
 	cllk  sync.Mutex
 	clock int64
@@ -49,6 +52,7 @@ func NewFakeIndex() *FakeIndex {
 		ownerClaims:     make(map[string]search.ClaimList),
 		signerAttrValue: make(map[string]*blobref.BlobRef),
 		path:            make(map[string]*search.Path),
+		contentWords:    make(map[string][]string),
 	}
 }
 
@@ -98,6 +102,14 @@ func (fi *FakeIndex) AddClaim(owner, permanode *blobref.BlobRef, claimType, attr
 	}
 }
 
+// AddContentText indexes text as the contents of the file schema
+// blob file.
+func (fi *FakeIndex) AddContentText(file *blobref.BlobRef, text string) {
+	fi.lk.Lock()
+	defer fi.lk.Unlock()
+	fi.contentWords[file.String()] = search.TextWords(text)
+}
+
 func (fi *FakeIndex) AddSignerAttrValue(signer *blobref.BlobRef, attr, val string, latest *blobref.BlobRef) {
 	fi.lk.Lock()
 	defer fi.lk.Unlock()
@@ -108,13 +120,178 @@ func (fi *FakeIndex) AddSignerAttrValue(signer *blobref.BlobRef, attr, val strin
 // Interface implementation
 //
 
-func (fi *FakeIndex) GetRecentPermanodes(dest chan *search.Result, owner []*blobref.BlobRef, limit int) os.Error {
-	panic("NOIMPL")
+type recentResults []*search.Result
+
+func (s recentResults) Len() int      { return len(s) }
+func (s recentResults) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s recentResults) Less(i, j int) bool {
+	if s[i].LastModTime != s[j].LastModTime {
+		return s[i].LastModTime > s[j].LastModTime
+	}
+	return s[i].BlobRef.String() > s[j].BlobRef.String()
 }
 
-// TODO(mpl): write real tests
-func (fi *FakeIndex) SearchPermanodesWithAttr(dest chan<- *blobref.BlobRef, request *search.PermanodeByAttrRequest) os.Error {
-	panic("NOIMPL")
+func (fi *FakeIndex) GetRecentPermanodes(dest chan *search.Result, owner []*blobref.BlobRef, limit int, cont string) os.Error {
+	defer close(dest)
+	var after *search.Result
+	if cont != "" {
+		parts, err := search.DecodeContinue(cont, 2)
+		if err != nil {
+			return err
+		}
+		mod, err := strconv.Atoi64(parts[0])
+		if err != nil {
+			return search.ErrBadContinue
+		}
+		after = &search.Result{BlobRef: blobref.Parse(parts[1]), LastModTime: mod}
+		if after.BlobRef == nil {
+			return search.ErrBadContinue
+		}
+	}
+
+	var results recentResults
+	fi.lk.Lock()
+	for key, claims := range fi.ownerClaims {
+		slash := strings.Index(key, "/")
+		for _, o := range owner {
+			if key[slash+1:] != o.String() {
+				continue
+			}
+			res := &search.Result{BlobRef: blobref.MustParse(key[:slash]), Signer: o}
+			for _, cl := range claims {
+				if sec := cl.Date.Seconds(); sec > res.LastModTime {
+					res.LastModTime = sec
+				}
+			}
+			if after != nil && !(recentResults{after, res}).Less(0, 1) {
+				continue
+			}
+			res.Continue = search.EncodeContinue(strconv.Itoa64(res.LastModTime), res.BlobRef.String())
+			results = append(results, res)
+		}
+	}
+	fi.lk.Unlock()
+
+	sort.Sort(results)
+	for i, res := range results {
+		if limit > 0 && i == limit {
+			break
+		}
+		dest <- res
+	}
+	return nil
+}
+
+// fakeIndexed reports whether the real indexers would search
+// values of attr for request: attributes for which
+// search.IsIndexedAttribute is true, and only "tag" and "title" for
+// fuzzy matches of any attribute.
+func fakeIndexed(request *search.PermanodeByAttrRequest, attr string) bool {
+	if request.Attribute != "" {
+		return attr == request.Attribute && search.IsIndexedAttribute(attr)
+	}
+	return request.FuzzyMatch && (attr == "tag" || attr == "title")
+}
+
+// SearchPermanodesWithAttr finds permanodes with any claim setting
+// or adding a matching value of an indexed attribute, even if since
+// deleted. Results are in blobref order.
+func (fi *FakeIndex) SearchPermanodesWithAttr(dest chan<- *search.Result, request *search.PermanodeByAttrRequest) os.Error {
+	defer close(dest)
+	after := ""
+	if request.Continue != "" {
+		parts, err := search.DecodeContinue(request.Continue, 1)
+		if err != nil {
+			return err
+		}
+		after = parts[0]
+	}
+
+	var matches []string
+	fi.lk.Lock()
+	for key, claims := range fi.ownerClaims {
+		slash := strings.Index(key, "/")
+		if key[slash+1:] != request.Signer.String() || key[:slash] <= after {
+			continue
+		}
+		for _, cl := range claims {
+			if cl.Type != "set-attribute" && cl.Type != "add-attribute" {
+				continue
+			}
+			if !fakeIndexed(request, cl.Attr) {
+				continue
+			}
+			if (!request.FuzzyMatch && cl.Value == request.Query) || (request.FuzzyMatch &&
+				strings.Contains(strings.ToLower(cl.Value), strings.ToLower(request.Query))) {
+				matches = append(matches, key[:slash])
+				break
+			}
+		}
+	}
+	fi.lk.Unlock()
+
+	sort.Strings(matches)
+	for i, pn := range matches {
+		if request.MaxResults > 0 && i == request.MaxResults {
+			break
+		}
+		dest <- &search.Result{
+			BlobRef:  blobref.MustParse(pn),
+			Continue: search.EncodeContinue(pn),
+		}
+	}
+	return nil
+}
+
+// SearchPermanodesWithContent finds permanodes whose last
+// camliContent claim names a file added with AddContentText
+// containing all the query words. Results are in blobref order.
+func (fi *FakeIndex) SearchPermanodesWithContent(dest chan<- *search.Result, request *search.PermanodeByContentRequest) os.Error {
+	defer close(dest)
+	words := search.TextWords(request.Query)
+	if len(words) == 0 {
+		return nil
+	}
+
+	var matches []string
+	fi.lk.Lock()
+	for key, claims := range fi.ownerClaims {
+		slash := strings.Index(key, "/")
+		if key[slash+1:] != request.Signer.String() {
+			continue
+		}
+		content := ""
+		for _, cl := range claims {
+			if cl.Attr == "camliContent" {
+				content = cl.Value
+			}
+		}
+		if hasWords(fi.contentWords[content], words) {
+			matches = append(matches, key[:slash])
+		}
+	}
+	fi.lk.Unlock()
+
+	sort.Strings(matches)
+	for i, pn := range matches {
+		if request.MaxResults > 0 && i == request.MaxResults {
+			break
+		}
+		dest <- &search.Result{BlobRef: blobref.MustParse(pn)}
+	}
+	return nil
+}
+
+// hasWords reports whether the sorted list have contains all of
+// want.
+func hasWords(have, want []string) bool {
+	for _, w := range want {
+		i := sort.SearchStrings(have, w)
+		if i == len(have) || have[i] != w {
+			return false
+		}
+	}
+	return true
 }
 
 func (fi *FakeIndex) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (search.ClaimList, os.Error) {
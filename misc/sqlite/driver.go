@@ -0,0 +1,180 @@
+package sqlite
+
+// This file registers a "sqlite3" driver with the camli/db package.
+// The data source name is the database's filename.
+
+import (
+	"os"
+	"sync"
+
+	"camli/db"
+	"camli/db/dbimpl"
+)
+
+func init() {
+	db.Register("sqlite3", &driver{conns: make(map[string]*sharedConn)})
+}
+
+// driver shares a single SQLite connection between all dbimpl.Conns
+// open on the same file. Our VFS doesn't implement file locking yet,
+// so separate connections to one file aren't safe, while a single
+// connection may be used from multiple threads.
+type driver struct {
+	mu    sync.Mutex
+	conns map[string]*sharedConn // filename -> conn
+}
+
+// sharedConn is a connection shared by several dbimpl.Conns. Each
+// call into SQLite holds its mutex, so that, for instance, Changes
+// reports the changes of the statement just executed rather than of
+// another user's.
+type sharedConn struct {
+	mu   sync.Mutex
+	c    *Conn
+	refs int // guarded by driver.mu
+}
+
+func (d *driver) Open(name string) (dbimpl.Conn, os.Error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sc, ok := d.conns[name]
+	if !ok {
+		c, err := Open(name)
+		if err != nil {
+			return nil, err
+		}
+		sc = &sharedConn{c: c}
+		d.conns[name] = sc
+	}
+	sc.refs++
+	return &conn{d: d, name: name, sc: sc}, nil
+}
+
+func (d *driver) release(name string) os.Error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	sc, ok := d.conns[name]
+	if !ok {
+		return nil
+	}
+	sc.refs--
+	if sc.refs > 0 {
+		return nil
+	}
+	d.conns[name] = nil, false
+	return sc.c.Close()
+}
+
+type conn struct {
+	d      *driver
+	name   string
+	sc     *sharedConn
+	closed bool
+}
+
+func (c *conn) Prepare(query string) (dbimpl.Stmt, os.Error) {
+	c.sc.mu.Lock()
+	defer c.sc.mu.Unlock()
+	s, err := c.sc.c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{sc: c.sc, s: s}, nil
+}
+
+func (c *conn) Close() os.Error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.d.release(c.name)
+}
+
+func (c *conn) Begin() (dbimpl.Tx, os.Error) {
+	// A transaction would apply to every user of the shared
+	// connection.
+	return nil, os.NewError("sqlite: transactions not supported")
+}
+
+type stmt struct {
+	sc *sharedConn
+	s  *Stmt
+}
+
+func (s *stmt) Close() os.Error {
+	s.sc.mu.Lock()
+	defer s.sc.mu.Unlock()
+	return s.s.Finalize()
+}
+
+func (s *stmt) NumInput() int {
+	return s.s.NumInput()
+}
+
+// bind binds args, which are restricted to the dbimpl subset of
+// types. The db package passes strings as []byte; bind those as
+// text so they compare equal to SQL string literals. s.sc.mu must
+// be held.
+func (s *stmt) bind(args []interface{}) os.Error {
+	bargs := make([]interface{}, len(args))
+	for i, v := range args {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		bargs[i] = v
+	}
+	return s.s.Exec(bargs...)
+}
+
+func (s *stmt) Exec(args []interface{}) (dbimpl.Result, os.Error) {
+	s.sc.mu.Lock()
+	defer s.sc.mu.Unlock()
+	if err := s.bind(args); err != nil {
+		return nil, err
+	}
+	for s.s.Next() {
+	}
+	if err := s.s.Error(); err != nil {
+		return nil, err
+	}
+	return dbimpl.RowsAffected(s.sc.c.Changes()), nil
+}
+
+func (s *stmt) Query(args []interface{}) (dbimpl.Rows, os.Error) {
+	s.sc.mu.Lock()
+	defer s.sc.mu.Unlock()
+	if err := s.bind(args); err != nil {
+		return nil, err
+	}
+	return &rows{sc: s.sc, s: s.s, cols: s.s.Columns()}, nil
+}
+
+// rows steps its statement holding the shared connection's mutex
+// for each row only, so other users may run statements between rows.
+type rows struct {
+	sc   *sharedConn
+	s    *Stmt
+	cols []string
+}
+
+func (r *rows) Columns() []string {
+	return r.cols
+}
+
+func (r *rows) Close() os.Error {
+	r.sc.mu.Lock()
+	defer r.sc.mu.Unlock()
+	return r.s.Reset()
+}
+
+func (r *rows) Next(dest []interface{}) os.Error {
+	r.sc.mu.Lock()
+	defer r.sc.mu.Unlock()
+	if !r.s.Next() {
+		if err := r.s.Error(); err != nil {
+			return err
+		}
+		return os.EOF
+	}
+	return r.s.Values(dest)
+}
@@ -0,0 +1,118 @@
+package sqlite
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"camli/db"
+)
+
+func TestDriver(t *testing.T) {
+	td, err := ioutil.TempDir("", "go-sqlite-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	d, err := db.Open("sqlite3", filepath.Join(td, "foo.db"))
+	if err != nil {
+		t.Fatalf("db.Open: %v", err)
+	}
+	if _, err := d.Exec("CREATE TABLE foo (name VARCHAR(200), age INTEGER)"); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	for _, age := range []int{3, 5, 7} {
+		if _, err := d.Exec("INSERT INTO foo VALUES (?, ?)", "name", age); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+	}
+	res, err := d.Exec("UPDATE foo SET name='other' WHERE age > ?", 4)
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n != 2 {
+		t.Errorf("RowsAffected = %d; want 2", n)
+	}
+
+	var count int64
+	if err := d.QueryRow("SELECT COUNT(*) FROM foo WHERE name = ?", "other").Scan(&count); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("count = %d; want 2", count)
+	}
+
+	rows, err := d.Query("SELECT name, age FROM foo ORDER BY age")
+	if err != nil {
+		t.Fatalf("Query: %v", err)
+	}
+	var got []string
+	for rows.Next() {
+		var name string
+		var age int64
+		if err := rows.Scan(&name, &age); err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		got = append(got, name)
+	}
+	if err := rows.Error(); err != nil {
+		t.Fatalf("rows.Error: %v", err)
+	}
+	rows.Close()
+	if len(got) != 3 || got[0] != "name" || got[2] != "other" {
+		t.Errorf("got names %q", got)
+	}
+}
+
+func TestConcurrentExec(t *testing.T) {
+	td, err := ioutil.TempDir("", "go-sqlite-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(td)
+
+	d, err := db.Open("sqlite3", filepath.Join(td, "foo.db"))
+	if err != nil {
+		t.Fatalf("db.Open: %v", err)
+	}
+	if _, err := d.Exec("CREATE TABLE foo (grp INTEGER, n INTEGER)"); err != nil {
+		t.Fatalf("create table: %v", err)
+	}
+	// Group g has g+1 rows.
+	const groups = 8
+	for g := 0; g < groups; g++ {
+		for i := 0; i <= g; i++ {
+			if _, err := d.Exec("INSERT INTO foo VALUES (?, 0)", g); err != nil {
+				t.Fatalf("insert: %v", err)
+			}
+		}
+	}
+
+	// Each update reports its own rows, however the shared
+	// connection's users interleave.
+	errc := make(chan string, groups)
+	for g := 0; g < groups; g++ {
+		go func(g int) {
+			for i := 0; i < 50; i++ {
+				res, err := d.Exec("UPDATE foo SET n = n + 1 WHERE grp = ?", g)
+				if err != nil {
+					errc <- err.String()
+					return
+				}
+				if n, _ := res.RowsAffected(); n != int64(g+1) {
+					errc <- fmt.Sprintf("group %d: RowsAffected = %d", g, n)
+					return
+				}
+			}
+			errc <- ""
+		}(g)
+	}
+	for g := 0; g < groups; g++ {
+		if e := <-errc; e != "" {
+			t.Error(e)
+		}
+	}
+}
@@ -182,9 +182,28 @@ func (s *Stmt) Exec(args ...interface{}) os.Error {
 		return os.NewError(fmt.Sprintf("incorrect argument count: have %d want %d", len(args), n))
 	}
 
+	s.err = nil
 	for i, v := range args {
 		var str string
 		switch v := v.(type) {
+		case nil:
+			if rv := C.sqlite3_bind_null(s.stmt, C.int(i+1)); rv != 0 {
+				return s.c.error(rv)
+			}
+			continue
+
+		case int64:
+			if rv := C.sqlite3_bind_int64(s.stmt, C.int(i+1), C.sqlite3_int64(v)); rv != 0 {
+				return s.c.error(rv)
+			}
+			continue
+
+		case float64:
+			if rv := C.sqlite3_bind_double(s.stmt, C.int(i+1), C.double(v)); rv != 0 {
+				return s.c.error(rv)
+			}
+			continue
+
 		case []byte:
 			var p *byte
 			if len(v) > 0 {
@@ -216,6 +235,62 @@ func (s *Stmt) Exec(args ...interface{}) os.Error {
 	return nil
 }
 
+// NumInput returns the number of parameters in the statement.
+func (s *Stmt) NumInput() int {
+	return int(C.sqlite3_bind_parameter_count(s.stmt))
+}
+
+// Columns returns the names of the statement's result columns.
+func (s *Stmt) Columns() []string {
+	n := int(C.sqlite3_column_count(s.stmt))
+	cols := make([]string, n)
+	for i := 0; i < n; i++ {
+		cols[i] = C.GoString(C.sqlite3_column_name(s.stmt, C.int(i)))
+	}
+	return cols
+}
+
+// Values copies the current row into dest, which must have one
+// element per result column. Integer columns are returned as int64,
+// floats as float64, NULL as nil, and text and blobs as []byte.
+func (s *Stmt) Values(dest []interface{}) os.Error {
+	n := int(C.sqlite3_column_count(s.stmt))
+	if n != len(dest) {
+		return os.NewError("incorrect argument count")
+	}
+	for i := range dest {
+		switch C.sqlite3_column_type(s.stmt, C.int(i)) {
+		case C.SQLITE_INTEGER:
+			dest[i] = int64(C.sqlite3_column_int64(s.stmt, C.int(i)))
+		case C.SQLITE_FLOAT:
+			dest[i] = float64(C.sqlite3_column_double(s.stmt, C.int(i)))
+		case C.SQLITE_NULL:
+			dest[i] = nil
+		default:
+			n := C.sqlite3_column_bytes(s.stmt, C.int(i))
+			p := C.sqlite3_column_blob(s.stmt, C.int(i))
+			if p == nil && n > 0 {
+				return os.NewError("got nil blob")
+			}
+			// Copy, since p is only valid until the next step.
+			data := make([]byte, int(n))
+			if n > 0 {
+				copy(data, (*[1 << 30]byte)(unsafe.Pointer(p))[0:n])
+			}
+			dest[i] = data
+		}
+	}
+	return nil
+}
+
+// Reset resets the statement so it may be executed again.
+func (s *Stmt) Reset() os.Error {
+	if rv := C.sqlite3_reset(s.stmt); rv != 0 {
+		return s.c.error(rv)
+	}
+	return nil
+}
+
 func (s *Stmt) Error() os.Error {
 	return s.err
 }
@@ -288,6 +363,12 @@ func (s *Stmt) Finalize() os.Error {
 	return nil
 }
 
+// Changes returns the number of rows modified by the most recently
+// completed INSERT, UPDATE or DELETE statement.
+func (c *Conn) Changes() int {
+	return int(C.sqlite3_changes(c.db))
+}
+
 func (c *Conn) Close() os.Error {
 	rv := C.sqlite3_close(c.db)
 	if rv != 0 {
@@ -25,17 +25,27 @@ import (
 	"os"
 	"path/filepath"
 
+	"camli/blobref"
+	"camli/fsck"
+	"camli/gc"
 	"camli/osutil"
+	"camli/reindex"
 	"camli/serverconfig"
 	"camli/webserver"
 
 	// Storage options:
+	_ "camli/blobserver/compress"
 	_ "camli/blobserver/cond"
+	_ "camli/blobserver/diskcache"
+	_ "camli/blobserver/diskpacked"
+	_ "camli/blobserver/encrypt"
 	_ "camli/blobserver/localdisk"
+	_ "camli/blobserver/memory"
 	_ "camli/blobserver/remote"
 	_ "camli/blobserver/replica"
 	_ "camli/blobserver/s3"
 	_ "camli/blobserver/shard"
+	_ "camli/kvindexer"    // indexer, but uses storage interface
 	_ "camli/mysqlindexer" // indexer, but uses storage interface
 	// Handlers:
 	_ "camli/search"
@@ -44,6 +54,31 @@ import (
 var flagConfigFile = flag.String("configfile", "serverconfig",
 	"Config file to use, relative to camli config dir root, or blank to not use config files.")
 
+var (
+	flagReindex = flag.String("reindex", "",
+		"If non-empty, the prefix of an index (e.g. /index-mysql/) to rebuild from -reindexsource, instead of serving. The index must already have an up-to-date, empty schema.")
+	flagReindexSource  = flag.String("reindexsource", "/bs/", "Prefix of the blob storage to reindex from.")
+	flagReindexWorkers = flag.Int("reindexworkers", 4, "Number of blobs to index in parallel when reindexing.")
+	flagReindexState   = flag.String("reindexstate", "",
+		"If non-empty, file recording reindex progress, to resume an interrupted -reindex run.")
+
+	flagFsck = flag.String("fsck", "",
+		"If non-empty, the prefix of a blob storage (e.g. /bs/) to verify, instead of serving.")
+	flagFsckQuarantine = flag.Bool("fsckquarantine", false,
+		"Move blobs which -fsck finds corrupt aside, if the storage supports it (e.g. into a localdisk \"quarantine\" partition).")
+	flagFsckRefs = flag.Bool("fsckrefs", false,
+		"With -fsck, also check that the storage's schema blobs don't reference missing blobs.")
+
+	flagGC = flag.String("gc", "",
+		"If non-empty, the prefix of a blob storage (e.g. /bs/) to garbage collect, instead of serving.")
+	flagGCDryRun = flag.Bool("gcdryrun", false, "Only report what -gc would remove.")
+	flagGCGrace  = flag.Int64("gcgrace", 86400, "Seconds a blob must have been unreachable before -gc removes it.")
+	flagGCState  = flag.String("gcstate", "",
+		"File recording when -gc first saw each unreachable blob, needed if -gcgrace is non-zero. Defaults to a file per storage in the config directory.")
+	flagGCOwners = flag.String("gcowners", "",
+		"If non-empty, comma-separated public key blobrefs whose signed objects are the -gc roots. By default any valid signature counts.")
+)
+
 func exitFailure(pattern string, args ...interface{}) {
 	if !strings.HasSuffix(pattern, "\n") {
 		pattern = pattern + "\n"
@@ -82,6 +117,16 @@ func main() {
 		exitFailure("Error parsing config: %v", err)
 	}
 
+	if *flagReindex != "" {
+		reindexAndExit(config)
+	}
+	if *flagFsck != "" {
+		fsckAndExit(config)
+	}
+	if *flagGC != "" {
+		gcAndExit(config)
+	}
+
 	ws.Listen()
 
 	if config.UIPath != "" {
@@ -95,3 +140,110 @@ func main() {
 	}
 	ws.Serve()
 }
+
+func reindexAndExit(config *serverconfig.Config) {
+	index, err := config.GetStorage(*flagReindex)
+	if err != nil {
+		exitFailure("Error finding index to rebuild: %v", err)
+	}
+	source, err := config.GetStorage(*flagReindexSource)
+	if err != nil {
+		exitFailure("Error finding blobs to reindex: %v", err)
+	}
+	r := &reindex.Reindexer{
+		Source:    source,
+		Index:     index,
+		Workers:   *flagReindexWorkers,
+		StateFile: *flagReindexState,
+	}
+	log.Printf("Reindexing %s from %s", *flagReindex, *flagReindexSource)
+	if err := r.Run(); err != nil {
+		exitFailure("%v", err)
+	}
+	os.Exit(0)
+}
+
+func fsckAndExit(config *serverconfig.Config) {
+	sto, err := config.GetStorage(*flagFsck)
+	if err != nil {
+		exitFailure("Error finding storage to verify: %v", err)
+	}
+	c := &fsck.Checker{
+		Storage:    sto,
+		Quarantine: *flagFsckQuarantine,
+	}
+	log.Printf("Verifying %s", *flagFsck)
+	rep, err := c.Run()
+	if err != nil {
+		exitFailure("%v", err)
+	}
+	for _, p := range rep.Problems {
+		fmt.Println(p)
+	}
+	for _, path := range rep.Stray {
+		fmt.Printf("stray file: %s\n", path)
+	}
+	log.Printf("%v", rep)
+	ok := rep.OK()
+	if *flagFsckRefs {
+		rrep, err := (&fsck.RefChecker{Storage: sto}).Run()
+		if err != nil {
+			exitFailure("%v", err)
+		}
+		for _, rr := range rrep.Roots {
+			fmt.Printf("root %s (%s):\n", rr.Root, rr.Type)
+			for _, d := range rr.Dangling {
+				fmt.Printf("\t%v\n", d)
+			}
+		}
+		log.Printf("%v", rrep)
+		ok = ok && rrep.OK()
+	}
+	if !ok {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func gcAndExit(config *serverconfig.Config) {
+	sto, err := config.GetStorage(*flagGC)
+	if err != nil {
+		exitFailure("Error finding storage to garbage collect: %v", err)
+	}
+	stateFile := *flagGCState
+	if stateFile == "" && *flagGCGrace > 0 {
+		// One per storage, so collecting another storage doesn't
+		// reset the grace periods of this one's blobs.
+		stateFile = filepath.Join(osutil.CamliConfigDir(), "gcstate"+strings.Replace(*flagGC, "/", "-", -1))
+		if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+			exitFailure("Error creating the directory of the default -gcstate file (set -gcstate, or -gcgrace=0): %v", err)
+		}
+	}
+	c := &gc.Collector{
+		Storage:     sto,
+		DryRun:      *flagGCDryRun,
+		GracePeriod: *flagGCGrace,
+		StateFile:   stateFile,
+	}
+	if *flagGCOwners != "" {
+		for _, s := range strings.Split(*flagGCOwners, ",") {
+			br := blobref.Parse(strings.TrimSpace(s))
+			if br == nil {
+				exitFailure("Invalid -gcowners blobref %q", s)
+			}
+			c.Owners = append(c.Owners, br)
+		}
+	}
+	log.Printf("Garbage collecting %s", *flagGC)
+	rep, err := c.Run()
+	if err != nil {
+		exitFailure("%v", err)
+	}
+	if c.DryRun {
+		for _, sb := range rep.Removed {
+			fmt.Printf("%s %d\n", sb.BlobRef, sb.Size)
+		}
+	}
+	log.Printf("%v", rep)
+	os.Exit(0)
+}
@@ -25,6 +25,7 @@ import (
 
 	"camli/blobref"
 	"camli/blobserver"
+	"camli/cacher"
 	"camli/schema"
 )
 
@@ -35,7 +36,22 @@ type DownloadHandler struct {
 }
 
 func (dh *DownloadHandler) storageSeekFetcher() (blobref.SeekFetcher, os.Error) {
-	return blobref.SeekerFromStreamingFetcher(dh.Fetcher) // TODO: pass dh.Cache?
+	return cachingSeekFetcher(dh.Fetcher, dh.Cache)
+}
+
+// cachingSeekFetcher returns fetcher as a SeekFetcher. If fetcher
+// can't seek, blobs are faulted into cache, if it's a
+// blobserver.Cache, and read from there. A bounded cache, such as
+// the "diskcache" storage type, keeps that from filling the disk.
+func cachingSeekFetcher(fetcher blobref.StreamingFetcher, cache blobserver.Storage) (blobref.SeekFetcher, os.Error) {
+	sf, err := blobref.SeekerFromStreamingFetcher(fetcher)
+	if err == nil {
+		return sf, nil
+	}
+	if c, ok := cache.(blobserver.Cache); ok {
+		return cacher.NewCachingFetcher(c, fetcher), nil
+	}
+	return nil, err
 }
 
 func (dh *DownloadHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request, file *blobref.BlobRef) {
@@ -0,0 +1,125 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"html"
+	"http"
+	"os"
+	"sync"
+	"time"
+
+	"camli/auth"
+	"camli/blobserver"
+	"camli/fsck"
+	"camli/jsonconfig"
+)
+
+// FsckHandler serves a status page listing the dangling schema
+// references of a storage.
+type FsckHandler struct {
+	storageName string
+	storage     blobserver.Storage
+
+	lk      sync.Mutex // protects following
+	running *time.Time // start of the check in progress, if any
+	last    *fsck.RefReport
+	lastErr os.Error
+	lastRun *time.Time
+}
+
+func init() {
+	blobserver.RegisterHandlerConstructor("fsck", newFsckFromConfig)
+}
+
+func newFsckFromConfig(ld blobserver.Loader, conf jsonconfig.Obj) (h http.Handler, err os.Error) {
+	storageName := conf.RequiredString("storage")
+	if err = conf.Validate(); err != nil {
+		return
+	}
+	sto, err := ld.GetStorage(storageName)
+	if err != nil {
+		return
+	}
+	return &FsckHandler{storageName: storageName, storage: sto}, nil
+}
+
+// ServeHTTP shows the report of the last check. An authorized POST
+// starts a new check in the background; the page reloads itself
+// until it's done.
+func (fh *FsckHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		if !auth.IsAuthorized(req) {
+			auth.SendUnauthorized(rw)
+			return
+		}
+		fh.startCheck()
+		http.Redirect(rw, req, req.URL.Path, http.StatusFound)
+		return
+	}
+
+	fh.lk.Lock()
+	defer fh.lk.Unlock()
+
+	if fh.running != nil {
+		fmt.Fprintf(rw, "<meta http-equiv='refresh' content='5'>")
+	}
+	fmt.Fprintf(rw, "<h1>%s Dangling References</h1>", html.EscapeString(fh.storageName))
+	if fh.running != nil {
+		fmt.Fprintf(rw, "<p>Check started at %s is running...</p>", fh.running.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(rw, "<form method='POST'><input type='submit' value='Check now'></form>")
+	}
+	switch {
+	case fh.lastRun == nil:
+		fmt.Fprintf(rw, "<p>Not checked yet.</p>")
+		return
+	case fh.lastErr != nil:
+		fmt.Fprintf(rw, "<p><b>Check at %s failed: </b>%s</p>",
+			fh.lastRun.Format(time.RFC3339), html.EscapeString(fh.lastErr.String()))
+		return
+	}
+	fmt.Fprintf(rw, "<p><b>Checked at %s: </b>%s</p>",
+		fh.lastRun.Format(time.RFC3339), html.EscapeString(fh.last.String()))
+	for _, rr := range fh.last.Roots {
+		fmt.Fprintf(rw, "<h2>%s (%s)</h2><ul>", rr.Root, html.EscapeString(rr.Type))
+		for _, d := range rr.Dangling {
+			fmt.Fprintf(rw, "<li>%s</li>\n", html.EscapeString(d.String()))
+		}
+		fmt.Fprintf(rw, "</ul>")
+	}
+}
+
+// startCheck starts a check in a new goroutine, unless one is
+// already running.
+func (fh *FsckHandler) startCheck() {
+	fh.lk.Lock()
+	defer fh.lk.Unlock()
+	if fh.running != nil {
+		return
+	}
+	fh.running = time.UTC()
+	go func() {
+		rep, err := (&fsck.RefChecker{Storage: fh.storage}).Run()
+		fh.lk.Lock()
+		defer fh.lk.Unlock()
+		fh.last, fh.lastErr = rep, err
+		fh.lastRun = fh.running
+		fh.running = nil
+	}()
+}
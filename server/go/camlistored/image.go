@@ -41,7 +41,7 @@ type ImageHandler struct {
 }
 
 func (ih *ImageHandler) storageSeekFetcher() (blobref.SeekFetcher, os.Error) {
-	return blobref.SeekerFromStreamingFetcher(ih.Fetcher) // TODO: pass ih.Cache?
+	return cachingSeekFetcher(ih.Fetcher, ih.Cache)
 }
 
 type subImager interface {
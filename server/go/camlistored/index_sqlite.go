@@ -0,0 +1,25 @@
+/*
+Copyright 2011 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This file is only built if CAMLI_SQLITE is set (see build.pl). It
+// links in the camli/db "sqlite3" driver, which the "sqliteindexer"
+// storage type needs.
+
+import (
+	_ "camdev/sqlite"
+)